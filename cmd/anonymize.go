@@ -0,0 +1,544 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+)
+
+var (
+	// Whether to replace the identities of users with pseudonyms, with
+	// --anonymize.
+	anonymize bool
+	// The file mapping the pseudonyms back to the identities they replace,
+	// given with --anonymize-mapping.
+	anonymizeMappingFile string
+)
+
+// The fields of users, and of the profiles of users, which identify them:
+// those replaced with pseudonyms, and those left out.
+var (
+	pseudonymizedUserFields = []string{"name", "real_name", "display_name", "real_name_normalized", "display_name_normalized", "email", "user"}
+	removedUserFields       = []string{"first_name", "last_name", "phone", "skype", "title", "pronouns", "status_text", "status_emoji", "fields", "avatar_hash", "image_original", "is_custom_image"}
+)
+
+// The fields of messages and conversations which hold the IDs of users, or
+// arrays of them, whose values are pseudonymized whatever they look like.
+var userIdFields = []string{"user", "users", "reply_users", "members", "inviter", "creator", "parent_user_id", "pinned_by", "bot_user_id"}
+
+// The mapping of the pseudonyms back to what they replace, written to
+// --anonymize-mapping, outside of the archive. The key the pseudonyms are
+// derived from is kept with it, so that later exports anonymized with the same
+// mapping give the same users the same pseudonyms.
+type anonymizationMapping struct {
+	Key string `json:"key"`
+	// The identities of the users, by their pseudonymous IDs.
+	Users map[string]map[string]string `json:"users"`
+}
+
+// anonymizingWriter replaces the identities of users in the JSON files written
+// to the archive with pseudonyms, derived from their IDs with HMAC-SHA256, so
+// that the same user gets the same pseudonym everywhere: the IDs of users
+// wherever they are found, including in the mentions of the text of messages,
+// and their names and e-mails, replaced with user- followed by their
+// pseudonymous ID. The other identifying fields of their profiles, such
+// as their phone numbers and pictures, are left out. The names of group
+// direct messages, made of the names of their members, are rewritten with
+// the pseudonyms of the names, in the files and in the names of their
+// directories alike.
+//
+// Each JSON file is kept in memory until the next one is created, to be
+// rewritten before it is written to the archive. Other files, such as
+// attachments, are written as they are.
+type anonymizingWriter struct {
+	archiveWriter
+	mapping anonymizationMapping
+	key     []byte
+	// The pseudonyms given, which aren't replaced again.
+	pseudonyms map[string]bool
+	// The IDs of the users found, in the users of the input archive, the
+	// mapping and the files written so far, which are replaced wherever they
+	// are found even when they don't look like the IDs of users.
+	userIds map[string]bool
+	// The IDs which didn't look like those of users, reported once each.
+	unusualIds map[string]bool
+	// The IDs of the users, by their names, for the names of group direct
+	// messages, and the names given to those, by their original names.
+	userNames map[string]string
+	mpimNames map[string]string
+	// The file being written, if it is rewritten.
+	name   string
+	header *zip.FileHeader
+	data   *bytes.Buffer
+}
+
+// anonymizingArchiveWriter returns the writer, replacing the identities of
+// users in the files written to it with --anonymize.
+func anonymizingArchiveWriter(w archiveWriter) (archiveWriter, error) {
+	if !anonymize {
+		return w, nil
+	}
+	a := &anonymizingWriter{
+		archiveWriter: w,
+		pseudonyms:    make(map[string]bool),
+		userIds:       make(map[string]bool),
+		unusualIds:    make(map[string]bool),
+		userNames:     make(map[string]string),
+		mpimNames:     make(map[string]string),
+	}
+	if err := a.loadMapping(); err != nil {
+		return nil, fmt.Errorf("failed to read the anonymization mapping: %w", err)
+	}
+	if err := a.loadUserIds(); err != nil {
+		return nil, fmt.Errorf("failed to read the users to anonymize: %w", err)
+	}
+	return a, nil
+}
+
+// loadUserIds collects the IDs of the users of the input archive, whatever
+// they look like, for them to be replaced in the files written before the
+// list of users is, along with their names, for those of group direct
+// messages.
+func (a *anonymizingWriter) loadUserIds() error {
+	if inputArchive == "" {
+		return nil
+	}
+	r, err := zip.OpenReader(inputArchive)
+	if err != nil {
+		// Reported by the command, if it reads the input archive.
+		return nil
+	}
+	defer r.Close()
+	for _, name := range []string{"users.json", externalUsersFile} {
+		var users []map[string]interface{}
+		if _, err := readArchiveJson(r, name, &users); err != nil {
+			return err
+		}
+		for _, user := range users {
+			if id, _ := user["id"].(string); id != "" {
+				a.userIds[id] = true
+				if name, _ := user["name"].(string); name != "" {
+					a.userNames[name] = id
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// loadMapping reads the mapping written by a previous export, if any, or
+// generates a new key.
+func (a *anonymizingWriter) loadMapping() error {
+	a.mapping = anonymizationMapping{Users: make(map[string]map[string]string)}
+	data, err := os.ReadFile(anonymizeMappingFile)
+	if errors.Is(err, os.ErrNotExist) {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		a.key = key
+		a.mapping.Key = hex.EncodeToString(key)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := json.Unmarshal(data, &a.mapping); err != nil {
+		return fmt.Errorf("couldn't parse %s: %w", anonymizeMappingFile, err)
+	}
+	a.key, err = hex.DecodeString(a.mapping.Key)
+	if err != nil || len(a.key) == 0 {
+		return fmt.Errorf("%s has no valid key", anonymizeMappingFile)
+	}
+	if a.mapping.Users == nil {
+		a.mapping.Users = make(map[string]map[string]string)
+	}
+	for id, entry := range a.mapping.Users {
+		if original := entry["id"]; original != "" {
+			a.userIds[original] = true
+			if name := entry["name"]; name != "" {
+				a.userNames[name] = original
+			}
+		}
+		a.pseudonyms[id] = true
+		a.pseudonyms[a.fieldPseudonym(id, "name")] = true
+		a.pseudonyms[a.fieldPseudonym(id, "email")] = true
+		if entry == nil {
+			a.mapping.Users[id] = map[string]string{}
+		}
+	}
+	return nil
+}
+
+func (a *anonymizingWriter) Create(name string) (io.Writer, error) {
+	if err := a.flush(); err != nil {
+		return nil, err
+	}
+	name = a.anonymizeEntryName(name)
+	if !isAnonymizedFile(name) {
+		return a.archiveWriter.Create(name)
+	}
+	a.name, a.header, a.data = name, nil, &bytes.Buffer{}
+	return a.data, nil
+}
+
+func (a *anonymizingWriter) CreateHeader(header *zip.FileHeader) (io.Writer, error) {
+	if err := a.flush(); err != nil {
+		return nil, err
+	}
+	if name := a.anonymizeEntryName(header.Name); name != header.Name {
+		renamed := *header
+		renamed.Name = name
+		header = &renamed
+	}
+	if !isAnonymizedFile(header.Name) {
+		return a.archiveWriter.CreateHeader(header)
+	}
+	a.name, a.header, a.data = header.Name, header, &bytes.Buffer{}
+	return a.data, nil
+}
+
+// anonymizeEntryName returns the name of the file of the archive, with the
+// name of the group direct message whose directory it is in rewritten.
+func (a *anonymizingWriter) anonymizeEntryName(name string) string {
+	dir, rest, found := strings.Cut(name, "/")
+	if !found || !strings.HasPrefix(dir, mpimNamePrefix) {
+		return name
+	}
+	return a.anonymizeMpimName(dir) + "/" + rest
+}
+
+// isAnonymizedFile returns whether the file of the archive is rewritten, as
+// JSON files and JSON lines are, even when gzip-compressed.
+func isAnonymizedFile(name string) bool {
+	name = strings.TrimSuffix(name, gzipSuffix)
+	return strings.HasSuffix(name, ".json") || isJsonLinesFile(name)
+}
+
+// flush writes the file being written, once rewritten, to the archive.
+func (a *anonymizingWriter) flush() error {
+	if a.data == nil {
+		return nil
+	}
+	name, header, data := a.name, a.header, a.data.Bytes()
+	a.data = nil
+
+	data, err := a.anonymizeFile(name, data)
+	if err != nil {
+		return fmt.Errorf("couldn't anonymize %s: %w", name, err)
+	}
+	var out io.Writer
+	if header != nil {
+		out, err = a.archiveWriter.CreateHeader(header)
+	} else {
+		out, err = a.archiveWriter.Create(name)
+	}
+	if err != nil {
+		return err
+	}
+	_, err = out.Write(data)
+	return err
+}
+
+func (a *anonymizingWriter) Close() error {
+	if err := a.flush(); err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(&a.mapping, "", "    ")
+	if err != nil {
+		return err
+	}
+	// Written before the archive, which is only worth keeping along with
+	// the mapping.
+	if err := os.WriteFile(anonymizeMappingFile, append(data, '\n'), 0600); err != nil {
+		return fmt.Errorf("failed to write the anonymization mapping: %w", err)
+	}
+	verbosePrintln(fmt.Sprintf("Anonymized %d users, the mapping of their pseudonyms was written to %s", len(a.mapping.Users), anonymizeMappingFile))
+	return a.archiveWriter.Close()
+}
+
+// anonymizeFile returns the JSON file with the identities of users replaced,
+// in the same format as it was written in.
+func (a *anonymizingWriter) anonymizeFile(name string, data []byte) ([]byte, error) {
+	plainName, buf, err := gunzipFile(name, data)
+	if err != nil {
+		return nil, err
+	}
+	if isJsonLinesFile(plainName) {
+		if buf, err = jsonLinesToArray(buf); err != nil {
+			return nil, err
+		}
+	}
+
+	var value interface{}
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	// Keep numbers, such as timestamps, as they are written.
+	dec.UseNumber()
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	a.name = name
+	value = a.anonymizeValue(value, "")
+
+	var res bytes.Buffer
+	if err := newJsonEncoder(&res).Encode(value); err != nil {
+		return nil, err
+	}
+	out := res.Bytes()
+	if isJsonLinesFile(plainName) {
+		if out, err = jsonArrayToLines(out); err != nil {
+			return nil, err
+		}
+	}
+	if isGzipFile(name) {
+		if _, out, err = gzipFile(plainName, out); err != nil {
+			return nil, err
+		}
+	}
+	return out, nil
+}
+
+// anonymizeValue returns the JSON value with the identities of users
+// replaced. The owner is the ID of the user the value describes, if it is a
+// user or their profile, whose fields are then replaced too.
+func (a *anonymizingWriter) anonymizeValue(value interface{}, owner string) interface{} {
+	switch value := value.(type) {
+	case string:
+		return a.anonymizeString(value)
+	case []interface{}:
+		for i, item := range value {
+			value[i] = a.anonymizeValue(item, "")
+		}
+		return value
+	case map[string]interface{}:
+		return a.anonymizeObject(value, owner)
+	}
+	return value
+}
+
+// anonymizeObject replaces the identities of users in the object. Users are
+// told apart by their profile, and the users behind tokens by a user_id next
+// to the name of the user. Their IDs are replaced whatever they look like.
+// Group direct messages are told apart by their names, which are rewritten
+// along with their purposes, which list their members. The text of messages
+// whose mentions were resolved is rebuilt from their raw_text, as the names of
+// the users mentioned can't be told apart from the rest of it.
+func (a *anonymizingWriter) anonymizeObject(object map[string]interface{}, owner string) map[string]interface{} {
+	id, _ := object["id"].(string)
+	_, hasProfile := object["profile"]
+	userId, _ := object["user_id"].(string)
+	replacedId := false
+	switch {
+	case id != "" && hasProfile:
+		owner = id
+		a.userIds[id] = true
+		object["id"] = a.pseudonymizeId(id)
+		replacedId = true
+	case userId != "":
+		owner = userId
+		a.userIds[userId] = true
+	}
+	// The profile of the user who posted a message is embedded into it.
+	author, _ := object["user"].(string)
+
+	for key, value := range object {
+		if owner != "" {
+			if containsString(removedUserFields, key) || strings.HasPrefix(key, "image_") {
+				delete(object, key)
+				continue
+			}
+			if text, ok := value.(string); ok && containsString(pseudonymizedUserFields, key) && text != "" && !userIdPattern.MatchString(text) {
+				if key == "name" {
+					a.userNames[text] = owner
+				}
+				object[key] = a.pseudonymizeField(owner, key, text)
+				continue
+			}
+		}
+		switch {
+		case key == "name" && owner == "" && isMpimName(value):
+			object[key] = a.anonymizeMpimName(value.(string))
+		case key == "id" && replacedId:
+			// Already replaced.
+		case key == "user_profile" && author != "":
+			object[key] = a.anonymizeValue(value, author)
+		case key == "profile" && owner != "":
+			object[key] = a.anonymizeValue(value, owner)
+		case containsString(userIdFields, key) || key == "user_id":
+			object[key] = a.anonymizeUserIds(key, value)
+		default:
+			object[key] = a.anonymizeValue(value, "")
+		}
+	}
+	if purpose, ok := object["purpose"].(map[string]interface{}); ok && owner == "" && isMpimName(object["name"]) {
+		purpose["value"] = mpimPurpose(object["name"].(string))
+	}
+	if raw, ok := object["raw_text"].(string); ok {
+		object["text"] = raw
+	}
+	return object
+}
+
+// The prefix of the names of group direct messages, which Slack names
+// mpdm-alice--bob--carol-1 after their members.
+const mpimNamePrefix = "mpdm-"
+
+// isMpimName returns whether the value is the name of a group direct message.
+func isMpimName(value interface{}) bool {
+	name, _ := value.(string)
+	return strings.HasPrefix(name, mpimNamePrefix)
+}
+
+// anonymizeMpimName returns the name of the group direct message with the
+// names of its members replaced with their pseudonyms, or, for those of users
+// who aren't known, with pseudonyms derived from their names. Each name is
+// given the same pseudonym everywhere, however many users are known by then.
+func (a *anonymizingWriter) anonymizeMpimName(name string) string {
+	if a.pseudonyms[name] {
+		return name
+	}
+	if pseudonym, ok := a.mpimNames[name]; ok {
+		return pseudonym
+	}
+	members, suffix := splitMpimName(name)
+	for i, member := range members {
+		if id, ok := a.userNames[member]; ok {
+			members[i] = a.fieldPseudonym(a.pseudonymizeId(id), "name")
+		} else {
+			members[i] = "user-" + a.digest("name:" + member)[:10]
+		}
+	}
+	pseudonym := mpimNamePrefix + strings.Join(members, "--") + suffix
+	a.mpimNames[name] = pseudonym
+	a.pseudonyms[pseudonym] = true
+	return pseudonym
+}
+
+// splitMpimName returns the names of the members of the group direct message
+// of the name, and the suffix, such as -1, which follows them.
+func splitMpimName(name string) ([]string, string) {
+	members, suffix := strings.TrimPrefix(name, mpimNamePrefix), ""
+	if i := strings.LastIndex(members, "-"); i > 0 && strings.Trim(members[i+1:], "0123456789") == "" {
+		members, suffix = members[:i], members[i:]
+	}
+	return strings.Split(members, "--"), suffix
+}
+
+// mpimPurpose returns the purpose Slack gives the group direct message of the
+// name, listing its members.
+func mpimPurpose(name string) string {
+	members, _ := splitMpimName(name)
+	return "Group messaging with: @" + strings.Join(members, " @")
+}
+
+// anonymizeUserIds returns the value of a field holding the ID of a user, or
+// an array of them, with the IDs replaced whatever they look like. The IDs
+// which don't look like those of users are reported, in case they are
+// something else, as they are replaced wherever they are found from then on.
+func (a *anonymizingWriter) anonymizeUserIds(key string, value interface{}) interface{} {
+	switch value := value.(type) {
+	case string:
+		if value == "" || a.pseudonyms[value] {
+			return value
+		}
+		if !userIdPattern.MatchString(value) && !a.userIds[value] && !a.unusualIds[value] {
+			a.unusualIds[value] = true
+			log.Printf("++++++ The %s field of %s has an ID which doesn't look like the ID of a user, replaced with a pseudonym all the same", key, a.name)
+		}
+		a.userIds[value] = true
+		return a.pseudonymizeId(value)
+	case []interface{}:
+		for i, item := range value {
+			value[i] = a.anonymizeUserIds(key, item)
+		}
+		return value
+	}
+	return a.anonymizeValue(value, "")
+}
+
+// isUserId returns whether the string is the ID of a user, as it looks like
+// one or was found as one.
+func (a *anonymizingWriter) isUserId(text string) bool {
+	return userIdPattern.MatchString(text) || a.userIds[text]
+}
+
+// anonymizeString replaces the string if it is the ID of a user, and the
+// mentions of users it has otherwise, leaving out their labels, which may
+// be their names.
+func (a *anonymizingWriter) anonymizeString(text string) string {
+	if a.isUserId(text) {
+		return a.pseudonymizeId(text)
+	}
+	if !strings.Contains(text, "<@") {
+		return text
+	}
+	return mentionPattern.ReplaceAllStringFunc(text, func(mention string) string {
+		parts := mentionPattern.FindStringSubmatch(mention)
+		if parts[1] != "@" {
+			return mention
+		}
+		if !a.isUserId(parts[2]) && !a.unusualIds[parts[2]] {
+			a.unusualIds[parts[2]] = true
+			log.Printf("++++++ A mention in %s has an ID which doesn't look like the ID of a user, replaced with a pseudonym all the same", a.name)
+		}
+		return "<@" + a.pseudonymizeId(parts[2]) + ">"
+	})
+}
+
+// pseudonymizeId returns the pseudonymous ID of the user, which starts with
+// the same letter as their ID.
+func (a *anonymizingWriter) pseudonymizeId(id string) string {
+	if a.pseudonyms[id] {
+		return id
+	}
+	pseudonym := id[:1] + strings.ToUpper(a.digest(id)[:10])
+	a.pseudonyms[pseudonym] = true
+	if _, ok := a.mapping.Users[pseudonym]; !ok {
+		a.mapping.Users[pseudonym] = map[string]string{"id": id}
+	}
+	a.pseudonyms[a.fieldPseudonym(pseudonym, "name")] = true
+	a.pseudonyms[a.fieldPseudonym(pseudonym, "email")] = true
+	return pseudonym
+}
+
+// pseudonymizeField returns the pseudonym of the name or e-mail of the user,
+// recording what it replaces in the mapping.
+func (a *anonymizingWriter) pseudonymizeField(owner string, key string, value string) string {
+	if a.pseudonyms[value] {
+		return value
+	}
+	id := a.pseudonymizeId(owner)
+	pseudonym := a.fieldPseudonym(id, key)
+	a.mapping.Users[id][key] = value
+	a.pseudonyms[pseudonym] = true
+	return pseudonym
+}
+
+// fieldPseudonym returns the pseudonym of a field of the user with the given
+// pseudonymous ID: user- followed by the start of the ID, as an e-mail of
+// example.invalid for e-mails.
+func (a *anonymizingWriter) fieldPseudonym(id string, key string) string {
+	pseudonym := "user-" + strings.ToLower(id[1:])
+	if key == "email" {
+		pseudonym += "@example.invalid"
+	}
+	return pseudonym
+}
+
+// digest returns the HMAC-SHA256 of the value with the key of the mapping, in
+// hexadecimal.
+func (a *anonymizingWriter) digest(value string) string {
+	mac := hmac.New(sha256.New, a.key)
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,196 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testArchiveWriter keeps the files written to it in memory.
+type testArchiveWriter struct {
+	files map[string]*bytes.Buffer
+	names []string
+}
+
+func newTestArchiveWriter() *testArchiveWriter {
+	return &testArchiveWriter{files: make(map[string]*bytes.Buffer)}
+}
+
+func (w *testArchiveWriter) Create(name string) (io.Writer, error) {
+	w.files[name] = &bytes.Buffer{}
+	w.names = append(w.names, name)
+	return w.files[name], nil
+}
+
+func (w *testArchiveWriter) CreateHeader(header *zip.FileHeader) (io.Writer, error) {
+	return w.Create(header.Name)
+}
+
+func (w *testArchiveWriter) Close() error {
+	return nil
+}
+
+func TestAnonymizeUserIdsOfAnyShape(t *testing.T) {
+	dir := t.TempDir()
+	defer func(archive string, enabled bool, mapping string) {
+		inputArchive, anonymize, anonymizeMappingFile = archive, enabled, mapping
+	}(inputArchive, anonymize, anonymizeMappingFile)
+	// The users of the input archive are known before the files
+	// referring to them are written, whatever their IDs look like.
+	users := `[
+		{"id": "U123", "name": "alice", "profile": {"real_name": "Alice Liddell", "email": "alice@example.com"}},
+		{"id": "USLACKBOT", "name": "slackbot", "profile": {"real_name": "Slackbot"}},
+		{"id": "W0123ABCDE", "name": "bob", "profile": {"real_name": "Bob", "email": "bob@example.com"}}
+	]`
+	inputArchive = writeTestArchive(t, map[string]string{"users.json": users})
+	anonymize = true
+	anonymizeMappingFile = filepath.Join(dir, "mapping.json")
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+
+	out := newTestArchiveWriter()
+	w, err := anonymizingArchiveWriter(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []struct{ name, contents string }{
+		{"general/2021-01-01.json", `[
+			{"ts": "1609459200.000100", "user": "U123", "text": "hi <@U123>, <@W0123ABCDE> and <@ext-7>, see <#C0123ABCDE|general>", "reply_users": ["U123", "x-99"]},
+			{"ts": "1609459201.000100", "user": "x-99", "text": "U123", "reactions": [{"name": "+1", "users": ["U123", "USLACKBOT"]}]}
+		]`},
+		{"channels.json", `[{"id": "C0123ABCDE", "name": "general", "creator": "U123", "members": ["U123", "W0123ABCDE"]}]`},
+		{"users.json", users},
+	}
+	for _, file := range files {
+		fw, err := w.Create(file.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(fw, file.contents)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	all := ""
+	for _, name := range out.names {
+		all += out.files[name].String()
+	}
+	for _, leaked := range []string{`"U123"`, "<@U123>", "W0123ABCDE", "USLACKBOT", "ext-7", "x-99", "alice", "Alice", "bob", "Slackbot"} {
+		if strings.Contains(all, leaked) {
+			t.Errorf("%s is left in the anonymized files:\n%s", leaked, all)
+		}
+	}
+	for _, kept := range []string{"C0123ABCDE", "general", "+1"} {
+		if !strings.Contains(all, kept) {
+			t.Errorf("%s, which doesn't identify users, was replaced:\n%s", kept, all)
+		}
+	}
+
+	// The same user has the same pseudonym everywhere.
+	var messages []map[string]interface{}
+	decodeTestJson(t, "the messages", out.files["general/2021-01-01.json"].String(), &messages)
+	var written []map[string]interface{}
+	decodeTestJson(t, "users.json", out.files["users.json"].String(), &written)
+	if messages[0]["user"] != written[0]["id"] || messages[0]["text"].(string)[:len("hi <@")+11] != "hi <@"+written[0]["id"].(string) {
+		t.Errorf("expected the messages to refer to %s, got %v", written[0]["id"], messages[0])
+	}
+
+	// The IDs which don't look like those of users are reported, once each.
+	if count := strings.Count(logs.String(), "doesn't look like the ID of a user"); count != 2 {
+		t.Errorf("expected the 2 unusual IDs to be reported, got %d reports:\n%s", count, logs.String())
+	}
+}
+
+func TestAnonymizedArchiveHasNoIdentities(t *testing.T) {
+	users := []interface{}{
+		map[string]interface{}{"id": "U00000001", "name": "alicel", "real_name": "Alice Liddell", "profile": map[string]interface{}{"real_name": "Alice Liddell", "display_name": "Ali", "email": "alice@wonderland.example"}},
+		map[string]interface{}{"id": "U00000002", "name": "bobb", "real_name": "Bob Builder", "profile": map[string]interface{}{"real_name": "Bob Builder", "display_name": "Bobby", "email": "bob@builders.example"}},
+		map[string]interface{}{"id": "U00000003", "name": "carolc", "real_name": "Carol Chen", "profile": map[string]interface{}{"real_name": "Carol Chen", "display_name": "Caz", "email": "carol@chen.example"}},
+	}
+	slack := newFakeSlack(t)
+	slack.handle("users.list", func(url.Values) map[string]interface{} {
+		return map[string]interface{}{"members": users}
+	})
+	slack.handle("conversations.list", func(url.Values) map[string]interface{} {
+		return map[string]interface{}{"channels": []interface{}{
+			map[string]interface{}{"id": "D00000001", "user": "U00000002", "is_im": true, "created": 1500000000},
+			map[string]interface{}{
+				"id": "G00000001", "name": "mpdm-alicel--bobb--carolc-1", "is_mpim": true, "is_private": true, "created": 1500000000,
+				"purpose": map[string]interface{}{"value": "Group messaging with: @alicel @bobb @carolc", "creator": "U00000001", "last_set": 0},
+			},
+		}}
+	})
+	slack.handle("conversations.members", func(url.Values) map[string]interface{} {
+		return map[string]interface{}{"members": []interface{}{"U00000001", "U00000002", "U00000003"}}
+	})
+	slack.handle("conversations.history", func(params url.Values) map[string]interface{} {
+		return map[string]interface{}{"messages": []interface{}{
+			map[string]interface{}{"ts": "1500000100.000100", "user": "U00000001", "text": "hi <@U00000002> and <@U00000003>",
+				"user_profile": map[string]interface{}{"name": "alicel", "real_name": "Alice Liddell", "display_name": "Ali"}},
+		}}
+	})
+
+	// An export topped up before, with its mentions resolved.
+	input := writeTestArchive(t, map[string]string{
+		"dms.json":                `[{"id": "D00000001", "members": ["U00000001", "U00000002"]}]`,
+		"D00000001/messages.json": `[{"ts": "1500000000.000100", "user": "U00000002", "raw_text": "hey <@U00000001>", "text": "hey @Ali"}]`,
+	})
+	dir := t.TempDir()
+	output := filepath.Join(dir, "output.zip")
+	args := append(slack.args(), "--input-archive", input, "--output-archive", output, "--anonymize",
+		"fetch-dms", "--api-token", "xoxp-test", "--merge")
+	if out, err := runExporter(t, args...); err != nil {
+		t.Fatalf("fetch-dms --anonymize failed: %v\n%s", err, out)
+	}
+
+	files := readTestArchive(t, output)
+	if len(files) < 5 {
+		t.Fatalf("expected the lists and histories of the conversations, got %v", fileNames(files))
+	}
+	identities := []string{"U00000001", "U00000002", "U00000003"}
+	for _, user := range users {
+		user := user.(map[string]interface{})
+		profile := user["profile"].(map[string]interface{})
+		identities = append(identities, user["name"].(string), user["real_name"].(string), profile["display_name"].(string), profile["email"].(string))
+	}
+	for name, contents := range files {
+		for _, identity := range identities {
+			if strings.Contains(name, identity) {
+				t.Errorf("the name of %s has %s", name, identity)
+			}
+			if strings.Contains(contents, identity) {
+				t.Errorf("%s has %s:\n%s", name, identity, contents)
+			}
+		}
+	}
+
+	// The group direct message is named after the pseudonyms of its
+	// members, in mpims.json and in the name of its directory alike.
+	var mpims []map[string]interface{}
+	decodeTestJson(t, "mpims.json", files["mpims.json"], &mpims)
+	if len(mpims) != 1 {
+		t.Fatalf("expected the group direct message in mpims.json, got %s", files["mpims.json"])
+	}
+	var written []map[string]interface{}
+	decodeTestJson(t, "users.json", files["users.json"], &written)
+	names := make([]string, 0)
+	for _, user := range written {
+		names = append(names, user["name"].(string))
+	}
+	expected := "mpdm-" + strings.Join(names, "--") + "-1"
+	if mpims[0]["name"] != expected {
+		t.Errorf("expected the group direct message to be named %s, got %v", expected, mpims[0]["name"])
+	}
+	if _, ok := files[expected+"/messages.json"]; !ok {
+		t.Errorf("expected the history of the group direct message in %s/, got %v", expected, fileNames(files))
+	}
+}
@@ -0,0 +1,592 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"compress/flate"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// archiveWriter writes the files of the output archive one after the other.
+// As with zip.Writer, which it mirrors, the writer returned for a file is only
+// valid until the next file is created or the archive is closed.
+type archiveWriter interface {
+	Create(name string) (io.Writer, error)
+	// CreateHeader creates a file with the name, modification time and
+	// permissions of the header, as found in the input archive.
+	CreateHeader(header *zip.FileHeader) (io.Writer, error)
+	// Close finishes writing the archive, without closing the underlying
+	// writer.
+	Close() error
+}
+
+// outputArchiveFormat returns the format to write the output in: dir when
+// writing to --output-dir, or otherwise the format given with --output-format,
+// or the one matching the extension of the output archive, defaulting to zip.
+func outputArchiveFormat() (string, error) {
+	if outputDir != "" {
+		if outputArchive != "" {
+			return "", errors.New("only one of --output-archive and --output-dir can be given")
+		}
+		if outputFormat != "" {
+			return "", errors.New("--output-format can't be used with --output-dir")
+		}
+		return "dir", nil
+	}
+	if outputArchive == "" {
+		return "", errors.New("either --output-archive or --output-dir must be given")
+	}
+
+	switch outputFormat {
+	case "":
+		if strings.HasSuffix(outputArchive, ".tar.gz") || strings.HasSuffix(outputArchive, ".tgz") {
+			return "tar.gz", nil
+		}
+		return "zip", nil
+	case "zip", "tar.gz":
+		return outputFormat, nil
+	default:
+		return "", fmt.Errorf("unknown output format %s, expected zip or tar.gz", outputFormat)
+	}
+}
+
+// outputPath returns the path of the output archive, or directory.
+func outputPath() string {
+	if outputDir != "" {
+		return outputDir
+	}
+	return outputArchive
+}
+
+// createOutputArchive creates the output archive, or directory, and returns a
+// writer on it, in the format returned by outputArchiveFormat. The closer
+// returned needs to be closed once done, whether writing succeeded or not,
+// after closing the writer.
+//
+// The archive is written to a temporary file next to it, which closing the
+// writer renames to the output archive. If the writer isn't closed, because
+// the export failed or was interrupted, the closer removes the temporary
+// file, so that a half-written archive is never mistaken for a complete one.
+// Directories are written in place.
+func createOutputArchive() (archiveWriter, io.Closer, error) {
+	format, err := outputArchiveFormat()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if format == "dir" {
+		if err := os.MkdirAll(outputDir, 0755); err != nil {
+			return nil, nil, fmt.Errorf("could not create the output directory %s: %w", outputDir, err)
+		}
+		w := &dirWriter{dir: outputDir}
+		aw, err := anonymizingArchiveWriter(validatingArchiveWriter(checksummingArchiveWriter(countingArchiveWriter(w))))
+		if err != nil {
+			return nil, nil, err
+		}
+		return aw, w, nil
+	}
+
+	partialPath := outputArchive + ".partial"
+	f, err := os.Create(partialPath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("could not open the output archive for writing %s: %w", partialPath, err)
+	}
+	w := &partialArchiveWriter{file: f, path: outputArchive}
+	if format == "tar.gz" {
+		tw, err := newTarGzWriter(f)
+		if err != nil {
+			f.Close()
+			os.Remove(partialPath)
+			return nil, nil, err
+		}
+		w.archiveWriter = tw
+	} else {
+		w.archiveWriter = newZipWriter(f)
+	}
+	aw, err := anonymizingArchiveWriter(validatingArchiveWriter(checksummingArchiveWriter(countingArchiveWriter(w))))
+	if err != nil {
+		partialArchiveCloser{w}.Close()
+		return nil, nil, err
+	}
+	return aw, partialArchiveCloser{w}, nil
+}
+
+// validatingArchiveWriter returns the writer, checking the files written to it
+// with --validate.
+func validatingArchiveWriter(w archiveWriter) archiveWriter {
+	if !validateOutput {
+		return w
+	}
+	return &validatingWriter{archiveWriter: w}
+}
+
+// The compression level of the output archive given with --compression-level,
+// or -1 for the default one.
+var compressionLevel int
+
+// Whether to write the same archive, byte for byte, given the same input
+// archive and the same responses from Slack, with --reproducible.
+var reproducible bool
+
+// newFileModTime returns the modification time of the files written by the
+// exporter, rather than copied from the input archive: the current time, or
+// the Unix epoch with --reproducible. The files of zip archives have none.
+func newFileModTime() time.Time {
+	if reproducible {
+		return time.Unix(0, 0).UTC()
+	}
+	return time.Now()
+}
+
+// zipWriter is a zip.Writer compressing its files at the level given with
+// --compression-level, if any: either storing them as they are with level 0,
+// or deflating them at that level.
+type zipWriter struct {
+	*zip.Writer
+}
+
+func newZipWriter(output io.Writer) *zipWriter {
+	w := zip.NewWriter(output)
+	if compressionLevel > 0 {
+		level := compressionLevel
+		w.RegisterCompressor(zip.Deflate, func(out io.Writer) (io.WriteCloser, error) {
+			return flate.NewWriter(out, level)
+		})
+	}
+	return &zipWriter{w}
+}
+
+func (z *zipWriter) Create(name string) (io.Writer, error) {
+	return z.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate})
+}
+
+func (z *zipWriter) CreateHeader(header *zip.FileHeader) (io.Writer, error) {
+	if compressionLevel == 0 {
+		header.Method = zip.Store
+	} else if compressionLevel > 0 {
+		header.Method = zip.Deflate
+	}
+	return z.Writer.CreateHeader(header)
+}
+
+// partialArchiveWriter writes an archive to a temporary file, and renames it
+// to its final path once the archive is closed.
+type partialArchiveWriter struct {
+	archiveWriter
+	file *os.File
+	path string
+	// Whether the archive was written in full, and renamed.
+	done bool
+}
+
+func (p *partialArchiveWriter) Close() error {
+	if p.done {
+		return nil
+	}
+	if err := p.archiveWriter.Close(); err != nil {
+		return err
+	}
+	if err := p.file.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(p.file.Name(), p.path); err != nil {
+		return fmt.Errorf("could not rename %s to %s: %w", p.file.Name(), p.path, err)
+	}
+	p.done = true
+	return nil
+}
+
+// partialArchiveCloser removes the temporary file of the archive, unless it
+// was written in full.
+type partialArchiveCloser struct {
+	writer *partialArchiveWriter
+}
+
+func (p partialArchiveCloser) Close() error {
+	if p.writer.done {
+		return nil
+	}
+	p.writer.file.Close()
+	return os.Remove(p.writer.file.Name())
+}
+
+// dirWriter writes the files of the output as plain files in a directory,
+// with the same interface as zip.Writer.
+type dirWriter struct {
+	dir string
+	// The file being written, if any, and the modification time and
+	// permissions to give it once written, if not the defaults.
+	file     *os.File
+	modified time.Time
+	mode     os.FileMode
+}
+
+func (d *dirWriter) Create(name string) (io.Writer, error) {
+	return d.create(name, newFileModTime(), 0)
+}
+
+func (d *dirWriter) CreateHeader(header *zip.FileHeader) (io.Writer, error) {
+	return d.create(header.Name, header.Modified, entryMode(header))
+}
+
+func (d *dirWriter) create(name string, modified time.Time, mode os.FileMode) (io.Writer, error) {
+	if err := d.Close(); err != nil {
+		return nil, err
+	}
+
+	// Names come from Slack, which we don't want to write outside of the
+	// output directory.
+	path := filepath.Join(d.dir, filepath.FromSlash(name))
+	if rel, err := filepath.Rel(d.dir, path); err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return nil, fmt.Errorf("the file name %s points outside of the output directory", name)
+	}
+
+	// Some archives have entries for their directories, which are created
+	// along with their files anyway.
+	if strings.HasSuffix(name, "/") {
+		if err := os.MkdirAll(path, 0755); err != nil {
+			return nil, err
+		}
+		return ioutil.Discard, nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, err
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	d.file = file
+	d.modified = modified
+	d.mode = mode
+	return file, nil
+}
+
+// Close closes the file being written, if any. It can be called more than
+// once.
+func (d *dirWriter) Close() error {
+	if d.file == nil {
+		return nil
+	}
+	file := d.file
+	d.file = nil
+
+	if err := file.Close(); err != nil {
+		return err
+	}
+	if d.mode != 0 {
+		if err := os.Chmod(file.Name(), d.mode); err != nil {
+			return err
+		}
+	}
+	if !d.modified.IsZero() {
+		return os.Chtimes(file.Name(), d.modified, d.modified)
+	}
+	return nil
+}
+
+// tarGzWriter writes a gzipped tar archive with the same interface as
+// zip.Writer.
+//
+// The header of each file in a tar archive gives its size, which isn't known
+// until the file has been written in full, so each file is first written to a
+// temporary file, and only added to the archive once the next one is created
+// or the archive is closed.
+type tarGzWriter struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+	// The file being written, if any, and its contents so far.
+	pending *tar.Header
+	tmp     *os.File
+}
+
+func newTarGzWriter(output io.Writer) (*tarGzWriter, error) {
+	level := gzip.DefaultCompression
+	if compressionLevel >= 0 {
+		level = compressionLevel
+	}
+	gz, err := gzip.NewWriterLevel(output, level)
+	if err != nil {
+		return nil, err
+	}
+	return &tarGzWriter{gz: gz, tw: tar.NewWriter(gz)}, nil
+}
+
+func (t *tarGzWriter) Create(name string) (io.Writer, error) {
+	return t.create(name, newFileModTime(), 0)
+}
+
+func (t *tarGzWriter) CreateHeader(header *zip.FileHeader) (io.Writer, error) {
+	return t.create(header.Name, header.Modified, entryMode(header))
+}
+
+func (t *tarGzWriter) create(name string, modified time.Time, mode os.FileMode) (io.Writer, error) {
+	if err := t.flush(); err != nil {
+		return nil, err
+	}
+
+	if t.tmp == nil {
+		tmp, err := createTempFile("archive-entry-")
+		if err != nil {
+			return nil, err
+		}
+		t.tmp = tmp
+	}
+	if err := t.tmp.Truncate(0); err != nil {
+		return nil, err
+	}
+	if _, err := t.tmp.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+
+	typeflag := byte(tar.TypeReg)
+	if strings.HasSuffix(name, "/") {
+		// The entries for directories, which some archives have.
+		typeflag = tar.TypeDir
+		if mode == 0 {
+			mode = 0755
+		}
+	} else if mode == 0 {
+		mode = 0644
+	}
+	t.pending = &tar.Header{
+		Typeflag: typeflag,
+		Name:     name,
+		Mode:     int64(mode),
+		ModTime:  modified,
+	}
+	return t.tmp, nil
+}
+
+// flush adds the file being written, if any, to the archive.
+func (t *tarGzWriter) flush() error {
+	if t.pending == nil {
+		return nil
+	}
+	header := t.pending
+	t.pending = nil
+
+	size, err := t.tmp.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	header.Size = size
+	if err := t.tw.WriteHeader(header); err != nil {
+		return err
+	}
+	if _, err := t.tmp.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	_, err = io.CopyN(t.tw, t.tmp, size)
+	return err
+}
+
+func (t *tarGzWriter) Close() error {
+	err := t.flush()
+	if t.tmp != nil {
+		t.tmp.Close()
+		os.Remove(t.tmp.Name())
+		t.tmp = nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := t.tw.Close(); err != nil {
+		return err
+	}
+	return t.gz.Close()
+}
+
+// The top-level files of Slack exports, at least one of which any export has.
+var slackExportFiles = []string{"channels.json", "users.json", "groups.json", "dms.json", "mpims.json", "integration_logs.json"}
+
+// openInputArchive opens the input archive, checking that it looks like a
+// Slack export unless --force is given, so that pointing the tool at the
+// wrong archive doesn't go unnoticed.
+func openInputArchive() (*zip.ReadCloser, error) {
+	return openArchive(inputArchive)
+}
+
+// openArchive opens the archive at the given path as openInputArchive does.
+func openArchive(path string) (*zip.ReadCloser, error) {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return nil, fmt.Errorf("could not open input archive for reading %s: %w", path, err)
+	}
+	if force {
+		return r, nil
+	}
+
+	for _, file := range r.File {
+		if containsString(slackExportFiles, file.Name) {
+			return r, nil
+		}
+	}
+	r.Close()
+	return nil, fmt.Errorf("the input archive %s doesn't look like a Slack export, as it has none of %s at its top level (use --force to process it anyway)", path, strings.Join(slackExportFiles, ", "))
+}
+
+// copyArchiveFiles copies all the files of the input archive into the output
+// archive unchanged, except for the excluded ones, and returns the set of the
+// names of the files copied.
+//
+// With --skip-unreadable, the files which can't be read, such as corrupt ones,
+// are left out rather than failing the command, and listed once it is done.
+//
+// The export metadata file is never copied, as each command writes it anew, and
+// neither are the checksums of an earlier run, which no longer match.
+func copyArchiveFiles(r *zip.ReadCloser, w archiveWriter, exclude ...string) (map[string]bool, error) {
+	names := make(map[string]bool)
+
+	// Run through all the files in the input archive.
+	for _, file := range r.File {
+		// The external users, the changes of the conversations and the
+		// parts of the split files of the input archive are written again
+		// along with those found since.
+		if containsString(exclude, file.Name) || file.Name == exportMetadataFile || file.Name == checksumsFile ||
+			(file.Name == externalUsersFile && localUserIds != nil) || (file.Name == channelChangesFile && channelChanges != nil) ||
+			(file.Name == filePartsFile && fileParts != nil) {
+			verbosePrintln(fmt.Sprintf("Skipping file: %s\n", file.Name))
+			continue
+		}
+		verbosePrintln(fmt.Sprintf("Processing file: %s\n", file.Name))
+		if skipUnreadable {
+			if err := checkArchiveFile(file); err != nil {
+				reportUnreadableEntry(file.Name, err)
+				continue
+			}
+		}
+		if err := copyArchiveFile(w, file); err != nil {
+			return nil, err
+		}
+
+		names[file.Name] = true
+	}
+
+	return names, nil
+}
+
+// copyArchiveFile copies the file of an input archive into the output archive
+// unchanged.
+func copyArchiveFile(w archiveWriter, file *zip.File) error {
+	// Open the file from the input archive.
+	inReader, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("failed to open file in input archive %s: %w", file.Name, err)
+	}
+	defer inReader.Close()
+
+	outFile, err := w.CreateHeader(copyFileHeader(file))
+	if err != nil {
+		return fmt.Errorf("failed to create file in output archive %s: %w", file.Name, err)
+	}
+
+	_, err = io.Copy(outFile, inReader)
+	if err != nil {
+		return fmt.Errorf("failed to copy file to output archive %s: %w", file.Name, err)
+	}
+	return nil
+}
+
+// copyFileHeader returns a copy of the header of the file of an input archive,
+// to create the file of the output archive with, as CreateHeader modifies it.
+// The modification time, the permissions and the other external attributes
+// are kept as they are, but the extended timestamp is left out of the extra
+// fields, as zip.Writer adds it again from the modification time: otherwise,
+// each repack would add yet another copy of it.
+func copyFileHeader(file *zip.File) *zip.FileHeader {
+	header := file.FileHeader
+	header.Extra = withoutExtraField(header.Extra, extendedTimestampExtraId)
+	return &header
+}
+
+// The ID of the extra field of zip entries giving their modification time as a
+// Unix timestamp.
+const extendedTimestampExtraId = 0x5455
+
+// withoutExtraField returns the extra fields of a zip entry, leaving out those
+// with the given ID. Fields which run past the end are kept as they are.
+func withoutExtraField(extra []byte, id uint16) []byte {
+	res := make([]byte, 0, len(extra))
+	for len(extra) >= 4 {
+		fieldId := binary.LittleEndian.Uint16(extra)
+		size := 4 + int(binary.LittleEndian.Uint16(extra[2:]))
+		if size > len(extra) {
+			break
+		}
+		if fieldId != id {
+			res = append(res, extra[:size]...)
+		}
+		extra = extra[size:]
+	}
+	return append(res, extra...)
+}
+
+// entryMode returns the permissions of the file of the input archive, or 0
+// when the archive doesn't record any, as the zip files written on Windows
+// don't.
+func entryMode(header *zip.FileHeader) os.FileMode {
+	if header.ExternalAttrs == 0 {
+		return 0
+	}
+	return header.Mode().Perm()
+}
+
+var (
+	// Whether to leave out the files of the input archive which can't be
+	// read, with --skip-unreadable.
+	skipUnreadable bool
+	// The files of the input archive which were left out, with the errors
+	// reading them ran into.
+	unreadableEntries []string
+)
+
+// checkArchiveFile reads the file of an input archive in full, without keeping
+// it, to find out whether it can be read before writing any of it to the
+// output archive, which can't take back a file half-written. Reading it to the
+// end also checks its CRC-32 checksum.
+func checkArchiveFile(file *zip.File) error {
+	inReader, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer inReader.Close()
+	_, err = io.Copy(ioutil.Discard, inReader)
+	return err
+}
+
+// reportUnreadableEntry reports that the file of the input archive couldn't be
+// read, and is left out of the output archive.
+func reportUnreadableEntry(name string, err error) {
+	unreadableEntries = append(unreadableEntries, name+": "+err.Error())
+	log.Printf("++++++ Failed to read %s from the input archive, skipping it: %s", name, err)
+}
+
+// reportUnreadableEntries lists the files of the input archive which were left
+// out with --skip-unreadable, once the command is done.
+func reportUnreadableEntries() {
+	if len(unreadableEntries) == 0 {
+		return
+	}
+	log.Printf("++++++ Skipped %d files of the input archive which couldn't be read:\n  %s", len(unreadableEntries), strings.Join(unreadableEntries, "\n  "))
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
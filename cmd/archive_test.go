@@ -0,0 +1,173 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestTarGzWriterTempFile(t *testing.T) {
+	var output bytes.Buffer
+	w, err := newTarGzWriter(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"users.json", "general/messages.json"} {
+		out, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(out, "[]")
+	}
+
+	// The files are written to a temporary file of the run until they are
+	// added to the archive.
+	tmp := w.tmp.Name()
+	if filepath.Dir(tmp) != runTempDir {
+		t.Errorf("expected the temporary file to be in the directory of the run %s, got %s", runTempDir, tmp)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(tmp); !os.IsNotExist(err) {
+		t.Errorf("expected the temporary file %s to be removed once the archive is written, got %v", tmp, err)
+	}
+
+	gz, err := gzip.NewReader(&output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tr := tar.NewReader(gz)
+	names := make([]string, 0)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		data, _ := io.ReadAll(tr)
+		if string(data) != "[]" {
+			t.Errorf("expected %s to contain [], got %q", header.Name, data)
+		}
+		names = append(names, header.Name)
+	}
+	if len(names) != 2 || names[0] != "users.json" || names[1] != "general/messages.json" {
+		t.Errorf("expected users.json and general/messages.json in the archive, got %v", names)
+	}
+}
+
+func TestFailedRunLeavesNoOutput(t *testing.T) {
+	for _, name := range []string{"output.zip", "output.tar.gz"} {
+		slack := newFakeSlack(t)
+		slack.handle("conversations.list", func(url.Values) map[string]interface{} {
+			return map[string]interface{}{"channels": []interface{}{
+				map[string]interface{}{"id": "C00000001", "name": "general"},
+				map[string]interface{}{"id": "C00000002", "name": "random"},
+			}}
+		})
+		slack.handle("conversations.history", func(params url.Values) map[string]interface{} {
+			if params.Get("channel") == "C00000002" {
+				return map[string]interface{}{"ok": false, "error": "invalid_auth"}
+			}
+			return map[string]interface{}{"messages": []interface{}{
+				map[string]interface{}{"ts": "1700000000.000100", "text": "hello"},
+			}}
+		})
+
+		input := writeTestArchive(t, map[string]string{"users.json": "[]"})
+		dir := t.TempDir()
+		output := filepath.Join(dir, name)
+		args := append(slack.args(), "--input-archive", input, "--output-archive", output, "fetch-public-channels", "--api-token", "xoxp-test")
+		if out, err := runExporter(t, args...); err == nil {
+			t.Fatalf("expected the run writing %s to fail\n%s", name, out)
+		}
+
+		// Neither the output nor its partial version is left behind.
+		for _, path := range []string{output, output + ".partial"} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Errorf("expected the failed run not to leave %s behind (%v)", filepath.Base(path), err)
+			}
+		}
+	}
+}
+
+// zipEntry writes the data to the only file of an archive, and returns the
+// method and the compressed contents of the file, as written.
+func zipEntry(t *testing.T, newWriter func(io.Writer) archiveWriter, data []byte) (uint16, []byte) {
+	t.Helper()
+	var output bytes.Buffer
+	w := newWriter(&output)
+	out, err := w.Create("general/messages.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out.Write(data)
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := zip.NewReader(bytes.NewReader(output.Bytes()), int64(output.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := r.File[0].OpenRaw()
+	if err != nil {
+		t.Fatal(err)
+	}
+	compressed, err := io.ReadAll(raw)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return r.File[0].Method, compressed
+}
+
+func TestZipWriterCompressionLevel(t *testing.T) {
+	defer func(level int) { compressionLevel = level }(compressionLevel)
+
+	// Text repetitive enough for the levels to compress it differently.
+	var data bytes.Buffer
+	for i := 0; i < 2000; i++ {
+		fmt.Fprintf(&data, `{"ts": "17000%05d.000100", "text": "message %d of %d"},`, i*7, i%13, i%29)
+	}
+	newWriter := func(output io.Writer) archiveWriter {
+		return newZipWriter(output)
+	}
+
+	for _, level := range []int{-1, 0, 1, 9} {
+		compressionLevel = level
+		method, compressed := zipEntry(t, newWriter, data.Bytes())
+
+		expectedMethod := uint16(zip.Deflate)
+		var expected []byte
+		switch level {
+		case -1:
+			// What zip writes with the compressor it registers by default.
+			_, expected = zipEntry(t, func(output io.Writer) archiveWriter {
+				return zip.NewWriter(output)
+			}, data.Bytes())
+		case 0:
+			expectedMethod, expected = zip.Store, data.Bytes()
+		default:
+			var buf bytes.Buffer
+			fw, _ := flate.NewWriter(&buf, level)
+			fw.Write(data.Bytes())
+			fw.Close()
+			expected = buf.Bytes()
+		}
+		if method != expectedMethod {
+			t.Errorf("with level %d, expected method %d, got %d", level, expectedMethod, method)
+		}
+		if !bytes.Equal(compressed, expected) {
+			t.Errorf("with level %d, expected %d compressed bytes, got %d, as if written at another level", level, len(expected), len(compressed))
+		}
+	}
+}
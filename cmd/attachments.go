@@ -0,0 +1,417 @@
+package cmd
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+// attachmentStore keeps track of the attachments downloaded into the output
+// archive, so that each of them is only stored once, however many posts it is
+// shared in.
+type attachmentStore struct {
+	w archiveWriter
+	// The path in the archive of each file, by file ID.
+	paths map[string]string
+	// With --dedupe-content, the path of the first file stored with each
+	// SHA-256 checksum, so that files with different IDs but the same
+	// contents are only stored once as well.
+	sums map[string]string
+	// The files which weren't downloaded, as with --max-attachment-size or the
+	// MIME type filters, by
+	// file ID, in the order they were skipped in.
+	skippedIds []string
+	skipped    map[string]*skippedAttachment
+}
+
+// An attachment which wasn't downloaded, as listed in skipped_attachments.json
+// for it to be retrieved later if needed.
+type skippedAttachment struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Size     int64  `json:"size"`
+	Mimetype string `json:"mimetype,omitempty"`
+	Url      string `json:"url"`
+	// Why the file wasn't downloaded: too_large or mimetype_excluded.
+	Reason string `json:"reason"`
+}
+
+func newAttachmentStore(w archiveWriter) *attachmentStore {
+	return &attachmentStore{
+		w:       w,
+		paths:   make(map[string]string),
+		sums:    make(map[string]string),
+		skipped: make(map[string]*skippedAttachment),
+	}
+}
+
+// skip records that the file isn't downloaded for the given reason.
+func (s *attachmentStore) skip(file *SlackFile, url string, reason string) {
+	s.skipped[file.Id] = &skippedAttachment{Id: file.Id, Name: file.Name, Size: file.Size, Mimetype: file.Mimetype, Url: url, Reason: reason}
+	s.skippedIds = append(s.skippedIds, file.Id)
+}
+
+// stored returns the path of the file in the archive, if it was already stored.
+func (s *attachmentStore) stored(fileId string) (string, bool) {
+	path, ok := s.paths[fileId]
+	return path, ok
+}
+
+// store writes the contents of the file to the archive under outputPath, and
+// returns the path it is stored under, which is that of an identical file
+// stored earlier when deduplicating by contents.
+func (s *attachmentStore) store(fileId string, outputPath string, contents io.Reader) (string, error) {
+	if !attachmentsDedupeContent {
+		outFile, err := s.w.Create(outputPath)
+		if err != nil {
+			return "", err
+		}
+		if _, err := io.Copy(outFile, contents); err != nil {
+			return "", err
+		}
+		s.paths[fileId] = outputPath
+		return outputPath, nil
+	}
+
+	// The checksum is only known once the whole file is downloaded, and
+	// entries can't be removed from an archive, so the file goes to a
+	// temporary file first.
+	tmp, err := createTempFile("attachment-")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	hash := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(tmp, hash), contents); err != nil {
+		return "", err
+	}
+	sum := hex.EncodeToString(hash.Sum(nil))
+
+	if path, ok := s.sums[sum]; ok {
+		verbosePrintln("File " + fileId + " has the same contents as " + path + ", not storing it again")
+		s.paths[fileId] = path
+		return path, nil
+	}
+
+	if _, err := tmp.Seek(0, io.SeekStart); err != nil {
+		return "", err
+	}
+	outFile, err := s.w.Create(outputPath)
+	if err != nil {
+		return "", err
+	}
+	if _, err := io.Copy(outFile, tmp); err != nil {
+		return "", err
+	}
+	s.sums[sum] = outputPath
+	s.paths[fileId] = outputPath
+	return outputPath, nil
+}
+
+// writeManifest writes attachments.json, mapping the ID of each file
+// downloaded to its path in the archive, along with skipped_attachments.json,
+// listing the files which weren't downloaded with their download URLs, if any.
+func (s *attachmentStore) writeManifest() error {
+	outFile, err := s.w.Create("attachments.json")
+	if err != nil {
+		return err
+	}
+	enc := newJsonEncoder(outFile)
+	if err := enc.Encode(&s.paths); err != nil {
+		return err
+	}
+
+	if len(s.skippedIds) == 0 {
+		return nil
+	}
+	skipped := make([]*skippedAttachment, 0, len(s.skippedIds))
+	for _, id := range s.skippedIds {
+		skipped = append(skipped, s.skipped[id])
+	}
+	outFile, err = s.w.Create("skipped_attachments.json")
+	if err != nil {
+		return err
+	}
+	enc = newJsonEncoder(outFile)
+	return enc.Encode(&skipped)
+}
+
+// fileDirectory holds the metadata of the files of the workspace listed by
+// files.list with --files-list, to recover what the messages they are shared
+// in lack, such as their download URLs, along with the consolidated metadata
+// of the files shared in the messages, for files.json.
+type fileDirectory struct {
+	// The files listed by files.list, by file ID.
+	listed map[string]map[string]interface{}
+	// The consolidated metadata of the files shared in the messages, by
+	// file ID, in the order they are first found in.
+	ids   []string
+	files map[string]map[string]interface{}
+}
+
+func newFileDirectory(listed []map[string]interface{}) *fileDirectory {
+	d := &fileDirectory{
+		listed: make(map[string]map[string]interface{}),
+		files:  make(map[string]map[string]interface{}),
+	}
+	for _, file := range listed {
+		if id, _ := file["id"].(string); id != "" {
+			d.listed[id] = file
+		}
+	}
+	return d
+}
+
+// complete fills in the name, size, MIME type and download URLs of the file from files.list,
+// where the message lacks them.
+func (d *fileDirectory) complete(file *SlackFile) {
+	listed, ok := d.listed[file.Id]
+	if !ok {
+		return
+	}
+	fill := func(value *string, key string) {
+		if *value == "" {
+			*value, _ = listed[key].(string)
+		}
+	}
+	fill(&file.Name, "name")
+	fill(&file.UrlPrivate, "url_private")
+	fill(&file.UrlPrivateDownload, "url_private_download")
+	fill(&file.Mimetype, "mimetype")
+	if size, ok := listed["size"].(float64); ok && file.Size == 0 {
+		file.Size = int64(size)
+	}
+}
+
+// addChannelFile adds the files shared in the posts of a channel file to the
+// consolidated metadata, with the properties listed by files.list taking
+// precedence over those of the messages.
+func (d *fileDirectory) addChannelFile(fileName string, inBuf []byte) error {
+	var posts []map[string]interface{}
+	if err := json.Unmarshal(inBuf, &posts); err != nil {
+		return fmt.Errorf("couldn't parse the JSON file %s: %w", fileName, err)
+	}
+
+	add := func(file interface{}) {
+		fileObject, ok := file.(map[string]interface{})
+		if !ok {
+			return
+		}
+		id, _ := fileObject["id"].(string)
+		if id == "" {
+			return
+		}
+		consolidated, ok := d.files[id]
+		if !ok {
+			consolidated = make(map[string]interface{})
+			d.files[id] = consolidated
+			d.ids = append(d.ids, id)
+		}
+		for key, value := range fileObject {
+			if _, ok := consolidated[key]; !ok {
+				consolidated[key] = value
+			}
+		}
+		for key, value := range d.listed[id] {
+			consolidated[key] = value
+		}
+	}
+
+	for _, post := range posts {
+		// Support for legacy file_share posts.
+		add(post["file"])
+		if files, ok := post["files"].([]interface{}); ok {
+			for _, file := range files {
+				add(file)
+			}
+		}
+	}
+	return nil
+}
+
+// writeManifest writes files.json, listing the consolidated metadata of the
+// files shared in the messages.
+func (d *fileDirectory) writeManifest(w archiveWriter) error {
+	files := make([]map[string]interface{}, 0, len(d.ids))
+	for _, id := range d.ids {
+		files = append(files, d.files[id])
+	}
+
+	outFile, err := w.Create("files.json")
+	if err != nil {
+		return err
+	}
+	enc := newJsonEncoder(outFile)
+	return enc.Encode(&files)
+}
+
+// downloadAttachment downloads the file to the checkpoint through the client,
+// or to a temporary file without one, which the caller removes once done with
+// it, and returns the path it was downloaded to. A file downloaded by an
+// interrupted run is used as it is, when resuming, and one downloaded in part
+// is carried on with an HTTP Range request, or downloaded again from the start
+// if the server doesn't support ranges. So is a download interrupted along the
+// way, as those of files too large to be downloaded within --http-timeout are,
+// up to --max-retries times. The size of the file downloaded is checked
+// against the size in its metadata, when there is one.
+func downloadAttachment(ctx context.Context, client *slackexport.Client, cp *checkpoint, file *SlackFile, downloadUrl string) (downloaded string, err error) {
+	var donePath string
+	if cp == nil {
+		var temp *os.File
+		temp, err = createTempFile("attachment-")
+		if err != nil {
+			return "", err
+		}
+		temp.Close()
+		donePath = temp.Name()
+		defer func() {
+			if err != nil {
+				os.Remove(donePath)
+				os.Remove(donePath + ".partial")
+			}
+		}()
+	} else {
+		donePath = cp.attachmentPath(file.Id)
+		if info, err := os.Stat(donePath); err == nil && (file.Size <= 0 || info.Size() == file.Size) {
+			verbosePrintln(fmt.Sprintf("File %s was downloaded by the interrupted run", file.Id))
+			return donePath, nil
+		}
+		if err := os.MkdirAll(filepath.Dir(donePath), 0700); err != nil {
+			return "", err
+		}
+	}
+
+	partialPath := donePath + ".partial"
+	out, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer out.Close()
+	offset, err := out.Seek(0, io.SeekEnd)
+	if err != nil {
+		return "", err
+	}
+	restart := func() error {
+		offset = 0
+		if err := out.Truncate(0); err != nil {
+			return err
+		}
+		_, err := out.Seek(0, io.SeekStart)
+		return err
+	}
+	if file.Size > 0 && offset > file.Size {
+		if err := restart(); err != nil {
+			return "", err
+		}
+	}
+
+	for attempt := 0; file.Size <= 0 || offset < file.Size; attempt++ {
+		err := continueDownload(ctx, client, file, downloadUrl, out, &offset, restart)
+		var interrupted *interruptedDownload
+		if !errors.As(err, &interrupted) {
+			if err != nil {
+				return "", err
+			}
+			break
+		}
+		if ctx.Err() != nil || attempt >= client.MaxRetries {
+			if cp == nil {
+				return "", fmt.Errorf("the download was interrupted after %d bytes: %w", offset, interrupted.err)
+			}
+			return "", fmt.Errorf("the download was interrupted after %d bytes, which --resume carries on from: %w", offset, interrupted.err)
+		}
+		verbosePrintln(fmt.Sprintf("The download of file %s was interrupted after %d bytes (%s), carrying on", file.Id, offset, interrupted.err))
+	}
+
+	if file.Size > 0 && offset != file.Size {
+		out.Close()
+		os.Remove(partialPath)
+		return "", fmt.Errorf("downloaded %d bytes instead of the %d of its metadata", offset, file.Size)
+	}
+	if err := out.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Rename(partialPath, donePath); err != nil {
+		return "", err
+	}
+	return donePath, nil
+}
+
+// An error reading the body of a download, which can be carried on from where
+// it stopped, unlike the errors of the request, which the client already
+// retried.
+type interruptedDownload struct {
+	err error
+}
+
+func (e *interruptedDownload) Error() string {
+	return e.err.Error()
+}
+
+// continueDownload downloads the file from the offset onwards to out, or from
+// the start if the server can't carry on from the offset, and advances the
+// offset by the bytes downloaded.
+func continueDownload(ctx context.Context, client *slackexport.Client, file *SlackFile, downloadUrl string, out io.Writer, offset *int64, restart func() error) error {
+	resp, err := client.Download(ctx, downloadUrl, *offset)
+	if err != nil {
+		return err
+	}
+	defer func() { resp.Body.Close() }()
+
+	switch {
+	case *offset > 0 && resp.StatusCode == http.StatusPartialContent && contentRangeStart(resp) == *offset:
+		verbosePrintln(fmt.Sprintf("Carrying on with the download of file %s from byte %d", file.Id, *offset))
+	case resp.StatusCode == http.StatusOK:
+		if *offset > 0 {
+			verbosePrintln(fmt.Sprintf("The server doesn't support ranges, downloading file %s again from the start", file.Id))
+			if err := restart(); err != nil {
+				return err
+			}
+		}
+	case *offset > 0 && (resp.StatusCode == http.StatusPartialContent || resp.StatusCode == http.StatusRequestedRangeNotSatisfiable):
+		// The part downloaded doesn't match what the server has.
+		verbosePrintln(fmt.Sprintf("The server can't carry on with the download of file %s, downloading it again from the start", file.Id))
+		resp.Body.Close()
+		if err := restart(); err != nil {
+			return err
+		}
+		resp, err = client.Download(ctx, downloadUrl, 0)
+		if err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusOK {
+			return fmt.Errorf("HTTP code %d", resp.StatusCode)
+		}
+	default:
+		return fmt.Errorf("HTTP code %d", resp.StatusCode)
+	}
+
+	n, err := io.Copy(out, resp.Body)
+	*offset += n
+	if err != nil {
+		return &interruptedDownload{err: err}
+	}
+	return nil
+}
+
+// contentRangeStart returns the first byte of the range of the file in the
+// partial response, or -1 if the response doesn't say.
+func contentRangeStart(resp *http.Response) int64 {
+	var start, end int64
+	var size string
+	if _, err := fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%s", &start, &end, &size); err != nil {
+		return -1
+	}
+	return start
+}
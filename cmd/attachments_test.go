@@ -0,0 +1,132 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+func TestDownloadAttachmentCarriesOn(t *testing.T) {
+	contents := strings.Repeat("0123456789", 1000)
+	var mutex sync.Mutex
+	ranges := make([]string, 0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		attempt := len(ranges)
+		mutex.Unlock()
+		if attempt == 1 {
+			// Rate limited first, which the client retries.
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+
+		var start int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-", &start)
+		w.Header().Set("Content-Length", fmt.Sprint(len(contents)-start))
+		if start > 0 {
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(contents)-1, len(contents)))
+			w.WriteHeader(http.StatusPartialContent)
+		}
+		if attempt == 2 {
+			// The connection breaks halfway through.
+			w.Write([]byte(contents[start : start+4000]))
+			hijacker := w.(http.Hijacker)
+			conn, _, _ := hijacker.Hijack()
+			conn.Close()
+			return
+		}
+		w.Write([]byte(contents[start:]))
+	}))
+	defer server.Close()
+
+	client := slackexport.NewClient("xoxp-test")
+	client.RetryBaseDelay = time.Millisecond
+	cp, err := openCheckpoint(t.TempDir(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := &SlackFile{Id: "F00000001", Name: "a.txt", Size: int64(len(contents))}
+	path, err := downloadAttachment(context.Background(), client, cp, file, server.URL+"/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != contents {
+		t.Errorf("expected the %d bytes of the file, got %d", len(contents), len(data))
+	}
+	if fmt.Sprint(ranges) != "[  bytes=4000-]" {
+		t.Errorf("expected the download to be retried once rate limited, then carried on from byte 4000, got ranges %q", ranges)
+	}
+	if _, err := os.Stat(path + ".partial"); !os.IsNotExist(err) {
+		t.Errorf("expected the partial download to be gone, got %v", err)
+	}
+}
+
+func TestDownloadAttachmentGivesUp(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+
+	client := slackexport.NewClient("xoxp-test")
+	client.RetryBaseDelay = time.Millisecond
+	client.MaxRetries = 2
+	cp, err := openCheckpoint(t.TempDir(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := &SlackFile{Id: "F00000001", Name: "a.txt", Size: 10}
+	if _, err := downloadAttachment(context.Background(), client, cp, file, server.URL+"/a.txt"); err == nil || !strings.Contains(err.Error(), "giving up after 2 retries") {
+		t.Errorf("expected the download to give up after 2 retries, got %v", err)
+	}
+}
+
+func TestDownloadAttachmentWithoutCheckpoint(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/a.txt" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("contents"))
+	}))
+	defer server.Close()
+
+	client := slackexport.NewClient("xoxp-test")
+	client.RetryBaseDelay = time.Millisecond
+	client.MaxRetries = 1
+	path, err := downloadAttachment(context.Background(), client, nil, &SlackFile{Id: "F00000001", Size: 8}, server.URL+"/a.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(path)
+	if data, err := os.ReadFile(path); err != nil || string(data) != "contents" {
+		t.Errorf("expected the file to be downloaded to a temporary file, got %q (%v)", data, err)
+	}
+
+	// A failed download leaves nothing behind.
+	dir := filepath.Dir(path)
+	before, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := downloadAttachment(context.Background(), client, nil, &SlackFile{Id: "F00000002", Size: 8}, server.URL+"/b.txt"); err == nil {
+		t.Fatal("expected the download to fail")
+	}
+	if after, err := os.ReadDir(dir); err != nil || len(after) != len(before) {
+		t.Errorf("expected the failed download to leave no files behind, got %d files instead of %d (%v)", len(after), len(before), err)
+	}
+}
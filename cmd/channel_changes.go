@@ -0,0 +1,122 @@
+package cmd
+
+import (
+	"archive/zip"
+	"fmt"
+	"sort"
+)
+
+// Whether to write the history of the topics, purposes and names of the
+// conversations to channel_changes.json, with --channel-changes.
+var includeChannelChanges bool
+
+// The file of the archive giving the history of the topics, purposes and names
+// of the conversations.
+const channelChangesFile = "channel_changes.json"
+
+// A change to a conversation, as found in the message Slack posts to it when
+// its topic, purpose or name is changed, or when it is archived or brought
+// back.
+type channelChange struct {
+	Ts   string `json:"ts"`
+	Type string `json:"type"`
+	User string `json:"user,omitempty"`
+	// The topic, purpose or name the conversation was given, and the name
+	// it had before for renames.
+	Value    string `json:"value,omitempty"`
+	OldValue string `json:"old_value,omitempty"`
+}
+
+// The types of the changes, by the subtypes of the messages recording them,
+// and the fields of those messages which give the new values.
+var channelChangeSubtypes = map[string]struct{ changeType, field string }{
+	"channel_topic":     {"topic", "topic"},
+	"group_topic":       {"topic", "topic"},
+	"channel_purpose":   {"purpose", "purpose"},
+	"group_purpose":     {"purpose", "purpose"},
+	"channel_name":      {"name", "name"},
+	"group_name":        {"name", "name"},
+	"channel_archive":   {"archive", ""},
+	"group_archive":     {"archive", ""},
+	"channel_unarchive": {"unarchive", ""},
+	"group_unarchive":   {"unarchive", ""},
+}
+
+// The changes of each conversation, by ID, or nil when they aren't written.
+var channelChanges map[string][]channelChange
+
+// setupChannelChanges reads the changes the input archive already has, when
+// writing the changes, so that those of the conversations which aren't
+// fetched again are kept.
+func setupChannelChanges(r *zip.ReadCloser) error {
+	if !includeChannelChanges {
+		return nil
+	}
+	channelChanges = make(map[string][]channelChange)
+	if _, err := readArchiveJson(r, channelChangesFile, &channelChanges); err != nil {
+		return err
+	}
+	return nil
+}
+
+// collectChannelChanges records the changes of the conversation found in the
+// messages of its files, read one at a time, which replace those the input
+// archive had for it.
+// The changes are only found in the history of the conversation, so the
+// changes of a conversation fetched from a given date on, without topping up
+// an archive which has the rest of it, are those made since.
+func collectChannelChanges(id string, files []*conversationFile) error {
+	if channelChanges == nil {
+		return nil
+	}
+
+	changes := make([]channelChange, 0)
+	seen := make(map[string]bool)
+	for _, file := range files {
+		err := file.walkMessages(func(message map[string]interface{}) error {
+			subtype, _ := message["subtype"].(string)
+			kind, ok := channelChangeSubtypes[subtype]
+			ts, _ := message["ts"].(string)
+			if !ok || ts == "" || seen[ts] {
+				return nil
+			}
+			seen[ts] = true
+			change := channelChange{Ts: ts, Type: kind.changeType}
+			change.User, _ = message["user"].(string)
+			if kind.field != "" {
+				change.Value, _ = message[kind.field].(string)
+			}
+			change.OldValue, _ = message["old_name"].(string)
+			changes = append(changes, change)
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't parse %s: %w", file.name, err)
+		}
+	}
+
+	sort.SliceStable(changes, func(i, j int) bool {
+		return slackTimestampTime(changes[i].Ts).Before(slackTimestampTime(changes[j].Ts))
+	})
+	if len(changes) > 0 {
+		channelChanges[id] = changes
+	} else {
+		delete(channelChanges, id)
+	}
+	return nil
+}
+
+// writeChannelChanges writes the changes found to channel_changes.json, if
+// any, when writing the changes.
+func writeChannelChanges(w archiveWriter) error {
+	if len(channelChanges) == 0 {
+		return nil
+	}
+	verbosePrintln(fmt.Sprintf("Writing the changes of %d conversations to %s", len(channelChanges), channelChangesFile))
+	outFile, err := w.Create(channelChangesFile)
+	if err != nil {
+		return err
+	}
+	enc := newJsonEncoder(outFile)
+	return enc.Encode(&channelChanges)
+}
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestCollectChannelChanges(t *testing.T) {
+	defer func(changes map[string][]channelChange) { channelChanges = changes }(channelChanges)
+	channelChanges = map[string][]channelChange{"C00000001": {{Ts: "1", Type: "topic"}}}
+
+	files := make([]*conversationFile, 0)
+	for _, contents := range []string{
+		`[{"ts": "1500000002.000100", "subtype": "channel_name", "user": "U1", "name": "new", "old_name": "old"},
+		  {"ts": "1500000000.000100", "text": "hi"}]`,
+		`[{"ts": "1500000001.000100", "subtype": "channel_topic", "user": "U2", "topic": "the topic"},
+		  {"ts": "1500000002.000100", "subtype": "channel_name", "user": "U1", "name": "new", "old_name": "old"},
+		  {"ts": "1500000003.000100", "subtype": "channel_archive", "user": "U1"}]`,
+	} {
+		file, err := newConversationFile("day.json", []byte(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.remove()
+		files = append(files, file)
+	}
+	if err := collectChannelChanges("C00000001", files); err != nil {
+		t.Fatal(err)
+	}
+	expected := "[{1500000001.000100 topic U2 the topic } {1500000002.000100 name U1 new old} {1500000003.000100 archive U1  }]"
+	if got := fmt.Sprint(channelChanges["C00000001"]); got != expected {
+		t.Errorf("expected the changes\n%s\ngot\n%s", expected, got)
+	}
+}
@@ -0,0 +1,419 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// A checkpoint records the progress of an export on disk, so that an
+// interrupted export can be resumed without fetching again what it had already
+// fetched.
+//
+// The checkpoint directory contains a state.json file recording how far along
+// each conversation is, and a directory per conversation, named after its ID,
+// holding the history and the threads fetched so far and, once the
+// conversation is complete, the files it adds to the archive. Attachments are
+// downloaded to its attachments directory.
+//
+// A checkpoint is only kept with --resume, as it holds a copy of everything
+// fetched until the export completes. All the methods but attachmentPath and
+// conversationDir can be called on a nil checkpoint, which records nothing.
+type checkpoint struct {
+	dir   string
+	mutex sync.Mutex
+	state checkpointState
+}
+
+type checkpointState struct {
+	Conversations map[string]*conversationProgress `json:"conversations"`
+}
+
+type conversationProgress struct {
+	// The cursor of the next page of history to fetch.
+	Cursor string `json:"cursor,omitempty"`
+	// The number of messages of the history saved so far, up to that cursor.
+	HistoryMessages int `json:"history_messages,omitempty"`
+	// Whether the whole history has been fetched.
+	HistoryDone bool `json:"history_done,omitempty"`
+	// Whether all the files of the conversation have been saved.
+	Completed bool `json:"completed,omitempty"`
+	// The numbers of messages and thread replies of a completed conversation.
+	Messages int `json:"messages,omitempty"`
+	Replies  int `json:"replies,omitempty"`
+}
+
+// The checkpoint of an export is kept next to its output archive, or
+// directory.
+func checkpointDir(output string) string {
+	return output + ".checkpoint"
+}
+
+// openCheckpoint opens the checkpoint in dir. When resuming, the progress
+// recorded in an existing checkpoint is loaded, or a new one started if there
+// is none. Otherwise any existing checkpoint is discarded, and nil is returned
+// for the export to keep none.
+func openCheckpoint(dir string, resume bool) (*checkpoint, error) {
+	if !resume {
+		if err := os.RemoveAll(dir); err != nil {
+			return nil, fmt.Errorf("failed to remove the old checkpoint in %s: %w", dir, err)
+		}
+		return nil, nil
+	}
+
+	c := &checkpoint{
+		dir: dir,
+		state: checkpointState{
+			Conversations: make(map[string]*conversationProgress),
+		},
+	}
+
+	buf, err := ioutil.ReadFile(filepath.Join(dir, "state.json"))
+	if err == nil {
+		if err := json.Unmarshal(buf, &c.state); err != nil {
+			return nil, fmt.Errorf("failed to read the checkpoint in %s: %w", dir, err)
+		}
+		if c.state.Conversations == nil {
+			c.state.Conversations = make(map[string]*conversationProgress)
+		}
+		verbosePrintln(fmt.Sprintf("Resuming from the checkpoint in %s", dir))
+		return c, nil
+	} else if !os.IsNotExist(err) {
+		return nil, fmt.Errorf("failed to read the checkpoint in %s: %w", dir, err)
+	}
+	verbosePrintln(fmt.Sprintf("There is no checkpoint in %s, starting from scratch", dir))
+
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, fmt.Errorf("failed to remove the old checkpoint in %s: %w", dir, err)
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create the checkpoint in %s: %w", dir, err)
+	}
+	return c, nil
+}
+
+// remove deletes the checkpoint, once the export has completed successfully.
+func (c *checkpoint) remove() error {
+	if c == nil {
+		return nil
+	}
+	return os.RemoveAll(c.dir)
+}
+
+func (c *checkpoint) progress(conversationId string) conversationProgress {
+	if c == nil {
+		return conversationProgress{}
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if progress, ok := c.state.Conversations[conversationId]; ok {
+		return *progress
+	}
+	return conversationProgress{}
+}
+
+// update applies the change to the progress of the conversation and saves the
+// state.
+func (c *checkpoint) update(conversationId string, change func(*conversationProgress)) error {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	progress, ok := c.state.Conversations[conversationId]
+	if !ok {
+		progress = &conversationProgress{}
+		c.state.Conversations[conversationId] = progress
+	}
+	change(progress)
+	return c.save()
+}
+
+// save writes the state, which marks the directory as a checkpoint to resume
+// from. The state is written to a temporary file first, so that it is never
+// left half-written.
+func (c *checkpoint) save() error {
+	if c == nil {
+		return nil
+	}
+	buf, err := json.Marshal(&c.state)
+	if err != nil {
+		return err
+	}
+	statePath := filepath.Join(c.dir, "state.json")
+	if err := ioutil.WriteFile(statePath+".tmp", buf, 0600); err != nil {
+		return err
+	}
+	return os.Rename(statePath+".tmp", statePath)
+}
+
+// attachmentPath returns the path the attachment is downloaded to, with
+// ".partial" added to it until it is complete.
+func (c *checkpoint) attachmentPath(fileId string) string {
+	return filepath.Join(c.dir, "attachments", fileId)
+}
+
+func (c *checkpoint) conversationDir(conversationId string) string {
+	return filepath.Join(c.dir, conversationId)
+}
+
+// savePage records a page of the history of the conversation, along with the
+// cursor of the next page, which is empty after the last page.
+func (c *checkpoint) savePage(conversationId string, messages []map[string]interface{}, nextCursor string) error {
+	if c == nil {
+		return nil
+	}
+
+	dir := c.conversationDir(conversationId)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "history.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	enc := json.NewEncoder(f)
+	for _, message := range messages {
+		if err := enc.Encode(message); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	return c.update(conversationId, func(progress *conversationProgress) {
+		progress.Cursor = nextCursor
+		progress.HistoryMessages += len(messages)
+		progress.HistoryDone = nextCursor == ""
+	})
+}
+
+// The number of messages of the history saved in a checkpoint which
+// walkSavedHistory reads at a time.
+const savedHistoryChunk = 1000
+
+// walkSavedHistory calls handle with the history of the conversation saved so
+// far, a chunk of messages at a time, in the order they were saved, and
+// returns the number of messages handled.
+//
+// If the export was interrupted after a page was saved but before its cursor
+// was, the messages of that page are left out, since fetching carries on from
+// the cursor before it and gets them again.
+func (c *checkpoint) walkSavedHistory(conversationId string, handle func(messages []map[string]interface{}) error) (int, error) {
+	if c == nil {
+		return 0, nil
+	}
+
+	f, err := os.Open(filepath.Join(c.conversationDir(conversationId), "history.jsonl"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	// Checkpoints written by earlier versions don't have the number of
+	// messages, but do have a cursor once a page was saved.
+	progress := c.progress(conversationId)
+	counted := progress.HistoryMessages > 0 || (progress.Cursor == "" && !progress.HistoryDone)
+
+	count, left := 0, 0
+	chunk := make([]map[string]interface{}, 0, savedHistoryChunk)
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var message map[string]interface{}
+		if err := dec.Decode(&message); err != nil {
+			return 0, fmt.Errorf("failed to read the history saved in the checkpoint: %w", err)
+		}
+		if counted && count+len(chunk) >= progress.HistoryMessages {
+			left++
+			continue
+		}
+		chunk = append(chunk, message)
+		if len(chunk) == savedHistoryChunk {
+			if err := handle(chunk); err != nil {
+				return 0, err
+			}
+			count += len(chunk)
+			chunk = make([]map[string]interface{}, 0, savedHistoryChunk)
+		}
+	}
+	if len(chunk) > 0 {
+		if err := handle(chunk); err != nil {
+			return 0, err
+		}
+		count += len(chunk)
+	}
+	if left > 0 {
+		verbosePrintln(fmt.Sprintf("Leaving out %d messages of %s which were saved without their cursor", left, conversationId), "channel", conversationId)
+	}
+	return count, nil
+}
+
+// A thread saved in the checkpoint, as a line of threads.jsonl.
+type savedThread struct {
+	Ts       string                   `json:"ts"`
+	Messages []map[string]interface{} `json:"messages"`
+}
+
+// saveThread records the messages of a thread of the conversation, fetched in
+// full, starting with its root message.
+func (c *checkpoint) saveThread(conversationId string, ts string, messages []map[string]interface{}) error {
+	if c == nil {
+		return nil
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	dir := c.conversationDir(conversationId)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, "threads.jsonl"), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(&savedThread{Ts: ts, Messages: messages}); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// savedThreads returns the messages of the threads of the conversation saved
+// so far, by the timestamp of their root message.
+//
+// If the export was interrupted while a thread was being saved, that thread
+// and the ones saved after it are left out, and fetched again.
+func (c *checkpoint) savedThreads(conversationId string) (map[string][]map[string]interface{}, error) {
+	threads := make(map[string][]map[string]interface{})
+	if c == nil {
+		return threads, nil
+	}
+
+	f, err := os.Open(filepath.Join(c.conversationDir(conversationId), "threads.jsonl"))
+	if os.IsNotExist(err) {
+		return threads, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for dec.More() {
+		var thread savedThread
+		if err := dec.Decode(&thread); err != nil {
+			verbosePrintln(fmt.Sprintf("Leaving out the threads of %s after a thread which was saved only in part", conversationId), "channel", conversationId)
+			break
+		}
+		threads[thread.Ts] = thread.Messages
+	}
+	return threads, nil
+}
+
+// complete saves the files of the conversation, and marks it as completed.
+func (c *checkpoint) complete(contents *conversationContents) error {
+	if c == nil {
+		return nil
+	}
+	conversationId := contents.id
+
+	dir := filepath.Join(c.conversationDir(conversationId), "files")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return err
+	}
+	for _, file := range contents.files {
+		if err := saveConversationFile(filepath.Join(dir, file.name), file); err != nil {
+			return err
+		}
+	}
+
+	// The files have all the history and threads, so we don't need them
+	// separately anymore.
+	for _, name := range []string{"history.jsonl", "threads.jsonl"} {
+		if err := os.Remove(filepath.Join(c.conversationDir(conversationId), name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+
+	return c.update(conversationId, func(progress *conversationProgress) {
+		progress.Completed = true
+		progress.Messages = contents.messages
+		progress.Replies = contents.replies
+	})
+}
+
+// saveConversationFile copies the file of a conversation to the path.
+func saveConversationFile(path string, file *conversationFile) error {
+	r, err := file.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	out, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, r); err != nil {
+		out.Close()
+		return err
+	}
+	return out.Close()
+}
+
+// completedFiles returns the files saved for a completed conversation, sorted
+// by name.
+func (c *checkpoint) completedFiles(conversationId string) ([]*conversationFile, error) {
+	dir := filepath.Join(c.conversationDir(conversationId), "files")
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	names := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		names = append(names, entry.Name())
+	}
+	sort.Strings(names)
+
+	files := make([]*conversationFile, 0, len(names))
+	for _, name := range names {
+		file, err := loadConversationFile(filepath.Join(dir, name), name)
+		if err != nil {
+			removeConversationFiles(files)
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+// loadConversationFile returns a file of a conversation with the contents of
+// the file at the path, which are copied a piece at a time rather than read
+// into memory.
+func loadConversationFile(path string, name string) (*conversationFile, error) {
+	in, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer in.Close()
+	file := &conversationFile{name: name}
+	if _, err := io.Copy(file, bufio.NewReader(in)); err != nil {
+		file.remove()
+		return nil, err
+	}
+	if err := file.finish(); err != nil {
+		file.remove()
+		return nil, err
+	}
+	return file, nil
+}
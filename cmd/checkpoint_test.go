@@ -0,0 +1,108 @@
+package cmd
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestCompletedFiles(t *testing.T) {
+	cp, err := openCheckpoint(t.TempDir(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A line longer than the buffers the files are copied with.
+	long := `[{"ts": "1700000000.000100", "text": "` + strings.Repeat("x", 200000) + `"}]`
+	saved := map[string]string{
+		"messages.json": "[\n    {\n        \"ts\": \"1700000000.000100\"\n    }\n]\n",
+		"replies.json":  long,
+	}
+	dir := filepath.Join(cp.conversationDir("C00000001"), "files")
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	for name, contents := range saved {
+		if err := os.WriteFile(filepath.Join(dir, name), []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	files, err := cp.completedFiles("C00000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer removeConversationFiles(files)
+	if len(files) != 2 || files[0].name != "messages.json" || files[1].name != "replies.json" {
+		t.Fatalf("expected messages.json and replies.json, got %d files", len(files))
+	}
+	for _, file := range files {
+		data, err := file.bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != saved[file.name] {
+			t.Errorf("the contents of %s changed when read back from the checkpoint", file.name)
+		}
+		if file.size != int64(len(saved[file.name])) {
+			t.Errorf("expected %s to be %d bytes, got %d", file.name, len(saved[file.name]), file.size)
+		}
+	}
+}
+
+func TestCheckpointOnlyKeptWithResume(t *testing.T) {
+	slack := newFakeSlack(t)
+	slack.handle("conversations.list", func(url.Values) map[string]interface{} {
+		return map[string]interface{}{"channels": []interface{}{
+			map[string]interface{}{"id": "C00000001", "name": "general"},
+			map[string]interface{}{"id": "C00000002", "name": "random"},
+		}}
+	})
+	var failing atomic.Bool
+	failing.Store(true)
+	slack.handle("conversations.history", func(params url.Values) map[string]interface{} {
+		if failing.Load() && params.Get("channel") == "C00000002" {
+			return map[string]interface{}{"ok": false, "error": "invalid_auth"}
+		}
+		return map[string]interface{}{"messages": []interface{}{
+			map[string]interface{}{"ts": "1700000000.000100", "text": "hello"},
+		}}
+	})
+	input := writeTestArchive(t, map[string]string{"users.json": "[]"})
+	output := filepath.Join(t.TempDir(), "output.zip")
+	run := func(flags ...string) error {
+		args := append(slack.args(), "--input-archive", input, "--output-archive", output, "fetch-public-channels", "--api-token", "xoxp-test")
+		_, err := runExporter(t, append(args, flags...)...)
+		return err
+	}
+
+	if err := run(); err == nil {
+		t.Fatal("expected the export to fail")
+	}
+	if _, err := os.Stat(checkpointDir(output)); !os.IsNotExist(err) {
+		t.Errorf("expected no checkpoint without --resume, got %v", err)
+	}
+
+	if err := run("--resume"); err == nil {
+		t.Fatal("expected the export to fail")
+	}
+	if _, err := os.Stat(filepath.Join(checkpointDir(output), "state.json")); err != nil {
+		t.Errorf("expected a checkpoint with --resume: %v", err)
+	}
+
+	failing.Store(false)
+	before := len(slack.calls("conversations.history"))
+	if err := run("--resume"); err != nil {
+		t.Fatalf("expected the resumed export to succeed: %v", err)
+	}
+	for _, params := range slack.calls("conversations.history")[before:] {
+		if params.Get("channel") != "C00000002" {
+			t.Errorf("expected the resumed export to only fetch the failed channel, got a request for %s", params.Get("channel"))
+		}
+	}
+	if _, err := os.Stat(checkpointDir(output)); !os.IsNotExist(err) {
+		t.Errorf("expected the checkpoint to be removed once the export completed, got %v", err)
+	}
+}
@@ -0,0 +1,88 @@
+package cmd
+
+import (
+	"archive/zip"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"strings"
+)
+
+// The file listing the SHA-256 of the other files of the output archive, with
+// --checksums.
+const checksumsFile = "checksums.txt"
+
+// Whether to write checksumsFile, with --checksums.
+var writeChecksums bool
+
+// checksumWriter computes the SHA-256 of each file as it is written to the
+// archive, and adds them all to checksumsFile when the archive is closed, in
+// the format of sha256sum, so that an extracted archive can be checked with
+// sha256sum -c.
+type checksumWriter struct {
+	archiveWriter
+	// The name and hash of the file being written, if any.
+	name string
+	hash hash.Hash
+	sums strings.Builder
+	done bool
+}
+
+// checksummingArchiveWriter returns the writer, listing the checksums of the
+// files written to it with --checksums.
+func checksummingArchiveWriter(w archiveWriter) archiveWriter {
+	if !writeChecksums {
+		return w
+	}
+	return &checksumWriter{archiveWriter: w}
+}
+
+func (c *checksumWriter) Create(name string) (io.Writer, error) {
+	out, err := c.archiveWriter.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return c.track(name, out), nil
+}
+
+func (c *checksumWriter) CreateHeader(header *zip.FileHeader) (io.Writer, error) {
+	out, err := c.archiveWriter.CreateHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	return c.track(header.Name, out), nil
+}
+
+// track records the checksum of the file written before, and starts hashing
+// the new one.
+func (c *checksumWriter) track(name string, out io.Writer) io.Writer {
+	c.record()
+	c.name = name
+	c.hash = sha256.New()
+	return io.MultiWriter(out, c.hash)
+}
+
+func (c *checksumWriter) record() {
+	if c.hash == nil {
+		return
+	}
+	fmt.Fprintf(&c.sums, "%s  %s\n", hex.EncodeToString(c.hash.Sum(nil)), c.name)
+	c.hash = nil
+}
+
+func (c *checksumWriter) Close() error {
+	if !c.done {
+		c.record()
+		out, err := c.archiveWriter.Create(checksumsFile)
+		if err != nil {
+			return fmt.Errorf("failed to create %s: %w", checksumsFile, err)
+		}
+		if _, err := io.WriteString(out, c.sums.String()); err != nil {
+			return fmt.Errorf("failed to write %s: %w", checksumsFile, err)
+		}
+		c.done = true
+	}
+	return c.archiveWriter.Close()
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+// The environment variable telling the test binary to run the command line it
+// is given instead of the tests, for runExporter.
+const runExporterEnvVar = "SLACK_ADVANCED_EXPORTER_TEST_RUN"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(runExporterEnvVar) != "" {
+		os.Args = append([]string{"slack-advanced-exporter"}, os.Args[1:]...)
+		if err := Execute(); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	code := m.Run()
+	removeTempFiles()
+	os.Exit(code)
+}
+
+// runExporter runs the exporter with the arguments in a process of its own, as
+// the commands keep their state in globals, and returns what it printed along
+// with whether it failed.
+func runExporter(t *testing.T, args ...string) (string, error) {
+	t.Helper()
+	output, err := exporterCommand(args...).CombinedOutput()
+	return string(output), err
+}
+
+// exporterCommand returns the command running the exporter with the
+// arguments, for runExporter, without the API token of the environment.
+func exporterCommand(args ...string) *exec.Cmd {
+	cmd := exec.Command(os.Args[0], args...)
+	cmd.Env = append(os.Environ(), runExporterEnvVar+"=1", apiTokenEnvVar+"=")
+	return cmd
+}
+
+// fakeSlack is a Slack API server answering each method with the response of
+// its handler, along with "ok": true, or with a default response for the
+// methods every command calls.
+type fakeSlack struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	handlers map[string]func(params url.Values) map[string]interface{}
+	// The parameters of the requests made to each method, in order.
+	requests map[string][]url.Values
+}
+
+func newFakeSlack(t *testing.T) *fakeSlack {
+	s := &fakeSlack{
+		handlers: map[string]func(params url.Values) map[string]interface{}{
+			"auth.test": func(url.Values) map[string]interface{} {
+				return map[string]interface{}{"user_id": "U00000001", "team_id": "T00000001"}
+			},
+			"users.list": func(url.Values) map[string]interface{} {
+				return map[string]interface{}{"members": []interface{}{}}
+			},
+			"conversations.history": func(url.Values) map[string]interface{} {
+				return map[string]interface{}{"messages": []interface{}{}}
+			},
+			"conversations.replies": func(url.Values) map[string]interface{} {
+				return map[string]interface{}{"messages": []interface{}{}}
+			},
+		},
+		requests: make(map[string][]url.Values),
+	}
+	s.Server = httptest.NewServer(http.HandlerFunc(s.serve))
+	t.Cleanup(s.Close)
+	return s
+}
+
+// handle sets the handler of the API method.
+func (s *fakeSlack) handle(method string, handler func(params url.Values) map[string]interface{}) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.handlers[method] = handler
+}
+
+// calls returns the parameters of the requests made to the API method.
+func (s *fakeSlack) calls(method string) []url.Values {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.requests[method]
+}
+
+func (s *fakeSlack) serve(w http.ResponseWriter, r *http.Request) {
+	method := strings.TrimPrefix(r.URL.Path, "/")
+	r.ParseForm()
+	s.mu.Lock()
+	s.requests[method] = append(s.requests[method], r.Form)
+	handler := s.handlers[method]
+	s.mu.Unlock()
+
+	res := map[string]interface{}{"ok": false, "error": "unknown_method"}
+	if handler != nil {
+		res = handler(r.Form)
+		if _, ok := res["ok"]; !ok {
+			res["ok"] = true
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// args returns the flags pointing the exporter to the server.
+func (s *fakeSlack) args() []string {
+	return []string{"--api-base-url", s.URL, "--skip-scope-check", "--requests-per-minute", "0", "--retry-base-delay", "1ms"}
+}
+
+// client returns a client of the server, retrying without waiting.
+func (s *fakeSlack) client() *slackexport.Client {
+	client := slackexport.NewClient("xoxp-test")
+	client.BaseURL = s.URL
+	client.RetryBaseDelay = time.Millisecond
+	return client
+}
+
+// writeTestArchive writes a zip archive with the files, by name, to a new
+// temporary directory, and returns its path.
+func writeTestArchive(t *testing.T, files map[string]string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "input.zip")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := zip.NewWriter(f)
+	for name, contents := range files {
+		out, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(out, contents)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// readTestArchive returns the contents of the files of the zip archive, by
+// name.
+func readTestArchive(t *testing.T, path string) map[string]string {
+	t.Helper()
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	files := make(map[string]string)
+	for _, file := range r.File {
+		in, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(in)
+		in.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		files[file.Name] = string(data)
+	}
+	return files
+}
+
+// decodeTestJson parses the JSON data into v, failing the test if it can't.
+func decodeTestJson(t *testing.T, name string, data string, v interface{}) {
+	t.Helper()
+	if err := json.Unmarshal([]byte(data), v); err != nil {
+		t.Fatalf("couldn't parse %s: %v\n%s", name, err, data)
+	}
+}
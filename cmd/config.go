@@ -0,0 +1,285 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+	"github.com/spf13/cobra"
+	"gopkg.in/yaml.v3"
+)
+
+var configFile string
+
+// A flag set in the config file, on line line of it, or 0 when the format
+// doesn't tell.
+type configValue struct {
+	name   string
+	values []string
+	// Whether the value is a list, which only flags which can be repeated
+	// accept.
+	list bool
+	line int
+}
+
+// location returns where the flag is set in the config file of the path, for
+// errors.
+func (v *configValue) location(path string) string {
+	if v.line == 0 {
+		return path
+	}
+	return fmt.Sprintf("%s:%d", path, v.line)
+}
+
+// applyConfigFile sets the flags of the command which are set in the config
+// file given with --config, unless they were given on the command line. The
+// API token of the config file is also left out when the environment variable
+// sets one, so that it can be overridden without editing the file.
+//
+// Flags which the command doesn't have, such as the filters of another
+// command, are ignored, so that one config file can be used with several
+// commands, but flags which no command has are an error, as they are most
+// likely misspelled.
+func applyConfigFile(cmd *cobra.Command) error {
+	if configFile == "" {
+		return nil
+	}
+
+	values, err := readConfigFile(configFile)
+	if err != nil {
+		return fmt.Errorf("failed to read the config file: %w", err)
+	}
+
+	for _, value := range values {
+		if value.name == "config" {
+			return fmt.Errorf("%s: the config file can't set --config", value.location(configFile))
+		}
+
+		flag := cmd.Flags().Lookup(value.name)
+		if flag == nil {
+			if !isKnownFlag(cmd.Root(), value.name) {
+				return fmt.Errorf("%s: unknown flag %q", value.location(configFile), value.name)
+			}
+			continue
+		}
+		if flag.Changed {
+			continue
+		}
+		if (value.name == "api-token" || value.name == "api-token-file") && strings.TrimSpace(os.Getenv(apiTokenEnvVar)) != "" {
+			verbosePrintln("Using the API token of the " + apiTokenEnvVar + " environment variable instead of the one of the config file")
+			continue
+		}
+
+		repeatable := strings.HasSuffix(flag.Value.Type(), "Slice") || strings.HasSuffix(flag.Value.Type(), "Array")
+		if value.list && !repeatable {
+			return fmt.Errorf("%s: --%s takes a single value, not a list", value.location(configFile), value.name)
+		}
+		for _, v := range value.values {
+			if err := cmd.Flags().Set(value.name, v); err != nil {
+				return fmt.Errorf("%s: invalid value %q for --%s: %w", value.location(configFile), v, value.name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// isKnownFlag returns whether the command or any of its subcommands has the
+// flag.
+func isKnownFlag(cmd *cobra.Command, name string) bool {
+	if cmd.Flags().Lookup(name) != nil || cmd.PersistentFlags().Lookup(name) != nil {
+		return true
+	}
+	for _, sub := range cmd.Commands() {
+		if isKnownFlag(sub, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// readConfigFile reads the flags set in a config file, in the order they are
+// set in. The file maps the names of the flags to their values, either in
+// YAML, as in "concurrency: 4", or in TOML, as in "concurrency = 4", as told
+// by its extension, or, for other extensions, by which of the two it can be
+// parsed as. Underscores in names stand for dashes, as TOML keys usually have
+// them. Lists are only accepted for the flags which can be repeated. As flags
+// are set by name, nested values, such as the tables of TOML, are an error.
+func readConfigFile(path string) ([]*configValue, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var values []*configValue
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		values, err = readTomlConfig(data)
+	case ".yaml", ".yml":
+		values, err = readYamlConfig(data)
+	default:
+		values, err = readYamlConfig(data)
+		if err != nil {
+			if tomlValues, tomlErr := readTomlConfig(data); tomlErr == nil {
+				values, err = tomlValues, nil
+			}
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	names := make(map[string]bool)
+	for _, value := range values {
+		if names[value.name] {
+			return nil, fmt.Errorf("%s: %s is set twice", value.location(path), value.name)
+		}
+		names[value.name] = true
+	}
+	return values, nil
+}
+
+// readYamlConfig reads the flags set in a YAML config file.
+func readYamlConfig(data []byte) ([]*configValue, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	var doc yaml.Node
+	if err := dec.Decode(&doc); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var next yaml.Node
+	if err := dec.Decode(&next); err != io.EOF {
+		return nil, fmt.Errorf("line %d: only one YAML document is supported", next.Line)
+	}
+
+	root := resolveYamlAlias(&doc)
+	if root.Kind == yaml.DocumentNode && len(root.Content) > 0 {
+		root = resolveYamlAlias(root.Content[0])
+	}
+	if root.Kind == yaml.DocumentNode || root.Kind == yaml.ScalarNode && root.Tag == "!!null" {
+		return nil, nil
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: expected the names of flags followed by their values", root.Line)
+	}
+
+	values := make([]*configValue, 0, len(root.Content)/2)
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		key, node := root.Content[i], resolveYamlAlias(root.Content[i+1])
+		value := &configValue{name: strings.ReplaceAll(key.Value, "_", "-"), line: key.Line}
+		switch node.Kind {
+		case yaml.ScalarNode:
+			item, err := yamlConfigScalar(key.Value, node)
+			if err != nil {
+				return nil, err
+			}
+			value.values = []string{item}
+		case yaml.SequenceNode:
+			value.list = true
+			value.values = make([]string, 0, len(node.Content))
+			for _, itemNode := range node.Content {
+				itemNode = resolveYamlAlias(itemNode)
+				if itemNode.Kind != yaml.ScalarNode {
+					return nil, fmt.Errorf("line %d: the items of %s have to be single values", itemNode.Line, key.Value)
+				}
+				item, err := yamlConfigScalar(key.Value, itemNode)
+				if err != nil {
+					return nil, err
+				}
+				value.values = append(value.values, item)
+			}
+		default:
+			return nil, fmt.Errorf("line %d: %s has nested values, set the flags at the top level", key.Line, key.Value)
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// resolveYamlAlias returns the node an alias refers to, or the node itself.
+func resolveYamlAlias(node *yaml.Node) *yaml.Node {
+	for node.Kind == yaml.AliasNode && node.Alias != nil {
+		node = node.Alias
+	}
+	return node
+}
+
+// yamlConfigScalar returns the value of the flag of the name given by a YAML
+// scalar, which can't be null.
+func yamlConfigScalar(name string, node *yaml.Node) (string, error) {
+	if node.Tag == "!!null" {
+		return "", fmt.Errorf("line %d: %s has a null value, leave the flag out instead", node.Line, name)
+	}
+	return node.Value, nil
+}
+
+// readTomlConfig reads the flags set in a TOML config file.
+func readTomlConfig(data []byte) ([]*configValue, error) {
+	var table map[string]interface{}
+	md, err := toml.Decode(string(data), &table)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]*configValue, 0, len(table))
+	seen := make(map[string]bool)
+	for _, key := range md.Keys() {
+		// The keys of tables are listed along with the keys in them,
+		// which are reported along with their table.
+		name := key[0]
+		if seen[name] {
+			continue
+		}
+		seen[name] = true
+		value := &configValue{name: strings.ReplaceAll(name, "_", "-")}
+		switch v := table[name].(type) {
+		case []interface{}:
+			value.list = true
+			value.values = make([]string, 0, len(v))
+			for _, item := range v {
+				itemValue, err := tomlConfigScalar(name, item)
+				if err != nil {
+					return nil, err
+				}
+				value.values = append(value.values, itemValue)
+			}
+		default:
+			item, err := tomlConfigScalar(name, v)
+			if err != nil {
+				return nil, err
+			}
+			value.values = []string{item}
+		}
+		values = append(values, value)
+	}
+	return values, nil
+}
+
+// tomlConfigScalar returns the value of the flag of the name given by a TOML
+// value, as it would be written on the command line.
+func tomlConfigScalar(name string, value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case float64:
+		return strconv.FormatFloat(v, 'g', -1, 64), nil
+	case time.Time:
+		// Dates without a time are told apart by the location the
+		// TOML package gives them.
+		if v.Location().String() == "date-local" {
+			return v.Format("2006-01-02"), nil
+		}
+		return v.Format(time.RFC3339Nano), nil
+	}
+	return "", fmt.Errorf("%s has nested values, set the flags at the top level", name)
+}
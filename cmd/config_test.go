@@ -0,0 +1,189 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+)
+
+// writeConfigFile writes the config file of the name to a new temporary
+// directory, and returns its path.
+func writeConfigFile(t *testing.T, name string, contents string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// formatConfigValues returns the values read from a config file as
+// name=values lines, with a * after the name of lists.
+func formatConfigValues(values []*configValue) string {
+	lines := make([]string, 0, len(values))
+	for _, value := range values {
+		name := value.name
+		if value.list {
+			name += "*"
+		}
+		lines = append(lines, fmt.Sprintf("%s=%q", name, value.values))
+	}
+	return strings.Join(lines, "\n")
+}
+
+func TestReadConfigFile(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		expected string
+	}{
+		{"YAML scalars", "config.yaml", "concurrency: 4\napi-base-url: https://slack.com/api\ninclude-archived: true\n",
+			`concurrency=["4"]` + "\n" + `api-base-url=["https://slack.com/api"]` + "\n" + `include-archived=["true"]`},
+		{"TOML scalars", "config.toml", "concurrency = 4\napi_token_file = \"token.txt\"\ninclude-archived = true\nratio = 0.5\n",
+			`concurrency=["4"]` + "\n" + `api-token-file=["token.txt"]` + "\n" + `include-archived=["true"]` + "\n" + `ratio=["0.5"]`},
+		{"YAML without an extension", "config", "concurrency: 4\n",
+			`concurrency=["4"]`},
+		{"TOML without an extension", "config", "concurrency = 4\n",
+			`concurrency=["4"]`},
+		{"YAML quoted strings", "config.yml", `header: "X-Token: \"a\\b\"\t"` + "\nchannel: 'it''s'\n",
+			`header=["X-Token: \"a\\b\"\t"]` + "\n" + `channel=["it's"]`},
+		{"TOML escapes", "config.toml", `header = "X-Token: \"a\\b\"\t\u00e9"` + "\nchannel = 'C:\\x'\n",
+			`header=["X-Token: \"a\\b\"\té"]` + "\n" + `channel=["C:\\x"]`},
+		{"YAML multi-line strings", "config.yaml", "api-token: |\n  xoxp-123\n  xoxp-456\nlatest: >-\n  2021-01-01\n",
+			`api-token=["xoxp-123\nxoxp-456\n"]` + "\n" + `latest=["2021-01-01"]`},
+		{"TOML multi-line strings", "config.toml", "api-token = \"\"\"\nxoxp-123\"\"\"\nchannel = '''a\nb'''\n",
+			`api-token=["xoxp-123"]` + "\n" + `channel=["a\nb"]`},
+		{"YAML anchors, aliases and tags", "config.yaml", "oldest: &day 2021-01-01\nlatest: *day\nconcurrency: !!str 4\n",
+			`oldest=["2021-01-01"]` + "\n" + `latest=["2021-01-01"]` + "\n" + `concurrency=["4"]`},
+		{"TOML dates", "config.toml", "oldest = 2021-01-01\nlatest = 2021-01-02T03:04:05Z\n",
+			`oldest=["2021-01-01"]` + "\n" + `latest=["2021-01-02T03:04:05Z"]`},
+		{"comments", "config.yaml", "# the workspace\n\nconcurrency: 4 # at most\nchannel: \"a #b\" # quoted\ntoken: abc#def\n",
+			`concurrency=["4"]` + "\n" + `channel=["a #b"]` + "\n" + `token=["abc#def"]`},
+		{"YAML document markers", "config.yaml", "---\nconcurrency: 4\n...\n",
+			`concurrency=["4"]`},
+		{"YAML block lists", "config.yaml", "channel:\n  - general\n  - \"proj-*\"\n  - 'a b'  # comment\nconcurrency: 2\n",
+			`channel*=["general" "proj-*" "a b"]` + "\n" + `concurrency=["2"]`},
+		{"YAML flow lists", "config.yaml", "channel: [general, 'proj-*', \"a,b\"]\n",
+			`channel*=["general" "proj-*" "a,b"]`},
+		{"TOML arrays spanning lines", "config.toml", "channel = [\n  \"general\",\n  'proj-*', # comment\n]\n",
+			`channel*=["general" "proj-*"]`},
+		{"empty lists", "config.toml", `channel = []`,
+			`channel*=[]`},
+		{"empty YAML files", "config.yaml", "\n# nothing\n", ``},
+		{"empty TOML files", "config.toml", "\n# nothing\n", ``},
+	}
+	for _, test := range tests {
+		values, err := readConfigFile(writeConfigFile(t, test.file, test.contents))
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if got := formatConfigValues(values); got != test.expected {
+			t.Errorf("%s: expected\n%s\ngot\n%s", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestReadConfigFileRejects(t *testing.T) {
+	tests := []struct {
+		name     string
+		file     string
+		contents string
+		expected string
+	}{
+		{"TOML tables", "config.toml", "[fetch]\nconcurrency = 4\n", "fetch has nested values"},
+		{"TOML inline tables", "config.toml", "fetch = {concurrency = 4}\n", "fetch has nested values"},
+		{"TOML dotted keys", "config.toml", "fetch.concurrency = 4\n", "fetch has nested values"},
+		{"TOML arrays of tables", "config.toml", "[[runs]]\n", "runs has nested values"},
+		{"invalid TOML", "config.toml", "concurrency 4\n", "line 1"},
+		{"nested YAML maps", "config.yaml", "fetch:\n  concurrency: 4\n", "line 1: fetch has nested values"},
+		{"YAML flow maps", "config.yaml", "fetch: {concurrency: 4}\n", "line 1: fetch has nested values"},
+		{"nested YAML lists", "config.yaml", "channel: [[a], b]\n", "line 1: the items of channel have to be single values"},
+		{"YAML nulls", "config.yaml", "oldest: ~\nlatest: null\n", "line 1: oldest has a null value"},
+		{"YAML names without a value", "config.yaml", "concurrency:\n", "line 1: concurrency has a null value"},
+		{"YAML lists at the top level", "config.yaml", "- general\n", "line 1: expected the names of flags"},
+		{"several YAML documents", "config.yaml", "concurrency: 4\n---\nconcurrency: 5\n", "line 2: only one YAML document"},
+		{"invalid YAML", "config.yaml", "channel: [a, b\n", "yaml:"},
+		{"neither YAML nor TOML", "config", "concurrency 4\n", "expected the names of flags"},
+		{"duplicate YAML names", "config.yaml", "concurrency: 4\nconcurrency: 5\n", ":2: concurrency is set twice"},
+		{"duplicate names with underscores", "config.yaml", "page-size: 4\npage_size: 5\n", ":2: page-size is set twice"},
+		{"duplicate TOML names with underscores", "config.toml", "page-size = 4\npage_size = 5\n", "page-size is set twice"},
+	}
+	for _, test := range tests {
+		values, err := readConfigFile(writeConfigFile(t, test.file, test.contents))
+		if err == nil {
+			t.Errorf("%s: expected an error, got\n%s", test.name, formatConfigValues(values))
+		} else if !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error with %q, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestApplyConfigFile(t *testing.T) {
+	defer func(file string) { configFile = file }(configFile)
+	t.Setenv(apiTokenEnvVar, "")
+
+	var (
+		concurrency int
+		archived    bool
+		channels    []string
+		token       string
+	)
+	root := &cobra.Command{Use: "root"}
+	cmd := &cobra.Command{Use: "fetch"}
+	cmd.Flags().IntVar(&concurrency, "concurrency", 1, "")
+	cmd.Flags().BoolVar(&archived, "include-archived", false, "")
+	cmd.Flags().StringArrayVar(&channels, "channel", nil, "")
+	cmd.Flags().StringVar(&token, "api-token", "", "")
+	other := &cobra.Command{Use: "other"}
+	other.Flags().String("team-id", "", "")
+	root.AddCommand(cmd, other)
+
+	configFile = writeConfigFile(t, "config.yaml", "concurrency: 4\ninclude_archived: true\nchannel:\n  - general\n  - proj-*\napi-token: xoxp-file\nteam-id: T1\n")
+	if err := cmd.Flags().Parse([]string{"--concurrency", "8"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := applyConfigFile(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if concurrency != 8 {
+		t.Errorf("expected the command line to take precedence, got --concurrency %d", concurrency)
+	}
+	if !archived || fmt.Sprint(channels) != "[general proj-*]" || token != "xoxp-file" {
+		t.Errorf("expected the flags of the file to be set, got %v, %v and %q", archived, channels, token)
+	}
+
+	t.Setenv(apiTokenEnvVar, "xoxp-env")
+	token = ""
+	cmd.Flags().Lookup("api-token").Changed = false
+	if err := applyConfigFile(cmd); err != nil {
+		t.Fatal(err)
+	}
+	if token != "" {
+		t.Errorf("expected the environment variable to take precedence over the token of the file, got %q", token)
+	}
+
+	cmd.Flags().Lookup("concurrency").Changed = false
+	for contents, expected := range map[string]string{
+		"concurrenc: 4\n":         `:1: unknown flag "concurrenc"`,
+		"concurrency: [1, 2]\n":   ":1: --concurrency takes a single value, not a list",
+		"concurrency: four\n":     `:1: invalid value "four" for --concurrency`,
+		"channel: a\nconfig: b\n": ":2: the config file can't set --config",
+	} {
+		configFile = writeConfigFile(t, "config.yaml", contents)
+		if err := applyConfigFile(cmd); err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("expected an error with %q for %q, got %v", expected, contents, err)
+		}
+	}
+
+	// TOML doesn't tell on which line a value is.
+	configFile = writeConfigFile(t, "config.toml", "concurrency = \"four\"\n")
+	if err := applyConfigFile(cmd); err == nil || !strings.Contains(err.Error(), `config.toml: invalid value "four"`) {
+		t.Errorf("expected an error about the value of the TOML file, got %v", err)
+	}
+}
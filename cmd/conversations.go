@@ -0,0 +1,1036 @@
+package cmd
+
+import (
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+var (
+	// The number of conversations fetched in parallel.
+	concurrency int
+	// The number of threads of a conversation fetched in parallel.
+	threadConcurrency int
+	// Whether to write messages into one file per day, like Slack's exports.
+	nativeLayout bool
+	// Whether to keep a checkpoint of the export, and resume from that of
+	// an interrupted one.
+	resumeExport bool
+	// Whether to fetch the full list of users of each reaction.
+	fullReactions bool
+	// Whether to go on with the other conversations when one fails.
+	continueOnError bool
+	// Whether to leave out the messages of bots and integrations, and those
+	// Slack posts when someone joins or leaves.
+	excludeBots   bool
+	excludeSystem bool
+	// The range of messages to fetch, as given on the command line.
+	oldestFlag string
+	latestFlag string
+	// The same range, as Slack timestamps. Empty when unbounded.
+	historyOldest string
+	historyLatest string
+)
+
+// addConversationsContentsFlags registers the flags controlling how the
+// contents of conversations are fetched on a command that fetches them.
+func addConversationsContentsFlags(cmd *cobra.Command) {
+	cmd.PersistentFlags().IntVar(&concurrency, "concurrency", 4, "the number of conversations to fetch in parallel")
+	cmd.PersistentFlags().IntVar(&threadConcurrency, "thread-concurrency", 1, "the number of threads of each conversation to fetch the replies of in parallel, on top of --concurrency")
+	cmd.PersistentFlags().BoolVar(&nativeLayout, "native-layout", false, "write the messages of each conversation, including thread replies, into one YYYY-MM-DD.json file per day like Slack's own exports, instead of messages.json and replies.json")
+	cmd.PersistentFlags().BoolVar(&resumeExport, "resume", false, "keep a checkpoint of the export next to the output archive, and resume from it if there is one")
+	cmd.PersistentFlags().BoolVar(&fullReactions, "full-reactions", false, "fetch the full list of the users behind each reaction, which Slack truncates in the history. This takes one more request per message with such reactions, and needs the reactions:read scope")
+	cmd.PersistentFlags().BoolVar(&continueOnError, "continue-on-error", false, "go on with the other conversations when fetching one of them fails, and list the failed ones at the end, instead of stopping the export")
+	cmd.PersistentFlags().BoolVar(&excludeBots, "exclude-bots", false, "leave out the messages posted by bots and integrations")
+	cmd.PersistentFlags().BoolVar(&excludeSystem, "exclude-system", false, "leave out the messages Slack posts when someone joins or leaves a conversation")
+	cmd.PersistentFlags().BoolVar(&includeChannelChanges, "channel-changes", false, "write the history of the topics, purposes and names of the conversations, and of when they were archived, to channel_changes.json, from the messages Slack posts about them in their history. This takes no more requests")
+	cmd.PersistentFlags().BoolVar(&includeExternalUsers, "include-external-users", false, "fetch the users of other workspaces found in the conversations, such as those of Slack Connect channels and DMs, which users.json doesn't have, into external_users.json. Their mentions are then resolved too with --resolve-mentions. This takes one more request per external user")
+	cmd.PersistentFlags().BoolVar(&resolveMentions, "resolve-mentions", false, "rewrite the mentions of users and channels in the text of messages, such as <@U12345>, with their names, keeping the original text in raw_text")
+	cmd.PersistentFlags().BoolVar(&addPermalinks, "permalinks", false, "add a permalink field to each message, with its link in Slack, such as https://example.slack.com/archives/C12345/p1700000000123456, built from the domain of the workspace returned by team.info, which needs the team:read scope")
+	cmd.PersistentFlags().StringVar(&workspaceUrl, "workspace-url", "", "the URL of the workspace, such as https://example.slack.com, to build the permalinks of --permalinks with instead of fetching its domain. Implies --permalinks")
+	cmd.PersistentFlags().StringVar(&messageFormat, "message-format", "array", "how to write the messages of each conversation: array for a JSON array per file, as in Slack's own exports, or jsonl for one JSON object per line, in files ending in .jsonl, which are easier to stream")
+	cmd.PersistentFlags().BoolVar(&gzipJson, "gzip-json", false, "gzip-compress the files of each conversation inside the archive, such as messages.json into messages.json.gz, which takes far less space when the archive itself is stored uncompressed. Importers of Slack's exports don't expect these files")
+	cmd.PersistentFlags().StringVar(&maxFileSizeFlag, "max-file-size", "", "split the files of each conversation larger than this, such as 100MB, into parts of at most that size, such as messages.part1.json and messages.part2.json, listed in file_parts.json")
+	cmd.PersistentFlags().StringVar(&oldestFlag, "oldest", "", "only fetch messages posted at or after this time, as a Unix timestamp or an RFC3339 date")
+	cmd.PersistentFlags().StringVar(&latestFlag, "latest", "", "only fetch messages posted at or before this time, as a Unix timestamp or an RFC3339 date")
+	cmd.PreRunE = func(cmd *cobra.Command, args []string) error {
+		if messageFormat != "array" && messageFormat != "jsonl" {
+			return fmt.Errorf("unknown message format %s, expected array or jsonl", messageFormat)
+		}
+		var err error
+		maxFileBytes, err = parseByteSize(maxFileSizeFlag)
+		if err != nil {
+			return fmt.Errorf("invalid --max-file-size: %w", err)
+		}
+		historyOldest, err = parseSlackTimestamp(oldestFlag)
+		if err != nil {
+			return fmt.Errorf("invalid --oldest: %w", err)
+		}
+		historyLatest, err = parseSlackTimestamp(latestFlag)
+		if err != nil {
+			return fmt.Errorf("invalid --latest: %w", err)
+		}
+		return checkWorkspaceUrl()
+	}
+}
+
+// The contents of a single conversation, fetched by a worker and waiting to be
+// written to the archive.
+type conversationContents struct {
+	id    string
+	dir   string
+	files []*conversationFile
+	err   error
+	// The numbers of messages and thread replies fetched.
+	messages int
+	replies  int
+}
+
+// inaccessibleReason returns the error code Slack returns when a listed
+// conversation can't be read with the token, as when it belongs to a bot which
+// hasn't been invited to it, or an empty string for any other error.
+func inaccessibleReason(err error) string {
+	var slackErr *slackexport.Error
+	if errors.As(err, &slackErr) && (slackErr.Code == "not_in_channel" || slackErr.Code == "channel_not_found") {
+		return slackErr.Code
+	}
+	return ""
+}
+
+// addFile adds a file to the contents, to be written to in full before the
+// next one is added, which finishes writing the ones before.
+func (c *conversationContents) addFile(name string) (io.Writer, error) {
+	if err := c.finishFiles(); err != nil {
+		return nil, err
+	}
+	file := &conversationFile{name: name}
+	c.files = append(c.files, file)
+	return file, nil
+}
+
+// finishFiles closes the temporary files of the contents, once written.
+func (c *conversationContents) finishFiles() error {
+	for _, file := range c.files {
+		if err := file.finish(); err != nil {
+			return fmt.Errorf("failed to write %s to its temporary file: %w", file.name, err)
+		}
+	}
+	return nil
+}
+
+// fetchConversationsContents fetches the history and thread replies of each of
+// the conversations, writing them to the archive under the directory returned
+// by dirName for that conversation.
+//
+// Conversations are fetched by a pool of workers into temporary files, since
+// the archive can't be written to concurrently. The files are then copied to
+// the archive from this goroutine, in the same order as the conversations, and
+// removed.
+//
+// Bot tokens can only read the conversations the bot has been invited to. The
+// others, and those Slack lists but then can't find, are skipped, with a
+// warning listing them once all the others have been fetched, rather than
+// failing the whole export. They stay in the list of conversations, and are
+// recorded in the export metadata. So are the conversations
+// which fail to be fetched with --continue-on-error, which are recorded for
+// the summary of the export.
+//
+// Once the --deadline of the export is reached, the conversations being
+// fetched are cancelled, and they and the ones after them are left out, so
+// that the archive can still be written.
+func fetchConversationsContents(ctx context.Context, w archiveWriter, client *slackexport.Client, cp *checkpoint, conversations []map[string]interface{}, dirName func(map[string]interface{}) string) error {
+	workers := concurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	dirs := conversationDirs(conversations, dirName)
+	addMentionConversations(conversations)
+
+	// One result channel per conversation lets us write them out in order.
+	results := make([]chan *conversationContents, len(conversations))
+	for i := range results {
+		results[i] = make(chan *conversationContents, 1)
+	}
+
+	fetchCtx, cancel := deadlineContext(ctx)
+	defer cancel()
+
+	jobs := make(chan int)
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer close(jobs)
+		for i := range conversations {
+			select {
+			case jobs <- i:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	bar := newProgressBar(len(conversations))
+	conversationsProgress = bar
+	defer func() {
+		bar.finish()
+		conversationsProgress = nil
+	}()
+
+	for n := 0; n < workers; n++ {
+		go func() {
+			for i := range jobs {
+				bar.start(dirs[i])
+				results[i] <- fetchConversationContents(fetchCtx, client, cp, conversations[i], dirs[i])
+			}
+		}()
+	}
+
+	var skipped []string
+	for i, result := range results {
+		contents := <-result
+		if contents.err != nil && deadlineReached(fetchCtx) && ctx.Err() == nil {
+			reportExportTruncated(i, len(conversations))
+			break
+		}
+		switch reason := inaccessibleReason(contents.err); {
+		case reason != "":
+			reportConversationSkipped(contents, reason)
+			skipped = append(skipped, contents.dir+" ("+reason+")")
+		case contents.err != nil && continueOnError && ctx.Err() == nil:
+			reportConversationFailed(i+1, len(conversations), contents)
+		case contents.err != nil:
+			return contents.err
+		default:
+			reportConversationDone(i+1, len(conversations), contents)
+		}
+
+		fetched := contents.files
+		base, ok := conversationBases[contents.id]
+		if !ok {
+			base = &conversationBase{}
+		}
+		if contents.err != nil {
+			// Keep what the input archive has of a skipped conversation when
+			// topping it up, and nothing of what was fetched.
+			contents.files = nil
+			if ok {
+				contents.files = base.files
+			}
+		} else if ok {
+			files, err := mergeConversationFiles(base.files, contents.files)
+			if err != nil {
+				return fmt.Errorf("failed to merge conversation %s: %w", contents.dir, err)
+			}
+			contents.files = files
+		}
+		if contents.err == nil && nativeLayout && len(contents.files) == 0 {
+			file, err := emptyConversationDay(conversations[i])
+			if err != nil {
+				return fmt.Errorf("failed to write conversation %s: %w", contents.dir, err)
+			}
+			contents.files = []*conversationFile{file}
+		}
+
+		if err := collectExternalUsers(ctx, client, conversations[i], contents.files); err != nil {
+			return fmt.Errorf("failed to fetch the external users of conversation %s: %w", contents.dir, err)
+		}
+		if err := collectChannelChanges(contents.id, contents.files); err != nil {
+			return fmt.Errorf("failed to find the changes of conversation %s: %w", contents.dir, err)
+		}
+		if err := resolveMentionsInFiles(contents.files); err != nil {
+			return fmt.Errorf("failed to resolve the mentions of conversation %s: %w", contents.dir, err)
+		}
+		if err := addPermalinksToFiles(contents.id, contents.files); err != nil {
+			return fmt.Errorf("failed to add the permalinks of conversation %s: %w", contents.dir, err)
+		}
+
+		latest, err := latestMessageTs(contents.files)
+		if err != nil {
+			return fmt.Errorf("failed to read conversation %s: %w", contents.dir, err)
+		}
+		if latest != "" {
+			latestConversationMessages[contents.id] = latest
+		}
+
+		files, err := splitConversationFiles(contents.files)
+		if err != nil {
+			return fmt.Errorf("failed to split the files of conversation %s: %w", contents.dir, err)
+		}
+		forgetFileParts(contents.dir)
+		for _, file := range files {
+			name, err := writeConversationFile(w, contents.dir, file)
+			if err != nil {
+				return fmt.Errorf("failed to write %s of conversation %s: %w", file.name, contents.dir, err)
+			}
+			recordFilePart(contents.dir + "/" + name)
+		}
+		removeConversationFiles(fetched, base.files, contents.files, files)
+	}
+
+	bar.finish()
+	if len(skipped) > 0 {
+		log.Printf("++++++ Skipped %d conversations which can't be read with this token. If it belongs to a bot, invite it to them to export them: %s", len(skipped), strings.Join(skipped, ", "))
+	}
+	return nil
+}
+
+// writeConversationFile copies the file to the directory of its conversation in
+// the archive, as JSON lines with --message-format jsonl, and gzip-compressed
+// with --gzip-json, and returns the name it is written under. Files written as
+// JSON arrays are streamed from their temporary file, without reading them
+// into memory.
+func writeConversationFile(w archiveWriter, dir string, file *conversationFile) (string, error) {
+	name := file.name
+	if messageFormat == "jsonl" {
+		name = jsonLinesFileName(name)
+	}
+	if gzipJson {
+		name += gzipSuffix
+	}
+	outFile, err := w.Create(dir + "/" + name)
+	if err != nil {
+		return "", err
+	}
+
+	var gw *gzip.Writer
+	if gzipJson {
+		gw, err = newGzipWriter(outFile)
+		if err != nil {
+			return "", err
+		}
+		outFile = gw
+	}
+	if messageFormat == "jsonl" {
+		data, err := file.bytes()
+		if err == nil {
+			data, err = jsonArrayToLines(data)
+		}
+		if err == nil {
+			_, err = outFile.Write(data)
+		}
+		if err != nil {
+			return "", err
+		}
+	} else {
+		r, err := file.open()
+		if err != nil {
+			return "", err
+		}
+		_, err = io.Copy(outFile, r)
+		r.Close()
+		if err != nil {
+			return "", err
+		}
+	}
+	if gw != nil {
+		if err := gw.Close(); err != nil {
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// conversationDirs returns the directory of each conversation in the archive.
+// Names are made safe for use as zip paths, and when two conversations end up
+// with the same directory, the ID of the later one is appended to its own so
+// that it doesn't overwrite the other.
+func conversationDirs(conversations []map[string]interface{}, dirName func(map[string]interface{}) string) []string {
+	dirs := make([]string, len(conversations))
+	used := make(map[string]bool)
+	for i, conversation := range conversations {
+		conversationId, _ := conversation["id"].(string)
+		dir := sanitizeDirName(dirName(conversation))
+		if dir == "" {
+			dir = conversationId
+		}
+		if used[dir] {
+			verbosePrintln(fmt.Sprintf("The directory %s is already used by another conversation, using %s-%s instead", dir, dir, conversationId))
+			dir = dir + "-" + conversationId
+		}
+		used[dir] = true
+		dirs[i] = dir
+	}
+	return dirs
+}
+
+// sanitizeDirName makes a conversation name safe to use as a single directory
+// in a zip path, by replacing path separators and removing leading dots.
+func sanitizeDirName(name string) string {
+	name = strings.NewReplacer("/", "_", "\\", "_").Replace(strings.TrimSpace(name))
+	return strings.TrimLeft(name, ".")
+}
+
+func fetchConversationContents(ctx context.Context, client *slackexport.Client, cp *checkpoint, conversation map[string]interface{}, dir string) *conversationContents {
+	conversationId, _ := conversation["id"].(string)
+	contents := &conversationContents{id: conversationId, dir: dir}
+
+	if progress := cp.progress(conversationId); progress.Completed {
+		verbosePrintln("Conversation "+dir+" was already fetched, using its checkpoint", "channel", conversationId)
+		contents.messages = progress.Messages
+		contents.replies = progress.Replies
+		contents.files, contents.err = cp.completedFiles(conversationId)
+		return contents
+	}
+
+	verbosePrintln("Fetching the history and replies of conversation "+dir, "channel", conversationId)
+
+	if nativeLayout {
+		contents.err = fetchConversationDays(ctx, contents, client, cp, conversationId)
+	} else {
+		contents.err = fetchConversationFiles(ctx, contents, client, cp, conversationId)
+	}
+	if contents.err == nil {
+		contents.err = contents.finishFiles()
+	}
+	if contents.err == nil {
+		contents.err = cp.complete(contents)
+	}
+
+	verbosePrintln("Done with conversation "+dir, "channel", conversationId)
+	return contents
+}
+
+// fetchConversationFiles fetches the history and thread replies of the
+// conversation and adds them to its contents as messages.json and
+// replies.json respectively. Both are added even when empty, as [], to tell
+// conversations found empty apart from those which weren't fetched.
+func fetchConversationFiles(ctx context.Context, contents *conversationContents, client *slackexport.Client, cp *checkpoint, conversationId string) error {
+	output, err := contents.addFile("messages.json")
+	if err != nil {
+		return err
+	}
+	ts_ids, messages, err := fetchChannelHistory(ctx, output, client, cp, conversationId)
+	if err != nil {
+		return err
+	}
+	contents.messages = messages
+
+	ts_ids = conversationThreads(conversationId, ts_ids)
+	output, err = contents.addFile("replies.json")
+	if err != nil {
+		return err
+	}
+	contents.replies, err = fetchChannelReplies(ctx, output, client, cp, conversationId, ts_ids)
+	return err
+}
+
+// fetchConversationDays fetches the history and thread replies of the
+// conversation and adds them to its contents as one file per day, named
+// YYYY-MM-DD.json after the UTC date the messages were posted on, with
+// the messages of each day in chronological order.
+func fetchConversationDays(ctx context.Context, contents *conversationContents, client *slackexport.Client, cp *checkpoint, conversationId string) error {
+	days := make(map[string][]map[string]interface{})
+	seen := make(map[string]bool)
+	addMessage := func(message map[string]interface{}) bool {
+		ts, _ := message["ts"].(string)
+		// Each thread starts with its root message, which we already
+		// got from the history.
+		if seen[ts] {
+			return false
+		}
+		seen[ts] = true
+		day := slackTimestampTime(ts).UTC().Format("2006-01-02")
+		days[day] = append(days[day], message)
+		return true
+	}
+
+	ts_ids, err := resumeChannelHistory(ctx, client, cp, conversationId, func(messages []map[string]interface{}) error {
+		for _, message := range messages {
+			if addMessage(message) {
+				contents.messages++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	ts_ids = conversationThreads(conversationId, ts_ids)
+	err = walkChannelReplies(ctx, client, cp, conversationId, ts_ids, func(message map[string]interface{}) error {
+		if addMessage(message) {
+			contents.replies++
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	dayNames := make([]string, 0, len(days))
+	for day := range days {
+		dayNames = append(dayNames, day)
+	}
+	sort.Strings(dayNames)
+
+	for _, day := range dayNames {
+		messages := days[day]
+		sortMessagesByTs(messages)
+
+		output, err := contents.addFile(day + ".json")
+		if err != nil {
+			return err
+		}
+		if err := newJsonEncoder(output).Encode(&messages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// emptyConversationDay returns the file an empty conversation gets with
+// --native-layout: an empty array for the day the conversation was created,
+// or the day of the export when Slack doesn't say. Without it, conversations
+// found empty couldn't be told apart from those which weren't fetched.
+func emptyConversationDay(conversation map[string]interface{}) (*conversationFile, error) {
+	day := newFileModTime()
+	if created, _ := conversation["created"].(float64); created > 0 {
+		day = time.Unix(int64(created), 0)
+	}
+	file := &conversationFile{name: day.UTC().Format("2006-01-02") + ".json"}
+	if err := file.encode([]interface{}{}); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// A page of the history of a channel, sorted oldest first, which is spooled to
+// a temporary file until the whole history is written, along with the times of
+// its oldest and newest messages.
+type historyPage struct {
+	file           *conversationFile
+	oldest, newest time.Time
+}
+
+// fetchChannelHistory writes the history of the channel to the output as a
+// JSON array, and returns the timestamps of the thread roots it contains and
+// the number of messages written.
+//
+// Slack returns the history newest first, but the messages are written oldest
+// first, as in Slack's own exports, which importers expect. Each page is
+// sorted and spooled to a temporary file as it is fetched, and once they all
+// are, the pages are written back oldest first, one at a time, so that even
+// the longest histories don't have to fit in memory.
+func fetchChannelHistory(ctx context.Context, output io.Writer, client *slackexport.Client, cp *checkpoint, channelId string) ([]string, int, error) {
+	pages := make([]*historyPage, 0)
+	defer func() {
+		for _, page := range pages {
+			page.file.remove()
+		}
+	}()
+	ts_ids, err := resumeChannelHistory(ctx, client, cp, channelId, func(messages []map[string]interface{}) error {
+		if len(messages) == 0 {
+			return nil
+		}
+		sortMessagesByTs(messages)
+		page := &historyPage{
+			file:   &conversationFile{name: "messages.json"},
+			oldest: slackTimestampTime(messages[0]["ts"]),
+			newest: slackTimestampTime(messages[len(messages)-1]["ts"]),
+		}
+		pages = append(pages, page)
+		return page.file.encode(&messages)
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	count, err := writeHistoryPages(output, pages)
+	if err != nil {
+		return nil, 0, err
+	}
+	return ts_ids, count, nil
+}
+
+// writeHistoryPages writes the messages of the pages to the output as a JSON
+// array, oldest first, and returns the number of messages written.
+//
+// The pages of a history don't overlap, unless it changed while it was being
+// fetched or the pages saved in a checkpoint were split differently, so
+// reading them back oldest page first is enough to write their messages in
+// order. Pages which do overlap are read and sorted together.
+func writeHistoryPages(output io.Writer, pages []*historyPage) (int, error) {
+	sort.SliceStable(pages, func(i, j int) bool {
+		return pages[i].oldest.Before(pages[j].oldest)
+	})
+
+	res := newJsonArrayWriter(output)
+	for start := 0; start < len(pages); {
+		end, newest := start+1, pages[start].newest
+		for end < len(pages) && !pages[end].oldest.After(newest) {
+			if pages[end].newest.After(newest) {
+				newest = pages[end].newest
+			}
+			end++
+		}
+
+		var messages []map[string]interface{}
+		for _, page := range pages[start:end] {
+			var pageMessages []map[string]interface{}
+			if err := page.file.decode(&pageMessages); err != nil {
+				return 0, fmt.Errorf("failed to read back the history: %w", err)
+			}
+			page.file.remove()
+			messages = append(messages, pageMessages...)
+		}
+		if end-start > 1 {
+			sortMessagesByTs(messages)
+		}
+		for _, message := range messages {
+			if err := res.Write(message); err != nil {
+				return 0, err
+			}
+		}
+		start = end
+	}
+	return res.count, res.Close()
+}
+
+// resumeChannelHistory calls handle with the messages of each page of the
+// history of the channel, and returns the timestamps of the thread roots it
+// contains.
+//
+// The history is saved in the checkpoint as it is fetched. Any history saved
+// by a previous, interrupted run is handled first, and fetching then carries
+// on from where that run stopped.
+func resumeChannelHistory(ctx context.Context, client *slackexport.Client, cp *checkpoint, channelId string, handle func(messages []map[string]interface{}) error) ([]string, error) {
+	ts_ids := make([]string, 0)
+	// The same thread root can show up on two pages, so we keep track of
+	// the ones we have already seen.
+	seen_ts_ids := make(map[string]bool)
+	// So can any other message, on rare occasions, which must only be
+	// written once all the same.
+	seenMessages := make(map[string]bool)
+	duplicates := 0
+	defer func() {
+		if duplicates > 0 {
+			verbosePrintln(fmt.Sprintf("Dropped %d duplicate messages from the history of %s", duplicates, channelId), "channel", channelId, "duplicates", duplicates)
+		}
+	}()
+	handleAll := func(messages []map[string]interface{}) error {
+		kept := make([]map[string]interface{}, 0, len(messages))
+		for _, message := range messages {
+			if ts, _ := message["ts"].(string); ts != "" {
+				if seenMessages[ts] {
+					duplicates++
+					continue
+				}
+				seenMessages[ts] = true
+			}
+			// Threads started by excluded messages may still have
+			// replies worth keeping.
+			if excludeMessage(message) {
+				atomic.AddInt64(&messagesExcluded, 1)
+			} else {
+				kept = append(kept, message)
+			}
+			if isThreadRoot(message) {
+				id, _ := message["ts"].(string)
+				if !seen_ts_ids[id] {
+					seen_ts_ids[id] = true
+					ts_ids = append(ts_ids, id)
+				}
+			}
+		}
+		return handle(kept)
+	}
+
+	saved, err := cp.walkSavedHistory(channelId, handleAll)
+	if err != nil {
+		return nil, err
+	}
+
+	progress := cp.progress(channelId)
+	if progress.HistoryDone {
+		return ts_ids, nil
+	}
+	if progress.Cursor != "" {
+		verbosePrintln(fmt.Sprintf("Resuming the history of %s after %d messages", channelId, saved), "channel", channelId, "cursor", progress.Cursor)
+	}
+
+	err = walkChannelHistory(ctx, client, channelId, progress.Cursor, func(messages []map[string]interface{}, nextCursor string) error {
+		completeReactions(ctx, client, channelId, messages)
+		if err := handleAll(messages); err != nil {
+			return err
+		}
+		return cp.savePage(channelId, messages, nextCursor)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ts_ids, nil
+}
+
+// The subtypes of the messages Slack posts when someone joins or leaves a
+// conversation, left out with --exclude-system.
+var joinLeaveSubtypes = []string{"channel_join", "channel_leave", "group_join", "group_leave"}
+
+// excludeMessage returns whether the message is left out of the export, with
+// --exclude-bots or --exclude-system.
+func excludeMessage(message map[string]interface{}) bool {
+	subtype, _ := message["subtype"].(string)
+	botId, _ := message["bot_id"].(string)
+	return (excludeBots && (botId != "" || subtype == "bot_message")) ||
+		(excludeSystem && containsString(joinLeaveSubtypes, subtype))
+}
+
+// isThreadRoot returns whether the message starts a thread with replies to
+// fetch. Slack doesn't always give all the details of a thread on its root, so
+// any of them will do: a positive reply_count or reply_users_count, a
+// latest_reply, or a thread_ts equal to the ts of the message. Messages whose
+// replies were all deleted still have a reply_count, of zero, and have no
+// replies to fetch.
+func isThreadRoot(message map[string]interface{}) bool {
+	ts, _ := message["ts"].(string)
+	if ts == "" {
+		return false
+	}
+	if replyCount, ok := message["reply_count"]; ok {
+		count, _ := replyCount.(float64)
+		return count > 0
+	}
+	if count, _ := message["reply_users_count"].(float64); count > 0 {
+		return true
+	}
+	if latestReply, _ := message["latest_reply"].(string); latestReply != "" {
+		return true
+	}
+	threadTs, _ := message["thread_ts"].(string)
+	return threadTs == ts
+}
+
+// walkChannelHistory calls handle for each page of the history of the
+// channel, starting from the given cursor, along with the cursor of the next
+// page, which is empty for the last page.
+func walkChannelHistory(ctx context.Context, client *slackexport.Client, channelId string, cursor string, handle func(messages []map[string]interface{}, nextCursor string) error) error {
+	historyRange := slackexport.HistoryRange{Oldest: conversationOldest(channelId), Latest: historyLatest}
+	return client.History(ctx, channelId, historyRange, cursor, handle)
+}
+
+// fetchChannelReplies fetches the replies of each of the threads whose
+// root messages have the given timestamps, and returns the number of replies,
+// not counting the roots.
+//
+// Only the lower bound of the range of messages to fetch is applied to
+// replies: any reply to a thread whose root is in the range is fetched, even
+// if it was posted after the range ends, so that threads are never truncated.
+func fetchChannelReplies(ctx context.Context, output io.Writer, client *slackexport.Client, cp *checkpoint, channelId string, tsIds []string) (int, error) {
+	res := newJsonArrayWriter(output)
+	replies := 0
+	err := walkChannelReplies(ctx, client, cp, channelId, tsIds, func(message map[string]interface{}) error {
+		ts, _ := message["ts"].(string)
+		threadTs, _ := message["thread_ts"].(string)
+		if ts != threadTs {
+			replies++
+		}
+		return res.Write(message)
+	})
+	if err != nil {
+		return 0, err
+	}
+	return replies, res.Close()
+}
+
+// walkChannelReplies calls handle for each message in the threads whose root
+// messages have the given timestamps. As returned by Slack, each thread starts
+// with its root message.
+//
+// Threads are fetched by a pool of workers, sharing the rate limit of the
+// client, but handled one after the other in the order of their timestamps,
+// so that the output doesn't depend on which thread was fetched first.
+//
+// Each thread is saved in the checkpoint once fetched, and the threads saved
+// by a previous, interrupted run aren't fetched again.
+func walkChannelReplies(ctx context.Context, client *slackexport.Client, cp *checkpoint, channelId string, tsIds []string, handle func(map[string]interface{}) error) error {
+	workers := threadConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+
+	saved, err := cp.savedThreads(channelId)
+	if err != nil {
+		return err
+	}
+	if len(saved) > 0 {
+		verbosePrintln(fmt.Sprintf("Resuming the threads of %s, %d of which were already fetched", channelId, len(saved)), "channel", channelId)
+	}
+
+	// Once a thread fails, there is no point fetching the others.
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type thread struct {
+		messages []map[string]interface{}
+		err      error
+	}
+	results := make([]chan thread, len(tsIds))
+	for i := range results {
+		results[i] = make(chan thread, 1)
+	}
+
+	jobs := make(chan int)
+	go func() {
+		defer close(jobs)
+		for i := range tsIds {
+			select {
+			case jobs <- i:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	for n := 0; n < workers; n++ {
+		go func() {
+			for i := range jobs {
+				if messages, ok := saved[tsIds[i]]; ok {
+					results[i] <- thread{messages: messages}
+					continue
+				}
+				var res thread
+				res.err = client.Replies(ctx, channelId, tsIds[i], conversationOldest(channelId), func(messages []map[string]interface{}) error {
+					completeReactions(ctx, client, channelId, messages)
+					res.messages = append(res.messages, messages...)
+					return nil
+				})
+				if res.err == nil {
+					res.err = cp.saveThread(channelId, tsIds[i], res.messages)
+				}
+				results[i] <- res
+			}
+		}()
+	}
+
+	duplicates := 0
+	for _, result := range results {
+		res := <-result
+		if res.err != nil {
+			return res.err
+		}
+		// As with the history, the same reply can show up on two pages.
+		seen := make(map[string]bool)
+		for _, message := range res.messages {
+			if ts, _ := message["ts"].(string); ts != "" {
+				if seen[ts] {
+					duplicates++
+					continue
+				}
+				seen[ts] = true
+			}
+			if excludeMessage(message) {
+				// The root of each thread was already counted with the
+				// history.
+				ts, _ := message["ts"].(string)
+				if threadTs, _ := message["thread_ts"].(string); ts != threadTs {
+					atomic.AddInt64(&messagesExcluded, 1)
+				}
+				continue
+			}
+			if err := handle(message); err != nil {
+				return err
+			}
+		}
+	}
+	if duplicates > 0 {
+		verbosePrintln(fmt.Sprintf("Dropped %d duplicate replies from the threads of %s", duplicates, channelId), "channel", channelId, "duplicates", duplicates)
+	}
+	return nil
+}
+
+// fetchConversationMembers returns the IDs of the members of the conversation.
+func fetchConversationMembers(ctx context.Context, client *slackexport.Client, channelId string) ([]string, error) {
+	verbosePrintln("Fetching the members of conversation "+channelId, "channel", channelId)
+	return client.Members(ctx, channelId)
+}
+
+// conversationsContentsScopes returns the scopes needed on top of those to
+// read the history of conversations, depending on the options given.
+func conversationsContentsScopes() []string {
+	scopes := make([]string, 0)
+	if fullReactions {
+		scopes = append(scopes, "reactions:read")
+	}
+	if includeExternalUsers {
+		scopes = append(scopes, "users:read")
+	}
+	if addPermalinks && workspaceUrl == "" {
+		scopes = append(scopes, "team:read")
+	}
+	return scopes
+}
+
+// completeReactions replaces the reactions of the messages with their full
+// versions when asked to, for those messages where Slack didn't list all the
+// users behind a reaction. Messages whose reactions can't be fetched keep the
+// ones they have.
+func completeReactions(ctx context.Context, client *slackexport.Client, channelId string, messages []map[string]interface{}) {
+	if !fullReactions {
+		return
+	}
+	for _, message := range messages {
+		if !hasTruncatedReactions(message) {
+			continue
+		}
+		ts, _ := message["ts"].(string)
+		reactions, err := fetchMessageReactions(ctx, client, channelId, ts)
+		if err != nil {
+			log.Print("++++++ Failed to fetch the reactions of message " + ts + " in conversation " + channelId + "\n\n" + err.Error() + "\n")
+			continue
+		}
+		message["reactions"] = reactions
+	}
+}
+
+// hasTruncatedReactions returns whether some reaction of the message has more
+// users than it lists.
+func hasTruncatedReactions(message map[string]interface{}) bool {
+	reactions, _ := message["reactions"].([]interface{})
+	for _, value := range reactions {
+		reaction, _ := value.(map[string]interface{})
+		count, _ := reaction["count"].(float64)
+		users, _ := reaction["users"].([]interface{})
+		if int(count) > len(users) {
+			return true
+		}
+	}
+	return false
+}
+
+// fetchMessageReactions returns the reactions of the message, with all of
+// their users.
+func fetchMessageReactions(ctx context.Context, client *slackexport.Client, channelId string, ts string) ([]interface{}, error) {
+	verbosePrintln("Fetching the reactions of message "+ts, "channel", channelId, "timestamp", ts)
+	return client.Reactions(ctx, channelId, ts)
+}
+
+// conversationTypesScopes returns the scopes needed to list the conversations
+// of the given comma-separated types, as for conversations.list.
+func conversationTypesScopes(types string) []string {
+	typeScopes := map[string]string{
+		"public_channel":  "channels:read",
+		"private_channel": "groups:read",
+		"mpim":            "mpim:read",
+		"im":              "im:read",
+	}
+	scopes := make([]string, 0)
+	for _, conversationType := range strings.Split(types, ",") {
+		if scope, ok := typeScopes[strings.TrimSpace(conversationType)]; ok {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// fetchConversationsList lists all the conversations of the given
+// comma-separated types that are accessible with the token, leaving out the
+// archived ones if excludeArchived is set.
+func fetchConversationsList(ctx context.Context, client *slackexport.Client, types string, excludeArchived bool) ([]map[string]interface{}, error) {
+	verbosePrintln("Fetching conversations of types " + types + " from Slack API")
+
+	res, err := client.ListConversations(ctx, types, excludeArchived, teamId)
+	if err != nil {
+		return nil, err
+	}
+
+	verbosePrintln("Fetched all conversations of types " + types + " from Slack API.")
+	if reproducible {
+		sortById(res)
+	}
+	return res, nil
+}
+
+// sortById sorts the objects by their ID, for --reproducible, as Slack may
+// list the same objects in different orders.
+func sortById(list []map[string]interface{}) {
+	sort.SliceStable(list, func(i, j int) bool {
+		a, _ := list[i]["id"].(string)
+		b, _ := list[j]["id"].(string)
+		return a < b
+	})
+}
+
+// isSharedConversation returns whether the conversation, as listed by
+// conversations.list, is shared with other workspaces of an Enterprise Grid
+// organization or with other organizations through Slack Connect.
+func isSharedConversation(conversation map[string]interface{}) bool {
+	for _, field := range []string{"is_shared", "is_ext_shared", "is_org_shared", "is_pending_ext_shared"} {
+		if shared, _ := conversation[field].(bool); shared {
+			return true
+		}
+	}
+	return false
+}
+
+// markSharedChannels sets the is_shared, is_ext_shared and is_org_shared
+// fields of each channel, which Slack leaves out of some of them, for the
+// channels shared with other workspaces to be told apart from the others in
+// the list of channels written, with --include-shared. The kind of the
+// channels, such as "private channel", is used in messages.
+func markSharedChannels(channels []map[string]interface{}, kind string) {
+	for _, channel := range channels {
+		for _, field := range []string{"is_shared", "is_ext_shared", "is_org_shared"} {
+			shared, _ := channel[field].(bool)
+			channel[field] = shared
+		}
+		if isSharedConversation(channel) {
+			name, _ := channel["name"].(string)
+			verbosePrintln("The "+kind+" "+name+" is shared with other workspaces", "channel", channel["id"])
+		}
+	}
+}
+
+// createConversationsItemsJson writes a file mapping the ID of each
+// conversation of the given types to the items that fetch returns for it,
+// leaving out the conversations without any.
+//
+// Such items go in a single top-level file rather than in the directories of
+// the conversations, where importers expect nothing but messages.
+func createConversationsItemsJson(ctx context.Context, w archiveWriter, fileName string, client *slackexport.Client, types string, fetch func(channelId string) ([]map[string]interface{}, error)) error {
+	conversations, err := fetchConversationsList(ctx, client, types, false)
+	if err != nil {
+		return err
+	}
+
+	items := make(map[string][]map[string]interface{})
+	for _, conversation := range conversations {
+		id, _ := conversation["id"].(string)
+		conversationItems, err := fetch(id)
+		if err != nil && ctx.Err() != nil {
+			return ctx.Err()
+		} else if err != nil {
+			log.Print("++++++ Failed to fetch " + fileName + " for conversation " + id + "\n\n" + err.Error() + "\n")
+			continue
+		}
+		if len(conversationItems) > 0 {
+			items[id] = conversationItems
+		}
+	}
+	verbosePrintln(fmt.Sprintf("Found items for %s in %d of %d conversations.", fileName, len(items), len(conversations)))
+
+	outFile, err := w.Create(fileName)
+	if err != nil {
+		return err
+	}
+	enc := newJsonEncoder(outFile)
+	return enc.Encode(&items)
+}
+
+// fetchConversationItems calls a Slack API method listing the items of a
+// conversation, such as pins.list, and returns the list found in the given
+// field of its response.
+func fetchConversationItems(ctx context.Context, client *slackexport.Client, method string, field string, channelId string) ([]map[string]interface{}, error) {
+	verbosePrintln("Calling "+method+" for conversation "+channelId, "channel", channelId)
+	return client.ConversationItems(ctx, method, field, channelId)
+}
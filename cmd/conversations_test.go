@@ -0,0 +1,237 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestFetchChannelHistoryAscending(t *testing.T) {
+	// Three pages of three messages, newest first as Slack returns them.
+	// The second page overlaps the first, as if a message had been posted
+	// on the day while it was being fetched.
+	pages := map[string][]interface{}{
+		"":   {"1700000009.000100", "1700000008.000100", "1700000007.000100"},
+		"p2": {"1700000006.000100", "1700000007.500000", "1700000005.000100"},
+		"p3": {"999999999.000100", "1700000004.000100", "1600000000.000100"},
+	}
+	next := map[string]string{"": "p2", "p2": "p3"}
+	slack := newFakeSlack(t)
+	slack.handle("conversations.history", func(params url.Values) map[string]interface{} {
+		cursor := params.Get("cursor")
+		messages := make([]interface{}, 0)
+		for _, ts := range pages[cursor] {
+			messages = append(messages, map[string]interface{}{"ts": ts, "text": "at " + ts.(string)})
+		}
+		res := map[string]interface{}{"messages": messages}
+		if next[cursor] != "" {
+			res["has_more"] = true
+			res["response_metadata"] = map[string]interface{}{"next_cursor": next[cursor]}
+		}
+		return res
+	})
+
+	var output bytes.Buffer
+	_, count, err := fetchChannelHistory(context.Background(), &output, slack.client(), nil, "C00000001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 9 {
+		t.Errorf("expected 9 messages to be written, got %d", count)
+	}
+
+	var messages []map[string]interface{}
+	decodeTestJson(t, "the history", output.String(), &messages)
+	expected := []string{
+		"999999999.000100", "1600000000.000100", "1700000004.000100",
+		"1700000005.000100", "1700000006.000100", "1700000007.000100",
+		"1700000007.500000", "1700000008.000100", "1700000009.000100",
+	}
+	got := make([]string, 0, len(messages))
+	for _, message := range messages {
+		got = append(got, message["ts"].(string))
+	}
+	if fmt.Sprint(got) != fmt.Sprint(expected) {
+		t.Errorf("expected the messages in ascending order of timestamp\n%v\ngot\n%v", expected, got)
+	}
+}
+
+func TestFetchChannelHistoryResumed(t *testing.T) {
+	cp, err := openCheckpoint(t.TempDir(), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The first page was saved by an interrupted run.
+	saved := []map[string]interface{}{{"ts": "300.000001"}, {"ts": "200.000001"}}
+	if err := cp.savePage("C00000001", saved, "p2"); err != nil {
+		t.Fatal(err)
+	}
+
+	slack := newFakeSlack(t)
+	slack.handle("conversations.history", func(params url.Values) map[string]interface{} {
+		if params.Get("cursor") != "p2" {
+			t.Errorf("expected the history to carry on from the saved cursor, got cursor %q", params.Get("cursor"))
+		}
+		return map[string]interface{}{"messages": []interface{}{
+			map[string]interface{}{"ts": "150.000001"},
+			map[string]interface{}{"ts": "100.000001"},
+		}}
+	})
+
+	var output bytes.Buffer
+	if _, _, err := fetchChannelHistory(context.Background(), &output, slack.client(), cp, "C00000001"); err != nil {
+		t.Fatal(err)
+	}
+	var messages []struct{ Ts string }
+	if err := json.Unmarshal(output.Bytes(), &messages); err != nil {
+		t.Fatal(err)
+	}
+	got := fmt.Sprint(messages)
+	if expected := "[{100.000001} {150.000001} {200.000001} {300.000001}]"; got != expected {
+		t.Errorf("expected %s, got %s", expected, got)
+	}
+}
+
+func TestIsThreadRoot(t *testing.T) {
+	tests := []struct {
+		name     string
+		message  map[string]interface{}
+		expected bool
+	}{
+		{"plain message", map[string]interface{}{"ts": "1700000000.000100"}, false},
+		{"root with replies", map[string]interface{}{"ts": "1700000000.000100", "thread_ts": "1700000000.000100", "reply_count": 2.0}, true},
+		{"root with only thread_ts", map[string]interface{}{"ts": "1700000000.000100", "thread_ts": "1700000000.000100"}, true},
+		{"root with only reply_users_count", map[string]interface{}{"ts": "1700000000.000100", "reply_users_count": 1.0}, true},
+		{"root with only latest_reply", map[string]interface{}{"ts": "1700000000.000100", "latest_reply": "1700000001.000100"}, true},
+		{"root whose replies were all deleted", map[string]interface{}{"ts": "1700000000.000100", "thread_ts": "1700000000.000100", "reply_count": 0.0}, false},
+		{"reply", map[string]interface{}{"ts": "1700000001.000100", "thread_ts": "1700000000.000100"}, false},
+		{"reply broadcast to the channel", map[string]interface{}{"ts": "1700000001.000100", "thread_ts": "1700000000.000100", "subtype": "thread_broadcast"}, false},
+		{"message without ts", map[string]interface{}{"thread_ts": "1700000000.000100", "reply_count": 1.0}, false},
+	}
+	for _, test := range tests {
+		if got := isThreadRoot(test.message); got != test.expected {
+			t.Errorf("%s: expected isThreadRoot to be %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestInaccessibleConversationsSkipped(t *testing.T) {
+	slack := newFakeSlack(t)
+	slack.handle("conversations.list", func(url.Values) map[string]interface{} {
+		return map[string]interface{}{"channels": []interface{}{
+			map[string]interface{}{"id": "C00000001", "name": "general"},
+			map[string]interface{}{"id": "C00000002", "name": "secret"},
+			map[string]interface{}{"id": "C00000003", "name": "random"},
+		}}
+	})
+	slack.handle("conversations.history", func(params url.Values) map[string]interface{} {
+		if params.Get("channel") == "C00000002" {
+			return map[string]interface{}{"ok": false, "error": "not_in_channel"}
+		}
+		return map[string]interface{}{"messages": []interface{}{
+			map[string]interface{}{"ts": "1700000000.000100", "text": "hello " + params.Get("channel")},
+		}}
+	})
+
+	input := writeTestArchive(t, map[string]string{"users.json": "[]"})
+	output := filepath.Join(t.TempDir(), "output.zip")
+	args := append(slack.args(), "--input-archive", input, "--output-archive", output, "fetch-public-channels", "--api-token", "xoxb-test")
+	out, err := runExporter(t, args...)
+	if err != nil {
+		t.Fatalf("expected the run to carry on past the inaccessible channel, got %v\n%s", err, out)
+	}
+	if !strings.Contains(out, "Skipped 1 conversations which can't be read with this token") || !strings.Contains(out, "secret (not_in_channel)") {
+		t.Errorf("expected the skipped channel to be reported, got\n%s", out)
+	}
+
+	files := readTestArchive(t, output)
+	for name, id := range map[string]string{"general": "C00000001", "random": "C00000003"} {
+		if !strings.Contains(files[name+"/2023-11-14.json"], "hello "+id) {
+			t.Errorf("expected the history of %s, after the skipped channel, got the files %v", name, fileNames(files))
+		}
+	}
+	for name := range files {
+		if strings.HasPrefix(name, "secret/") {
+			t.Errorf("expected nothing of the skipped channel, got %s", name)
+		}
+	}
+}
+
+// fileNames returns the names of the files of an archive, as read by
+// readTestArchive.
+func fileNames(files map[string]string) []string {
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	return names
+}
+
+func TestEmptyConversationFiles(t *testing.T) {
+	tests := []struct {
+		layout   string
+		expected map[string][]string
+	}{
+		{"--native-layout=false", map[string][]string{
+			"general": {"messages.json", "replies.json"},
+			"empty":   {"messages.json", "replies.json"},
+			"undated": {"messages.json", "replies.json"},
+		}},
+		{"--native-layout", map[string][]string{
+			"general": {"2023-11-14.json"},
+			"empty":   {"2020-09-13.json"},
+			"undated": {"1970-01-01.json"},
+		}},
+	}
+	for _, test := range tests {
+		slack := newFakeSlack(t)
+		slack.handle("conversations.list", func(url.Values) map[string]interface{} {
+			return map[string]interface{}{"channels": []interface{}{
+				map[string]interface{}{"id": "C00000001", "name": "general", "created": 1500000000},
+				map[string]interface{}{"id": "C00000002", "name": "empty", "created": 1600000000},
+				map[string]interface{}{"id": "C00000003", "name": "undated"},
+			}}
+		})
+		slack.handle("conversations.history", func(params url.Values) map[string]interface{} {
+			messages := []interface{}{}
+			if params.Get("channel") == "C00000001" {
+				messages = append(messages, map[string]interface{}{"ts": "1700000000.000100", "text": "hello"})
+			}
+			return map[string]interface{}{"messages": messages}
+		})
+
+		input := writeTestArchive(t, map[string]string{"users.json": "[]"})
+		output := filepath.Join(t.TempDir(), "output.zip")
+		args := append(slack.args(), "--input-archive", input, "--output-archive", output, "--reproducible", "fetch-public-channels", "--api-token", "xoxp-test", test.layout)
+		if out, err := runExporter(t, args...); err != nil {
+			t.Fatalf("with %s, fetch-public-channels failed: %v\n%s", test.layout, err, out)
+		}
+
+		files := readTestArchive(t, output)
+		for dir, names := range test.expected {
+			for _, name := range names {
+				data, ok := files[dir+"/"+name]
+				if !ok {
+					t.Errorf("with %s, expected %s/%s, got the files %v", test.layout, dir, name, fileNames(files))
+					continue
+				}
+				var messages []map[string]interface{}
+				decodeTestJson(t, dir+"/"+name, data, &messages)
+				if dir != "general" && (messages == nil || len(messages) != 0) {
+					t.Errorf("with %s, expected %s/%s to be an empty array, got %s", test.layout, dir, name, data)
+				}
+			}
+		}
+		for name := range files {
+			dir, base := filepath.Split(name)
+			if dir != "" && !containsString(test.expected[strings.TrimSuffix(dir, "/")], base) {
+				t.Errorf("with %s, unexpected file %s", test.layout, name)
+			}
+		}
+	}
+}
@@ -0,0 +1,49 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+var (
+	// How long the conversations may be fetched for, from the start of the
+	// command, given with --deadline, or 0 for no limit.
+	exportDeadline time.Duration
+	// Whether conversations were left out of the export because the
+	// deadline was reached.
+	exportTruncated bool
+)
+
+// checkDeadline checks the --deadline given.
+func checkDeadline() error {
+	if exportDeadline < 0 {
+		return fmt.Errorf("invalid --deadline %s, expected a positive duration such as 2h", exportDeadline)
+	}
+	return nil
+}
+
+// deadlineContext returns a context for fetching conversations, which is
+// cancelled once the --deadline of the export is reached, if any.
+func deadlineContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	if exportDeadline == 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, runStartedAt.Add(exportDeadline))
+}
+
+// deadlineReached returns whether the context returned by deadlineContext was
+// cancelled because the deadline was reached, rather than interrupted.
+func deadlineReached(ctx context.Context) bool {
+	return exportDeadline > 0 && errors.Is(ctx.Err(), context.DeadlineExceeded)
+}
+
+// reportExportTruncated reports that the deadline was reached once written out
+// of total conversations were written, and that the others are left out.
+func reportExportTruncated(written int, total int) {
+	exportTruncated = true
+	conversationsProgress.clear()
+	log.Printf("++++++ The --deadline of %s was reached after writing %d of %d conversations, leaving out the others", exportDeadline, written, total)
+}
@@ -0,0 +1,260 @@
+package cmd
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var diffArchivesFormat string
+
+var diffArchivesCmd = &cobra.Command{
+	Use:   "diff-archives OLD NEW",
+	Short: "Compare two export archives, without calling the Slack API",
+	Long: `Compare two export archives, such as two runs of an incremental backup, and report the conversations added to
+and removed from the lists of conversations, such as channels.json, along with the number of messages added to
+and removed from each conversation, told apart by their timestamps.
+
+Both the layout of messages.json and replies.json and the one with one file per day are read, as are messages
+written as JSON lines or gzip-compressed, so that archives written with different options can be compared.`,
+	Args: cobra.ExactArgs(2),
+	// The archives to compare are given as arguments, and no archive is
+	// written.
+	Annotations: map[string]string{archivesAnnotation: archivesNone},
+	RunE:        diffArchives,
+}
+
+func init() {
+	diffArchivesCmd.PersistentFlags().StringVar(&diffArchivesFormat, "format", "table", "how to print the differences: table, or json for a JSON object")
+}
+
+// A conversation of the archives compared, along with the number of messages
+// found in the new archive but not in the old one, and the other way round.
+type diffConversation struct {
+	Id              string `json:"id"`
+	Name            string `json:"name"`
+	Type            string `json:"type"`
+	NewMessages     int    `json:"new_messages"`
+	RemovedMessages int    `json:"removed_messages"`
+}
+
+// The differences between two archives, as printed by diff-archives.
+type archiveDiff struct {
+	Added           []diffConversation `json:"added_conversations"`
+	Removed         []diffConversation `json:"removed_conversations"`
+	Changed         []diffConversation `json:"changed_conversations"`
+	NewMessages     int                `json:"new_messages"`
+	RemovedMessages int                `json:"removed_messages"`
+}
+
+// A conversation of an archive, with the timestamps of its messages.
+type archivedConversation struct {
+	diffConversation
+	messages map[string]bool
+}
+
+func diffArchives(cmd *cobra.Command, args []string) error {
+	if diffArchivesFormat != "table" && diffArchivesFormat != "json" {
+		return fmt.Errorf("unknown format %s, expected table or json", diffArchivesFormat)
+	}
+
+	archives := make([]map[string]*archivedConversation, 0, len(args))
+	order := make([][]string, 0, len(args))
+	for _, archivePath := range args {
+		r, err := openArchive(archivePath)
+		if err != nil {
+			return err
+		}
+		conversations, ids, err := readArchivedConversations(r)
+		r.Close()
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %w", archivePath, err)
+		}
+		archives = append(archives, conversations)
+		order = append(order, ids)
+	}
+	oldArchive, newArchive := archives[0], archives[1]
+
+	diff := archiveDiff{
+		Added:   make([]diffConversation, 0),
+		Removed: make([]diffConversation, 0),
+		Changed: make([]diffConversation, 0),
+	}
+	for _, id := range order[1] {
+		conversation := newArchive[id]
+		old, ok := oldArchive[id]
+		entry := conversation.diffConversation
+		if !ok {
+			entry.NewMessages = len(conversation.messages)
+			diff.Added = append(diff.Added, entry)
+			diff.NewMessages += entry.NewMessages
+			continue
+		}
+		entry.NewMessages = countMissing(conversation.messages, old.messages)
+		entry.RemovedMessages = countMissing(old.messages, conversation.messages)
+		if entry.NewMessages > 0 || entry.RemovedMessages > 0 {
+			diff.Changed = append(diff.Changed, entry)
+			diff.NewMessages += entry.NewMessages
+			diff.RemovedMessages += entry.RemovedMessages
+		}
+	}
+	for _, id := range order[0] {
+		if _, ok := newArchive[id]; !ok {
+			entry := oldArchive[id].diffConversation
+			entry.RemovedMessages = len(oldArchive[id].messages)
+			diff.Removed = append(diff.Removed, entry)
+			diff.RemovedMessages += entry.RemovedMessages
+		}
+	}
+
+	if diffArchivesFormat == "json" {
+		enc := newJsonEncoder(os.Stdout)
+		return enc.Encode(&diff)
+	}
+	printArchiveDiff(os.Stdout, diff)
+	return nil
+}
+
+// readArchivedConversations returns the conversations listed in the archive,
+// by ID, along with the timestamps of the messages found in their directories,
+// and their IDs in the order they are listed in.
+func readArchivedConversations(r *zip.ReadCloser) (map[string]*archivedConversation, []string, error) {
+	conversations := make(map[string]*archivedConversation)
+	ids := make([]string, 0)
+	byDir := make(map[string]*archivedConversation)
+	for _, kind := range conversationKinds {
+		var list []map[string]interface{}
+		if _, err := readArchiveJson(r, kind.fileName, &list); err != nil {
+			return nil, nil, err
+		}
+		dirs := conversationDirs(list, kind.dirName)
+		for i, conversation := range list {
+			id, _ := conversation["id"].(string)
+			if id == "" || conversations[id] != nil {
+				continue
+			}
+			name, _ := conversation["name"].(string)
+			if name == "" {
+				name, _ = conversation["user"].(string)
+			}
+			archived := &archivedConversation{
+				diffConversation: diffConversation{Id: id, Name: name, Type: kind.conversationType},
+				messages:         make(map[string]bool),
+			}
+			conversations[id] = archived
+			byDir[dirs[i]] = archived
+			ids = append(ids, id)
+		}
+	}
+
+	for _, file := range r.File {
+		if validatedFileKind(file.Name) != "messages" {
+			continue
+		}
+		conversation, ok := byDir[path.Dir(file.Name)]
+		if !ok {
+			continue
+		}
+		messages, err := readMessagesFile(file)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, message := range messages {
+			if ts, _ := message["ts"].(string); ts != "" {
+				conversation.messages[ts] = true
+			}
+		}
+	}
+	return conversations, ids, nil
+}
+
+// readMessagesFile returns the messages of a file of a conversation, whether
+// it holds a JSON array or JSON lines, and whether it is gzip-compressed or
+// not.
+func readMessagesFile(file *zip.File) ([]map[string]interface{}, error) {
+	inReader, err := file.Open()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open file in input archive %s: %w", file.Name, err)
+	}
+	buf, err := ioutil.ReadAll(inReader)
+	inReader.Close()
+	if err != nil {
+		return nil, fmt.Errorf("failed to read file in input archive %s: %w", file.Name, err)
+	}
+
+	name, buf, err := gunzipFile(file.Name, buf)
+	if err != nil {
+		return nil, err
+	}
+	if isJsonLinesFile(name) {
+		buf, err = jsonLinesToArray(buf)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse the JSON lines file %s: %w", file.Name, err)
+		}
+	}
+	var messages []map[string]interface{}
+	if err := json.Unmarshal(buf, &messages); err != nil {
+		return nil, fmt.Errorf("couldn't parse the JSON file %s: %w", file.Name, err)
+	}
+	return messages, nil
+}
+
+// countMissing returns the number of timestamps of a which b doesn't have.
+func countMissing(a map[string]bool, b map[string]bool) int {
+	missing := 0
+	for ts := range a {
+		if !b[ts] {
+			missing++
+		}
+	}
+	return missing
+}
+
+// printArchiveDiff prints the differences between the archives as a summary,
+// listing the conversations added, removed and changed by type and name.
+func printArchiveDiff(out io.Writer, diff archiveDiff) {
+	sections := []struct {
+		title         string
+		conversations []diffConversation
+	}{
+		{"Conversations added", diff.Added},
+		{"Conversations removed", diff.Removed},
+		{"Conversations changed", diff.Changed},
+	}
+	for _, section := range sections {
+		if len(section.conversations) == 0 {
+			continue
+		}
+		sort.SliceStable(section.conversations, func(i, j int) bool {
+			if section.conversations[i].Type != section.conversations[j].Type {
+				return section.conversations[i].Type < section.conversations[j].Type
+			}
+			return section.conversations[i].Name < section.conversations[j].Name
+		})
+		fmt.Fprintf(out, "%s: %d\n", section.title, len(section.conversations))
+		for _, conversation := range section.conversations {
+			changes := make([]string, 0, 2)
+			if conversation.NewMessages > 0 {
+				changes = append(changes, fmt.Sprintf("+%d", conversation.NewMessages))
+			}
+			if conversation.RemovedMessages > 0 {
+				changes = append(changes, fmt.Sprintf("-%d", conversation.RemovedMessages))
+			}
+			line := fmt.Sprintf("  %s %s (%s)", conversation.Type, conversation.Name, conversation.Id)
+			if len(changes) > 0 {
+				line += ": " + strings.Join(changes, " ") + " messages"
+			}
+			fmt.Fprintln(out, line)
+		}
+	}
+	fmt.Fprintf(out, "%d new messages and %d removed, in %d conversations added, %d removed and %d changed.\n",
+		diff.NewMessages, diff.RemovedMessages, len(diff.Added), len(diff.Removed), len(diff.Changed))
+}
@@ -0,0 +1,167 @@
+package cmd
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+// Whether to fetch the users of other workspaces found in the conversations,
+// with --include-external-users.
+var includeExternalUsers bool
+
+// The file of the archive listing the users of other workspaces found in the
+// conversations, in the same format as users.json.
+const externalUsersFile = "external_users.json"
+
+var (
+	// The IDs of the users of the workspace, which aren't looked up, or nil
+	// when external users aren't fetched.
+	localUserIds map[string]bool
+	// The IDs of the external users looked up already, whether Slack found
+	// them or not.
+	externalUsersLookedUp map[string]bool
+	// The external users found, in the order they were found in.
+	externalUsers []map[string]interface{}
+)
+
+// The IDs of users, as opposed to those of bots or conversations, such as
+// U0123ABCD.
+var userIdPattern = regexp.MustCompile(`^[UW][A-Z0-9]{8,}$`)
+
+// setupExternalUsers collects the IDs of the users of the workspace, from the
+// users.json of the input archive or from Slack, when fetching external users,
+// along with the external users the input archive already has, which aren't
+// looked up again.
+func setupExternalUsers(ctx context.Context, r *zip.ReadCloser, client *slackexport.Client) error {
+	if !includeExternalUsers {
+		return nil
+	}
+
+	users, err := workspaceUsers(ctx, r, client)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the users to tell external ones apart: %w", err)
+	}
+	localUserIds = make(map[string]bool)
+	for _, user := range users {
+		if id, _ := user["id"].(string); id != "" {
+			localUserIds[id] = true
+		}
+	}
+
+	externalUsersLookedUp = make(map[string]bool)
+	var previous []map[string]interface{}
+	if _, err := readArchiveJson(r, externalUsersFile, &previous); err != nil {
+		return err
+	}
+	for _, user := range previous {
+		if id, _ := user["id"].(string); id != "" && !externalUsersLookedUp[id] {
+			externalUsersLookedUp[id] = true
+			addExternalUser(user)
+		}
+	}
+	return nil
+}
+
+// addExternalUser records the external user, whose mentions are then resolved
+// to their name as those of the users of the workspace are.
+func addExternalUser(user map[string]interface{}) {
+	externalUsers = append(externalUsers, user)
+	id, _ := user["id"].(string)
+	if name := userDisplayName(user); mentionNames != nil && name != "" {
+		mentionNames[id] = name
+	}
+}
+
+// collectExternalUsers looks up the users the conversation and the messages of
+// its files refer to which aren't users of the workspace, as in the Slack
+// Connect conversations shared with other workspaces, when fetching external
+// users. Users are referred to by the authors of messages, their mentions, the
+// reactions and the replies to them, and the members of the conversation.
+// The messages are read one at a time.
+//
+// Users which Slack can't find are reported and left out.
+func collectExternalUsers(ctx context.Context, client *slackexport.Client, conversation map[string]interface{}, files []*conversationFile) error {
+	if localUserIds == nil {
+		return nil
+	}
+
+	ids := make([]string, 0)
+	add := func(value interface{}) {
+		id, _ := value.(string)
+		if userIdPattern.MatchString(id) && !localUserIds[id] && !externalUsersLookedUp[id] && !containsString(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	addAll := func(values interface{}) {
+		list, _ := values.([]interface{})
+		for _, value := range list {
+			add(value)
+		}
+	}
+
+	add(conversation["user"])
+	addAll(conversation["members"])
+	for _, file := range files {
+		err := file.walkMessages(func(message map[string]interface{}) error {
+			add(message["user"])
+			addAll(message["reply_users"])
+			reactions, _ := message["reactions"].([]interface{})
+			for _, reaction := range reactions {
+				reaction, _ := reaction.(map[string]interface{})
+				addAll(reaction["users"])
+			}
+			text, ok := message["raw_text"].(string)
+			if !ok {
+				text, _ = message["text"].(string)
+			}
+			for _, mention := range mentionPattern.FindAllStringSubmatch(text, -1) {
+				if mention[1] == "@" {
+					add(mention[2])
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't parse %s: %w", file.name, err)
+		}
+	}
+
+	for _, id := range ids {
+		externalUsersLookedUp[id] = true
+		verbosePrintln("Fetching the external user "+id, "user", id)
+		user, err := client.UserInfo(ctx, id)
+		var slackErr *slackexport.Error
+		if errors.As(err, &slackErr) {
+			log.Printf("++++++ Couldn't fetch the external user %s, leaving them out: %s", id, err)
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("failed to fetch the external user %s: %w", id, err)
+		}
+		if user != nil {
+			addExternalUser(user)
+		}
+	}
+	return nil
+}
+
+// writeExternalUsers writes the external users found to external_users.json,
+// if any, when fetching external users.
+func writeExternalUsers(w archiveWriter) error {
+	if localUserIds == nil || len(externalUsers) == 0 {
+		return nil
+	}
+	verbosePrintln(fmt.Sprintf("Writing the %d external users found to %s", len(externalUsers), externalUsersFile))
+	outFile, err := w.Create(externalUsersFile)
+	if err != nil {
+		return err
+	}
+	enc := newJsonEncoder(outFile)
+	return enc.Encode(&externalUsers)
+}
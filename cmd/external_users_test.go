@@ -0,0 +1,50 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"testing"
+)
+
+func TestCollectExternalUsers(t *testing.T) {
+	defer func(local, lookedUp map[string]bool, users []map[string]interface{}, names map[string]string) {
+		localUserIds, externalUsersLookedUp, externalUsers, mentionNames = local, lookedUp, users, names
+	}(localUserIds, externalUsersLookedUp, externalUsers, mentionNames)
+	localUserIds = map[string]bool{"U00000001": true}
+	externalUsersLookedUp = map[string]bool{"U00000009": true}
+	externalUsers, mentionNames = nil, nil
+
+	slack := newFakeSlack(t)
+	slack.handle("users.info", func(params url.Values) map[string]interface{} {
+		if params.Get("user") == "U00000005" {
+			return map[string]interface{}{"ok": false, "error": "user_not_found"}
+		}
+		return map[string]interface{}{"user": map[string]interface{}{"id": params.Get("user")}}
+	})
+
+	file, err := newConversationFile("messages.json", []byte(`[
+		{"ts": "1", "user": "U00000001", "text": "hi <@U00000002> and <@U00000009>"},
+		{"ts": "2", "user": "U00000003", "reply_users": ["U00000001", "U00000004"]},
+		{"ts": "3", "user": "B00000001", "reactions": [{"name": "+1", "users": ["U00000005", "U00000002"]}]}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.remove()
+	conversation := map[string]interface{}{"id": "C00000001", "members": []interface{}{"U00000001", "W00000006"}}
+	if err := collectExternalUsers(context.Background(), slack.client(), conversation, []*conversationFile{file}); err != nil {
+		t.Fatal(err)
+	}
+
+	found := make([]string, 0)
+	for _, user := range externalUsers {
+		found = append(found, user["id"].(string))
+	}
+	if fmt.Sprint(found) != "[W00000006 U00000002 U00000003 U00000004]" {
+		t.Errorf("expected the external users other than the one Slack can't find, in order, got %v", found)
+	}
+	if calls := len(slack.calls("users.info")); calls != 5 {
+		t.Errorf("expected each external user to be looked up once, got %d lookups", calls)
+	}
+}
@@ -2,21 +2,32 @@ package cmd
 
 import (
 	"archive/zip"
+	"bytes"
+	"context"
 	"encoding/json"
-	"errors"
 	"fmt"
-	"io"
 	"io/ioutil"
 	"log"
-	"net/http"
 	"os"
+	"path"
 	"strings"
 
 	"github.com/spf13/cobra"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
 )
 
 var (
-	attachmentsApiToken string
+	attachmentsApiToken      string
+	attachmentsApiTokenFile  string
+	attachmentsLocalPaths    bool
+	attachmentsDedupeContent bool
+	attachmentsFilesList     bool
+	attachmentsMaxSize       string
+	attachmentsMimeInclude   []string
+	attachmentsMimeExclude   []string
+	// The size parsed from attachmentsMaxSize, or 0 for no limit.
+	attachmentsMaxBytes int64
 )
 
 var fetchAttachmentsCmd = &cobra.Command{
@@ -26,87 +37,201 @@ var fetchAttachmentsCmd = &cobra.Command{
 }
 
 func init() {
-	fetchAttachmentsCmd.PersistentFlags().StringVar(&attachmentsApiToken, "api-token", "", "Slack API token. Can be obtained here: https://api.slack.com/docs/oauth-test-tokens")
+	fetchAttachmentsCmd.PersistentFlags().StringVar(&attachmentsApiToken, "api-token", "", "Slack API token, either a user token (xoxp-) or the bot token (xoxb-) of a Slack app. Defaults to the "+apiTokenEnvVar+" environment variable")
+	fetchAttachmentsCmd.PersistentFlags().StringVar(&attachmentsApiTokenFile, "api-token-file", "", "path to a file containing the Slack API token, used if --api-token is not set")
+	fetchAttachmentsCmd.PersistentFlags().BoolVar(&attachmentsLocalPaths, "add-local-paths", false, "add a local_path property to each downloaded file in the messages, with the path of the file in the output archive")
+	fetchAttachmentsCmd.PersistentFlags().BoolVar(&attachmentsFilesList, "files-list", false, "cross-reference the files shared in the messages with those listed by files.list, to download those the messages have no download URL for, and write their consolidated metadata to files.json. Needs an API token")
+	fetchAttachmentsCmd.PersistentFlags().StringVar(&attachmentsMaxSize, "max-attachment-size", "", "don't download the files larger than this, such as 500KB, 100MB or 2GB, as given by the size in their metadata, and list them with their download URLs in skipped_attachments.json instead")
+	fetchAttachmentsCmd.PersistentFlags().StringArrayVar(&attachmentsMimeInclude, "attachment-include-mimetype", nil, "only download the files with this MIME type, which may be a glob pattern such as image/*, and list the others in skipped_attachments.json. Can be repeated")
+	fetchAttachmentsCmd.PersistentFlags().StringArrayVar(&attachmentsMimeExclude, "attachment-exclude-mimetype", nil, "don't download the files with this MIME type, which may be a glob pattern such as video/*, and list them in skipped_attachments.json instead. Can be repeated")
+	fetchAttachmentsCmd.PersistentFlags().BoolVar(&resumeExport, "resume", false, "keep a checkpoint of the downloads next to the output archive, and resume from it if there is one, carrying on with the files downloaded in part")
+	fetchAttachmentsCmd.PersistentFlags().BoolVar(&attachmentsDedupeContent, "dedupe-content", false, "only store once the files which have different IDs but the same contents, as verified by their SHA-256 checksum")
 }
 
 func fetchAttachments(cmd *cobra.Command, args []string) error {
+	token, err := resolveApiToken(attachmentsApiToken, attachmentsApiTokenFile, false)
+	if err != nil {
+		return err
+	}
+
+	client := newSlackClient(token)
+	ctx := cmd.Context()
+
+	attachmentsMaxBytes, err = parseByteSize(attachmentsMaxSize)
+	if err != nil {
+		return fmt.Errorf("invalid --max-attachment-size: %w", err)
+	}
+
+	for _, pattern := range append(append([]string{}, attachmentsMimeInclude...), attachmentsMimeExclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid MIME type pattern %s: %w", pattern, err)
+		}
+	}
+
+	if attachmentsFilesList && token == "" {
+		return fmt.Errorf("--files-list needs an API token: use --api-token, --api-token-file or the %s environment variable", apiTokenEnvVar)
+	}
+
+	// Not all attachments need a token, but if one is given, it needs to be able to read files.
+	if token != "" {
+		err = checkTokenScopes(ctx, client, "files:read")
+		if err != nil {
+			return err
+		}
+	}
+
 	// Open the input archive.
-	r, err := zip.OpenReader(inputArchive)
+	r, err := openInputArchive()
 	if err != nil {
-		fmt.Printf("Could not open input archive for reading: %s\n", inputArchive)
-		os.Exit(1)
+		return err
 	}
 	defer r.Close()
 
 	// Open the output archive.
-	f, err := os.Create(outputArchive)
+	w, f, err := createOutputArchive()
 	if err != nil {
-		fmt.Printf("Could not open the output archive for writing: %s\n\n%s", outputArchive, err)
-		os.Exit(1)
+		return err
 	}
 	defer f.Close()
+	store := newAttachmentStore(w)
 
-	// Create a zip writer on the output archive.
-	w := zip.NewWriter(f)
+	// With --resume, the attachments are downloaded to the checkpoint first,
+	// for them not to be downloaded again when resuming.
+	cp, err := openCheckpoint(checkpointDir(outputPath()), resumeExport)
+	if err != nil {
+		return err
+	}
+	if err := cp.save(); err != nil {
+		return fmt.Errorf("failed to create the checkpoint: %w", err)
+	}
+
+	var directory *fileDirectory
+	if attachmentsFilesList {
+		verbosePrintln("Fetching the files of the workspace from Slack API")
+		listed, err := client.Files(ctx, "")
+		if err != nil {
+			return fmt.Errorf("failed to list the files: %w", err)
+		}
+		directory = newFileDirectory(listed)
+	}
 
 	// Run through all the files in the input archive.
 	for _, file := range r.File {
+		// It is written anew below.
+		if file.Name == exportMetadataFile || file.Name == "skipped_attachments.json" || (directory != nil && file.Name == "files.json") {
+			continue
+		}
 		verbosePrintln(fmt.Sprintf("Processing file: %s\n", file.Name))
 
 		// Open the file from the input archive.
 		inReader, err := file.Open()
 		if err != nil {
-			fmt.Printf("Failed to open file in input archive: %s\n\n%s", file.Name, err)
-			os.Exit(1)
+			return fmt.Errorf("failed to open file in input archive %s: %w", file.Name, err)
 		}
 
 		// Read the file into a byte array.
 		inBuf, err := ioutil.ReadAll(inReader)
 		if err != nil {
-			fmt.Printf("Failed to read file in input archive: %s\n\n%s", file.Name, err)
+			return fmt.Errorf("failed to read file in input archive %s: %w", file.Name, err)
 		}
 
-		// Now write this file to the output archive.
-		outFile, err := w.Create(file.Name)
+		// Check if the file name matches the pattern for files we need to parse.
+		splits := strings.Split(strings.TrimSuffix(file.Name, gzipSuffix), "/")
+		if len(splits) == 2 && !strings.HasPrefix(splits[0], "__") && (strings.HasSuffix(splits[1], ".json") || isJsonLinesFile(splits[1])) {
+			// Messages written as JSON lines are read as a JSON array, and
+			// written back as JSON lines, as are gzip-compressed files.
+			plainName, channelBuf, err := gunzipFile(file.Name, inBuf)
+			if err != nil {
+				return err
+			}
+			if isJsonLinesFile(plainName) {
+				channelBuf, err = jsonLinesToArray(channelBuf)
+				if err != nil {
+					return fmt.Errorf("couldn't parse the JSON lines file %s: %w", file.Name, err)
+				}
+			}
+
+			// Parse this file.
+			paths, err := processChannelFile(ctx, client, store, cp, directory, file, channelBuf)
+			if err != nil {
+				return err
+			}
+			if directory != nil {
+				if err := directory.addChannelFile(file.Name, channelBuf); err != nil {
+					return err
+				}
+			}
+			if attachmentsLocalPaths && len(paths) > 0 {
+				inBuf, err = addLocalPaths(file.Name, channelBuf, paths)
+				if err == nil && isJsonLinesFile(plainName) {
+					inBuf, err = jsonArrayToLines(inBuf)
+				}
+				if err == nil && isGzipFile(file.Name) {
+					_, inBuf, err = gzipFile(plainName, inBuf)
+				}
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		// Now write this file to the output archive, with the same
+		// modification time and permissions.
+		outFile, err := w.CreateHeader(copyFileHeader(file))
 		if err != nil {
-			fmt.Printf("Failed to create file in output archive: %s\n\n%s", file.Name, err)
-			os.Exit(1)
+			return fmt.Errorf("failed to create file in output archive %s: %w", file.Name, err)
 		}
 		_, err = outFile.Write(inBuf)
 		if err != nil {
-			fmt.Printf("Failed to write file in output archive: %s\n\n%s", file.Name, err)
+			return fmt.Errorf("failed to write file in output archive %s: %w", file.Name, err)
 		}
+	}
 
-		// Check if the file name matches the pattern for files we need to parse.
-		splits := strings.Split(file.Name, "/")
-		if len(splits) == 2 && !strings.HasPrefix(splits[0], "__") && strings.HasSuffix(splits[1], ".json") {
-			// Parse this file.
-			err = processChannelFile(w, file, inBuf, attachmentsApiToken)
-			if err != nil {
-				fmt.Printf("%s", err)
-				os.Exit(1)
-			}
+	err = store.writeManifest()
+	if err != nil {
+		return fmt.Errorf("failed to write the manifest of attachments: %w", err)
+	}
+	if len(store.skippedIds) > 0 {
+		log.Printf("++++++ Skipped %d attachments which were too large or filtered out by their MIME type, listed with their download URLs in skipped_attachments.json", len(store.skippedIds))
+	}
+
+	if directory != nil {
+		err = directory.writeManifest(w)
+		if err != nil {
+			return fmt.Errorf("failed to write the metadata of files: %w", err)
 		}
 	}
 
-	// Close the output zip writer.
+	err = writeExportMetadata(ctx, r, w, cmd, client)
+	if err != nil {
+		return fmt.Errorf("failed to write the export metadata: %w", err)
+	}
+
+	// Close the output archive writer.
 	err = w.Close()
 	if err != nil {
-		fmt.Printf("Failed to close the output archive.\n\n%s", err)
+		return fmt.Errorf("failed to close the output archive: %w", err)
 	}
 
-	return nil
+	// The export is complete, so there is nothing left to resume.
+	return cp.remove()
 }
 
-func processChannelFile(w *zip.Writer, file *zip.File, inBuf []byte, token string) error {
+// processChannelFile downloads the files attached to the posts of a channel
+// file into the output archive, through the checkpoint, and returns the paths in the archive of the
+// files downloaded, by file ID. The names and download URLs the posts lack
+// are taken from the directory of files, unless it is nil.
+func processChannelFile(ctx context.Context, client *slackexport.Client, store *attachmentStore, cp *checkpoint, directory *fileDirectory, file *zip.File, inBuf []byte) (map[string]string, error) {
 	verbosePrintln("This is a 'channels' file. Examining its contents for attachments.")
 
 	// Parse the JSON of the file.
 	var posts []SlackPost
 	if err := json.Unmarshal(inBuf, &posts); err != nil {
-		return errors.New("Couldn't parse the JSON file: " + file.Name + "\n\n" + err.Error() + "\n")
+		return nil, fmt.Errorf("couldn't parse the JSON file %s: %w", file.Name, err)
 	}
 
+	paths := make(map[string]string)
+
 	// Loop through all the posts.
 	for _, post := range posts {
 		// Support for legacy file_share posts.
@@ -126,15 +251,39 @@ func processChannelFile(w *zip.Writer, file *zip.File, inBuf []byte, token strin
 			continue
 		}
 
-		client := &http.Client{}
-
 		// Loop through all the files.
 		for _, file := range post.Files {
+			// Deleted and hidden files are still listed, but there is nothing to download.
+			if file.Mode == "tombstone" || file.Mode == "hidden_by_limit" {
+				verbosePrintln(fmt.Sprintf("Skipping file %s of post %s, which is no longer available (%s)", file.Id, post.Ts, file.Mode))
+				continue
+			}
+
+			if directory != nil {
+				directory.complete(file)
+			}
+
 			// Check there's an Id, Name and either UrlPrivateDownload or UrlPrivate property.
-			if len(file.Id) < 1 || len(file.Name) < 1 || !(len(file.UrlPrivate) > 0 || len(file.UrlPrivateDownload) > 0) {
+			if len(file.Id) < 1 || len(file.Name) < 1 {
 				log.Print("++++++ file_share post has missing properties on its File object: " + post.Ts + "\n")
 				continue
 			}
+			if !(len(file.UrlPrivate) > 0 || len(file.UrlPrivateDownload) > 0) {
+				log.Print("++++++ file " + file.Id + " of post " + post.Ts + " has no download URL\n")
+				continue
+			}
+
+			// The same file can be shared in several posts, but we only need it once.
+			if path, ok := store.stored(file.Id); ok {
+				verbosePrintln(fmt.Sprintf("File %s was already downloaded", file.Id))
+				paths[file.Id] = path
+				continue
+			}
+
+			// So is a file we already decided not to download.
+			if _, ok := store.skipped[file.Id]; ok {
+				continue
+			}
 
 			// Figure out the download URL to use.
 			var downloadUrl string
@@ -144,44 +293,113 @@ func processChannelFile(w *zip.Writer, file *zip.File, inBuf []byte, token strin
 				downloadUrl = file.UrlPrivate
 			}
 
-			// Build the output file path.
-			outputPath := "__uploads/" + file.Id + "/" + file.Name
+			if attachmentsMaxBytes > 0 && file.Size > attachmentsMaxBytes {
+				verbosePrintln(fmt.Sprintf("Skipping file %s (%s), which is larger than --max-attachment-size at %d bytes", file.Id, file.Name, file.Size))
+				store.skip(file, downloadUrl, "too_large")
+				continue
+			}
 
-			// Create the file in the zip output file.
-			outFile, err := w.Create(outputPath)
-			if err != nil {
-				log.Print("++++++ Failed to create output file in output archive: " + outputPath + "\n\n" + err.Error() + "\n")
+			if !attachmentMimetypeWanted(file.Mimetype) {
+				verbosePrintln(fmt.Sprintf("Skipping file %s (%s), whose MIME type %q is filtered out", file.Id, file.Name, file.Mimetype))
+				store.skip(file, downloadUrl, "mimetype_excluded")
 				continue
 			}
 
+			// Build the output file path.
+			outputPath := "__uploads/" + file.Id + "/" + file.Name
+
 			verbosePrintln(fmt.Sprintf("Downloading file %s (%s)", file.Id, file.Name))
 
-			// Fetch the file.
-			req, err := http.NewRequest("GET", downloadUrl, nil)
-			if err != nil {
-				log.Print("++++++ Failed to create file download request: " + downloadUrl)
-				continue
-			}
-			if token != "" {
-				req.Header.Add("Authorization", "Bearer "+token)
-			}
-			response, err := client.Do(req)
+			// Fetch the file into the checkpoint, or a temporary file, from
+			// which it is copied to the output archive.
+			downloadPath, err := downloadAttachment(ctx, client, cp, file, downloadUrl)
 			if err != nil {
-				log.Print("++++++ Failed to download the file: " + downloadUrl)
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				log.Print("++++++ Failed to download the file " + downloadUrl + ": " + err.Error())
 				continue
 			}
-			defer response.Body.Close()
 
 			// Save the file to the output zip file.
-			_, err = io.Copy(outFile, response.Body)
+			downloaded, err := os.Open(downloadPath)
+			if err != nil {
+				return nil, fmt.Errorf("failed to open the downloaded file %s: %w", downloadPath, err)
+			}
+			storedPath, err := store.store(file.Id, outputPath, downloaded)
+			downloaded.Close()
+			if cp == nil {
+				os.Remove(downloadPath)
+			}
 			if err != nil {
 				log.Print("++++++ Failed to write the downloaded file to the output archive: " + downloadUrl + "\n\n" + err.Error() + "\n")
+				continue
 			}
 
 			// Success at last.
-			fmt.Printf("Downloaded attachment into output archive: %s.\n", file.Id)
+			paths[file.Id] = storedPath
+			attachmentsDownloaded++
+			statusPrintf("Downloaded attachment into output archive: %s.\n", file.Id)
+		}
+	}
+
+	return paths, nil
+}
+
+// attachmentMimetypeWanted returns whether files of the MIME type are to be
+// downloaded, according to --attachment-include-mimetype and
+// --attachment-exclude-mimetype. Files without a MIME type only are when no
+// MIME type is to be included in particular.
+func attachmentMimetypeWanted(mimetype string) bool {
+	mimetype = strings.ToLower(mimetype)
+	matches := func(patterns []string) bool {
+		for _, pattern := range patterns {
+			if ok, _ := path.Match(strings.ToLower(pattern), mimetype); ok {
+				return true
+			}
+		}
+		return false
+	}
+	if len(attachmentsMimeInclude) > 0 && (mimetype == "" || !matches(attachmentsMimeInclude)) {
+		return false
+	}
+	return mimetype == "" || !matches(attachmentsMimeExclude)
+}
+
+// addLocalPaths returns the channel file with a local_path property added to
+// each of the files of its posts which were downloaded, holding the path of
+// the file in the archive.
+func addLocalPaths(fileName string, inBuf []byte, paths map[string]string) ([]byte, error) {
+	var posts []map[string]interface{}
+	if err := json.Unmarshal(inBuf, &posts); err != nil {
+		return nil, fmt.Errorf("couldn't parse the JSON file %s: %w", fileName, err)
+	}
+
+	addLocalPath := func(file interface{}) {
+		fileObject, ok := file.(map[string]interface{})
+		if !ok {
+			return
+		}
+		id, _ := fileObject["id"].(string)
+		if path, ok := paths[id]; ok {
+			fileObject["local_path"] = path
 		}
 	}
 
-	return nil
+	for _, post := range posts {
+		// Support for legacy file_share posts.
+		addLocalPath(post["file"])
+		if files, ok := post["files"].([]interface{}); ok {
+			for _, file := range files {
+				addLocalPath(file)
+			}
+		}
+	}
+
+	var outBuf bytes.Buffer
+	enc := newJsonEncoder(&outBuf)
+	if err := enc.Encode(&posts); err != nil {
+		return nil, err
+	}
+	return outBuf.Bytes(), nil
 }
@@ -0,0 +1,249 @@
+package cmd
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFetchAttachmentsKeepsFileHeaders(t *testing.T) {
+	files := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "attachment")
+	}))
+	defer files.Close()
+
+	modified := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	entries := []struct {
+		name     string
+		mode     os.FileMode
+		contents string
+	}{
+		{"users.json", 0640, "[]"},
+		{"channels.json", 0600, `[{"id": "C00000001", "name": "general"}]`},
+		// Rewritten with the local paths of its attachments.
+		{"general/2021-03-04.json", 0604, `[{"ts": "1614834367.000100", "files": [{"id": "F00000001", "name": "a.txt", "url_private": "` + files.URL + `/a.txt"}]}]`},
+	}
+
+	input := filepath.Join(t.TempDir(), "input.zip")
+	f, err := os.Create(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate, Modified: modified}
+		header.SetMode(entry.mode)
+		out, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(out, entry.contents)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	output := filepath.Join(t.TempDir(), "output.zip")
+	if out, err := runExporter(t, "--input-archive", input, "--output-archive", output, "fetch-attachments", "--add-local-paths"); err != nil {
+		t.Fatalf("fetch-attachments failed: %v\n%s", err, out)
+	}
+
+	r, err := zip.OpenReader(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+	written := make(map[string]*zip.File)
+	for _, file := range r.File {
+		written[file.Name] = file
+	}
+	for _, entry := range entries {
+		file := written[entry.name]
+		if file == nil {
+			t.Errorf("%s is missing from the output archive", entry.name)
+			continue
+		}
+		if !file.Modified.Equal(modified) {
+			t.Errorf("expected %s to be modified at %s, got %s", entry.name, modified, file.Modified)
+		}
+		if file.Mode() != entry.mode {
+			t.Errorf("expected %s to have mode %s, got %s", entry.name, entry.mode, file.Mode())
+		}
+		in, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := io.ReadAll(in)
+		in.Close()
+		if err != nil {
+			t.Errorf("couldn't read %s back: %v", entry.name, err)
+		}
+		if strings.HasPrefix(entry.name, "general/") && !strings.Contains(string(data), "local_path") {
+			t.Errorf("expected the local paths of the attachments to be added to %s, got %s", entry.name, data)
+		}
+	}
+}
+
+func TestCopiedFilesKeepHeaders(t *testing.T) {
+	modified := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	extra := []byte{0xfe, 0xca, 2, 0, 'h', 'i'}
+	// Each with an extra field of its own and a comment, which zip
+	// archives keep.
+	entries := []struct {
+		name     string
+		mode     os.FileMode
+		contents string
+	}{
+		{"users.json", 0640, "[]"},
+		{"groups.json", 0600, `[{"id": "G00000001", "name": "project"}]`},
+		{"project/messages.json", 0604, `[{"ts": "1614834367.000100", "text": "hi"}]`},
+		{"notes/readme.txt", 0755, "not a conversation"},
+	}
+	input := filepath.Join(t.TempDir(), "input.zip")
+	f, err := os.Create(input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zw := zip.NewWriter(f)
+	for _, entry := range entries {
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate, Modified: modified, Comment: "from " + entry.name, Extra: extra}
+		header.SetMode(entry.mode)
+		out, err := zw.CreateHeader(header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.WriteString(out, entry.contents)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	slack := newFakeSlack(t)
+	for _, command := range [][]string{
+		{"fetch-private-channels"},
+		{"fetch-conversations", "--types", "private_channel"},
+	} {
+		for _, format := range []string{"zip", "tar.gz", "dir"} {
+			name := strings.Join(command, " ") + " to " + format
+			output := filepath.Join(t.TempDir(), "output."+format)
+			outputFlag := "--output-archive"
+			if format == "dir" {
+				outputFlag = "--output-dir"
+			}
+			args := append(slack.args(), "--input-archive", input, outputFlag, output)
+			args = append(append(args, command...), "--api-token", "xoxp-test")
+			if out, err := runExporter(t, args...); err != nil {
+				t.Fatalf("%s failed: %v\n%s", name, err, out)
+			}
+
+			written := readCopiedEntries(t, format, output)
+			for _, entry := range entries {
+				got, ok := written[entry.name]
+				if !ok {
+					t.Errorf("%s: %s is missing from the output", name, entry.name)
+					continue
+				}
+				if got.contents != entry.contents {
+					t.Errorf("%s: expected %s to be copied as it was, got %s", name, entry.name, got.contents)
+				}
+				if !got.modified.Equal(modified) {
+					t.Errorf("%s: expected %s to be modified at %s, got %s", name, entry.name, modified, got.modified)
+				}
+				if got.mode != entry.mode {
+					t.Errorf("%s: expected %s to have mode %s, got %s", name, entry.name, entry.mode, got.mode)
+				}
+				if format == "zip" && (got.comment != "from "+entry.name || !bytes.Contains(got.extra, extra)) {
+					t.Errorf("%s: expected the comment and extra field of %s to be kept, got %q and %x", name, entry.name, got.comment, got.extra)
+				}
+			}
+		}
+	}
+}
+
+// A file read back by readCopiedEntries, with what its format records of it.
+type copiedFile struct {
+	contents string
+	modified time.Time
+	mode     os.FileMode
+	comment  string
+	extra    []byte
+}
+
+// readCopiedEntries returns the files of the output of the format, by name.
+func readCopiedEntries(t *testing.T, format string, output string) map[string]copiedFile {
+	t.Helper()
+	files := make(map[string]copiedFile)
+	switch format {
+	case "zip":
+		r, err := zip.OpenReader(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer r.Close()
+		for _, file := range r.File {
+			in, err := file.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(in)
+			in.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[file.Name] = copiedFile{string(data), file.Modified, file.Mode(), file.Comment, file.Extra}
+		}
+	case "tar.gz":
+		f, err := os.Open(output)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		tr := tar.NewReader(gz)
+		for {
+			header, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files[header.Name] = copiedFile{contents: string(data), modified: header.ModTime, mode: os.FileMode(header.Mode).Perm()}
+		}
+	case "dir":
+		err := filepath.Walk(output, func(path string, info os.FileInfo, err error) error {
+			if err != nil || info.IsDir() {
+				return err
+			}
+			data, err := os.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			rel, _ := filepath.Rel(output, path)
+			files[filepath.ToSlash(rel)] = copiedFile{contents: string(data), modified: info.ModTime(), mode: info.Mode().Perm()}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
@@ -0,0 +1,95 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+var (
+	bookmarksApiToken     string
+	bookmarksApiTokenFile string
+)
+
+var fetchBookmarksCmd = &cobra.Command{
+	Use:   "fetch-bookmarks",
+	Short: "Fetch the bookmarks of all the conversations accessible to the user",
+	RunE:  fetchBookmarks,
+}
+
+func init() {
+	fetchBookmarksCmd.PersistentFlags().StringVar(&bookmarksApiToken, "api-token", "", "Slack API token, either a user token (xoxp-) or the bot token (xoxb-) of a Slack app. Defaults to the "+apiTokenEnvVar+" environment variable")
+	fetchBookmarksCmd.PersistentFlags().StringVar(&bookmarksApiTokenFile, "api-token-file", "", "path to a file containing the Slack API token, used if --api-token is not set")
+}
+
+// All the types of conversations whose bookmarks are fetched.
+const bookmarksConversationTypes = "public_channel,private_channel,mpim,im"
+
+func fetchBookmarks(cmd *cobra.Command, args []string) error {
+	token, err := resolveApiToken(bookmarksApiToken, bookmarksApiTokenFile, true)
+	if err != nil {
+		return err
+	}
+
+	client := newSlackClient(token)
+	ctx := cmd.Context()
+
+	err = checkTokenScopes(ctx, client, append(conversationTypesScopes(bookmarksConversationTypes), "bookmarks:read")...)
+	if err != nil {
+		return err
+	}
+
+	// Open the input archive.
+	r, err := openInputArchive()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Open the output archive.
+	w, f, err := createOutputArchive()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	files, err := copyArchiveFiles(r, w)
+	if err != nil {
+		return err
+	}
+
+	if files["bookmarks.json"] {
+		verbosePrintln("The file bookmarks.json is already present in the dump, we don't fetch it again")
+	} else {
+		err = createBookmarksJson(ctx, w, client)
+		if err != nil {
+			return fmt.Errorf("failed to fetch bookmarks: %w", err)
+		}
+	}
+
+	err = writeExportMetadata(ctx, r, w, cmd, client)
+	if err != nil {
+		return fmt.Errorf("failed to write the export metadata: %w", err)
+	}
+
+	// Close the output archive writer.
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close the output archive: %w", err)
+	}
+
+	return nil
+}
+
+// createBookmarksJson writes bookmarks.json, mapping the ID of each
+// conversation with bookmarks to the list of those bookmarks, as returned by
+// bookmarks.list, with their title, link, emoji and type among others.
+func createBookmarksJson(ctx context.Context, w archiveWriter, client *slackexport.Client) error {
+	verbosePrintln("Creating bookmarks.json by fetching bookmarks.")
+	return createConversationsItemsJson(ctx, w, "bookmarks.json", client, bookmarksConversationTypes, func(channelId string) ([]map[string]interface{}, error) {
+		return fetchConversationItems(ctx, client, "bookmarks.list", "bookmarks", channelId)
+	})
+}
@@ -0,0 +1,191 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/spf13/cobra"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+var (
+	canvasesApiToken     string
+	canvasesApiTokenFile string
+)
+
+var fetchCanvasesCmd = &cobra.Command{
+	Use:   "fetch-canvases",
+	Short: "Fetch the canvases of the workspace and add them to the output archive",
+	RunE:  fetchCanvases,
+}
+
+func init() {
+	fetchCanvasesCmd.PersistentFlags().StringVar(&canvasesApiToken, "api-token", "", "Slack API token, either a user token (xoxp-) or the bot token (xoxb-) of a Slack app. Defaults to the "+apiTokenEnvVar+" environment variable")
+	fetchCanvasesCmd.PersistentFlags().StringVar(&canvasesApiTokenFile, "api-token-file", "", "path to a file containing the Slack API token, used if --api-token is not set")
+}
+
+// The manifest of the canvases, listing them along with their paths in the
+// archive.
+const canvasesManifest = "canvases/canvases.json"
+
+// The error codes Slack returns when canvases aren't available on the plan of
+// the workspace, or have been disabled.
+var canvasesUnavailableCodes = []string{"feature_not_enabled", "not_allowed", "paid_only", "free_team_not_allowed", "canvas_disabled"}
+
+// A canvas as listed in the manifest.
+type canvasEntry struct {
+	Id      string  `json:"id"`
+	Title   string  `json:"title"`
+	Created float64 `json:"created"`
+	User    string  `json:"user,omitempty"`
+	// The channel of a channel canvas, which standalone canvases don't have.
+	Channel string `json:"channel,omitempty"`
+	Kind    string `json:"kind"`
+	Path    string `json:"path"`
+}
+
+func fetchCanvases(cmd *cobra.Command, args []string) error {
+	token, err := resolveApiToken(canvasesApiToken, canvasesApiTokenFile, true)
+	if err != nil {
+		return err
+	}
+
+	client := newSlackClient(token)
+	ctx := cmd.Context()
+
+	err = checkTokenScopes(ctx, client, "files:read")
+	if err != nil {
+		return err
+	}
+
+	// Open the input archive.
+	r, err := openInputArchive()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Open the output archive.
+	w, f, err := createOutputArchive()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	files, err := copyArchiveFiles(r, w)
+	if err != nil {
+		return err
+	}
+
+	if files[canvasesManifest] {
+		verbosePrintln("The file " + canvasesManifest + " is already present in the dump, we don't fetch the canvases again")
+	} else {
+		err = createCanvases(ctx, w, client)
+		if err != nil {
+			return fmt.Errorf("failed to fetch canvases: %w", err)
+		}
+	}
+
+	err = writeExportMetadata(ctx, r, w, cmd, client)
+	if err != nil {
+		return fmt.Errorf("failed to write the export metadata: %w", err)
+	}
+
+	// Close the output archive writer.
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close the output archive: %w", err)
+	}
+
+	return nil
+}
+
+// createCanvases downloads the contents of each canvas of the workspace to
+// canvases/ID.html, and lists them in the manifest. Canvases which fail to be
+// downloaded are left out, and when canvases aren't available at all on the
+// workspace, nothing is written.
+func createCanvases(ctx context.Context, w archiveWriter, client *slackexport.Client) error {
+	verbosePrintln("Fetching the canvases from Slack API")
+
+	canvases, err := client.Files(ctx, "canvas")
+	var slackErr *slackexport.Error
+	if errors.As(err, &slackErr) && containsString(canvasesUnavailableCodes, slackErr.Code) {
+		log.Print("++++++ Canvases aren't available on this workspace, skipping them: " + err.Error())
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	manifest := make([]canvasEntry, 0, len(canvases))
+	for _, canvas := range canvases {
+		entry := canvasEntry{Kind: "standalone"}
+		entry.Id, _ = canvas["id"].(string)
+		entry.Title, _ = canvas["title"].(string)
+		if entry.Title == "" {
+			entry.Title, _ = canvas["name"].(string)
+		}
+		entry.Created, _ = canvas["created"].(float64)
+		entry.User, _ = canvas["user"].(string)
+		if channel, _ := canvas["linked_channel_id"].(string); channel != "" {
+			entry.Channel = channel
+			entry.Kind = "channel"
+		}
+		entry.Path = "canvases/" + entry.Id + ".html"
+
+		downloadUrl, _ := canvas["url_private_download"].(string)
+		if downloadUrl == "" {
+			downloadUrl, _ = canvas["url_private"].(string)
+		}
+		if entry.Id == "" || downloadUrl == "" {
+			log.Print("++++++ Canvas " + entry.Id + " has no ID or download URL, skipping it\n")
+			continue
+		}
+
+		verbosePrintln(fmt.Sprintf("Downloading canvas %s (%s)", entry.Id, entry.Title))
+		if err := downloadCanvas(ctx, w, client, downloadUrl, entry.Path); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Print("++++++ Failed to download canvas " + entry.Id + "\n\n" + err.Error() + "\n")
+			continue
+		}
+		manifest = append(manifest, entry)
+	}
+
+	outFile, err := w.Create(canvasesManifest)
+	if err != nil {
+		return err
+	}
+	enc := newJsonEncoder(outFile)
+	if err := enc.Encode(&manifest); err != nil {
+		return err
+	}
+	statusPrintf("Downloaded %d canvases.\n", len(manifest))
+	return nil
+}
+
+// downloadCanvas downloads the contents of a canvas to the archive, through
+// the client, so that the download is retried and rate limited as the API
+// requests are.
+func downloadCanvas(ctx context.Context, w archiveWriter, client *slackexport.Client, downloadUrl string, outputPath string) error {
+	resp, err := client.Download(ctx, downloadUrl, 0)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("got HTTP code %d", resp.StatusCode)
+	}
+
+	outFile, err := w.Create(outputPath)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(outFile, resp.Body)
+	return err
+}
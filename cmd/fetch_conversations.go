@@ -0,0 +1,740 @@
+package cmd
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+var (
+	conversationsApiToken       string
+	conversationsApiTokenFile   string
+	conversationsTypes          string
+	conversationsDryRun         bool
+	conversationsInclude        []string
+	conversationsExclude        []string
+	conversationsArchived       bool
+	conversationsShared         bool
+	conversationsMembers        bool
+	conversationsMerge          bool
+	conversationsIncremental    bool
+	conversationsMissingReplies bool
+)
+
+var fetchConversationsCmd = &cobra.Command{
+	Use:   "fetch-conversations",
+	Short: "Fetch all the conversations of the given types accessible to the user in one go",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		return fetchConversations(cmd, conversationsTypes)
+	},
+}
+
+func init() {
+	fetchConversationsCmd.PersistentFlags().StringVar(&conversationsTypes, "types", "public_channel,private_channel,mpim,im", "the comma-separated types of the conversations to fetch, among public_channel, private_channel, mpim and im")
+	addFetchConversationsFlags(fetchConversationsCmd, fetchConversationsHelp{
+		kind:         "conversation",
+		list:         "the file listing the conversations of a type, such as groups.json,",
+		channelKind:  "channel",
+		channelLists: "channels.json and groups.json",
+	})
+}
+
+// How the flags of fetch-conversations name the conversations a command
+// fetches, in their help.
+type fetchConversationsHelp struct {
+	// The conversations fetched, such as "private channel".
+	kind string
+	// The file listing them, such as "groups.json".
+	list string
+	// The channels among them, such as "private channel", or "" for the
+	// commands fetching no channels, which have none of the flags about
+	// channels, such as --fetch-members.
+	channelKind string
+	// The files listing those channels, such as "groups.json".
+	channelLists string
+}
+
+// addFetchConversationsFlags adds the flags of fetch-conversations, but
+// --types, to the command, for the commands which fetch conversations of some
+// types only, and are fetch-conversations with those types.
+func addFetchConversationsFlags(cmd *cobra.Command, help fetchConversationsHelp) {
+	flags := cmd.PersistentFlags()
+	flags.StringVar(&conversationsApiToken, "api-token", "", "Slack API token, either a user token (xoxp-) or the bot token (xoxb-) of a Slack app. Defaults to the "+apiTokenEnvVar+" environment variable")
+	flags.StringVar(&conversationsApiTokenFile, "api-token-file", "", "path to a file containing the Slack API token, used if --api-token is not set")
+	flags.BoolVar(&conversationsDryRun, "dry-run", false, "only list the "+help.kind+"s, an estimate of their messages and files, and the files that would be written, without fetching their histories or writing the output archive")
+	flags.StringArrayVar(&conversationsInclude, "channel", nil, "only fetch the "+help.kind+" with this name or ID, which may be a glob pattern such as proj-*. Can be repeated")
+	flags.StringArrayVar(&conversationsExclude, "exclude-channel", nil, "don't fetch the "+help.kind+" with this name or ID, which may be a glob pattern such as proj-*. Can be repeated")
+	flags.BoolVar(&conversationsArchived, "include-archived", false, "also fetch the "+help.kind+"s which have been archived")
+	if help.channelKind != "" {
+		flags.BoolVar(&conversationsShared, "include-shared", false, "record whether each "+help.channelKind+" is shared with other workspaces or organizations, through Slack Connect or Enterprise Grid, in the is_shared, is_ext_shared and is_org_shared fields of "+help.channelLists+", even when Slack leaves them out. Shared channels are fetched either way")
+		flags.BoolVar(&conversationsMembers, "fetch-members", false, "add the IDs of the members of each "+help.channelKind+" to "+help.channelLists+", as in Slack's own exports. This takes one more request per channel")
+	}
+	flags.BoolVar(&conversationsMerge, "merge", false, "if "+help.list+" is already present in the input archive, add the "+help.kind+"s missing from it and the messages posted since in the others, such as those beyond the history limit of free workspaces, instead of leaving it as is")
+	flags.BoolVar(&conversationsIncremental, "incremental", false, "like --merge, but only fetch the messages posted since the newest one recorded in the export metadata of the input archive, and also fetch the new replies to the threads it already has. This takes one more request per thread")
+	flags.BoolVar(&conversationsMissingReplies, "fetch-missing-replies", false, "if "+help.list+" is already present in the input archive, fetch the thread replies of the "+help.kind+"s which have a messages.json but no replies.json, as in exports made by older versions, without fetching their history again")
+	addConversationsContentsFlags(cmd)
+}
+
+// A type of conversation, along with the file of the archive listing the
+// conversations of that type and how their directories are named, as in
+// Slack's own exports.
+type conversationKind struct {
+	conversationType string
+	// How the conversations of the type are called in messages, such as
+	// "private channel".
+	label        string
+	fileName     string
+	historyScope string
+	dirName      func(map[string]interface{}) string
+}
+
+var conversationKinds = []conversationKind{
+	{"public_channel", "public channel", "channels.json", "channels:history", conversationNameDir},
+	{"private_channel", "private channel", "groups.json", "groups:history", conversationNameDir},
+	{"mpim", "group direct message", "mpims.json", "mpim:history", conversationNameDir},
+	{"im", "direct message", "dms.json", "im:history", conversationIdDir},
+}
+
+// Channels and group direct messages are stored in directories named after
+// the conversation.
+func conversationNameDir(conversation map[string]interface{}) string {
+	name, _ := conversation["name"].(string)
+	return name
+}
+
+// Direct messages have no name of their own, so they are stored in
+// directories named after the conversation ID.
+func conversationIdDir(conversation map[string]interface{}) string {
+	id, _ := conversation["id"].(string)
+	return id
+}
+
+// requestedConversationKinds returns the kinds of the comma-separated types, in
+// the order of the files of Slack's exports.
+func requestedConversationKinds(types string) ([]conversationKind, error) {
+	requested := make([]string, 0)
+	for _, conversationType := range strings.Split(types, ",") {
+		conversationType = strings.TrimSpace(conversationType)
+		found := false
+		for _, kind := range conversationKinds {
+			found = found || kind.conversationType == conversationType
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown conversation type %s, expected public_channel, private_channel, mpim or im", conversationType)
+		}
+		requested = append(requested, conversationType)
+	}
+
+	kinds := make([]conversationKind, 0, len(requested))
+	for _, kind := range conversationKinds {
+		if containsString(requested, kind.conversationType) {
+			kinds = append(kinds, kind)
+		}
+	}
+	return kinds, nil
+}
+
+// conversationKindsLabel returns how the conversations of the kinds are called
+// in messages: as those of the kind if there is only one, such as "private
+// channel", or as conversations.
+func conversationKindsLabel(kinds []conversationKind) string {
+	if len(kinds) == 1 {
+		return kinds[0].label
+	}
+	return "conversation"
+}
+
+// fetchConversations writes the conversations of the comma-separated types to
+// the output archive, along with users.json if the input archive has none.
+// Each type is written to the file listing its conversations, unless the input
+// archive already has it, in which case it is topped up with --merge or
+// --incremental, or left as it is.
+func fetchConversations(cmd *cobra.Command, types string) error {
+	kinds, err := requestedConversationKinds(types)
+	if err != nil {
+		return fmt.Errorf("invalid --types: %w", err)
+	}
+	if err := checkFetchMissingReplies(conversationsMissingReplies, conversationsMerge, conversationsIncremental); err != nil {
+		return err
+	}
+
+	token, err := resolveApiToken(conversationsApiToken, conversationsApiTokenFile, true)
+	if err != nil {
+		return err
+	}
+
+	client := newSlackClient(token)
+	ctx := cmd.Context()
+
+	// Open the input archive, which tells whether users.json, and so its
+	// scope, is needed.
+	r, err := openInputArchive()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	typeNames := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		typeNames = append(typeNames, kind.conversationType)
+	}
+	scopes := append(conversationTypesScopes(strings.Join(typeNames, ",")), conversationsContentsScopes()...)
+	for _, kind := range kinds {
+		scopes = append(scopes, kind.historyScope)
+	}
+	if !archiveHasFile(r, "users.json") {
+		scopes = append(scopes, "users:read")
+	}
+	err = checkTokenScopes(ctx, client, scopes...)
+	if err != nil {
+		return err
+	}
+
+	if conversationsDryRun {
+		return dryRunConversations(ctx, r, client, kinds)
+	}
+
+	if err := setupMentionNames(ctx, r, client); err != nil {
+		return err
+	}
+	if err := setupPermalinks(ctx, client); err != nil {
+		return err
+	}
+	if err := setupExternalUsers(ctx, r, client); err != nil {
+		return err
+	}
+	if err := setupChannelChanges(r); err != nil {
+		return err
+	}
+	if err := setupFileParts(r); err != nil {
+		return err
+	}
+
+	cp, err := openCheckpoint(checkpointDir(outputPath()), resumeExport)
+	if err != nil {
+		return err
+	}
+
+	// Open the output archive.
+	w, f, err := createOutputArchive()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The users are written first, for --anonymize to know them, and so the
+	// names of group direct messages, before the conversations.
+	if archiveHasFile(r, "users.json") {
+		verbosePrintln("The file users.json is already present in the dump, we don't fetch it again")
+	} else {
+		outFile, err := w.Create("users.json")
+		if err != nil {
+			return err
+		}
+		err = createUsersJson(ctx, outFile, client)
+		if err != nil {
+			return fmt.Errorf("failed to fetch users: %w", err)
+		}
+	}
+
+	if err := createConversationsJsons(ctx, r, w, client, cp, kinds); err != nil {
+		return fmt.Errorf("failed to fetch conversations: %w", err)
+	}
+
+	if err := writeExternalUsers(w); err != nil {
+		return fmt.Errorf("failed to write the external users: %w", err)
+	}
+	if err := writeChannelChanges(w); err != nil {
+		return fmt.Errorf("failed to write the changes of the conversations: %w", err)
+	}
+	if err := writeFileParts(w); err != nil {
+		return fmt.Errorf("failed to write the parts of the split files: %w", err)
+	}
+
+	err = writeExportMetadata(ctx, r, w, cmd, client)
+	if err != nil {
+		return fmt.Errorf("failed to write the export metadata: %w", err)
+	}
+
+	// Close the output archive writer.
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close the output archive: %w", err)
+	}
+
+	// The checkpoint is kept when conversations failed, so that they can be
+	// fetched again with --resume.
+	if err := reportExportSummary(); err != nil {
+		return err
+	}
+
+	// The export is complete, so there is nothing left to resume.
+	return cp.remove()
+}
+
+// archiveHasFile returns whether the input archive has a file with the name.
+func archiveHasFile(r *zip.ReadCloser, name string) bool {
+	for _, file := range r.File {
+		if file.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// createConversationsJsons copies the files of the input archive to the output
+// archive, and writes the file listing the conversations of each of the kinds
+// which has none in the input archive, followed by their contents. The
+// conversations of all these kinds are listed in one go.
+//
+// With --merge or --incremental, the kinds which have one are topped up
+// instead, as mergeConversationsJson does. With --fetch-missing-replies, the
+// replies missing from the conversations of those kinds are fetched.
+func createConversationsJsons(ctx context.Context, r *zip.ReadCloser, w archiveWriter, client *slackexport.Client, cp *checkpoint, kinds []conversationKind) error {
+	merge := conversationsMerge || conversationsIncremental
+	listed := make([]conversationKind, 0, len(kinds))
+	for _, kind := range kinds {
+		switch {
+		case !archiveHasFile(r, kind.fileName):
+			verbosePrintln("Creating " + kind.fileName + " by fetching " + kind.label + "s.")
+		case merge:
+			verbosePrintln("Merging " + kind.fileName + " with the " + kind.label + "s fetched.")
+		default:
+			verbosePrintln("The file " + kind.fileName + " is already present in the dump, we don't fetch it again")
+			continue
+		}
+		listed = append(listed, kind)
+	}
+
+	byType, err := listConversations(ctx, client, listed)
+	if err != nil {
+		return err
+	}
+	if err := addConversationsDetails(ctx, client, byType); err != nil {
+		return err
+	}
+
+	// The conversations written to the file of each type, which are those
+	// fetched, along with those of the input archive when merging.
+	written := make(map[string][]map[string]interface{})
+	mergedFiles := make([]string, 0)
+	exclude := make([]string, 0)
+	if merge {
+		conversationBases = make(map[string]*conversationBase)
+	}
+	var previousLatest map[string]string
+	if conversationsIncremental {
+		previousLatest, err = previousLatestMessages(r)
+		if err != nil {
+			return err
+		}
+	}
+	for _, kind := range listed {
+		written[kind.conversationType] = byType[kind.conversationType]
+		if !archiveHasFile(r, kind.fileName) {
+			continue
+		}
+		merged, names, err := mergeConversationsJson(r, kind, byType[kind.conversationType], previousLatest)
+		if err != nil {
+			return fmt.Errorf("failed to merge %s: %w", kind.fileName, err)
+		}
+		written[kind.conversationType] = merged
+		mergedFiles = append(mergedFiles, kind.fileName)
+		exclude = append(exclude, kind.fileName)
+		exclude = append(exclude, names...)
+	}
+
+	files, err := copyArchiveFiles(r, w, exclude...)
+	if err != nil {
+		return err
+	}
+	for _, name := range mergedFiles {
+		files[name] = true
+	}
+
+	if conversationsMissingReplies {
+		for _, kind := range kinds {
+			if files[kind.fileName] {
+				if err := fetchMissingReplies(ctx, r, w, client, kind.fileName, kind.dirName); err != nil {
+					return fmt.Errorf("failed to fetch the missing replies: %w", err)
+				}
+			}
+		}
+	}
+
+	for _, kind := range listed {
+		if err := writeConversationsJson(w, kind.fileName, written[kind.conversationType]); err != nil {
+			return err
+		}
+
+		kindConversations := byType[kind.conversationType]
+		verbosePrintln(fmt.Sprintf("Fetching the contents of %d %ss", len(kindConversations), kind.label))
+		err = fetchConversationsContents(ctx, w, client, cp, kindConversations, kind.dirName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// listConversations lists the conversations of the kinds, with a single pass
+// over conversations.list, and returns those to fetch by type, as filtered by
+// --channel and --exclude-channel. Slack's default for archived channels isn't
+// documented consistently, so we always say whether we want them.
+func listConversations(ctx context.Context, client *slackexport.Client, kinds []conversationKind) (map[string][]map[string]interface{}, error) {
+	byType := make(map[string][]map[string]interface{})
+	for _, kind := range kinds {
+		byType[kind.conversationType] = make([]map[string]interface{}, 0)
+	}
+	if len(kinds) == 0 {
+		return byType, nil
+	}
+
+	types := make([]string, 0, len(kinds))
+	for _, kind := range kinds {
+		types = append(types, kind.conversationType)
+	}
+	conversations, err := fetchConversationsList(ctx, client, strings.Join(types, ","), !conversationsArchived)
+	if err != nil {
+		return nil, err
+	}
+	conversations = filterChannels(conversations, conversationKindsLabel(kinds), conversationsInclude, conversationsExclude)
+
+	for _, conversation := range conversations {
+		typ := conversationType(conversation)
+		if list, ok := byType[typ]; ok {
+			byType[typ] = append(list, conversation)
+		}
+	}
+	return byType, nil
+}
+
+// addConversationsDetails adds what the lists of conversations of Slack's
+// exports have and conversations.list leaves out to the conversations listed:
+// the members of direct messages, and with --include-shared and
+// --fetch-members, whether channels are shared and their members.
+func addConversationsDetails(ctx context.Context, client *slackexport.Client, byType map[string][]map[string]interface{}) error {
+	for _, kind := range conversationKinds {
+		if kind.conversationType != "public_channel" && kind.conversationType != "private_channel" {
+			continue
+		}
+		channels := byType[kind.conversationType]
+		if conversationsShared {
+			markSharedChannels(channels, kind.label)
+		}
+		if conversationsMembers && len(channels) > 0 {
+			if err := addChannelMembers(ctx, client, channels, kind.label); err != nil {
+				return err
+			}
+		}
+	}
+	if dms := byType["im"]; len(dms) > 0 {
+		if err := addDmMembers(ctx, client, dms); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// addChannelMembers adds the IDs of the members of each channel to it, as in
+// Slack's own exports. The kind of the channels, such as "private channel",
+// is used in messages.
+func addChannelMembers(ctx context.Context, client *slackexport.Client, channels []map[string]interface{}, kind string) error {
+	verbosePrintln("Fetching the members of " + kind + "s")
+	for _, channel := range channels {
+		id, _ := channel["id"].(string)
+		members, err := fetchConversationMembers(ctx, client, id)
+		if err != nil {
+			return fmt.Errorf("failed to fetch the members of %s %s: %w", kind, id, err)
+		}
+		channel["members"] = members
+	}
+	return nil
+}
+
+// addDmMembers lists both participants of each direct message as its members,
+// as the native export does.
+func addDmMembers(ctx context.Context, client *slackexport.Client, dms []map[string]interface{}) error {
+	auth, err := client.AuthTest(ctx)
+	if err != nil {
+		return err
+	}
+	for _, dm := range dms {
+		if user, ok := dm["user"].(string); ok {
+			dm["members"] = []string{auth.UserId, user}
+		}
+	}
+	return nil
+}
+
+// mergeConversationsJson tops up the conversations of the kind listed in its
+// file of the input archive, such as groups.json, with those fetched, and
+// returns the conversations to write to the file, along with the names of the
+// files of the input archive which are written again.
+//
+// The conversations fetched which are missing from the file are fetched in
+// full, and the messages posted since the input archive was exported are added
+// to the others, along with the replies to the threads they start. The
+// conversations in the file are replaced by their fresh versions, and those
+// which can't be found anymore are kept as they are.
+//
+// With --incremental, the messages are fetched from the newest one recorded in
+// the export metadata, as given by previousLatest, rather than found in the
+// files, and the replies to the threads already in the input archive are
+// fetched again as well.
+func mergeConversationsJson(r *zip.ReadCloser, kind conversationKind, conversations []map[string]interface{}, previousLatest map[string]string) ([]map[string]interface{}, []string, error) {
+	var existing []map[string]interface{}
+	if _, err := readArchiveJson(r, kind.fileName, &existing); err != nil {
+		return nil, nil, err
+	}
+
+	fresh := make(map[string]map[string]interface{})
+	for _, conversation := range conversations {
+		id, _ := conversation["id"].(string)
+		fresh[id] = conversation
+	}
+
+	// The conversations which are still there are written again, from the
+	// files of the input archive and the messages fetched.
+	names := make([]string, 0)
+	merged := make([]map[string]interface{}, 0, len(existing)+len(conversations))
+	known := make(map[string]bool)
+	existingDirs := conversationDirs(existing, kind.dirName)
+	topped := 0
+	for i, conversation := range existing {
+		id, _ := conversation["id"].(string)
+		known[id] = true
+		freshConversation, ok := fresh[id]
+		if !ok {
+			merged = append(merged, conversation)
+			continue
+		}
+		merged = append(merged, freshConversation)
+
+		base, baseNames, err := readConversationBase(r, existingDirs[i])
+		if err != nil {
+			return nil, nil, err
+		}
+		if conversationsIncremental {
+			// Archives written by earlier versions have no timestamps in
+			// their metadata, so we fall back to the files for those.
+			if latest, ok := previousLatest[id]; ok {
+				base.latest = latest
+			}
+		} else {
+			base.threads = nil
+		}
+		conversationBases[id] = base
+		names = append(names, baseNames...)
+		topped++
+	}
+	for _, conversation := range conversations {
+		id, _ := conversation["id"].(string)
+		if !known[id] {
+			merged = append(merged, conversation)
+		}
+	}
+	verbosePrintln(fmt.Sprintf("Topping up %d %ss and fetching %d new ones", topped, kind.label, len(conversations)-topped))
+	return merged, names, nil
+}
+
+func writeConversationsJson(w archiveWriter, fileName string, conversations []map[string]interface{}) error {
+	outFile, err := w.Create(fileName)
+	if err != nil {
+		return err
+	}
+
+	enc := newJsonEncoder(outFile)
+	return enc.Encode(&conversations)
+}
+
+// filterChannels returns the channels matching one of the include patterns,
+// or all of them if there are none, and none of the exclude patterns. A
+// channel matches a pattern when its name or ID does, where patterns may use
+// the glob syntax of path.Match. The kind of the channels, such as "private
+// channel", is used in messages.
+//
+// Include patterns which match no channel are reported, as they are likely
+// to be typos, but don't stop the export.
+func filterChannels(channels []map[string]interface{}, kind string, include []string, exclude []string) []map[string]interface{} {
+	if len(include) == 0 && len(exclude) == 0 {
+		return channels
+	}
+
+	matched := make(map[string]bool)
+	matches := func(channel map[string]interface{}, patterns []string) bool {
+		id, _ := channel["id"].(string)
+		name, _ := channel["name"].(string)
+		found := false
+		for _, pattern := range patterns {
+			nameMatch, _ := path.Match(pattern, name)
+			idMatch, _ := path.Match(pattern, id)
+			if nameMatch || idMatch {
+				matched[pattern] = true
+				found = true
+			}
+		}
+		return found
+	}
+
+	filtered := make([]map[string]interface{}, 0, len(channels))
+	for _, channel := range channels {
+		if len(include) > 0 && !matches(channel, include) {
+			continue
+		}
+		if matches(channel, exclude) {
+			continue
+		}
+		filtered = append(filtered, channel)
+	}
+
+	for _, pattern := range include {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Printf("++++++ Invalid channel pattern %s: %s", pattern, err)
+		} else if !matched[pattern] {
+			log.Printf("++++++ No %s matches %s, skipping it", kind, pattern)
+		}
+	}
+	for _, pattern := range exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			log.Printf("++++++ Invalid channel pattern %s: %s", pattern, err)
+		}
+	}
+
+	verbosePrintln(fmt.Sprintf("Kept %d of %d %ss after filtering", len(filtered), len(channels), kind))
+	return filtered
+}
+
+// errHistorySampled stops sampleHistory after the first page.
+var errHistorySampled = errors.New("sampled the history")
+
+// A sample of the history of a conversation, from the first page of the
+// messages which fetching it would add.
+type historySample struct {
+	messages int
+	files    int
+	// Whether there are more messages than those of the page.
+	more bool
+}
+
+// sampleHistory fetches the first page of the messages of the conversation
+// which fetching it would add, in the range of --oldest and --latest and
+// after the newest message of the input archive when topping it up.
+func sampleHistory(ctx context.Context, client *slackexport.Client, channelId string) (historySample, error) {
+	var sample historySample
+	err := walkChannelHistory(ctx, client, channelId, "", func(messages []map[string]interface{}, nextCursor string) error {
+		sample.messages = len(messages)
+		for _, message := range messages {
+			files, _ := message["files"].([]interface{})
+			sample.files += len(files)
+		}
+		sample.more = nextCursor != ""
+		return errHistorySampled
+	})
+	if err != nil && !errors.Is(err, errHistorySampled) {
+		return sample, err
+	}
+	return sample, nil
+}
+
+// String describes the sample as an estimate of the messages and files to
+// fetch.
+func (s historySample) String() string {
+	if s.more {
+		return fmt.Sprintf("more than %d messages with at least %d files", s.messages, s.files)
+	}
+	return fmt.Sprintf("%d messages with %d files", s.messages, s.files)
+}
+
+// dryRunConversations prints the conversations of the kinds accessible with
+// the token and the files which fetching them would add to the output archive,
+// along with an estimate of the number of messages and files of each, taken
+// from the first page of its history. With --merge or --incremental, the
+// page starts after the newest message of the input archive, as it would when
+// topping it up.
+func dryRunConversations(ctx context.Context, r *zip.ReadCloser, client *slackexport.Client, kinds []conversationKind) error {
+	merge := conversationsMerge || conversationsIncremental
+	listed := make([]conversationKind, 0, len(kinds))
+	for _, kind := range kinds {
+		switch {
+		case !archiveHasFile(r, kind.fileName):
+		case merge:
+			fmt.Printf("The file %s is already present in the dump, its %ss would be topped up.\n", kind.fileName, kind.label)
+		default:
+			fmt.Printf("The file %s is already present in the dump, no %ss would be fetched.\n", kind.fileName, kind.label)
+			continue
+		}
+		listed = append(listed, kind)
+	}
+
+	byType, err := listConversations(ctx, client, listed)
+	if err != nil {
+		return fmt.Errorf("failed to fetch conversations: %w", err)
+	}
+	if merge {
+		conversationBases = make(map[string]*conversationBase)
+	}
+	var previousLatest map[string]string
+	if conversationsIncremental {
+		previousLatest, err = previousLatestMessages(r)
+		if err != nil {
+			return err
+		}
+	}
+
+	var total historySample
+	totalConversations := 0
+	for _, kind := range listed {
+		conversations := byType[kind.conversationType]
+		if archiveHasFile(r, kind.fileName) {
+			if _, _, err := mergeConversationsJson(r, kind, conversations, previousLatest); err != nil {
+				return fmt.Errorf("failed to merge %s: %w", kind.fileName, err)
+			}
+		}
+		label := strings.ToUpper(kind.label[:1]) + kind.label[1:]
+		fmt.Println("Would write " + kind.fileName)
+		dirs := conversationDirs(conversations, kind.dirName)
+		for i, conversation := range conversations {
+			id, _ := conversation["id"].(string)
+			members := "unknown number of"
+			if numMembers, ok := conversation["num_members"].(float64); ok {
+				members = fmt.Sprintf("%d", int(numMembers))
+			}
+			sample, err := sampleHistory(ctx, client, id)
+			if err != nil {
+				return fmt.Errorf("failed to fetch the history of %s: %w", id, err)
+			}
+			total.messages += sample.messages
+			total.files += sample.files
+			total.more = total.more || sample.more
+			fmt.Printf("%s %s (%s), %s members, %s:\n", label, dirs[i], id, members, sample)
+			if nativeLayout {
+				fmt.Printf("    Would write %s/YYYY-MM-DD.json, one file per day\n", dirs[i])
+			} else {
+				fmt.Printf("    Would write %s/messages.json\n", dirs[i])
+				fmt.Printf("    Would write %s/replies.json\n", dirs[i])
+			}
+		}
+		fmt.Printf("Found %d %ss.\n", len(conversations), kind.label)
+		totalConversations += len(conversations)
+	}
+
+	if archiveHasFile(r, "users.json") {
+		fmt.Println("The file users.json is already present in the dump, it would not be fetched.")
+	} else {
+		fmt.Println("Would write users.json")
+	}
+	// Replies are only counted when they were also sent to the
+	// conversation, as fetching them takes a request per thread.
+	fmt.Printf("Would fetch %s from %d conversations, not counting the replies to threads.\n", total, totalConversations)
+
+	return nil
+}
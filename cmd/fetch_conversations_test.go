@@ -0,0 +1,208 @@
+package cmd
+
+import (
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// conversationsSlack returns a server with a conversation of each type, and
+// an archived one of each channel type, listing those of the types asked for.
+func conversationsSlack(t *testing.T) *fakeSlack {
+	conversations := map[string][]interface{}{
+		"public_channel": {
+			map[string]interface{}{"id": "C00000001", "name": "general", "created": 1500000000},
+			map[string]interface{}{"id": "C00000002", "name": "old", "created": 1500000000, "is_archived": true},
+		},
+		"private_channel": {
+			map[string]interface{}{"id": "G00000001", "name": "project", "is_private": true, "created": 1500000000},
+			map[string]interface{}{"id": "G00000002", "name": "connect", "is_private": true, "is_shared": true, "created": 1500000000},
+			map[string]interface{}{"id": "G00000003", "name": "closed", "is_private": true, "is_archived": true, "created": 1500000000},
+		},
+		"mpim": {
+			map[string]interface{}{"id": "G00000004", "name": "mpdm-a--b-1", "is_private": true, "is_mpim": true, "created": 1500000000},
+		},
+		"im": {
+			map[string]interface{}{"id": "D00000001", "user": "U00000002", "is_im": true, "created": 1500000000},
+			map[string]interface{}{"id": "D00000002", "user": "U00000003", "is_im": true, "is_archived": true, "created": 1500000000},
+		},
+	}
+	slack := newFakeSlack(t)
+	slack.handle("conversations.list", func(params url.Values) map[string]interface{} {
+		listed := make([]interface{}, 0)
+		for _, conversationType := range strings.Split(params.Get("types"), ",") {
+			for _, conversation := range conversations[conversationType] {
+				archived, _ := conversation.(map[string]interface{})["is_archived"].(bool)
+				if !archived || params.Get("exclude_archived") != "true" {
+					listed = append(listed, conversation)
+				}
+			}
+		}
+		return map[string]interface{}{"channels": listed}
+	})
+	slack.handle("conversations.history", func(params url.Values) map[string]interface{} {
+		return map[string]interface{}{"messages": []interface{}{
+			map[string]interface{}{"ts": "1500000100.000100", "user": "U00000001", "text": "in " + params.Get("channel")},
+		}}
+	})
+	return slack
+}
+
+func TestFetchCommandsAreFetchConversations(t *testing.T) {
+	for _, test := range []struct {
+		command []string
+		same    []string
+	}{
+		{
+			[]string{"fetch-private-channels"},
+			[]string{"fetch-conversations", "--types", "private_channel"},
+		},
+		{
+			[]string{"fetch-private-channels", "--include-shared", "--include-archived", "--exclude-channel", "project"},
+			[]string{"fetch-conversations", "--types", "private_channel", "--include-shared", "--include-archived", "--exclude-channel", "project"},
+		},
+		{
+			[]string{"fetch-public-channels"},
+			[]string{"fetch-conversations", "--types", "public_channel", "--native-layout"},
+		},
+		{
+			[]string{"fetch-public-channels", "--native-layout=false", "--include-archived"},
+			[]string{"fetch-conversations", "--types", "public_channel", "--include-archived"},
+		},
+		{
+			[]string{"fetch-dms"},
+			[]string{"fetch-conversations", "--types", "im,mpim", "--include-archived"},
+		},
+		{
+			[]string{"fetch-dms", "--include-archived=false"},
+			[]string{"fetch-conversations", "--types", "im,mpim"},
+		},
+	} {
+		name := strings.Join(test.command, " ")
+		slack := conversationsSlack(t)
+		input := writeTestArchive(t, map[string]string{"users.json": "[]"})
+		run := func(command []string) map[string]string {
+			output := filepath.Join(t.TempDir(), "output.zip")
+			args := append(slack.args(), "--reproducible", "--input-archive", input, "--output-archive", output)
+			args = append(append(args, command...), "--api-token", "xoxp-test")
+			if out, err := runExporter(t, args...); err != nil {
+				t.Fatalf("%s failed: %v\n%s", strings.Join(command, " "), err, out)
+			}
+			files := readTestArchive(t, output)
+			// The metadata records the command line.
+			delete(files, exportMetadataFile)
+			return files
+		}
+
+		files, same := run(test.command), run(test.same)
+		if len(files) <= 1 {
+			t.Errorf("%s fetched no conversations: %v", name, fileNames(files))
+		}
+		if len(files) != len(same) {
+			t.Errorf("%s wrote %v, but %s wrote %v", name, fileNames(files), strings.Join(test.same, " "), fileNames(same))
+			continue
+		}
+		for file, contents := range files {
+			if same[file] != contents {
+				t.Errorf("%s and %s wrote different %s:\n%s\n%s", name, strings.Join(test.same, " "), file, contents, same[file])
+			}
+		}
+	}
+}
+
+func TestFetchConversationsMergesEveryType(t *testing.T) {
+	slack := conversationsSlack(t)
+	input := writeTestArchive(t, map[string]string{
+		"users.json":              "[]",
+		"channels.json":           `[{"id": "C00000001", "name": "general"}]`,
+		"general/2017-07-14.json": `[{"ts": "1500000000.000100", "text": "from the export"}]`,
+		"dms.json":                `[{"id": "D00000001", "members": ["U00000001", "U00000002"]}]`,
+		"D00000001/messages.json": `[{"ts": "1500000000.000100", "text": "from the export"}]`,
+		"groups.json":             `[{"id": "G00000001", "name": "project"}]`,
+		"project/messages.json":   `[{"ts": "1500000000.000100", "text": "from the export"}]`,
+		"mpims.json":              `[]`,
+		"somewhere/else.json":     `{}`,
+	})
+	output := filepath.Join(t.TempDir(), "output.zip")
+	args := append(slack.args(), "--input-archive", input, "--output-archive", output,
+		"fetch-conversations", "--api-token", "xoxp-test", "--types", "public_channel,private_channel,im,mpim", "--merge")
+	if out, err := runExporter(t, args...); err != nil {
+		t.Fatalf("fetch-conversations --merge failed: %v\n%s", err, out)
+	}
+
+	files := readTestArchive(t, output)
+	for list, expected := range map[string]int{"channels.json": 1, "groups.json": 2, "dms.json": 1, "mpims.json": 1} {
+		var conversations []map[string]interface{}
+		decodeTestJson(t, list, files[list], &conversations)
+		if len(conversations) != expected {
+			t.Errorf("expected %d conversations in %s, got %d: %s", expected, list, len(conversations), files[list])
+		}
+	}
+	for _, file := range []string{"D00000001/messages.json", "project/messages.json"} {
+		var messages []map[string]interface{}
+		decodeTestJson(t, file, files[file], &messages)
+		if len(messages) != 2 {
+			t.Errorf("expected the message of the export and the fetched one in %s, got %s", file, files[file])
+		}
+	}
+	if _, ok := files["connect/messages.json"]; !ok {
+		t.Errorf("the private channel missing from the export wasn't fetched: %v", fileNames(files))
+	}
+	if _, ok := files["somewhere/else.json"]; !ok {
+		t.Errorf("the other files of the export weren't copied: %v", fileNames(files))
+	}
+}
+
+func TestDryRunEstimatesMessages(t *testing.T) {
+	slack := conversationsSlack(t)
+	slack.handle("conversations.history", func(params url.Values) map[string]interface{} {
+		if params.Get("channel") != "G00000002" {
+			return map[string]interface{}{"messages": []interface{}{
+				map[string]interface{}{"ts": "1500000100.000100", "text": "hi"},
+			}}
+		}
+		return map[string]interface{}{
+			"messages": []interface{}{
+				map[string]interface{}{"ts": "1500000200.000100", "files": []interface{}{map[string]interface{}{"id": "F1"}, map[string]interface{}{"id": "F2"}}},
+				map[string]interface{}{"ts": "1500000100.000100", "text": "hi"},
+			},
+			"response_metadata": map[string]interface{}{"next_cursor": "next"},
+		}
+	})
+	input := writeTestArchive(t, map[string]string{
+		"users.json":            "[]",
+		"groups.json":           `[{"id": "G00000001", "name": "project"}]`,
+		"project/messages.json": `[{"ts": "1500000050.000100", "text": "from the export"}]`,
+	})
+	output := filepath.Join(t.TempDir(), "output.zip")
+	args := append(slack.args(), "--input-archive", input, "--output-archive", output,
+		"fetch-private-channels", "--api-token", "xoxp-test", "--dry-run", "--merge")
+	out, err := runExporter(t, args...)
+	if err != nil {
+		t.Fatalf("fetch-private-channels --dry-run failed: %v\n%s", err, out)
+	}
+
+	for _, expected := range []string{
+		"its private channels would be topped up",
+		"(G00000001), unknown number of members, 1 messages with 0 files:",
+		"(G00000002), unknown number of members, more than 2 messages with at least 2 files:",
+		"Would fetch more than 3 messages with at least 2 files from 2 conversations",
+	} {
+		if !strings.Contains(out, expected) {
+			t.Errorf("expected the dry run to print %q, got\n%s", expected, out)
+		}
+	}
+	for _, params := range slack.calls("conversations.history") {
+		if params.Get("limit") == "" || params.Get("cursor") != "" {
+			t.Errorf("expected a single page of each history, got a request with %v", params)
+		}
+		if params.Get("channel") == "G00000001" && params.Get("oldest") != "1500000050.000100" {
+			t.Errorf("expected the history of the channel to top up to start from its newest message, got %v", params)
+		}
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Errorf("expected the dry run not to write the output archive, got %v", err)
+	}
+}
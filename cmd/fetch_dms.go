@@ -0,0 +1,33 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var fetchDmsCmd = &cobra.Command{
+	Use:   "fetch-dms",
+	Short: "Fetch all direct messages and group direct messages accessible to the user",
+	Long: `Fetch all direct messages and group direct messages accessible to the user, as fetch-conversations
+--types im,mpim --include-archived does. Pass --include-archived=false to leave out the archived
+ones.
+
+As in Slack's native export, direct messages are stored in directories named after the conversation ID, as
+they have no name of their own, while group direct messages are stored in directories named after the
+conversation.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !cmd.Flags().Changed("include-archived") {
+			conversationsArchived = true
+		}
+		return fetchConversations(cmd, "im,mpim")
+	},
+}
+
+func init() {
+	addFetchConversationsFlags(fetchDmsCmd, fetchConversationsHelp{
+		kind: "direct message",
+		list: "dms.json or mpims.json",
+	})
+	// Direct messages are fetched whether they are archived or not, as
+	// fetch-dms has always done, unless --include-archived=false is given.
+	fetchDmsCmd.PersistentFlags().Lookup("include-archived").DefValue = "true"
+}
@@ -1,20 +1,21 @@
 package cmd
 
 import (
-	"archive/zip"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"log"
-	"net/http"
-	"os"
 
 	"github.com/spf13/cobra"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
 )
 
 var (
-	emailsApiToken string
+	emailsApiToken     string
+	emailsApiTokenFile string
 )
 
 var fetchEmailsCmd = &cobra.Command{
@@ -24,75 +25,85 @@ var fetchEmailsCmd = &cobra.Command{
 }
 
 func init() {
-	fetchEmailsCmd.PersistentFlags().StringVar(&emailsApiToken, "api-token", "", "Slack API token. Can be obtained here: https://api.slack.com/docs/oauth-test-tokens")
-	fetchEmailsCmd.MarkPersistentFlagRequired("api-token")
+	fetchEmailsCmd.PersistentFlags().StringVar(&emailsApiToken, "api-token", "", "Slack API token, either a user token (xoxp-) or the bot token (xoxb-) of a Slack app. Defaults to the "+apiTokenEnvVar+" environment variable")
+	fetchEmailsCmd.PersistentFlags().StringVar(&emailsApiTokenFile, "api-token-file", "", "path to a file containing the Slack API token, used if --api-token is not set")
 }
 
 func fetchEmails(cmd *cobra.Command, args []string) error {
+	token, err := resolveApiToken(emailsApiToken, emailsApiTokenFile, true)
+	if err != nil {
+		return err
+	}
+
+	client := newSlackClient(token)
+	ctx := cmd.Context()
+
+	err = checkTokenScopes(ctx, client, "users:read", "users:read.email")
+	if err != nil {
+		return err
+	}
+
 	// Open the input archive.
-	r, err := zip.OpenReader(inputArchive)
+	r, err := openInputArchive()
 	if err != nil {
-		fmt.Printf("Could not open input archive for reading: %s\n", inputArchive)
-		os.Exit(1)
+		return err
 	}
 	defer r.Close()
 
 	// Open the output archive.
-	f, err := os.Create(outputArchive)
+	w, f, err := createOutputArchive()
 	if err != nil {
-		fmt.Printf("Could not open the output archive for writing: %s\n\n%s", outputArchive, err)
-		os.Exit(1)
+		return err
 	}
 	defer f.Close()
 
-	// Create a zip writer on the output archive.
-	w := zip.NewWriter(f)
-
 	// Run through all the files in the input archive.
 	for _, file := range r.File {
+		// It is written anew below.
+		if file.Name == exportMetadataFile {
+			continue
+		}
 		verbosePrintln(fmt.Sprintf("Processing file: %s\n", file.Name))
 
 		// Open the file from the input archive.
 		inReader, err := file.Open()
 		if err != nil {
-			fmt.Printf("Failed to open file in input archive: %s\n\n%s", file.Name, err)
-			os.Exit(1)
+			return fmt.Errorf("failed to open file in input archive %s: %w", file.Name, err)
 		}
 
-		// Copy, because CreateHeader modifies it.
-		header := file.FileHeader
-
-		outFile, err := w.CreateHeader(&header)
+		outFile, err := w.CreateHeader(copyFileHeader(file))
 		if err != nil {
-			fmt.Printf("Failed to create file in output archive: %s\n\n%s", file.Name, err)
-			os.Exit(1)
+			return fmt.Errorf("failed to create file in output archive %s: %w", file.Name, err)
 		}
 
 		if file.Name == "users.json" {
-			err = processUsersJson(outFile, inReader, emailsApiToken)
+			err = processUsersJson(ctx, outFile, inReader, client)
 			if err != nil {
-				fmt.Printf("Failed to fetch users' emails.\n\n%s", err)
-				os.Exit(1)
+				return fmt.Errorf("failed to fetch users' emails: %w", err)
 			}
 		} else {
 			_, err = io.Copy(outFile, inReader)
 			if err != nil {
-				fmt.Printf("Failed to copy file to output archive: %s\n\n%s", file.Name, err)
-				os.Exit(1)
+				return fmt.Errorf("failed to copy file to output archive %s: %w", file.Name, err)
 			}
 		}
 	}
 
-	// Close the output zip writer.
+	err = writeExportMetadata(ctx, r, w, cmd, client)
+	if err != nil {
+		return fmt.Errorf("failed to write the export metadata: %w", err)
+	}
+
+	// Close the output archive writer.
 	err = w.Close()
 	if err != nil {
-		fmt.Printf("Failed to close the output archive.\n\n%s", err)
+		return fmt.Errorf("failed to close the output archive: %w", err)
 	}
 
 	return nil
 }
 
-func processUsersJson(output io.Writer, input io.Reader, slackApiToken string) error {
+func processUsersJson(ctx context.Context, output io.Writer, input io.Reader, client *slackexport.Client) error {
 	verbosePrintln("Found users.json file.")
 
 	// We want to preserve all existing fields in JSON.
@@ -105,7 +116,7 @@ func processUsersJson(output io.Writer, input io.Reader, slackApiToken string) e
 		return err
 	}
 
-	emails, err := fetchUserEmails(slackApiToken)
+	emails, err := fetchUserEmails(ctx, client)
 	if err != nil {
 		return err
 	}
@@ -135,50 +146,24 @@ func processUsersJson(output io.Writer, input io.Reader, slackApiToken string) e
 			log.Print("Some user array entry doesn't have id, skipping")
 		}
 	}
-	enc := json.NewEncoder(output)
-	// The same indent level as export zip uses.
-	enc.SetIndent("", "    ")
+	enc := newJsonEncoder(output)
 	return enc.Encode(&data)
 }
 
-func fetchUserEmails(token string) (map[string]string, error) {
+func fetchUserEmails(ctx context.Context, client *slackexport.Client) (map[string]string, error) {
 	verbosePrintln("Fetching emails from Slack API")
 
-	client := &http.Client{}
-	req, err := http.NewRequest("GET", "https://slack.com/api/users.list", nil)
-	if err != nil {
-		return nil, fmt.Errorf("Got error %s when building the request", err.Error())
-	}
-
-	req.Header.Set("Authorization", "Bearer "+token)
-	resp, err := client.Do(req)
-
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Slack API returned HTTP code %d", resp.StatusCode)
-	}
-
-	// Here SlackUser struct is used instead of interface{}.
-	// It has very few fields defined, but the decoder will simply
-	// ignore extra fields, and we only need a couple of them.
 	var data struct {
-		Ok      bool        `json:"ok"`
+		// Here SlackUser struct is used instead of interface{}.
+		// It has very few fields defined, but the decoder will simply
+		// ignore extra fields, and we only need a couple of them.
 		Members []SlackUser `json:"members"`
 	}
-
-	err = json.NewDecoder(resp.Body).Decode(&data)
+	err := client.Get(ctx, "users.list", nil, &data)
 	if err != nil {
 		return nil, err
 	}
 
-	if !data.Ok {
-		return nil, errors.New("Unexpected lack of ok=true in Slack API response. Is access token correct?")
-	}
-
 	verbosePrintln("Fetched emails from Slack API. Now building a map of them to process.")
 
 	res := make(map[string]string)
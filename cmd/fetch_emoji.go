@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+var (
+	emojiApiToken     string
+	emojiApiTokenFile string
+)
+
+var fetchEmojiCmd = &cobra.Command{
+	Use:   "fetch-emoji",
+	Short: "Fetch all custom emoji and add them to the output archive",
+	RunE:  fetchEmoji,
+}
+
+func init() {
+	fetchEmojiCmd.PersistentFlags().StringVar(&emojiApiToken, "api-token", "", "Slack API token, either a user token (xoxp-) or the bot token (xoxb-) of a Slack app. Defaults to the "+apiTokenEnvVar+" environment variable")
+	fetchEmojiCmd.PersistentFlags().StringVar(&emojiApiTokenFile, "api-token-file", "", "path to a file containing the Slack API token, used if --api-token is not set")
+}
+
+func fetchEmoji(cmd *cobra.Command, args []string) error {
+	token, err := resolveApiToken(emojiApiToken, emojiApiTokenFile, true)
+	if err != nil {
+		return err
+	}
+
+	client := newSlackClient(token)
+	ctx := cmd.Context()
+
+	err = checkTokenScopes(ctx, client, "emoji:read")
+	if err != nil {
+		return err
+	}
+
+	// Open the input archive.
+	r, err := openInputArchive()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Open the output archive.
+	w, f, err := createOutputArchive()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	files, err := copyArchiveFiles(r, w)
+	if err != nil {
+		return err
+	}
+
+	if files["emoji.json"] {
+		verbosePrintln("The file emoji.json is already present in the dump, we don't fetch it again")
+	} else {
+		err = createEmojiJson(ctx, w, client)
+		if err != nil {
+			return fmt.Errorf("failed to fetch custom emoji: %w", err)
+		}
+	}
+
+	err = writeExportMetadata(ctx, r, w, cmd, client)
+	if err != nil {
+		return fmt.Errorf("failed to write the export metadata: %w", err)
+	}
+
+	// Close the output archive writer.
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close the output archive: %w", err)
+	}
+
+	return nil
+}
+
+// createEmojiJson writes the map of custom emoji names to their image URLs as
+// emoji.json, and downloads the image of each of them into the emoji directory.
+//
+// Aliases, whose value is "alias:" followed by the name of another emoji, are
+// recorded in emoji.json but have no image of their own.
+func createEmojiJson(ctx context.Context, w archiveWriter, client *slackexport.Client) error {
+	verbosePrintln("Creating emoji.json by fetching custom emoji.")
+
+	emoji, err := fetchEmojiList(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	outFile, err := w.Create("emoji.json")
+	if err != nil {
+		return err
+	}
+	enc := newJsonEncoder(outFile)
+	err = enc.Encode(&emoji)
+	if err != nil {
+		return err
+	}
+
+	// Download in a stable order, so that the output archive is predictable.
+	names := make([]string, 0, len(emoji))
+	for name := range emoji {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		imageUrl := emoji[name]
+		if strings.HasPrefix(imageUrl, "alias:") {
+			continue
+		}
+
+		parsedUrl, err := url.Parse(imageUrl)
+		if err != nil {
+			log.Print("++++++ Failed to parse the URL of emoji " + name + ": " + imageUrl)
+			continue
+		}
+		outputPath := "emoji/" + name + path.Ext(parsedUrl.Path)
+
+		verbosePrintln(fmt.Sprintf("Downloading emoji %s", name))
+
+		req, err := http.NewRequestWithContext(ctx, "GET", imageUrl, nil)
+		if err != nil {
+			log.Print("++++++ Failed to create emoji download request: " + imageUrl)
+			continue
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.Print("++++++ Failed to download the emoji: " + imageUrl + "\n\n" + err.Error() + "\n")
+			continue
+		}
+		if resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			log.Printf("++++++ Failed to download the emoji %s: HTTP code %d", imageUrl, resp.StatusCode)
+			continue
+		}
+
+		outFile, err := w.Create(outputPath)
+		if err != nil {
+			resp.Body.Close()
+			return err
+		}
+		_, err = io.Copy(outFile, resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return fmt.Errorf("failed to write the emoji %s to the output archive: %w", name, err)
+		}
+	}
+
+	return nil
+}
+
+func fetchEmojiList(ctx context.Context, client *slackexport.Client) (map[string]string, error) {
+	verbosePrintln("Fetching custom emoji from Slack API")
+
+	emoji, err := client.Emoji(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	verbosePrintln(fmt.Sprintf("Fetched %d custom emoji from Slack API.", len(emoji)))
+	return emoji, nil
+}
@@ -0,0 +1,96 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+var (
+	pinsApiToken     string
+	pinsApiTokenFile string
+)
+
+var fetchPinsCmd = &cobra.Command{
+	Use:   "fetch-pins",
+	Short: "Fetch the pinned items of all the conversations accessible to the user",
+	RunE:  fetchPins,
+}
+
+func init() {
+	fetchPinsCmd.PersistentFlags().StringVar(&pinsApiToken, "api-token", "", "Slack API token, either a user token (xoxp-) or the bot token (xoxb-) of a Slack app. Defaults to the "+apiTokenEnvVar+" environment variable")
+	fetchPinsCmd.PersistentFlags().StringVar(&pinsApiTokenFile, "api-token-file", "", "path to a file containing the Slack API token, used if --api-token is not set")
+}
+
+// All the types of conversations whose pins are fetched.
+const pinsConversationTypes = "public_channel,private_channel,mpim,im"
+
+func fetchPins(cmd *cobra.Command, args []string) error {
+	token, err := resolveApiToken(pinsApiToken, pinsApiTokenFile, true)
+	if err != nil {
+		return err
+	}
+
+	client := newSlackClient(token)
+	ctx := cmd.Context()
+
+	err = checkTokenScopes(ctx, client, append(conversationTypesScopes(pinsConversationTypes), "pins:read")...)
+	if err != nil {
+		return err
+	}
+
+	// Open the input archive.
+	r, err := openInputArchive()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Open the output archive.
+	w, f, err := createOutputArchive()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	files, err := copyArchiveFiles(r, w)
+	if err != nil {
+		return err
+	}
+
+	if files["pins.json"] {
+		verbosePrintln("The file pins.json is already present in the dump, we don't fetch it again")
+	} else {
+		err = createPinsJson(ctx, w, client)
+		if err != nil {
+			return fmt.Errorf("failed to fetch pins: %w", err)
+		}
+	}
+
+	err = writeExportMetadata(ctx, r, w, cmd, client)
+	if err != nil {
+		return fmt.Errorf("failed to write the export metadata: %w", err)
+	}
+
+	// Close the output archive writer.
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close the output archive: %w", err)
+	}
+
+	return nil
+}
+
+// createPinsJson writes pins.json, mapping the ID of each conversation with
+// pinned items to the list of those items, as returned by pins.list: each of
+// them records when and by whom it was pinned, along with the pinned message
+// or file.
+func createPinsJson(ctx context.Context, w archiveWriter, client *slackexport.Client) error {
+	verbosePrintln("Creating pins.json by fetching pinned items.")
+	return createConversationsItemsJson(ctx, w, "pins.json", client, pinsConversationTypes, func(channelId string) ([]map[string]interface{}, error) {
+		return fetchConversationItems(ctx, client, "pins.list", "items", channelId)
+	})
+}
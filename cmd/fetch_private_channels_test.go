@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"net/url"
+	"path/filepath"
+	"testing"
+)
+
+func TestSharedPrivateChannelsInGroupsJson(t *testing.T) {
+	for _, includeShared := range []bool{false, true} {
+		slack := newFakeSlack(t)
+		slack.handle("conversations.list", func(url.Values) map[string]interface{} {
+			return map[string]interface{}{"channels": []interface{}{
+				map[string]interface{}{"id": "G00000001", "name": "local", "is_private": true},
+				map[string]interface{}{"id": "G00000002", "name": "connect", "is_private": true, "is_shared": true, "is_ext_shared": true},
+				map[string]interface{}{"id": "G00000003", "name": "grid", "is_private": true, "is_org_shared": true},
+			}}
+		})
+
+		input := writeTestArchive(t, map[string]string{"users.json": "[]"})
+		output := filepath.Join(t.TempDir(), "output.zip")
+		args := append(slack.args(), "--input-archive", input, "--output-archive", output, "fetch-private-channels", "--api-token", "xoxp-test")
+		if includeShared {
+			args = append(args, "--include-shared")
+		}
+		if out, err := runExporter(t, args...); err != nil {
+			t.Fatalf("fetch-private-channels failed: %v\n%s", err, out)
+		}
+
+		files := readTestArchive(t, output)
+		var groups []map[string]interface{}
+		decodeTestJson(t, "groups.json", files["groups.json"], &groups)
+		if len(groups) != 3 {
+			t.Fatalf("with --include-shared=%v, expected the 3 private channels in groups.json, got %d: %s", includeShared, len(groups), files["groups.json"])
+		}
+		for _, dir := range []string{"local", "connect", "grid"} {
+			if _, ok := files[dir+"/messages.json"]; !ok {
+				t.Errorf("with --include-shared=%v, the history of %s wasn't fetched", includeShared, dir)
+			}
+		}
+
+		expected := map[string][3]bool{
+			"local":   {false, false, false},
+			"connect": {true, true, false},
+			"grid":    {false, false, true},
+		}
+		for _, group := range groups {
+			name := group["name"].(string)
+			for i, field := range []string{"is_shared", "is_ext_shared", "is_org_shared"} {
+				value, present := group[field]
+				if !includeShared {
+					if present && value != expected[name][i] {
+						t.Errorf("%s of %s changed to %v", field, name, value)
+					}
+					continue
+				}
+				if value != expected[name][i] {
+					t.Errorf("with --include-shared, expected %s of %s to be %v, got %v", field, name, expected[name][i], value)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,29 @@
+package cmd
+
+import (
+	"github.com/spf13/cobra"
+)
+
+var fetchPublicChannelsCmd = &cobra.Command{
+	Use:   "fetch-public-channels",
+	Short: "Fetch all public channels accessible to the user",
+	Long:  "Fetch all public channels accessible to the user, as fetch-conversations --types public_channel --native-layout does.",
+	RunE: func(cmd *cobra.Command, args []string) error {
+		if !cmd.Flags().Changed("native-layout") {
+			nativeLayout = true
+		}
+		return fetchConversations(cmd, "public_channel")
+	},
+}
+
+func init() {
+	addFetchConversationsFlags(fetchPublicChannelsCmd, fetchConversationsHelp{
+		kind:         "public channel",
+		list:         "channels.json",
+		channelKind:  "public channel",
+		channelLists: "channels.json",
+	})
+	// Public channels are mostly added to Slack's own exports, which have
+	// them in their layout, so it is the default here.
+	fetchPublicChannelsCmd.PersistentFlags().Lookup("native-layout").DefValue = "true"
+}
@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/spf13/cobra"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+var (
+	scheduledApiToken     string
+	scheduledApiTokenFile string
+)
+
+var fetchScheduledCmd = &cobra.Command{
+	Use:   "fetch-scheduled-messages",
+	Short: "Fetch the messages scheduled by the user or the app of the token",
+	Long: `Fetch the messages scheduled to be posted later, and write them to scheduled.json, mapping the ID of each
+conversation with scheduled messages to the list of those messages.
+
+Slack only lists the messages scheduled by the user or the app the token belongs to, so the tokens of each user
+whose scheduled messages are needed have to be used in turn, topping up the previous archive each time. Drafts
+aren't available through the Slack API, and can't be fetched.`,
+	RunE: fetchScheduled,
+}
+
+func init() {
+	fetchScheduledCmd.PersistentFlags().StringVar(&scheduledApiToken, "api-token", "", "Slack API token, either a user token (xoxp-) or the bot token (xoxb-) of a Slack app. Defaults to the "+apiTokenEnvVar+" environment variable")
+	fetchScheduledCmd.PersistentFlags().StringVar(&scheduledApiTokenFile, "api-token-file", "", "path to a file containing the Slack API token, used if --api-token is not set")
+}
+
+// The file of the archive listing the scheduled messages.
+const scheduledFile = "scheduled.json"
+
+func fetchScheduled(cmd *cobra.Command, args []string) error {
+	token, err := resolveApiToken(scheduledApiToken, scheduledApiTokenFile, true)
+	if err != nil {
+		return err
+	}
+
+	client := newSlackClient(token)
+	ctx := cmd.Context()
+
+	// Open the input archive.
+	r, err := openInputArchive()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Open the output archive.
+	w, f, err := createOutputArchive()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The scheduled messages of the input archive, if any, are topped up
+	// with those of the token rather than copied unchanged.
+	scheduled := make(map[string][]map[string]interface{})
+	if _, err := readArchiveJson(r, scheduledFile, &scheduled); err != nil {
+		return err
+	}
+	_, err = copyArchiveFiles(r, w, scheduledFile)
+	if err != nil {
+		return err
+	}
+
+	err = fetchScheduledMessages(ctx, client, scheduled)
+	if err != nil {
+		return fmt.Errorf("failed to fetch scheduled messages: %w", err)
+	}
+	if len(scheduled) > 0 {
+		outFile, err := w.Create(scheduledFile)
+		if err != nil {
+			return err
+		}
+		enc := newJsonEncoder(outFile)
+		if err := enc.Encode(&scheduled); err != nil {
+			return err
+		}
+	}
+
+	err = writeExportMetadata(ctx, r, w, cmd, client)
+	if err != nil {
+		return fmt.Errorf("failed to write the export metadata: %w", err)
+	}
+
+	// Close the output archive writer.
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close the output archive: %w", err)
+	}
+
+	return nil
+}
+
+// fetchScheduledMessages adds the messages scheduled by the user or the app of
+// the token to those given, by the ID of the conversation they will be posted
+// to, leaving out those already there. Tokens which aren't allowed to list
+// scheduled messages are reported, and no message is added.
+func fetchScheduledMessages(ctx context.Context, client *slackexport.Client, scheduled map[string][]map[string]interface{}) error {
+	verbosePrintln("Fetching the scheduled messages.")
+	messages, err := client.ScheduledMessages(ctx)
+	var slackErr *slackexport.Error
+	if errors.As(err, &slackErr) && (slackErr.Code == "missing_scope" || slackErr.Code == "not_allowed_token_type") {
+		log.Printf("++++++ Couldn't fetch the scheduled messages, leaving them out: %s", err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	added := 0
+	for _, message := range messages {
+		channelId, _ := message["channel_id"].(string)
+		id, _ := message["id"].(string)
+		if channelId == "" || id == "" || containsScheduledMessage(scheduled[channelId], id) {
+			continue
+		}
+		scheduled[channelId] = append(scheduled[channelId], message)
+		added++
+	}
+	verbosePrintln(fmt.Sprintf("Found %d new scheduled messages, %d in total in %d conversations.", added, countScheduledMessages(scheduled), len(scheduled)))
+	return nil
+}
+
+// containsScheduledMessage returns whether the scheduled message with the given
+// ID is in the list.
+func containsScheduledMessage(messages []map[string]interface{}, id string) bool {
+	for _, message := range messages {
+		if message["id"] == id {
+			return true
+		}
+	}
+	return false
+}
+
+// countScheduledMessages returns the number of scheduled messages of all the
+// conversations.
+func countScheduledMessages(scheduled map[string][]map[string]interface{}) int {
+	count := 0
+	for _, messages := range scheduled {
+		count += len(messages)
+	}
+	return count
+}
@@ -0,0 +1,139 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/spf13/cobra"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+var (
+	starsApiToken     string
+	starsApiTokenFile string
+)
+
+var fetchStarsCmd = &cobra.Command{
+	Use:   "fetch-stars",
+	Short: "Fetch the items starred by the user of the token",
+	Long: `Fetch the messages, files and conversations starred by the user the token belongs to, and write them to
+stars.json, mapping the ID of the user to the list of their starred items.
+
+Stars belong to users, so this needs a user token (xoxp-): bots have none, and their tokens are skipped with a
+warning. Use the tokens of each user whose stars are needed in turn, topping up the previous archive each time.`,
+	RunE: fetchStars,
+}
+
+func init() {
+	fetchStarsCmd.PersistentFlags().StringVar(&starsApiToken, "api-token", "", "Slack API token of the user whose stars to fetch (xoxp-). Defaults to the "+apiTokenEnvVar+" environment variable")
+	fetchStarsCmd.PersistentFlags().StringVar(&starsApiTokenFile, "api-token-file", "", "path to a file containing the Slack API token, used if --api-token is not set")
+}
+
+// The file of the archive listing the starred items of users.
+const starsFile = "stars.json"
+
+func fetchStars(cmd *cobra.Command, args []string) error {
+	token, err := resolveApiToken(starsApiToken, starsApiTokenFile, true)
+	if err != nil {
+		return err
+	}
+
+	client := newSlackClient(token)
+	ctx := cmd.Context()
+
+	isBot := strings.HasPrefix(token, "xoxb-")
+	if !isBot {
+		err = checkTokenScopes(ctx, client, "stars:read")
+		if err != nil {
+			return err
+		}
+	}
+
+	// Open the input archive.
+	r, err := openInputArchive()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Open the output archive.
+	w, f, err := createOutputArchive()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The stars of the input archive, if any, are topped up with those of
+	// the user of the token rather than copied unchanged.
+	stars := make(map[string][]map[string]interface{})
+	if _, err := readArchiveJson(r, starsFile, &stars); err != nil {
+		return err
+	}
+	_, err = copyArchiveFiles(r, w, starsFile)
+	if err != nil {
+		return err
+	}
+
+	if isBot {
+		log.Print("++++++ Bots can't star items, so the stars of a bot token aren't fetched: use the user token of each user whose stars are needed")
+	} else if err := fetchUserStars(ctx, client, stars); err != nil {
+		return fmt.Errorf("failed to fetch stars: %w", err)
+	}
+	if len(stars) > 0 {
+		outFile, err := w.Create(starsFile)
+		if err != nil {
+			return err
+		}
+		enc := newJsonEncoder(outFile)
+		if err := enc.Encode(&stars); err != nil {
+			return err
+		}
+	}
+
+	err = writeExportMetadata(ctx, r, w, cmd, client)
+	if err != nil {
+		return fmt.Errorf("failed to write the export metadata: %w", err)
+	}
+
+	// Close the output archive writer.
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close the output archive: %w", err)
+	}
+
+	return nil
+}
+
+// fetchUserStars sets the starred items of the user of the token in those
+// given, by the ID of their user, replacing the ones the user had. Tokens
+// which Slack doesn't allow to list stars, or which lack the stars:read scope,
+// are reported, and no star is added.
+func fetchUserStars(ctx context.Context, client *slackexport.Client, stars map[string][]map[string]interface{}) error {
+	auth, err := client.AuthTest(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find out the user of the token: %w", err)
+	}
+
+	verbosePrintln("Fetching the stars of " + auth.User + ".")
+	items, err := client.Stars(ctx)
+	var slackErr *slackexport.Error
+	if errors.As(err, &slackErr) && (slackErr.Code == "not_allowed_token_type" || slackErr.Code == "missing_scope") {
+		log.Printf("++++++ Couldn't fetch the stars of %s, leaving them out: %s", auth.User, err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if len(items) > 0 {
+		stars[auth.UserId] = items
+	} else {
+		delete(stars, auth.UserId)
+	}
+	verbosePrintln(fmt.Sprintf("Found %d starred items of %s.", len(items), auth.User))
+	return nil
+}
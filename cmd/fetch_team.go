@@ -0,0 +1,105 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/spf13/cobra"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+var (
+	teamApiToken     string
+	teamApiTokenFile string
+)
+
+var fetchTeamCmd = &cobra.Command{
+	Use:   "fetch-team",
+	Short: "Fetch the information of the workspace and add it to the output archive",
+	RunE:  fetchTeam,
+}
+
+func init() {
+	fetchTeamCmd.PersistentFlags().StringVar(&teamApiToken, "api-token", "", "Slack API token, either a user token (xoxp-) or the bot token (xoxb-) of a Slack app. Defaults to the "+apiTokenEnvVar+" environment variable")
+	fetchTeamCmd.PersistentFlags().StringVar(&teamApiTokenFile, "api-token-file", "", "path to a file containing the Slack API token, used if --api-token is not set")
+}
+
+func fetchTeam(cmd *cobra.Command, args []string) error {
+	token, err := resolveApiToken(teamApiToken, teamApiTokenFile, true)
+	if err != nil {
+		return err
+	}
+
+	client := newSlackClient(token)
+	ctx := cmd.Context()
+
+	err = checkTokenScopes(ctx, client, "team:read")
+	if err != nil {
+		return err
+	}
+
+	// Open the input archive.
+	r, err := openInputArchive()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Open the output archive.
+	w, f, err := createOutputArchive()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	files, err := copyArchiveFiles(r, w)
+	if err != nil {
+		return err
+	}
+
+	if files["team.json"] {
+		verbosePrintln("The file team.json is already present in the dump, we don't fetch it again")
+	} else {
+		err = createTeamJson(ctx, w, client)
+		if err != nil {
+			return fmt.Errorf("failed to fetch the team: %w", err)
+		}
+	}
+
+	err = writeExportMetadata(ctx, r, w, cmd, client)
+	if err != nil {
+		return fmt.Errorf("failed to write the export metadata: %w", err)
+	}
+
+	// Close the output archive writer.
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close the output archive: %w", err)
+	}
+
+	return nil
+}
+
+// createTeamJson writes team.json, holding the workspace as returned by
+// team.info, with its ID, name, domain and icon among others.
+func createTeamJson(ctx context.Context, w archiveWriter, client *slackexport.Client) error {
+	verbosePrintln("Creating team.json by fetching the team.")
+
+	team, err := fetchTeamInfo(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	outFile, err := w.Create("team.json")
+	if err != nil {
+		return err
+	}
+	enc := newJsonEncoder(outFile)
+	return enc.Encode(&team)
+}
+
+func fetchTeamInfo(ctx context.Context, client *slackexport.Client) (map[string]interface{}, error) {
+	verbosePrintln("Fetching the team from Slack API")
+	return client.TeamInfo(ctx)
+}
@@ -0,0 +1,149 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	threadApiToken     string
+	threadApiTokenFile string
+	threadOutputFile   string
+)
+
+var fetchThreadCmd = &cobra.Command{
+	Use:   "fetch-thread (PERMALINK | CHANNEL TS)",
+	Short: "Fetch a single thread into a standalone JSON file, without reading or writing an archive",
+	Long: `Fetch the root message and the replies of a single thread into a standalone JSON file, as they would be found
+in the replies.json of the conversation in an export.
+
+The thread is given either by the permalink of its root message or of one of its replies, as copied from Slack,
+such as https://team.slack.com/archives/C0123/p1700000000123456, or by the ID of the conversation and the
+timestamp of its root message, such as C0123 1700000000.123456.`,
+	Args: cobra.RangeArgs(1, 2),
+	// Neither the input archive nor the output archive are needed.
+	Annotations: map[string]string{archivesAnnotation: archivesNone},
+	RunE:        fetchThread,
+}
+
+func init() {
+	fetchThreadCmd.PersistentFlags().StringVar(&threadApiToken, "api-token", "", "Slack API token, either a user token (xoxp-) or the bot token (xoxb-) of a Slack app. Defaults to the "+apiTokenEnvVar+" environment variable")
+	fetchThreadCmd.PersistentFlags().StringVar(&threadApiTokenFile, "api-token-file", "", "path to a file containing the Slack API token, used if --api-token is not set")
+	fetchThreadCmd.PersistentFlags().StringVar(&threadOutputFile, "output-file", "", "the path of the JSON file to write the thread to, or - for the standard output. Defaults to <channel ID>-<timestamp>.json")
+}
+
+func fetchThread(cmd *cobra.Command, args []string) error {
+	channelId, ts, err := parseThreadArgs(args)
+	if err != nil {
+		return err
+	}
+
+	token, err := resolveApiToken(threadApiToken, threadApiTokenFile, true)
+	if err != nil {
+		return err
+	}
+
+	// The scope needed to read the thread depends on the type of the
+	// conversation, which isn't known until it is read, so Slack's own error
+	// says which is missing instead.
+	client := newSlackClient(token)
+	ctx := cmd.Context()
+
+	outputFile := threadOutputFile
+	if outputFile == "" {
+		outputFile = channelId + "-" + ts + ".json"
+	}
+
+	var output io.Writer = os.Stdout
+	var f *os.File
+	if outputFile != "-" {
+		f, err = os.Create(outputFile)
+		if err != nil {
+			return fmt.Errorf("could not open the output file for writing %s: %w", outputFile, err)
+		}
+		defer f.Close()
+		output = f
+	}
+
+	verbosePrintln(fmt.Sprintf("Fetching the thread %s of conversation %s", ts, channelId), "channel", channelId, "timestamp", ts)
+	replies, err := fetchChannelReplies(ctx, output, client, nil, channelId, []string{ts})
+	if err != nil {
+		// Leave no half-written file behind.
+		if f != nil {
+			f.Close()
+			os.Remove(outputFile)
+		}
+		return fmt.Errorf("failed to fetch the thread: %w", err)
+	}
+
+	if f != nil {
+		if err := f.Close(); err != nil {
+			return fmt.Errorf("failed to write the output file %s: %w", outputFile, err)
+		}
+		statusPrintf("Done: wrote the thread %s of conversation %s, with %d replies, to %s.\n", ts, channelId, replies, outputFile)
+	}
+	return nil
+}
+
+// The path of the permalink of a message, such as /archives/C0123/p1700000000123456.
+var permalinkPath = regexp.MustCompile(`^/archives/([A-Z0-9]+)/p([0-9]{7,})$`)
+
+// parseThreadArgs returns the ID of the conversation and the timestamp of the
+// root message of the thread given on the command line, either as a permalink
+// or as a conversation ID and a timestamp.
+func parseThreadArgs(args []string) (string, string, error) {
+	if len(args) == 2 {
+		ts, err := parseMessageTs(args[1])
+		if err != nil {
+			return "", "", err
+		}
+		return args[0], ts, nil
+	}
+
+	permalink, err := url.Parse(args[0])
+	if err != nil || permalink.Host == "" {
+		return "", "", errors.New("expected either the permalink of a message, or the ID of a conversation followed by the timestamp of the root message of the thread")
+	}
+	match := permalinkPath.FindStringSubmatch(permalink.Path)
+	if match == nil {
+		return "", "", fmt.Errorf("%s isn't the permalink of a message, such as https://team.slack.com/archives/C0123/p1700000000123456", args[0])
+	}
+
+	channelId, ts := match[1], permalinkTs(match[2])
+	// The permalinks of replies point to the root of their thread with
+	// thread_ts.
+	if threadTs := permalink.Query().Get("thread_ts"); threadTs != "" {
+		ts, err = parseMessageTs(threadTs)
+		if err != nil {
+			return "", "", err
+		}
+	}
+	return channelId, ts, nil
+}
+
+var messageTsPattern = regexp.MustCompile(`^[0-9]+\.[0-9]+$`)
+
+// parseMessageTs checks the timestamp of a message, which may also be given as
+// in permalinks, such as p1700000000123456.
+func parseMessageTs(value string) (string, error) {
+	if digits := strings.TrimPrefix(value, "p"); digits != value && len(digits) > 6 && strings.Trim(digits, "0123456789") == "" {
+		return permalinkTs(digits), nil
+	}
+	if !messageTsPattern.MatchString(value) {
+		return "", fmt.Errorf("invalid message timestamp %s, expected one such as 1700000000.123456", value)
+	}
+	return value, nil
+}
+
+// permalinkTs returns the timestamp of a message from its digits in a
+// permalink, which leave out the dot before the last six.
+func permalinkTs(digits string) string {
+	return digits[:len(digits)-6] + "." + digits[len(digits)-6:]
+}
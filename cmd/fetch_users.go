@@ -0,0 +1,177 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/spf13/cobra"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+var (
+	usersApiToken     string
+	usersApiTokenFile string
+	// These only apply to fetch-users, and stay unset for other commands.
+	usersFullProfiles bool
+	usersPresence     bool
+)
+
+var fetchUsersCmd = &cobra.Command{
+	Use:   "fetch-users",
+	Short: "Fetch all users and write them to users.json, replacing any existing one",
+	RunE:  fetchUsers,
+}
+
+func init() {
+	fetchUsersCmd.PersistentFlags().StringVar(&usersApiToken, "api-token", "", "Slack API token, either a user token (xoxp-) or the bot token (xoxb-) of a Slack app. Defaults to the "+apiTokenEnvVar+" environment variable")
+	fetchUsersCmd.PersistentFlags().StringVar(&usersApiTokenFile, "api-token-file", "", "path to a file containing the Slack API token, used if --api-token is not set")
+	fetchUsersCmd.PersistentFlags().BoolVar(&usersFullProfiles, "full-profiles", false, "fetch each user's full profile, including custom profile fields. This makes one extra request per user")
+	fetchUsersCmd.PersistentFlags().BoolVar(&usersPresence, "presence", false, "fetch each user's presence. This makes one extra request per user")
+}
+
+func fetchUsers(cmd *cobra.Command, args []string) error {
+	token, err := resolveApiToken(usersApiToken, usersApiTokenFile, true)
+	if err != nil {
+		return err
+	}
+
+	client := newSlackClient(token)
+	ctx := cmd.Context()
+
+	requiredScopes := []string{"users:read"}
+	if usersFullProfiles {
+		requiredScopes = append(requiredScopes, "users.profile:read")
+	}
+	err = checkTokenScopes(ctx, client, requiredScopes...)
+	if err != nil {
+		return err
+	}
+
+	// Open the input archive.
+	r, err := openInputArchive()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	// Open the output archive.
+	w, f, err := createOutputArchive()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The existing users.json is replaced by the one we fetch.
+	_, err = copyArchiveFiles(r, w, "users.json")
+	if err != nil {
+		return err
+	}
+
+	outFile, err := w.Create("users.json")
+	if err != nil {
+		return err
+	}
+	err = createUsersJson(ctx, outFile, client)
+	if err != nil {
+		return fmt.Errorf("failed to fetch users: %w", err)
+	}
+
+	err = writeExportMetadata(ctx, r, w, cmd, client)
+	if err != nil {
+		return fmt.Errorf("failed to write the export metadata: %w", err)
+	}
+
+	// Close the output archive writer.
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close the output archive: %w", err)
+	}
+
+	return nil
+}
+
+func createUsersJson(ctx context.Context, output io.Writer, client *slackexport.Client) error {
+	verbosePrintln("Creating users.json by fetching users.")
+
+	users, err := fetchUsersList(ctx, client)
+	if err != nil {
+		return err
+	}
+
+	if usersFullProfiles || usersPresence {
+		err = enrichUsers(ctx, users, client)
+		if err != nil {
+			return err
+		}
+	}
+
+	enc := newJsonEncoder(output)
+	return enc.Encode(&users)
+}
+
+func fetchUsersList(ctx context.Context, client *slackexport.Client) ([]map[string]interface{}, error) {
+	verbosePrintln("Fetching users from Slack API")
+
+	res, err := client.Users(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	verbosePrintln("Fetched all users from Slack API.")
+	return res, nil
+}
+
+// enrichUsers adds the full profile and/or the presence of each user to their
+// entry, as requested on the command line. Full profiles are merged into the
+// standard "profile" object, so that the users stay in the export's format.
+func enrichUsers(ctx context.Context, users []map[string]interface{}, client *slackexport.Client) error {
+	// Users are looked up once each, even if listed several times.
+	profiles := make(map[string]map[string]interface{})
+	presences := make(map[string]string)
+
+	for _, user := range users {
+		userId, ok := user["id"].(string)
+		if !ok {
+			continue
+		}
+
+		if usersFullProfiles {
+			fullProfile, cached := profiles[userId]
+			if !cached {
+				verbosePrintln("Fetching the full profile of user " + userId)
+				var err error
+				fullProfile, err = client.UserProfile(ctx, userId)
+				if err != nil {
+					return err
+				}
+				profiles[userId] = fullProfile
+			}
+
+			profile, ok := user["profile"].(map[string]interface{})
+			if !ok {
+				profile = make(map[string]interface{})
+				user["profile"] = profile
+			}
+			for key, value := range fullProfile {
+				profile[key] = value
+			}
+		}
+
+		if usersPresence {
+			presence, cached := presences[userId]
+			if !cached {
+				verbosePrintln("Fetching the presence of user " + userId)
+				var err error
+				presence, err = client.UserPresence(ctx, userId)
+				if err != nil {
+					return err
+				}
+				presences[userId] = presence
+			}
+			user["presence"] = presence
+		}
+	}
+	return nil
+}
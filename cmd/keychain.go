@@ -0,0 +1,47 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// The name of the item of the system's credential store holding the API
+// token, given with --token-keychain.
+var tokenKeychain string
+
+// readKeychainToken returns the API token stored under the given name in the
+// system's credential store: the Keychain on macOS, or the Secret Service on
+// Linux, such as GNOME Keyring or KWallet.
+func readKeychainToken(name string) (string, error) {
+	token, err := lookupKeychainToken(name)
+	if err != nil {
+		return "", fmt.Errorf("could not read the API token %s from the %s: %w", name, keychainName, err)
+	}
+	token = strings.TrimSpace(token)
+	if token == "" {
+		return "", fmt.Errorf("the API token %s of the %s is empty", name, keychainName)
+	}
+	return token, nil
+}
+
+// runKeychainTool runs the command line tool of the credential store, and
+// returns what it printed, or the error it printed if it failed.
+func runKeychainTool(name string, args ...string) (string, error) {
+	if _, err := exec.LookPath(name); err != nil {
+		return "", fmt.Errorf("%s, which reads it, isn't installed", name)
+	}
+	out, err := exec.Command(name, args...).Output()
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		if msg := strings.TrimSpace(string(exitErr.Stderr)); msg != "" {
+			return "", fmt.Errorf("%s failed: %s", name, msg)
+		}
+		return "", fmt.Errorf("%s failed with %s, the token may not be there", name, exitErr)
+	}
+	if err != nil {
+		return "", err
+	}
+	return string(out), nil
+}
@@ -0,0 +1,10 @@
+package cmd
+
+// The credential store the API token is read from with --token-keychain.
+const keychainName = "Keychain"
+
+// lookupKeychainToken returns the password of the generic password item of
+// the Keychain whose service is the given name.
+func lookupKeychainToken(name string) (string, error) {
+	return runKeychainTool("security", "find-generic-password", "-s", name, "-w")
+}
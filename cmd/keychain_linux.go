@@ -0,0 +1,11 @@
+package cmd
+
+// The credential store the API token is read from with --token-keychain.
+const keychainName = "Secret Service"
+
+// lookupKeychainToken returns the secret of the Secret Service whose service
+// attribute is the given name, through secret-tool, the command line tool of
+// libsecret.
+func lookupKeychainToken(name string) (string, error) {
+	return runKeychainTool("secret-tool", "lookup", "service", name)
+}
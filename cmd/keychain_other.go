@@ -0,0 +1,17 @@
+//go:build !darwin && !linux
+
+package cmd
+
+import (
+	"errors"
+	"runtime"
+)
+
+// The credential store the API token is read from with --token-keychain.
+const keychainName = "system's credential store"
+
+// lookupKeychainToken fails, as the credential stores of the other systems
+// aren't supported.
+func lookupKeychainToken(name string) (string, error) {
+	return "", errors.New("--token-keychain is only supported on macOS and Linux, not on " + runtime.GOOS + ": use --api-token-file or the " + apiTokenEnvVar + " environment variable instead")
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Whether to report the rate limits observed once the command is done, with
+// --report-limits.
+var reportLimits bool
+
+// The rate limit tiers Slack documents for the methods the commands call, as
+// a hint for --requests-per-minute. Tier 2 allows about 20 requests per
+// minute, Tier 3 about 50 and Tier 4 about 100.
+var methodTiers = map[string]int{
+	"bookmarks.list":              3,
+	"chat.scheduledMessages.list": 3,
+	"conversations.history":       3,
+	"conversations.info":          3,
+	"conversations.list":          2,
+	"conversations.members":       4,
+	"conversations.replies":       3,
+	"emoji.list":                  2,
+	"files.list":                  3,
+	"pins.list":                   2,
+	"reactions.get":               3,
+	"team.info":                   3,
+	"users.getPresence":           3,
+	"users.info":                  4,
+	"users.list":                  2,
+	"users.profile.get":           4,
+}
+
+// The rate limits observed for one method of the Slack API.
+type methodLimits struct {
+	calls       int
+	rateLimited int
+	// The longest Retry-After Slack asked for.
+	maxRetryAfter time.Duration
+	first, last   time.Time
+	// The last value of each of the headers about rate limits Slack
+	// returned, by name.
+	headers map[string]string
+}
+
+var (
+	limitsMutex sync.Mutex
+	// The rate limits observed, by method.
+	observedLimits = make(map[string]*methodLimits)
+)
+
+// observeRateLimits records the rate limits of the response to a request made
+// to the Slack API, for --report-limits. Downloads of files aren't recorded,
+// as they aren't rate limited the same way. With --verbose, each Retry-After
+// Slack asks for is printed as it happens.
+func observeRateLimits(req *http.Request, resp *http.Response) {
+	if resp == nil || !strings.HasPrefix(req.URL.String(), strings.TrimSuffix(apiBaseUrl, "/")+"/") {
+		return
+	}
+	method := path.Base(req.URL.Path)
+
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+	limits, ok := observedLimits[method]
+	if !ok {
+		limits = &methodLimits{first: time.Now(), headers: make(map[string]string)}
+		observedLimits[method] = limits
+	}
+	limits.calls++
+	limits.last = time.Now()
+
+	for name, values := range resp.Header {
+		if lower := strings.ToLower(name); strings.Contains(lower, "ratelimit") || lower == "retry-after" {
+			limits.headers[name] = strings.Join(values, ", ")
+		}
+	}
+
+	if resp.StatusCode == http.StatusTooManyRequests {
+		limits.rateLimited++
+		retryAfter := resp.Header.Get("Retry-After")
+		if seconds, err := strconv.Atoi(retryAfter); err == nil && time.Duration(seconds)*time.Second > limits.maxRetryAfter {
+			limits.maxRetryAfter = time.Duration(seconds) * time.Second
+		}
+		verbosePrintln(fmt.Sprintf("Rate limited by Slack API on %s, which asked to wait %s seconds", method, retryAfter), "url", req.URL.Path, "retry_after", retryAfter)
+	}
+}
+
+// reportRateLimits reports the rate limits observed for each method called,
+// with --report-limits, along with a hint for --requests-per-minute.
+func reportRateLimits() {
+	if !reportLimits {
+		return
+	}
+
+	limitsMutex.Lock()
+	defer limitsMutex.Unlock()
+	if len(observedLimits) == 0 {
+		return
+	}
+
+	methods := make([]string, 0, len(observedLimits))
+	rateLimited := 0
+	for method, limits := range observedLimits {
+		methods = append(methods, method)
+		rateLimited += limits.rateLimited
+	}
+	sort.Strings(methods)
+
+	if !jsonLogging {
+		fmt.Fprintln(os.Stderr, "Rate limits observed:")
+	}
+	for _, method := range methods {
+		limits := observedLimits[method]
+		// The rate is only meaningful over a few requests.
+		perMinute := 0.0
+		if elapsed := limits.last.Sub(limits.first); limits.calls > 1 && elapsed > 0 {
+			perMinute = float64(limits.calls-1) / elapsed.Minutes()
+		}
+		tier := methodTiers[method]
+
+		if jsonLogging {
+			slog.Info("Rate limits", "event", "limits", "method", method, "calls", limits.calls, "per_minute", perMinute,
+				"rate_limited", limits.rateLimited, "max_retry_after", limits.maxRetryAfter.Seconds(), "tier", tier, "headers", limits.headers)
+			continue
+		}
+		line := fmt.Sprintf("  %s: %d requests", method, limits.calls)
+		if perMinute > 0 {
+			line += fmt.Sprintf(", %.1f per minute", perMinute)
+		}
+		if tier > 0 {
+			line += fmt.Sprintf(", Tier %d", tier)
+		}
+		if limits.rateLimited > 0 {
+			line += fmt.Sprintf(", rate limited %d times, waiting up to %s", limits.rateLimited, limits.maxRetryAfter)
+		}
+		fmt.Fprintln(os.Stderr, line)
+
+		names := make([]string, 0, len(limits.headers))
+		for name := range limits.headers {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			fmt.Fprintf(os.Stderr, "    %s: %s\n", name, limits.headers[name])
+		}
+	}
+
+	if jsonLogging {
+		return
+	}
+	switch {
+	case rateLimited > 0:
+		fmt.Fprintf(os.Stderr, "Slack rate limited %d requests: lower --requests-per-minute or --concurrency to avoid waiting.\n", rateLimited)
+	case requestsPerMinute > 0:
+		fmt.Fprintf(os.Stderr, "No request was rate limited at --requests-per-minute %d: it can be raised towards the tiers of the methods called to go faster (Tier 2: about 20, Tier 3: about 50, Tier 4: about 100).\n", requestsPerMinute)
+	}
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+var (
+	listChannelsApiToken        string
+	listChannelsApiTokenFile    string
+	listChannelsTypes           string
+	listChannelsExcludeArchived bool
+	listChannelsFormat          string
+)
+
+var listChannelsCmd = &cobra.Command{
+	Use:   "list-channels",
+	Short: "List the conversations accessible to the user, without fetching them or writing an archive",
+	// Neither the input archive nor the output archive are needed.
+	Annotations: map[string]string{archivesAnnotation: archivesNone},
+	RunE:        listChannels,
+}
+
+func init() {
+	listChannelsCmd.PersistentFlags().StringVar(&listChannelsApiToken, "api-token", "", "Slack API token, either a user token (xoxp-) or the bot token (xoxb-) of a Slack app. Defaults to the "+apiTokenEnvVar+" environment variable")
+	listChannelsCmd.PersistentFlags().StringVar(&listChannelsApiTokenFile, "api-token-file", "", "path to a file containing the Slack API token, used if --api-token is not set")
+	listChannelsCmd.PersistentFlags().StringVar(&listChannelsTypes, "types", "public_channel,private_channel,mpim,im", "the comma-separated types of the conversations to list, among public_channel, private_channel, mpim and im")
+	listChannelsCmd.PersistentFlags().BoolVar(&listChannelsExcludeArchived, "exclude-archived", false, "leave out the conversations which have been archived")
+	listChannelsCmd.PersistentFlags().StringVar(&listChannelsFormat, "format", "table", "how to print the conversations: table, or json for a JSON array")
+}
+
+// A conversation as printed by list-channels.
+type listedChannel struct {
+	Id         string `json:"id"`
+	Name       string `json:"name"`
+	Type       string `json:"type"`
+	NumMembers *int   `json:"num_members,omitempty"`
+	IsArchived bool   `json:"is_archived"`
+}
+
+func listChannels(cmd *cobra.Command, args []string) error {
+	if listChannelsFormat != "table" && listChannelsFormat != "json" {
+		return fmt.Errorf("unknown format %s, expected table or json", listChannelsFormat)
+	}
+
+	token, err := resolveApiToken(listChannelsApiToken, listChannelsApiTokenFile, true)
+	if err != nil {
+		return err
+	}
+
+	client := newSlackClient(token)
+	ctx := cmd.Context()
+
+	err = checkTokenScopes(ctx, client, conversationTypesScopes(listChannelsTypes)...)
+	if err != nil {
+		return err
+	}
+
+	channels, err := fetchListedChannels(ctx, client)
+	if err != nil {
+		return fmt.Errorf("failed to list conversations: %w", err)
+	}
+
+	if listChannelsFormat == "json" {
+		enc := newJsonEncoder(os.Stdout)
+		return enc.Encode(&channels)
+	}
+	return printChannelsTable(os.Stdout, channels)
+}
+
+// fetchListedChannels returns the conversations of the types asked for,
+// sorted by type and name.
+func fetchListedChannels(ctx context.Context, client *slackexport.Client) ([]listedChannel, error) {
+	conversations, err := fetchConversationsList(ctx, client, listChannelsTypes, listChannelsExcludeArchived)
+	if err != nil {
+		return nil, err
+	}
+
+	channels := make([]listedChannel, 0, len(conversations))
+	for _, conversation := range conversations {
+		channel := listedChannel{Type: conversationType(conversation)}
+		channel.Id, _ = conversation["id"].(string)
+		channel.Name, _ = conversation["name"].(string)
+		if channel.Name == "" {
+			// Direct messages have no name, only the user on the other
+			// end.
+			channel.Name, _ = conversation["user"].(string)
+		}
+		channel.IsArchived, _ = conversation["is_archived"].(bool)
+		if numMembers, ok := conversation["num_members"].(float64); ok {
+			n := int(numMembers)
+			channel.NumMembers = &n
+		}
+		channels = append(channels, channel)
+	}
+	sort.SliceStable(channels, func(i, j int) bool {
+		if channels[i].Type != channels[j].Type {
+			return channels[i].Type < channels[j].Type
+		}
+		return channels[i].Name < channels[j].Name
+	})
+	return channels, nil
+}
+
+// conversationType returns the type of the conversation, as given to
+// conversations.list.
+func conversationType(conversation map[string]interface{}) string {
+	for _, conversationType := range []string{"im", "mpim"} {
+		if is, _ := conversation["is_"+conversationType].(bool); is {
+			return conversationType
+		}
+	}
+	if private, _ := conversation["is_private"].(bool); private {
+		return "private_channel"
+	}
+	return "public_channel"
+}
+
+func printChannelsTable(output io.Writer, channels []listedChannel) error {
+	tw := tabwriter.NewWriter(output, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tNAME\tTYPE\tMEMBERS\tARCHIVED")
+	for _, channel := range channels {
+		members := "-"
+		if channel.NumMembers != nil {
+			members = fmt.Sprintf("%d", *channel.NumMembers)
+		}
+		archived := ""
+		if channel.IsArchived {
+			archived = "yes"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", channel.Id, channel.Name, channel.Type, members, archived)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	fmt.Fprintf(output, "Found %d conversations.\n", len(channels))
+	return nil
+}
@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Whether log lines are written as JSON objects, rather than as plain text.
+var jsonLogging bool
+
+// Whether to print nothing but warnings and errors, with --quiet.
+var quiet bool
+
+// setupLogging configures the output of the logs according to --log-format.
+//
+// With the json format, every line goes through log/slog: the progress printed
+// with verbosePrintln at the debug level, and the failures reported with the
+// log package, which the exporter skips over, at the warning level. With
+// --quiet, only the warnings and errors are written.
+func setupLogging() error {
+	switch logFormat {
+	case "text":
+		return nil
+	case "json":
+		level := slog.LevelInfo
+		if verbosity > 0 {
+			level = slog.LevelDebug
+		} else if quiet {
+			level = slog.LevelWarn
+		}
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+		// This has to come after slog.SetDefault, which redirects the log
+		// package itself.
+		log.SetFlags(0)
+		log.SetOutput(slogWarningWriter{})
+		jsonLogging = true
+		return nil
+	default:
+		return fmt.Errorf("unknown log format %s, expected text or json", logFormat)
+	}
+}
+
+// slogWarningWriter logs each line written to it as a warning.
+type slogWarningWriter struct{}
+
+func (slogWarningWriter) Write(p []byte) (int, error) {
+	message := strings.TrimSpace(strings.TrimPrefix(string(p), "++++++ "))
+	slog.Warn(message)
+	return len(p), nil
+}
@@ -0,0 +1,165 @@
+package cmd
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"regexp"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+// Whether to rewrite the mentions in the text of messages with the names of
+// the users and channels they refer to.
+var resolveMentions bool
+
+// The names of the users and conversations mentions are resolved to, by ID,
+// or nil when mentions aren't resolved. It is set before fetching starts, and
+// then only added to from the goroutine writing the archive.
+var mentionNames map[string]string
+
+// Mentions in the text of messages, such as <@U12345>, <#C12345|general> or
+// <!here>, with an optional label after the pipe.
+var mentionPattern = regexp.MustCompile(`<([@#!])([^>|]+)(?:\|([^>]*))?>`)
+
+// setupMentionNames collects the names of the users and conversations of the
+// input archive when resolving mentions, fetching the users from Slack if the
+// input archive doesn't have them.
+func setupMentionNames(ctx context.Context, r *zip.ReadCloser, client *slackexport.Client) error {
+	if !resolveMentions {
+		return nil
+	}
+	mentionNames = make(map[string]string)
+
+	users, err := workspaceUsers(ctx, r, client)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the users to resolve mentions: %w", err)
+	}
+	for _, user := range users {
+		id, _ := user["id"].(string)
+		if name := userDisplayName(user); id != "" && name != "" {
+			mentionNames[id] = name
+		}
+	}
+
+	for _, fileName := range channelListFiles {
+		var conversations []map[string]interface{}
+		if _, err := readArchiveJson(r, fileName, &conversations); err != nil {
+			return err
+		}
+		addMentionConversations(conversations)
+	}
+	return nil
+}
+
+// The users of the workspace, once read by workspaceUsers.
+var cachedWorkspaceUsers []map[string]interface{}
+
+// workspaceUsers returns the users of the workspace, from the users.json of
+// the input archive, or fetched from Slack if it has none. They are only read
+// or fetched once, for both --resolve-mentions and --include-external-users.
+func workspaceUsers(ctx context.Context, r *zip.ReadCloser, client *slackexport.Client) ([]map[string]interface{}, error) {
+	if cachedWorkspaceUsers != nil {
+		return cachedWorkspaceUsers, nil
+	}
+	var users []map[string]interface{}
+	found, err := readArchiveJson(r, "users.json", &users)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		verbosePrintln("The input archive has no users.json, fetching the users")
+		users, err = fetchUsersList(ctx, client)
+		if err != nil {
+			return nil, err
+		}
+	}
+	cachedWorkspaceUsers = users
+	return users, nil
+}
+
+// userDisplayName returns the name a user goes by in Slack: their display
+// name if they have one, and otherwise their full name or user name.
+func userDisplayName(user map[string]interface{}) string {
+	profile, _ := user["profile"].(map[string]interface{})
+	for _, name := range []interface{}{profile["display_name"], user["real_name"], profile["real_name"], user["name"]} {
+		if name, _ := name.(string); name != "" {
+			return name
+		}
+	}
+	return ""
+}
+
+// addMentionConversations adds the names of the conversations to those
+// mentions are resolved to, when resolving them.
+func addMentionConversations(conversations []map[string]interface{}) {
+	if mentionNames == nil {
+		return
+	}
+	for _, conversation := range conversations {
+		id, _ := conversation["id"].(string)
+		if name, _ := conversation["name"].(string); id != "" && name != "" {
+			mentionNames[id] = name
+		}
+	}
+}
+
+// resolveMentionsInFiles rewrites the text of each message of the files of a
+// conversation with the names of the users and conversations it mentions,
+// keeping the original text in raw_text. Files which had their mentions
+// resolved already, such as those of an input archive being topped up, are
+// resolved again from their raw_text. The messages are rewritten one at a
+// time.
+func resolveMentionsInFiles(files []*conversationFile) error {
+	if mentionNames == nil {
+		return nil
+	}
+	for _, file := range files {
+		err := file.rewriteMessages(func(message map[string]interface{}) error {
+			raw, ok := message["raw_text"].(string)
+			if !ok {
+				raw, ok = message["text"].(string)
+			}
+			if ok && mentionPattern.MatchString(raw) {
+				message["raw_text"] = raw
+				message["text"] = resolveMentionsInText(raw)
+			}
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't resolve the mentions of %s: %w", file.name, err)
+		}
+	}
+	return nil
+}
+
+// resolveMentionsInText replaces the mentions of users and conversations in
+// the text with @ or # followed by their names, and special mentions such as
+// <!here> with @here. Mentions of unknown users or conversations are replaced
+// with their label if they have one, and otherwise left as they are.
+func resolveMentionsInText(text string) string {
+	return mentionPattern.ReplaceAllStringFunc(text, func(mention string) string {
+		parts := mentionPattern.FindStringSubmatch(mention)
+		kind, id, label := parts[1], parts[2], parts[3]
+
+		if kind == "!" {
+			// Special mentions, such as <!here> or <!subteam^S123|@team>.
+			if label != "" {
+				return label
+			}
+			return "@" + id
+		}
+
+		prefix := "#"
+		if kind == "@" {
+			prefix = "@"
+		}
+		if name, ok := mentionNames[id]; ok {
+			return prefix + name
+		}
+		if label != "" {
+			return prefix + label
+		}
+		return mention
+	})
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestResolveMentionsInFiles(t *testing.T) {
+	defer func(names map[string]string) { mentionNames = names }(mentionNames)
+	mentionNames = map[string]string{"U00000001": "Alice", "C00000001": "general"}
+
+	file, err := newConversationFile("messages.json", []byte(`[
+		{"ts": "1", "text": "hi <@U00000001>, see <#C00000001> and <@U00000009|bob>, <!here>"},
+		{"ts": "2", "text": "no mentions"},
+		{"ts": "3", "raw_text": "again <@U00000001>", "text": "again @Ali"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.remove()
+	if err := resolveMentionsInFiles([]*conversationFile{file}); err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []map[string]interface{}
+	if err := file.decode(&messages); err != nil {
+		t.Fatal(err)
+	}
+	expected := []struct{ text, raw interface{} }{
+		{"hi @Alice, see #general and @bob, @here", "hi <@U00000001>, see <#C00000001> and <@U00000009|bob>, <!here>"},
+		{"no mentions", nil},
+		{"again @Alice", "again <@U00000001>"},
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("expected %d messages, got %v", len(expected), messages)
+	}
+	for i, message := range messages {
+		if message["text"] != expected[i].text || message["raw_text"] != expected[i].raw {
+			t.Errorf("expected the text %q and the raw text %v, got %q and %v", expected[i].text, expected[i].raw, message["text"], message["raw_text"])
+		}
+	}
+}
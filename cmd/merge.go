@@ -0,0 +1,277 @@
+package cmd
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"time"
+)
+
+// A conversation as found in the input archive, which --merge tops up with
+// the messages posted since it was exported.
+type conversationBase struct {
+	files []*conversationFile
+	// The timestamp of the newest message found in the files.
+	latest string
+	// The timestamps of the thread roots found in the files, whose replies
+	// are fetched again with --incremental.
+	threads []string
+}
+
+// The conversations being topped up, by conversation ID. It is set before
+// fetching starts, and only read afterwards.
+var conversationBases map[string]*conversationBase
+
+// conversationOldest returns the timestamp of the oldest messages to fetch for
+// the conversation: those posted since it was exported when topping it up,
+// and otherwise those given with --oldest.
+func conversationOldest(channelId string) string {
+	base, ok := conversationBases[channelId]
+	if !ok || base.latest == "" {
+		return historyOldest
+	}
+	if historyOldest != "" && slackTimestampTime(historyOldest).After(slackTimestampTime(base.latest)) {
+		return historyOldest
+	}
+	return base.latest
+}
+
+// conversationThreads returns the timestamps of the thread roots whose replies
+// to fetch for the conversation: those found in its history, followed by those
+// of its existing export which are being refreshed.
+func conversationThreads(channelId string, tsIds []string) []string {
+	base, ok := conversationBases[channelId]
+	if !ok || len(base.threads) == 0 {
+		return tsIds
+	}
+	seen := make(map[string]bool)
+	for _, tsId := range tsIds {
+		seen[tsId] = true
+	}
+	for _, tsId := range base.threads {
+		if !seen[tsId] {
+			tsIds = append(tsIds, tsId)
+		}
+	}
+	return tsIds
+}
+
+// latestConversationMessages maps the conversations written to the output
+// archive to the timestamps of their newest messages, for the export
+// metadata, so that --incremental can carry on from there next time.
+var latestConversationMessages = make(map[string]string)
+
+// latestMessageTs returns the timestamp of the newest message in the files of
+// a conversation, or an empty string if there are none.
+func latestMessageTs(files []*conversationFile) (string, error) {
+	res := ""
+	for _, file := range files {
+		err := walkMessageTimestamps(file, func(ts string) {
+			if ts != "" && (res == "" || slackTimestampTime(ts).After(slackTimestampTime(res))) {
+				res = ts
+			}
+		})
+		if err != nil {
+			return "", fmt.Errorf("couldn't parse %s: %w", file.name, err)
+		}
+	}
+	return res, nil
+}
+
+// walkMessageTimestamps calls handle with the timestamp of each message of
+// the file, reading the messages one at a time rather than all of them at
+// once, as only their timestamps are needed.
+func walkMessageTimestamps(file *conversationFile, handle func(ts string)) error {
+	return file.walk(func(dec *json.Decoder) error {
+		var message struct {
+			Ts string `json:"ts"`
+		}
+		if err := dec.Decode(&message); err != nil {
+			return err
+		}
+		handle(message.Ts)
+		return nil
+	})
+}
+
+// previousLatestMessages returns the timestamps of the newest message of each
+// conversation, as recorded by the runs which produced the input archive.
+func previousLatestMessages(r *zip.ReadCloser) (map[string]string, error) {
+	var metadata exportMetadata
+	if _, err := readArchiveJson(r, exportMetadataFile, &metadata); err != nil {
+		return nil, err
+	}
+	res := make(map[string]string)
+	for _, run := range metadata.Runs {
+		for id, ts := range run.LatestMessages {
+			if previous, ok := res[id]; !ok || slackTimestampTime(ts).After(slackTimestampTime(previous)) {
+				res[id] = ts
+			}
+		}
+	}
+	return res, nil
+}
+
+// readArchiveJson decodes the file of the input archive with the given name
+// into value, and returns whether the file exists.
+func readArchiveJson(r *zip.ReadCloser, name string, value interface{}) (bool, error) {
+	for _, file := range r.File {
+		if file.Name != name {
+			continue
+		}
+		inReader, err := file.Open()
+		if err != nil {
+			return true, fmt.Errorf("failed to open file in input archive %s: %w", file.Name, err)
+		}
+		defer inReader.Close()
+		if err := json.NewDecoder(inReader).Decode(value); err != nil {
+			return true, fmt.Errorf("couldn't parse the JSON file %s: %w", file.Name, err)
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// readConversationBase reads the files of the conversation stored in the
+// directory of the input archive, and returns them along with their names in
+// the archive. The parts of split files are joined back together.
+func readConversationBase(r *zip.ReadCloser, dir string) (*conversationBase, []string, error) {
+	base := &conversationBase{}
+	names := make([]string, 0)
+	var latest time.Time
+	seenThreads := make(map[string]bool)
+	// The messages of the parts of split files, by the name of the whole
+	// file, in the order of their parts.
+	partMessages := make(map[string][]map[string]interface{})
+	partNames := make([]string, 0)
+
+	for _, file := range r.File {
+		name := strings.TrimPrefix(file.Name, dir+"/")
+		if name == file.Name || name == "" || strings.Contains(name, "/") {
+			continue
+		}
+
+		inReader, err := file.Open()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to open file in input archive %s: %w", file.Name, err)
+		}
+		buf, err := ioutil.ReadAll(inReader)
+		inReader.Close()
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read file in input archive %s: %w", file.Name, err)
+		}
+
+		// Files of JSON lines are merged with the JSON arrays fetched,
+		// and written again in the format asked for, as are
+		// gzip-compressed files.
+		name, buf, err = gunzipFile(name, buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isJsonLinesFile(name) {
+			buf, err = jsonLinesToArray(buf)
+			if err != nil {
+				return nil, nil, fmt.Errorf("couldn't parse the JSON lines file %s: %w", file.Name, err)
+			}
+			name = jsonArrayFileName(name)
+		}
+		whole := unsplitFileName(name)
+
+		var messages []map[string]interface{}
+		if err := json.Unmarshal(buf, &messages); err != nil {
+			return nil, nil, fmt.Errorf("couldn't parse the JSON file %s: %w", file.Name, err)
+		}
+		for _, message := range messages {
+			ts, _ := message["ts"].(string)
+			if t := slackTimestampTime(ts); ts != "" && t.After(latest) {
+				latest = t
+				base.latest = ts
+			}
+			if isThreadRoot(message) && !seenThreads[ts] {
+				seenThreads[ts] = true
+				base.threads = append(base.threads, ts)
+			}
+		}
+
+		names = append(names, file.Name)
+		if whole != name {
+			if _, ok := partMessages[whole]; !ok {
+				partNames = append(partNames, whole)
+			}
+			partMessages[whole] = append(partMessages[whole], messages...)
+			continue
+		}
+		baseFile, err := newConversationFile(name, buf)
+		if err != nil {
+			return nil, nil, err
+		}
+		base.files = append(base.files, baseFile)
+	}
+
+	for _, name := range partNames {
+		baseFile := &conversationFile{name: name}
+		messages := partMessages[name]
+		if err := baseFile.encode(&messages); err != nil {
+			return nil, nil, err
+		}
+		base.files = append(base.files, baseFile)
+	}
+	return base, names, nil
+}
+
+// mergeConversationFiles merges the files fetched for a conversation into
+// those of its existing export, file by file. Messages found in both, with the
+// same timestamp, are taken from the fetched files.
+//
+// The messages of each file are kept in the order they are fetched in: thread
+// by thread for replies.json, and oldest first otherwise.
+func mergeConversationFiles(base []*conversationFile, fetched []*conversationFile) ([]*conversationFile, error) {
+	names := make([]string, 0)
+	messagesByName := make(map[string]map[string]map[string]interface{})
+	for _, files := range [][]*conversationFile{base, fetched} {
+		for _, file := range files {
+			var messages []map[string]interface{}
+			if err := file.decode(&messages); err != nil {
+				return nil, fmt.Errorf("couldn't parse %s: %w", file.name, err)
+			}
+			byTs, ok := messagesByName[file.name]
+			if !ok {
+				byTs = make(map[string]map[string]interface{})
+				messagesByName[file.name] = byTs
+				names = append(names, file.name)
+			}
+			for _, message := range messages {
+				ts, _ := message["ts"].(string)
+				byTs[ts] = message
+			}
+		}
+	}
+	sort.Strings(names)
+
+	merged := make([]*conversationFile, 0, len(names))
+	for _, name := range names {
+		messages := make([]map[string]interface{}, 0, len(messagesByName[name]))
+		for _, message := range messagesByName[name] {
+			messages = append(messages, message)
+		}
+		before := func(i int, j int, key string) bool {
+			return slackTimestampTime(messages[i][key]).Before(slackTimestampTime(messages[j][key]))
+		}
+		sort.SliceStable(messages, func(i, j int) bool {
+			if name == "replies.json" && (before(i, j, "thread_ts") || before(j, i, "thread_ts")) {
+				return before(i, j, "thread_ts")
+			}
+			return before(i, j, "ts")
+		})
+
+		file := &conversationFile{name: name}
+		if err := file.encode(&messages); err != nil {
+			return nil, err
+		}
+		merged = append(merged, file)
+	}
+	return merged, nil
+}
@@ -0,0 +1,273 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/spf13/cobra"
+)
+
+var mergeArchivesCmd = &cobra.Command{
+	Use:   "merge-archives ARCHIVE...",
+	Short: "Merge several export archives into the output archive, without calling the Slack API",
+	Long: `Merge several export archives, such as exports done in pieces or by different people, into the output archive.
+
+The lists of conversations and users found in more than one archive, such as channels.json, groups.json and
+users.json, are merged by ID, and the messages of the conversations found in more than one archive are merged by
+timestamp. When the same conversation, user or message is found in more than one archive, the archive given last
+wins, as it does for any other file, such as attachments.`,
+	Args: cobra.MinimumNArgs(1),
+	// The archives to merge are given as arguments, instead of with
+	// --input-archive.
+	Annotations: map[string]string{archivesAnnotation: archivesOutput},
+	RunE:        mergeArchives,
+}
+
+// The copies of a file found in the archives being merged, in the order the
+// archives are given in.
+type archiveEntry struct {
+	name  string
+	files []*zip.File
+}
+
+func mergeArchives(cmd *cobra.Command, args []string) error {
+	ctx := cmd.Context()
+
+	// Open the input archives.
+	readers := make([]*zip.ReadCloser, 0, len(args))
+	defer func() {
+		for _, r := range readers {
+			r.Close()
+		}
+	}()
+	for _, archivePath := range args {
+		r, err := openArchive(archivePath)
+		if err != nil {
+			return err
+		}
+		readers = append(readers, r)
+	}
+
+	// Open the output archive.
+	w, f, err := createOutputArchive()
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	// The runs which produced each archive, leaving out those found in more
+	// than one, as when the archives were produced from the same export.
+	// Runs are compared in full, as those of --reproducible have no times.
+	runs := make([]exportRun, 0)
+	seenRuns := make(map[string]bool)
+	entries := make([]*archiveEntry, 0)
+	entriesByName := make(map[string]*archiveEntry)
+	for _, r := range readers {
+		for _, run := range readExportRuns(r) {
+			data, err := json.Marshal(&run)
+			if err != nil {
+				return err
+			}
+			key := string(data)
+			if !seenRuns[key] {
+				seenRuns[key] = true
+				runs = append(runs, run)
+			}
+		}
+
+		for _, file := range r.File {
+			if file.Name == exportMetadataFile || file.Name == checksumsFile {
+				continue
+			}
+			entry, ok := entriesByName[file.Name]
+			if !ok {
+				entry = &archiveEntry{name: file.Name}
+				entriesByName[file.Name] = entry
+				entries = append(entries, entry)
+			}
+			entry.files = append(entry.files, file)
+		}
+	}
+
+	merged := 0
+	for _, entry := range entries {
+		if plainName := strings.TrimSuffix(entry.name, gzipSuffix); len(entry.files) > 1 && (strings.HasSuffix(plainName, ".json") || isJsonLinesFile(plainName)) {
+			ok, err := mergeArchiveEntry(w, entry)
+			if err != nil {
+				return fmt.Errorf("failed to merge %s: %w", entry.name, err)
+			}
+			if ok {
+				merged++
+				continue
+			}
+		}
+
+		verbosePrintln(fmt.Sprintf("Processing file: %s\n", entry.name))
+		if skipUnreadable {
+			if err := checkArchiveFile(entry.files[len(entry.files)-1]); err != nil {
+				reportUnreadableEntry(entry.name, err)
+				continue
+			}
+		}
+		if err := copyArchiveFile(w, entry.files[len(entry.files)-1]); err != nil {
+			return err
+		}
+	}
+
+	err = writeExportRuns(ctx, runs, w, cmd, nil)
+	if err != nil {
+		return fmt.Errorf("failed to write the export metadata: %w", err)
+	}
+
+	// Close the output archive writer.
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("failed to close the output archive: %w", err)
+	}
+
+	if jsonLogging {
+		slog.Info("Merge done", "event", "summary", "archives", len(args), "files", len(entries), "merged", merged)
+	} else {
+		statusPrintf("Done: merged %d archives into %d files, %d of which were merged from several archives.\n", len(args), len(entries), merged)
+	}
+	return nil
+}
+
+// mergeArchiveEntry writes the file found in several archives to the output
+// archive, merging its copies, and returns whether it could merge them. Lists
+// of messages are merged by timestamp, as with --merge, and other lists of
+// objects, such as conversations and users, by ID, keeping them in the order
+// they are first found in. Anything else can't be merged.
+func mergeArchiveEntry(w archiveWriter, entry *archiveEntry) (bool, error) {
+	copies := make([]*conversationFile, 0, len(entry.files))
+	defer func() { removeConversationFiles(copies) }()
+	lists := make([][]map[string]interface{}, 0, len(entry.files))
+	haveTs, haveIds := true, true
+	items := 0
+	for _, file := range entry.files {
+		inReader, err := file.Open()
+		if err != nil {
+			return false, fmt.Errorf("failed to open file in input archive %s: %w", file.Name, err)
+		}
+		buf, err := ioutil.ReadAll(inReader)
+		inReader.Close()
+		if err != nil {
+			return false, fmt.Errorf("failed to read file in input archive %s: %w", file.Name, err)
+		}
+
+		plainName, buf, err := gunzipFile(entry.name, buf)
+		if err != nil {
+			return false, nil
+		}
+		if isJsonLinesFile(plainName) {
+			buf, err = jsonLinesToArray(buf)
+			if err != nil {
+				return false, nil
+			}
+		}
+
+		var list []map[string]interface{}
+		if err := json.Unmarshal(buf, &list); err != nil {
+			return false, nil
+		}
+		items += len(list)
+		for _, item := range list {
+			if ts, _ := item["ts"].(string); ts == "" {
+				haveTs = false
+			}
+			if id, _ := item["id"].(string); id == "" {
+				haveIds = false
+			}
+		}
+
+		// Named as in the directory of the conversation, for
+		// mergeConversationFiles to order the messages of the file.
+		entryCopy, err := newConversationFile(jsonArrayFileName(path.Base(plainName)), buf)
+		if err != nil {
+			return false, err
+		}
+		copies = append(copies, entryCopy)
+		lists = append(lists, list)
+	}
+
+	if haveTs && items > 0 {
+		files, err := mergeConversationFiles(copies[:1], copies[1:])
+		if err != nil {
+			return false, err
+		}
+		defer removeConversationFiles(files)
+		verbosePrintln(fmt.Sprintf("Merging the messages of %s from %d archives\n", entry.name, len(copies)))
+		data, err := files[0].bytes()
+		if err != nil {
+			return false, err
+		}
+		return true, writeMergedEntry(w, entry.name, data)
+	}
+	if !haveIds {
+		return false, nil
+	}
+
+	verbosePrintln(fmt.Sprintf("Merging %s by ID from %d archives\n", entry.name, len(copies)))
+	merged := mergeListsById(lists)
+	var buf bytes.Buffer
+	enc := newJsonEncoder(&buf)
+	if err := enc.Encode(&merged); err != nil {
+		return false, err
+	}
+	return true, writeMergedEntry(w, entry.name, buf.Bytes())
+}
+
+// writeMergedEntry writes the JSON array merged from the copies of a file to
+// the output archive, as JSON lines if the file holds JSON lines, and
+// gzip-compressed if it is.
+func writeMergedEntry(w archiveWriter, name string, data []byte) error {
+	plainName := strings.TrimSuffix(name, gzipSuffix)
+	var err error
+	if isJsonLinesFile(plainName) {
+		data, err = jsonArrayToLines(data)
+		if err != nil {
+			return err
+		}
+	}
+	if isGzipFile(name) {
+		_, data, err = gzipFile(plainName, data)
+		if err != nil {
+			return err
+		}
+	}
+	outFile, err := w.Create(name)
+	if err != nil {
+		return err
+	}
+	_, err = outFile.Write(data)
+	return err
+}
+
+// mergeListsById merges lists of objects by ID, keeping the objects in the
+// order they are first found in, or sorted by ID with --reproducible, but with
+// the last of their versions.
+func mergeListsById(lists [][]map[string]interface{}) []map[string]interface{} {
+	res := make([]map[string]interface{}, 0)
+	indexes := make(map[string]int)
+	for _, list := range lists {
+		for _, item := range list {
+			id := item["id"].(string)
+			if index, ok := indexes[id]; ok {
+				res[index] = item
+				continue
+			}
+			indexes[id] = len(res)
+			res = append(res, item)
+		}
+	}
+	if reproducible {
+		sortById(res)
+	}
+	return res
+}
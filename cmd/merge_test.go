@@ -0,0 +1,53 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLatestMessageTs(t *testing.T) {
+	first, err := newConversationFile("messages.json", []byte(`[
+		{"ts": "999999999.000100", "text": "older, with fewer digits"},
+		{"ts": "1700000000.000200", "files": [{"id": "F1", "ts": "1800000000"}]},
+		{"text": "no timestamp"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := newConversationFile("replies.json", []byte(`[{"ts": "1700000000.000100", "thread_ts": "1700000000.000200"}]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, err := newConversationFile("2023-11-14.json", []byte(`[]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := []*conversationFile{first, second, empty}
+	defer removeConversationFiles(files)
+
+	latest, err := latestMessageTs(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if latest != "1700000000.000200" {
+		t.Errorf("expected the newest message to be 1700000000.000200, got %q", latest)
+	}
+
+	if latest, err := latestMessageTs(nil); err != nil || latest != "" {
+		t.Errorf("expected no timestamp without files, got %q, %v", latest, err)
+	}
+}
+
+func TestLatestMessageTsInvalid(t *testing.T) {
+	for _, contents := range []string{`{"ts": "1700000000.000100"}`, `[{"ts": "1700000000.000100"}`, `[{"ts": 1700000000}]`} {
+		file, err := newConversationFile("messages.json", []byte(contents))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = latestMessageTs([]*conversationFile{file})
+		file.remove()
+		if err == nil || !strings.Contains(err.Error(), "messages.json") {
+			t.Errorf("expected an error parsing %s, got %v", contents, err)
+		}
+	}
+}
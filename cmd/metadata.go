@@ -0,0 +1,143 @@
+package cmd
+
+import (
+	"archive/zip"
+	"context"
+	"log"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+const version = "0.4.0"
+
+// The file of the output archive recording how it was produced.
+const exportMetadataFile = "slack-advanced-exporter.json"
+
+// The flags whose values must not end up in the export metadata.
+var secretFlags = []string{"api-token", "client-secret", "header"}
+
+// The flags giving the paths of the archives, and of the temporary files, which
+// are left out of the export metadata with --reproducible, so that the same
+// archive can be written to another path.
+var archivePathFlags = []string{"input-archive", "output-archive", "output-dir", "temp-dir"}
+
+// When the command started running.
+var runStartedAt = time.Now()
+
+// The contents of the export metadata file: one entry per command which
+// produced the archive, oldest first, as each command adds its own to those
+// found in its input archive.
+type exportMetadata struct {
+	Runs []exportRun `json:"runs"`
+}
+
+type exportRun struct {
+	Version    string            `json:"version"`
+	Command    string            `json:"command"`
+	StartedAt  time.Time         `json:"started_at"`
+	FinishedAt time.Time         `json:"finished_at"`
+	Flags      map[string]string `json:"flags"`
+	// The workspace and user the token belongs to, if there is a token.
+	Team   *slackexport.AuthTest `json:"team,omitempty"`
+	Counts exportCounts          `json:"counts"`
+	// The timestamp of the newest message of each conversation written, by
+	// conversation ID.
+	LatestMessages map[string]string `json:"latest_messages,omitempty"`
+	// The conversations which were listed but couldn't be read with the
+	// token, and so have no messages in the archive.
+	Skipped []skippedConversation `json:"skipped_conversations,omitempty"`
+	// Whether the --deadline was reached, leaving out conversations.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+type exportCounts struct {
+	ApiCalls      int64 `json:"api_calls"`
+	Conversations int   `json:"conversations"`
+	Messages      int   `json:"messages"`
+	Attachments   int   `json:"attachments"`
+}
+
+// writeExportMetadata writes the export metadata file, adding the command
+// being run to the runs recorded in the input archive.
+func writeExportMetadata(ctx context.Context, r *zip.ReadCloser, w archiveWriter, cmd *cobra.Command, client *slackexport.Client) error {
+	return writeExportRuns(ctx, readExportRuns(r), w, cmd, client)
+}
+
+// readExportRuns returns the runs recorded in the export metadata of the
+// archive, if any.
+func readExportRuns(r *zip.ReadCloser) []exportRun {
+	var metadata exportMetadata
+	if _, err := readArchiveJson(r, exportMetadataFile, &metadata); err != nil {
+		// The metadata of earlier runs is nice to have, but not worth
+		// failing an export over.
+		log.Print("++++++ Failed to read the export metadata of the input archive\n\n" + err.Error() + "\n")
+		return nil
+	}
+	return metadata.Runs
+}
+
+// writeExportRuns writes the export metadata file, adding the command being
+// run to the given runs. The client is nil for commands which don't call the
+// Slack API.
+func writeExportRuns(ctx context.Context, runs []exportRun, w archiveWriter, cmd *cobra.Command, client *slackexport.Client) error {
+	metadata := exportMetadata{Runs: runs}
+	run := exportRun{
+		Version:    version,
+		Command:    cmd.Name(),
+		StartedAt:  runStartedAt.UTC(),
+		FinishedAt: time.Now().UTC(),
+		Flags:      make(map[string]string),
+		Counts: exportCounts{
+			ApiCalls:      atomic.LoadInt64(&apiCalls),
+			Conversations: conversationsWritten,
+			Messages:      messagesWritten,
+			Attachments:   attachmentsDownloaded,
+		},
+		LatestMessages: latestConversationMessages,
+		Skipped:        conversationsSkipped,
+		Truncated:      exportTruncated,
+	}
+
+	// The times and the number of requests, which retries change, differ
+	// from one run to the next.
+	if reproducible {
+		run.StartedAt = time.Time{}
+		run.FinishedAt = time.Time{}
+		run.Counts.ApiCalls = 0
+	}
+
+	// Only the flags which were set, since the defaults may change between
+	// versions.
+	cmd.Flags().Visit(func(flag *pflag.Flag) {
+		if !containsString(secretFlags, flag.Name) && !(reproducible && containsString(archivePathFlags, flag.Name)) {
+			run.Flags[flag.Name] = flag.Value.String()
+		}
+	})
+
+	if client != nil && client.Token != "" {
+		auth, err := client.AuthTest(ctx)
+		if err != nil {
+			log.Print("++++++ Failed to fetch the team of the API token for the export metadata\n\n" + err.Error() + "\n")
+		} else {
+			run.Team = auth
+		}
+	}
+
+	metadata.Runs = append(metadata.Runs, run)
+	sort.SliceStable(metadata.Runs, func(i, j int) bool {
+		return metadata.Runs[i].StartedAt.Before(metadata.Runs[j].StartedAt)
+	})
+
+	outFile, err := w.Create(exportMetadataFile)
+	if err != nil {
+		return err
+	}
+	enc := newJsonEncoder(outFile)
+	return enc.Encode(&metadata)
+}
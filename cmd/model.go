@@ -5,6 +5,12 @@ type SlackFile struct {
 	Name               string `json:"name"`
 	UrlPrivate         string `json:"url_private"`
 	UrlPrivateDownload string `json:"url_private_download"`
+	// "tombstone" for deleted files, and "hidden_by_limit" for files beyond
+	// the storage limit of free workspaces, neither of which can be downloaded.
+	Mode string `json:"mode"`
+	// In bytes.
+	Size     int64  `json:"size"`
+	Mimetype string `json:"mimetype"`
 }
 
 type SlackPost struct {
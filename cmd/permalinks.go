@@ -0,0 +1,90 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+var (
+	// Whether to add a permalink to each message, with --permalinks or
+	// --workspace-url.
+	addPermalinks bool
+	// The URL of the workspace given with --workspace-url.
+	workspaceUrl string
+)
+
+// The URL of the workspace the permalinks of messages start with, such as
+// https://example.slack.com, or "" when they aren't added.
+var permalinkBase string
+
+// checkWorkspaceUrl checks the URL given with --workspace-url, which can be
+// given without its scheme, as in example.slack.com.
+func checkWorkspaceUrl() error {
+	if workspaceUrl == "" {
+		return nil
+	}
+	addPermalinks = true
+	raw := workspaceUrl
+	if !strings.Contains(raw, "://") {
+		raw = "https://" + raw
+	}
+	u, err := url.Parse(raw)
+	if err != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		return fmt.Errorf("invalid --workspace-url %s, expected the URL of the workspace, such as https://example.slack.com", workspaceUrl)
+	}
+	permalinkBase = u.Scheme + "://" + u.Host
+	return nil
+}
+
+// setupPermalinks finds the URL of the workspace from its domain, as returned
+// by team.info, when permalinks are added without --workspace-url.
+func setupPermalinks(ctx context.Context, client *slackexport.Client) error {
+	if !addPermalinks || permalinkBase != "" {
+		return nil
+	}
+	team, err := client.TeamInfo(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to fetch the domain of the workspace for the permalinks, which --workspace-url gives instead: %w", err)
+	}
+	domain, _ := team["domain"].(string)
+	if domain == "" {
+		return errors.New("Slack returned no domain for the workspace, give its URL with --workspace-url instead")
+	}
+	permalinkBase = "https://" + domain + ".slack.com"
+	verbosePrintln("Adding permalinks to the messages of " + permalinkBase)
+	return nil
+}
+
+// addPermalinksToFiles sets the permalink field of each message of the files
+// of a conversation to its link in Slack, such as
+// https://example.slack.com/archives/C12345/p1700000000123456, with the thread
+// it belongs to for thread replies, as Slack links them. The messages are
+// rewritten one at a time.
+func addPermalinksToFiles(channelId string, files []*conversationFile) error {
+	if permalinkBase == "" {
+		return nil
+	}
+	for _, file := range files {
+		err := file.rewriteMessages(func(message map[string]interface{}) error {
+			ts, _ := message["ts"].(string)
+			if ts == "" {
+				return nil
+			}
+			link := permalinkBase + "/archives/" + channelId + "/p" + strings.Replace(ts, ".", "", 1)
+			if threadTs, _ := message["thread_ts"].(string); threadTs != "" && threadTs != ts {
+				link += "?thread_ts=" + threadTs + "&cid=" + channelId
+			}
+			message["permalink"] = link
+			return nil
+		})
+		if err != nil {
+			return fmt.Errorf("couldn't add the permalinks to %s: %w", file.name, err)
+		}
+	}
+	return nil
+}
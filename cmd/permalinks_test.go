@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"testing"
+)
+
+func TestAddPermalinksToFiles(t *testing.T) {
+	defer func(base string) { permalinkBase = base }(permalinkBase)
+	permalinkBase = "https://example.slack.com"
+
+	file, err := newConversationFile("messages.json", []byte(`[
+		{"ts": "1700000000.123456", "text": "root", "thread_ts": "1700000000.123456"},
+		{"ts": "1700000001.000100", "text": "reply", "thread_ts": "1700000000.123456"},
+		{"text": "no timestamp"}
+	]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.remove()
+	if err := addPermalinksToFiles("C00000001", []*conversationFile{file}); err != nil {
+		t.Fatal(err)
+	}
+
+	var messages []map[string]interface{}
+	if err := file.decode(&messages); err != nil {
+		t.Fatal(err)
+	}
+	expected := []interface{}{
+		"https://example.slack.com/archives/C00000001/p1700000000123456",
+		"https://example.slack.com/archives/C00000001/p1700000001000100?thread_ts=1700000000.123456&cid=C00000001",
+		nil,
+	}
+	if len(messages) != len(expected) {
+		t.Fatalf("expected %d messages, got %v", len(expected), messages)
+	}
+	for i, message := range messages {
+		if message["permalink"] != expected[i] {
+			t.Errorf("expected the permalink %v, got %v", expected[i], message["permalink"])
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package cmd
+
+import (
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+)
+
+var (
+	// The number of requests made to the Slack API, including retries. It is
+	// updated from several goroutines, so only through sync/atomic.
+	apiCalls int64
+	// The number of those requests which were retries of failed ones.
+	apiRetries int64
+	// The number of messages left out with --exclude-bots or
+	// --exclude-system, also updated from several goroutines.
+	messagesExcluded int64
+	// The numbers of conversations, of their messages and thread replies,
+	// of the replies alone, and of attachments written to the archive.
+	conversationsWritten  int
+	messagesWritten       int
+	repliesWritten        int
+	attachmentsDownloaded int
+	// The conversations which failed to be fetched with --continue-on-error.
+	conversationFailures []*conversationContents
+	// The conversations which were listed but couldn't be read with the
+	// token, and so were skipped.
+	conversationsSkipped []skippedConversation
+)
+
+// A conversation which was listed but couldn't be read with the token, as
+// recorded in the export metadata.
+type skippedConversation struct {
+	Id   string `json:"id"`
+	Name string `json:"name"`
+	// The error Slack returned, such as not_in_channel.
+	Reason string `json:"reason"`
+}
+
+// reportConversationDone reports that the contents of the index-th conversation
+// out of total have been written to the archive.
+func reportConversationDone(index int, total int, contents *conversationContents) {
+	conversationsWritten++
+	messagesWritten += contents.messages + contents.replies
+	repliesWritten += contents.replies
+
+	if conversationsProgress != nil {
+		conversationsProgress.advance(contents.dir)
+	} else if jsonLogging {
+		slog.Info("Conversation done", "event", "progress", "index", index, "total", total,
+			"channel", contents.id, "name", contents.dir, "messages", contents.messages, "replies", contents.replies)
+	} else {
+		statusPrintf("Conversation %d of %d (%s) — %d messages, %d replies\n", index, total, contents.dir, contents.messages, contents.replies)
+	}
+}
+
+// reportConversationFailed reports that the index-th conversation out of
+// total failed to be fetched, and is left out of the archive.
+func reportConversationFailed(index int, total int, contents *conversationContents) {
+	conversationFailures = append(conversationFailures, contents)
+	conversationsProgress.clear()
+	log.Printf("++++++ Conversation %d of %d (%s) failed, skipping it: %s", index, total, contents.dir, contents.err)
+	conversationsProgress.advance(contents.dir)
+}
+
+// reportConversationSkipped reports that a conversation couldn't be read with
+// the token for the given reason, and is left out of the archive.
+func reportConversationSkipped(contents *conversationContents, reason string) {
+	conversationsSkipped = append(conversationsSkipped, skippedConversation{Id: contents.id, Name: contents.dir, Reason: reason})
+	verbosePrintln("Skipping conversation "+contents.dir+", which can't be read with this token: "+reason, "channel", contents.id, "reason", reason)
+	conversationsProgress.advance(contents.dir)
+}
+
+// reportExportSummary reports the totals of the whole export, once it is done,
+// along with the conversations which failed, in which case it returns an error.
+func reportExportSummary() error {
+	summary := newRunSummary()
+	if jsonLogging {
+		slog.Info("Export done", "event", "summary", "api_calls", summary.ApiCalls, "retries", summary.Retries,
+			"conversations", summary.Conversations, "messages", summary.Messages, "replies", summary.Replies, "excluded", summary.MessagesExcluded,
+			"attachments", summary.Attachments, "bytes", summary.BytesWritten, "duration_seconds", summary.DurationSeconds,
+			"failures", len(conversationFailures), "skipped", len(conversationsSkipped))
+		for _, skipped := range conversationsSkipped {
+			slog.Warn("Conversation skipped", "event", "skipped", "channel", skipped.Id, "name", skipped.Name, "reason", skipped.Reason)
+		}
+		for _, contents := range conversationFailures {
+			slog.Error("Conversation failed", "event", "failure", "channel", contents.id, "name", contents.dir, "error", contents.err.Error())
+		}
+	} else {
+		excluded := ""
+		if summary.MessagesExcluded > 0 {
+			excluded = fmt.Sprintf(", leaving out %d", summary.MessagesExcluded)
+		}
+		statusPrintf("Done in %s: wrote %d conversations, %d messages and %d replies%s, %d attachments and %s, making %d Slack API requests, %d of them retries.\n",
+			time.Duration(summary.DurationSeconds*float64(time.Second)).Round(time.Second), summary.Conversations, summary.Messages, summary.Replies, excluded,
+			summary.Attachments, formatByteSize(summary.BytesWritten), summary.ApiCalls, summary.Retries)
+		if len(conversationsSkipped) > 0 {
+			fmt.Fprintf(os.Stderr, "%d conversations couldn't be read with this token and were skipped:\n", len(conversationsSkipped))
+			for _, skipped := range conversationsSkipped {
+				fmt.Fprintf(os.Stderr, "  %s (%s): %s\n", skipped.Name, skipped.Id, skipped.Reason)
+			}
+		}
+		if len(conversationFailures) > 0 {
+			fmt.Fprintf(os.Stderr, "%d conversations failed:\n", len(conversationFailures))
+			for _, contents := range conversationFailures {
+				fmt.Fprintf(os.Stderr, "  %s (%s): %s\n", contents.dir, contents.id, contents.err)
+			}
+		}
+	}
+
+	if len(conversationFailures) > 0 {
+		return fmt.Errorf("failed to fetch %d conversations", len(conversationFailures))
+	}
+	if exportTruncated {
+		if !resumeExport {
+			return fmt.Errorf("the export was truncated at the --deadline of %s, run it with --resume to be able to carry on", exportDeadline)
+		}
+		return fmt.Errorf("the export was truncated at the --deadline of %s, run the same command again to carry on", exportDeadline)
+	}
+	return nil
+}
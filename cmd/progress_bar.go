@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+var (
+	// Whether to leave out the progress bar, with --no-progress.
+	noProgress bool
+	// The progress bar of the conversations being fetched, if shown.
+	conversationsProgress *progressBar
+)
+
+// The width of the bar itself, in characters.
+const progressBarWidth = 30
+
+// The longest list of the conversations being fetched shown after the bar, in
+// characters, for the line not to wrap.
+const progressBarMaxActive = 60
+
+// progressBar shows how many conversations out of the total were written to
+// the archive, along with an estimate of the time left and the conversations
+// being fetched, on a single line of the terminal redrawn as they progress.
+//
+// It is only shown when the standard error is a terminal, and neither
+// --verbose, --quiet nor --log-format json are given, as their lines would
+// garble it. Otherwise, all its methods do nothing, and progress is printed
+// line by line instead.
+type progressBar struct {
+	mutex sync.Mutex
+	bar   *progressbar.ProgressBar
+	// The conversations being fetched, by the workers fetching them.
+	active map[string]bool
+	// Whether finish was called.
+	finished bool
+}
+
+// newProgressBar returns the progress bar for the given number of
+// conversations, or nil when it isn't to be shown.
+func newProgressBar(total int) *progressBar {
+	if noProgress || jsonLogging || verbosity > 0 || total == 0 || !isTerminal(os.Stderr) {
+		return nil
+	}
+	return &progressBar{
+		bar: progressbar.NewOptions(total,
+			progressbar.OptionSetWriter(os.Stderr),
+			progressbar.OptionSetWidth(progressBarWidth),
+			progressbar.OptionShowCount(),
+			progressbar.OptionSetPredictTime(true),
+			progressbar.OptionShowDescriptionAtLineEnd(),
+			progressbar.OptionUseANSICodes(true),
+			progressbar.OptionSetRenderBlankState(true),
+		),
+		active: make(map[string]bool),
+	}
+}
+
+// isTerminal returns whether the file is a terminal, rather than a pipe or a
+// regular file.
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// start records that the conversation is being fetched.
+func (p *progressBar) start(name string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.active[name] = true
+	p.describe()
+}
+
+// advance records that the conversation was written to the archive, or
+// skipped.
+func (p *progressBar) advance(name string) {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	delete(p.active, name)
+	p.describe()
+	p.bar.Add(1)
+}
+
+// clear erases the bar, for a line to be printed in its place, before it is
+// drawn again below it.
+func (p *progressBar) clear() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.bar.Clear()
+}
+
+// finish stops redrawing the bar, leaving it as it last was on its own line.
+// It can be called more than once.
+func (p *progressBar) finish() {
+	if p == nil {
+		return
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.finished {
+		return
+	}
+	p.finished = true
+	p.bar.Exit()
+	fmt.Fprintln(os.Stderr)
+}
+
+// describe shows the conversations being fetched after the bar, until it is
+// finished. The mutex must be held.
+func (p *progressBar) describe() {
+	if p.finished {
+		return
+	}
+	names := make([]string, 0, len(p.active))
+	for name := range p.active {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	description := strings.Join(names, ", ")
+	if runes := []rune(description); len(runes) > progressBarMaxActive {
+		description = string(runes[:progressBarMaxActive-3]) + "..."
+	}
+	p.bar.Describe(description)
+}
@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestProgressBarOnlyOnTerminals(t *testing.T) {
+	stderr := os.Stderr
+	defer func() { os.Stderr = stderr }()
+	f, err := os.Create(filepath.Join(t.TempDir(), "stderr"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	os.Stderr = f
+
+	bar := newProgressBar(3)
+	if bar != nil {
+		t.Fatal("expected no progress bar when the standard error isn't a terminal")
+	}
+	// The methods of a missing bar do nothing.
+	bar.start("general")
+	bar.advance("general")
+	bar.clear()
+	bar.finish()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() != 0 {
+		t.Errorf("expected nothing to be drawn, got %d bytes", info.Size())
+	}
+}
@@ -0,0 +1,120 @@
+package cmd
+
+import (
+	"archive/zip"
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+// fetchMissingReplies fetches the thread replies of the conversations listed
+// in the given list file of the input archive, such as groups.json, which
+// have a messages.json but no replies.json, as in exports made by older
+// versions, and writes them to the output archive. Their histories aren't
+// fetched again: the threads are found in their messages.json. The directories
+// of the conversations are named by dirName.
+//
+// The replies are written in the same format as the messages, as JSON lines
+// when the messages are, and gzip-compressed when they are or with
+// --gzip-json.
+func fetchMissingReplies(ctx context.Context, r *zip.ReadCloser, w archiveWriter, client *slackexport.Client, listFile string, dirName func(map[string]interface{}) string) error {
+	var conversations []map[string]interface{}
+	if _, err := readArchiveJson(r, listFile, &conversations); err != nil {
+		return err
+	}
+	dirs := conversationDirs(conversations, dirName)
+
+	type target struct {
+		index   int
+		threads []string
+		jsonl   bool
+		gzip    bool
+	}
+	targets := make([]target, 0)
+	for i := range conversations {
+		base, names, err := readConversationBase(r, dirs[i])
+		if err != nil {
+			return err
+		}
+		hasMessages, hasReplies := false, false
+		for _, file := range base.files {
+			hasMessages = hasMessages || file.name == "messages.json"
+			hasReplies = hasReplies || file.name == "replies.json"
+		}
+		if hasMessages && !hasReplies {
+			jsonlName := dirs[i] + "/" + jsonLinesFileName("messages.json")
+			jsonl := containsString(names, jsonlName) || containsString(names, jsonlName+gzipSuffix)
+			gzipped := gzipJson || containsString(names, dirs[i]+"/messages.json"+gzipSuffix) || containsString(names, jsonlName+gzipSuffix)
+			targets = append(targets, target{index: i, threads: base.threads, jsonl: jsonl, gzip: gzipped})
+		}
+	}
+	if len(targets) == 0 {
+		verbosePrintln("No conversation of " + listFile + " is missing its replies.json")
+		return nil
+	}
+
+	verbosePrintln(fmt.Sprintf("Fetching the replies of %d conversations of %s missing their replies.json", len(targets), listFile))
+	for n, target := range targets {
+		id, _ := conversations[target.index]["id"].(string)
+		contents := &conversationContents{id: id, dir: dirs[target.index]}
+		output, err := contents.addFile("replies.json")
+		if err != nil {
+			return err
+		}
+		contents.replies, contents.err = fetchChannelReplies(ctx, output, client, nil, id, target.threads)
+		if reason := inaccessibleReason(contents.err); reason != "" {
+			reportConversationSkipped(contents, reason)
+			continue
+		}
+		if contents.err != nil {
+			return fmt.Errorf("failed to fetch the replies of conversation %s: %w", contents.dir, contents.err)
+		}
+		if err := collectExternalUsers(ctx, client, conversations[target.index], contents.files); err != nil {
+			return fmt.Errorf("failed to fetch the external users of conversation %s: %w", contents.dir, err)
+		}
+		if err := resolveMentionsInFiles(contents.files); err != nil {
+			return fmt.Errorf("failed to resolve the mentions of conversation %s: %w", contents.dir, err)
+		}
+
+		name := "replies.json"
+		data, err := contents.files[0].bytes()
+		removeConversationFiles(contents.files)
+		if err != nil {
+			return err
+		}
+		if target.jsonl {
+			name = jsonLinesFileName(name)
+			data, err = jsonArrayToLines(data)
+			if err != nil {
+				return err
+			}
+		}
+		if target.gzip {
+			name, data, err = gzipFile(name, data)
+			if err != nil {
+				return err
+			}
+		}
+		outFile, err := w.Create(contents.dir + "/" + name)
+		if err != nil {
+			return err
+		}
+		if _, err := outFile.Write(data); err != nil {
+			return err
+		}
+		reportConversationDone(n+1, len(targets), contents)
+	}
+	return nil
+}
+
+// checkFetchMissingReplies checks that --fetch-missing-replies isn't given
+// along with --merge or --incremental, which top up the conversations instead
+// of only adding their missing replies.
+func checkFetchMissingReplies(fetchMissing bool, merge bool, incremental bool) error {
+	if fetchMissing && (merge || incremental) {
+		return errors.New("--fetch-missing-replies can't be used with --merge or --incremental")
+	}
+	return nil
+}
@@ -1,35 +1,209 @@
 package cmd
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
 	"github.com/spf13/cobra"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
 )
 
 var (
-	inputArchive  string
-	outputArchive string
-	verbose       bool
+	inputArchive      string
+	outputArchive     string
+	verbosity         int
+	maxRetries        int
+	retryBaseDelay    time.Duration
+	requestsPerMinute int
+	pageSize          int
+	skipScopeCheck    bool
+	logFormat         string
+	apiBaseUrl        string
+	proxyFlag         string
+	httpTimeout       time.Duration
+	outputFormat      string
+	outputDir         string
+	force             bool
+	compactJson       bool
+	teamId            string
+	refreshTokenFile  string
+	oauthClientId     string
+	oauthClientSecret string
 )
 
 var rootCmd = &cobra.Command{
 	Use:   "slack-advanced-exporter",
 	Short: "The Slack Advanced Exporter ",
+	// Errors returned while running a command aren't usage errors.
+	SilenceUsage:      true,
+	PersistentPreRunE: setupCommand,
 	Long: `The Slack Advanced Exporter is a tool for supplementing official data exports from Slack with the other bits
 and pieces that these don't include.
 
-Version: 0.4.0`,
+Flags can also be set by their names in the YAML or TOML file given with --config, below those given on the
+command line and, for the API token, the ` + apiTokenEnvVar + ` environment variable. The README has the details
+of each flag.
+
+Version: ` + version,
 }
 
 func init() {
+	rootCmd.PersistentFlags().DurationVar(&exportDeadline, "deadline", 0, "how long the conversations may be fetched for, such as 2h, before the archive is written without the others")
+	rootCmd.PersistentFlags().StringVar(&tokenKeychain, "token-keychain", "", "the name of the item of the system's credential store to read the Slack API token from")
+	rootCmd.PersistentFlags().StringVar(&configFile, "config", "", "the path to a YAML or TOML file setting flags by their names")
 	rootCmd.PersistentFlags().StringVarP(&inputArchive, "input-archive", "i", "", "the path to the Slack export archive which you wish to augment")
 	rootCmd.PersistentFlags().StringVarP(&outputArchive, "output-archive", "o", "", "the path to which you would like the output archive to be written")
-	rootCmd.PersistentFlags().BoolVarP(&verbose, "verbose", "v", false, "print detailed information about what is happening while the command is executing")
-	rootCmd.MarkPersistentFlagRequired("input-archive")
-	rootCmd.MarkPersistentFlagRequired("output-archive")
+	rootCmd.PersistentFlags().StringVar(&outputDir, "output-dir", "", "the path of a directory to write the output to as plain files, instead of an output archive")
+	rootCmd.PersistentFlags().StringVar(&outputFormat, "output-format", "", "the format of the output archive, zip or tar.gz, guessed from its name by default")
+	rootCmd.PersistentFlags().BoolVar(&reproducible, "reproducible", false, "write the same archive, byte for byte, given the same input archive and responses from Slack")
+	rootCmd.PersistentFlags().IntVar(&compressionLevel, "compression-level", -1, "how much to compress the output archive, from 0 to 9, or -1 for the default level")
+	rootCmd.PersistentFlags().BoolVar(&skipUnreadable, "skip-unreadable", false, "leave out the files of the input archive which can't be read, instead of failing")
+	rootCmd.PersistentFlags().BoolVar(&force, "force", false, "process the input archive even if it doesn't look like a Slack export")
+	rootCmd.PersistentFlags().BoolVar(&validateOutput, "validate", false, "check that the output has the fields importers expect, and fail without writing it if not")
+	rootCmd.PersistentFlags().BoolVar(&writeChecksums, "checksums", false, "add "+checksumsFile+" to the output, listing the SHA-256 of every other file written")
+	rootCmd.PersistentFlags().BoolVar(&anonymize, "anonymize", false, "replace the identities of users with stable pseudonyms, for sharing the archive")
+	rootCmd.PersistentFlags().StringVar(&anonymizeMappingFile, "anonymize-mapping", "", "the path of the file mapping the pseudonyms of --anonymize back to the users (default <output>.mapping.json)")
+	rootCmd.PersistentFlags().StringVar(&tempDir, "temp-dir", "", "the directory to write temporary files in, instead of that of the system")
+	rootCmd.PersistentFlags().BoolVar(&compactJson, "compact", false, "write the JSON files without indentation")
+	rootCmd.PersistentFlags().CountVarP(&verbosity, "verbose", "v", "print detailed information about what is happening while the command is executing, repeated for more")
+	rootCmd.PersistentFlags().BoolVarP(&quiet, "quiet", "q", false, "print nothing but warnings and errors, overriding --verbose")
+	rootCmd.PersistentFlags().BoolVar(&noProgress, "no-progress", false, "print the progress line by line instead of as a progress bar")
+	rootCmd.PersistentFlags().StringVar(&logFormat, "log-format", "text", "the format of the log lines, text or json")
+	rootCmd.PersistentFlags().BoolVar(&traceRequests, "trace", false, "print every HTTP request made and its response, with their secrets redacted")
+	rootCmd.PersistentFlags().IntVar(&traceBodyBytes, "trace-body-bytes", 512, "how many bytes of the body of each response to print with --trace")
+	rootCmd.PersistentFlags().StringVar(&apiBaseUrl, "api-base-url", "https://slack.com/api", "the base URL of the Slack API")
+	rootCmd.PersistentFlags().StringVar(&proxyFlag, "proxy", "", "the URL of the proxy to make all requests through, instead of that of HTTP_PROXY and HTTPS_PROXY")
+	rootCmd.PersistentFlags().StringArrayVar(&headerFlags, "header", nil, "a header to add to every HTTP request, such as \"X-Gateway-Token: secret\". Can be repeated")
+	rootCmd.PersistentFlags().DurationVar(&httpTimeout, "http-timeout", 2*time.Minute, "how long to wait for each Slack API request before retrying it, or 0 to wait forever")
+	rootCmd.PersistentFlags().StringVar(&teamId, "team-id", "", "the ID of the workspace to export, with a token of a whole Enterprise Grid organization")
+	rootCmd.PersistentFlags().StringVar(&refreshTokenFile, "refresh-token-file", "", "path to a file containing the refresh token of a Slack app, to get a new API token with when it expires")
+	rootCmd.PersistentFlags().StringVar(&oauthClientId, "client-id", "", "the client ID of the Slack app, for --refresh-token-file")
+	rootCmd.PersistentFlags().StringVar(&oauthClientSecret, "client-secret", "", "the client secret of the Slack app, for --refresh-token-file (default $"+clientSecretEnvVar+")")
+	rootCmd.PersistentFlags().IntVar(&maxRetries, "max-retries", 5, "the number of times a failed Slack API request is retried before giving up")
+	rootCmd.PersistentFlags().DurationVar(&retryBaseDelay, "retry-base-delay", time.Second, "the delay before the first retry of a failed Slack API request, doubled on each further retry")
+	rootCmd.PersistentFlags().IntVar(&requestsPerMinute, "requests-per-minute", 50, "the maximum number of Slack API requests to make per minute, or 0 for no limit")
+	rootCmd.PersistentFlags().IntVar(&pageSize, "page-size", 0, fmt.Sprintf("the number of items to ask for in each page of results, up to %d", slackexport.MaxPageSize))
+	rootCmd.PersistentFlags().StringVar(&summaryFile, "summary-file", "", "the path of a JSON file to write the totals of the run to once it is done")
+	rootCmd.PersistentFlags().BoolVar(&reportLimits, "report-limits", false, "report the requests made to each method of the Slack API and their rate limits once done")
+	rootCmd.PersistentFlags().BoolVar(&skipScopeCheck, "skip-scope-check", false, "don't check that the API token has the scopes needed by the command before running it")
+	rootCmd.AddCommand(diffArchivesCmd)
 	rootCmd.AddCommand(fetchAttachmentsCmd)
+	rootCmd.AddCommand(fetchBookmarksCmd)
+	rootCmd.AddCommand(fetchCanvasesCmd)
+	rootCmd.AddCommand(fetchConversationsCmd)
+	rootCmd.AddCommand(fetchDmsCmd)
 	rootCmd.AddCommand(fetchEmailsCmd)
+	rootCmd.AddCommand(fetchEmojiCmd)
+	rootCmd.AddCommand(fetchPinsCmd)
 	rootCmd.AddCommand(fetchPrivateChannelsCmd)
+	rootCmd.AddCommand(fetchPublicChannelsCmd)
+	rootCmd.AddCommand(fetchScheduledCmd)
+	rootCmd.AddCommand(fetchStarsCmd)
+	rootCmd.AddCommand(fetchTeamCmd)
+	rootCmd.AddCommand(fetchThreadCmd)
+	rootCmd.AddCommand(fetchUsersCmd)
+	rootCmd.AddCommand(listChannelsCmd)
+	rootCmd.AddCommand(mergeArchivesCmd)
+}
+
+// The annotation of the commands which don't augment an input archive, telling
+// setupCommand which flags of the archives they use: archivesOutput for those
+// writing an archive from other inputs, or archivesNone for those writing
+// none.
+const (
+	archivesAnnotation = "archives"
+	archivesOutput     = "output"
+	archivesNone       = "none"
+)
+
+// setupCommand applies the config file, sets up the logging and the proxy
+// before running any command, and checks the flags of the archives the command
+// uses, as given by its archivesAnnotation.
+func setupCommand(cmd *cobra.Command, args []string) error {
+	if err := applyConfigFile(cmd); err != nil {
+		return err
+	}
+	if quiet {
+		verbosity = 0
+		noProgress = true
+	}
+	if err := setupLogging(); err != nil {
+		return err
+	}
+	archives := cmd.Annotations[archivesAnnotation]
+	if archives == "" && inputArchive == "" {
+		return errors.New(`required flag(s) "input-archive" not set`)
+	}
+	if archives != archivesNone {
+		if err := checkOutputFlags(); err != nil {
+			return err
+		}
+	}
+	if err := checkDeadline(); err != nil {
+		return err
+	}
+	if err := checkTempDir(); err != nil {
+		return err
+	}
+	if pageSize < 0 {
+		return fmt.Errorf("invalid --page-size %d, expected a positive number of items", pageSize)
+	}
+	if pageSize > slackexport.MaxPageSize {
+		log.Printf("++++++ --page-size %d is more than Slack allows, using %d instead", pageSize, slackexport.MaxPageSize)
+		pageSize = slackexport.MaxPageSize
+	}
+	if err := setupTokenRefresh(); err != nil {
+		return err
+	}
+	if err := setupHeaders(); err != nil {
+		return err
+	}
+	return setupProxy()
 }
 
+// checkOutputFlags checks the flags of the output archive.
+func checkOutputFlags() error {
+	if _, err := outputArchiveFormat(); err != nil {
+		return err
+	}
+	if compressionLevel < -1 || compressionLevel > 9 {
+		return fmt.Errorf("invalid --compression-level %d, expected a level from 0 to 9, or -1", compressionLevel)
+	}
+	if anonymize {
+		// The names mentions are resolved to couldn't be told apart
+		// from the rest of the text.
+		if resolveMentions {
+			return errors.New("--anonymize can't be used with --resolve-mentions")
+		}
+		if anonymizeMappingFile == "" {
+			anonymizeMappingFile = outputPath() + ".mapping.json"
+		}
+	}
+	return nil
+}
+
+// Execute runs the command given on the command line. Ctrl-C cancels the
+// context of the command, which stops the requests in flight and makes the
+// command return, without writing the output archive.
 func Execute() error {
-	return rootCmd.Execute()
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	cmd, err := rootCmd.ExecuteContextC(ctx)
+	// All are worth knowing about when the command failed too.
+	reportUnreadableEntries()
+	reportRateLimits()
+	writeRunSummary(cmd, err)
+	removeTempFiles()
+	if err != nil && ctx.Err() != nil {
+		log.Print("++++++ Interrupted before the export was complete. Run the same command again to start over, or to carry on if it was given --resume.")
+	}
+	return err
 }
@@ -0,0 +1,17 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/pflag"
+)
+
+func TestPersistentFlagHelpIsShort(t *testing.T) {
+	rootCmd.PersistentFlags().VisitAll(func(flag *pflag.Flag) {
+		// The details of the flags are in the README, for --help to fit
+		// on a screen.
+		if len(flag.Usage) > 120 {
+			t.Errorf("the help of --%s is %d characters long: %s", flag.Name, len(flag.Usage), flag.Usage)
+		}
+	})
+}
@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/time/rate"
+
+	"github.com/grundleborg/slack-advanced-exporter/pkg/slackexport"
+)
+
+// newSlackClient returns a client for making requests to the Slack API with
+// the token, configured from the command line. It is meant to be created once
+// per command and shared by all the requests it makes, so that they can't
+// exceed the rate limit between them, however many of them run concurrently.
+func newSlackClient(token string) *slackexport.Client {
+	client := slackexport.NewClient(token)
+	client.BaseURL = apiBaseUrl
+	client.HTTPClient = newHttpClient()
+	client.Limiter = newSlackRateLimiter()
+	client.MaxRetries = maxRetries
+	client.RetryBaseDelay = retryBaseDelay
+	client.Timeout = httpTimeout
+	client.PageSize = pageSize
+	client.OnRequest = func(*http.Request) {
+		atomic.AddInt64(&apiCalls, 1)
+	}
+	client.OnResponse = func(req *http.Request, resp *http.Response, err error, elapsed time.Duration) {
+		logSlackResponse(req, resp, err, elapsed)
+		observeRateLimits(req, resp)
+	}
+	client.OnRetry = func(*http.Request, string) {
+		atomic.AddInt64(&apiRetries, 1)
+	}
+	client.Log = verbosePrintln
+	if refreshTokenFile != "" {
+		client.Refresh = func(ctx context.Context) (string, error) {
+			return refreshApiToken(ctx, client)
+		}
+	}
+	return client
+}
+
+// The environment variable the client secret of the Slack app is read from
+// when it isn't given on the command line.
+const clientSecretEnvVar = "SLACK_CLIENT_SECRET"
+
+// setupTokenRefresh checks that everything needed to refresh the API token is
+// given along with --refresh-token-file.
+func setupTokenRefresh() error {
+	if refreshTokenFile == "" {
+		return nil
+	}
+	if oauthClientSecret == "" {
+		oauthClientSecret = strings.TrimSpace(os.Getenv(clientSecretEnvVar))
+	}
+	if oauthClientId == "" || oauthClientSecret == "" {
+		return fmt.Errorf("--refresh-token-file needs --client-id, and --client-secret or the %s environment variable", clientSecretEnvVar)
+	}
+	return nil
+}
+
+// refreshApiToken gets a new API token with the refresh token in the file
+// given with --refresh-token-file, and writes the new refresh token Slack
+// returns along with it to the file, as the old one can't be used again.
+func refreshApiToken(ctx context.Context, client *slackexport.Client) (string, error) {
+	buf, err := ioutil.ReadFile(refreshTokenFile)
+	if err != nil {
+		return "", fmt.Errorf("could not read the refresh token file: %w", err)
+	}
+	refreshToken := strings.TrimSpace(string(buf))
+	if refreshToken == "" {
+		return "", fmt.Errorf("the refresh token file %s is empty", refreshTokenFile)
+	}
+
+	token, err := client.RefreshOAuthToken(ctx, oauthClientId, oauthClientSecret, refreshToken)
+	if err != nil {
+		return "", err
+	}
+	if token.RefreshToken != "" && token.RefreshToken != refreshToken {
+		// Written to a temporary file first, so that the refresh token is
+		// never lost to a half-written file.
+		if err := ioutil.WriteFile(refreshTokenFile+".tmp", []byte(token.RefreshToken+"\n"), 0600); err != nil {
+			return "", fmt.Errorf("could not save the new refresh token: %w", err)
+		}
+		if err := os.Rename(refreshTokenFile+".tmp", refreshTokenFile); err != nil {
+			return "", fmt.Errorf("could not save the new refresh token: %w", err)
+		}
+	}
+	verbosePrintln(fmt.Sprintf("Refreshed the API token, which is valid for %d seconds.", token.ExpiresIn))
+	return token.AccessToken, nil
+}
+
+// logSlackResponse prints each request made by a Slack client with -vv, along
+// with its status and how long it took, and with -vvv, its full URL and the
+// headers of its response. The token is sent in a header, and the request
+// headers are never printed.
+func logSlackResponse(req *http.Request, resp *http.Response, err error, elapsed time.Duration) {
+	if verbosity < 2 {
+		return
+	}
+	target := req.URL.Path
+	if verbosity >= 3 {
+		target = redactedUrl(req.URL)
+	}
+	elapsed = elapsed.Round(time.Millisecond)
+
+	if err != nil {
+		verboseLevelPrintln(2, fmt.Sprintf("%s %s failed after %s: %s", req.Method, target, elapsed, err), "url", req.URL.Path, "duration", elapsed)
+		return
+	}
+	verboseLevelPrintln(2, fmt.Sprintf("%s %s returned HTTP %d in %s", req.Method, target, resp.StatusCode, elapsed), "url", req.URL.Path, "status", resp.StatusCode, "duration", elapsed)
+
+	if verbosity >= 3 {
+		names := make([]string, 0, len(resp.Header))
+		for name := range resp.Header {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			verboseLevelPrintln(3, "    "+name+": "+strings.Join(resp.Header[name], ", "), "url", req.URL.Path)
+		}
+	}
+}
+
+// The transport used by all the HTTP clients, or nil for the default one.
+var httpTransport http.RoundTripper
+
+// setupProxy makes all the requests go through the proxy given with --proxy,
+// if any. Otherwise, the default transport uses the proxy set in the
+// environment.
+func setupProxy() error {
+	if proxyFlag == "" {
+		return nil
+	}
+	proxyUrl, err := url.Parse(proxyFlag)
+	if err != nil {
+		return fmt.Errorf("invalid --proxy: %w", err)
+	}
+	if proxyUrl.Scheme == "" || proxyUrl.Host == "" {
+		return fmt.Errorf("invalid --proxy: %s is not an absolute URL", proxyFlag)
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = http.ProxyURL(proxyUrl)
+	httpTransport = transport
+	return nil
+}
+
+// The headers given with --header, as "Name: Value", and as parsed by
+// setupHeaders.
+var (
+	headerFlags   []string
+	customHeaders http.Header
+)
+
+// setupHeaders parses the headers given with --header, to add to every
+// request.
+func setupHeaders() error {
+	customHeaders = make(http.Header)
+	for _, header := range headerFlags {
+		name, value, ok := strings.Cut(header, ":")
+		name = strings.TrimSpace(name)
+		if !ok || name == "" || strings.ContainsAny(name, " \t") {
+			return fmt.Errorf("invalid --header %q, expected a header such as \"X-Gateway-Token: secret\"", header)
+		}
+		// The Slack API token is sent in it.
+		if strings.EqualFold(name, "Authorization") {
+			return errors.New("--header can't set the Authorization header, which holds the Slack API token")
+		}
+		customHeaders.Add(name, strings.TrimSpace(value))
+	}
+	return nil
+}
+
+// newHttpClient returns a client for making requests, to the Slack API or
+// to download files, going through the configured proxy, and printing them
+// with --trace.
+func newHttpClient() *http.Client {
+	transport := httpTransport
+	if traceRequests {
+		transport = &tracingTransport{next: httpTransport}
+	}
+	return &http.Client{Transport: &headersTransport{next: transport}}
+}
+
+// headersTransport sets the User-Agent header of each request going through
+// it, so that Slack and the administrators of proxies can tell where requests
+// come from, and as some proxies block the default one of Go, along with the
+// headers given with --header, which gateways may need.
+type headersTransport struct {
+	next http.RoundTripper
+}
+
+func (t *headersTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+	// A RoundTripper mustn't modify the request it is given.
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", userAgent)
+	for name, values := range customHeaders {
+		req.Header[name] = values
+	}
+	return next.RoundTrip(req)
+}
+
+// The User-Agent of the requests: the name and version of the tool, followed
+// by the Git commit it was built from, if known.
+var userAgent = func() string {
+	res := "slack-advanced-exporter/" + version
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return res
+	}
+	revision, modified := "", false
+	for _, setting := range info.Settings {
+		switch setting.Key {
+		case "vcs.revision":
+			revision = setting.Value
+		case "vcs.modified":
+			modified = setting.Value == "true"
+		}
+	}
+	if revision == "" {
+		return res
+	}
+	if len(revision) > 12 {
+		revision = revision[:12]
+	}
+	if modified {
+		revision += "-dirty"
+	}
+	return res + " (" + revision + ")"
+}()
+
+// newSlackRateLimiter returns a limiter allowing the number of requests per
+// minute set by the user.
+func newSlackRateLimiter() *rate.Limiter {
+	if requestsPerMinute <= 0 {
+		return rate.NewLimiter(rate.Inf, 1)
+	}
+	return rate.NewLimiter(rate.Every(time.Minute/time.Duration(requestsPerMinute)), 1)
+}
+
+// checkTokenScopes fails if the token lacks any of the required scopes, so
+// that users find out before a long export rather than halfway through it.
+// Tokens for which Slack doesn't report scopes, such as legacy tokens, are
+// assumed to have them all.
+func checkTokenScopes(ctx context.Context, client *slackexport.Client, required ...string) error {
+	if skipScopeCheck {
+		return nil
+	}
+
+	verbosePrintln("Checking the scopes of the API token.")
+	auth, err := client.AuthTest(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to check the API token: %w", err)
+	}
+
+	if auth.Scopes == nil {
+		verbosePrintln("Slack didn't report the scopes of the API token, assuming they are sufficient.")
+		return nil
+	}
+
+	missing := make([]string, 0)
+	for _, scope := range required {
+		if !containsString(auth.Scopes, scope) && !containsString(missing, scope) {
+			missing = append(missing, scope)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("the API token is missing the required scopes: %s (use --skip-scope-check to try anyway)", strings.Join(missing, ", "))
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package cmd
+
+import (
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestProxy(t *testing.T) {
+	for _, variable := range []string{"HTTP_PROXY", "http_proxy", "HTTPS_PROXY", "https_proxy", "NO_PROXY", "no_proxy"} {
+		t.Setenv(variable, "")
+	}
+	// Nothing listens on this address, so the requests only get through the
+	// proxy the fake server stands for, which answers them as Slack would.
+	const deadProxy = "http://127.0.0.1:1"
+
+	tests := []struct {
+		name  string
+		env   string
+		proxy string
+	}{
+		{"--proxy", "", "proxy"},
+		{"HTTP_PROXY", "proxy", ""},
+		{"--proxy over HTTP_PROXY", deadProxy, "proxy"},
+	}
+	for _, test := range tests {
+		slack := newFakeSlack(t)
+		resolve := func(value string) string {
+			if value == "proxy" {
+				return slack.URL
+			}
+			return value
+		}
+		t.Setenv("HTTP_PROXY", resolve(test.env))
+
+		input := writeTestArchive(t, map[string]string{"channels.json": "[]"})
+		output := filepath.Join(t.TempDir(), "output.zip")
+		args := append(slack.args(), "--api-base-url", "http://slack.invalid", "--max-retries", "0", "--input-archive", input, "--output-archive", output)
+		if test.proxy != "" {
+			args = append(args, "--proxy", resolve(test.proxy))
+		}
+		args = append(args, "fetch-users", "--api-token", "xoxp-test")
+		if out, err := runExporter(t, args...); err != nil {
+			t.Errorf("%s: fetch-users failed: %v\n%s", test.name, err, out)
+			continue
+		}
+		if len(slack.calls("users.list")) == 0 {
+			t.Errorf("%s: expected users.list to be called through the proxy", test.name)
+		}
+	}
+}
+
+func TestSetupProxy(t *testing.T) {
+	defer func(flag string, transport http.RoundTripper) {
+		proxyFlag, httpTransport = flag, transport
+	}(proxyFlag, httpTransport)
+
+	for _, proxy := range []string{"proxy.internal:3128", "http://", "http://%zz"} {
+		proxyFlag = proxy
+		if err := setupProxy(); err == nil || !strings.HasPrefix(err.Error(), "invalid --proxy") {
+			t.Errorf("expected --proxy %s to be invalid, got %v", proxy, err)
+		}
+	}
+
+	proxyFlag = "http://proxy.internal:3128"
+	if err := setupProxy(); err != nil {
+		t.Fatal(err)
+	}
+	req, _ := http.NewRequest("GET", "https://slack.com/api/auth.test", nil)
+	proxyUrl, err := httpTransport.(*http.Transport).Proxy(req)
+	if err != nil || proxyUrl == nil || proxyUrl.Host != "proxy.internal:3128" {
+		t.Errorf("expected the requests to go through proxy.internal:3128, got %v, %v", proxyUrl, err)
+	}
+}
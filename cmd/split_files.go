@@ -0,0 +1,180 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var (
+	// The largest size of the files of conversations given with
+	// --max-file-size, such as 100MB, and in bytes, or 0 for no limit.
+	maxFileSizeFlag string
+	maxFileBytes    int64
+)
+
+// The file of the archive listing the parts each file of a conversation
+// larger than --max-file-size was split into.
+const filePartsFile = "file_parts.json"
+
+// The parts of the split files, by the path the whole file would have in the
+// archive, such as general/messages.json, or nil when the archive has none.
+var fileParts map[string][]string
+
+// The names of the parts of split files, such as messages.part2.json or
+// messages.part2.jsonl.gz.
+var partFileName = regexp.MustCompile(`^(.+)\.part[0-9]+(\.jsonl?(\.gz)?)$`)
+
+// splitFileName returns the name of the n-th part, from 1, of the file of a
+// conversation, such as messages.part1.json for messages.json.
+func splitFileName(name string, n int) string {
+	return fmt.Sprintf("%s.part%d.json", strings.TrimSuffix(name, ".json"), n)
+}
+
+// unsplitFileName returns the name of the whole file the part belongs to, such
+// as messages.json for messages.part1.json, or the name itself if it isn't
+// that of a part.
+func unsplitFileName(name string) string {
+	return partFileName.ReplaceAllString(name, "$1$2")
+}
+
+// setupFileParts reads the parts the input archive has, so that those of the
+// conversations which aren't written again are kept in the index.
+func setupFileParts(r *zip.ReadCloser) error {
+	var parts map[string][]string
+	found, err := readArchiveJson(r, filePartsFile, &parts)
+	if err != nil || !found {
+		return err
+	}
+	fileParts = parts
+	if fileParts == nil {
+		fileParts = make(map[string][]string)
+	}
+	return nil
+}
+
+// splitConversationFiles returns the files of a conversation, with those
+// larger than --max-file-size split at message boundaries into parts of at
+// most that size, unless a single message is larger, in which case it gets a
+// part of its own. The sizes are those of the JSON arrays, before any
+// conversion to JSON lines or compression. The messages are copied to the
+// parts one at a time, without reading the whole file into memory.
+func splitConversationFiles(files []*conversationFile) ([]*conversationFile, error) {
+	if maxFileBytes == 0 {
+		return files, nil
+	}
+
+	res := make([]*conversationFile, 0, len(files))
+	for _, file := range files {
+		if file.size <= maxFileBytes {
+			res = append(res, file)
+			continue
+		}
+
+		parts, err := splitConversationFile(file)
+		if err != nil {
+			removeConversationFiles(parts)
+			return nil, fmt.Errorf("couldn't split %s: %w", file.name, err)
+		}
+		if len(parts) <= 1 {
+			removeConversationFiles(parts)
+			res = append(res, file)
+			continue
+		}
+		res = append(res, parts...)
+	}
+	return res, nil
+}
+
+// splitConversationFile copies the messages of the file to parts of at most
+// --max-file-size, one message at a time, and returns the parts, which are
+// left to be removed if it fails.
+func splitConversationFile(file *conversationFile) ([]*conversationFile, error) {
+	// The size of an empty array, which is that of a part without its
+	// messages, and of what separates its messages.
+	overhead, separator := int64(3), int64(1)
+	if !compactJson {
+		overhead = 4
+	}
+
+	parts := make([]*conversationFile, 0)
+	var part *jsonArrayWriter
+	var size int64
+	finishPart := func() error {
+		if err := part.Close(); err != nil {
+			return err
+		}
+		return parts[len(parts)-1].finish()
+	}
+	err := file.walk(func(dec *json.Decoder) error {
+		var message json.RawMessage
+		if err := dec.Decode(&message); err != nil {
+			return err
+		}
+		var buf bytes.Buffer
+		if err := newJsonEncoder(&buf).Encode([]json.RawMessage{message}); err != nil {
+			return err
+		}
+		messageSize := int64(buf.Len()) - overhead
+		if part != nil && part.count > 0 && size+separator+messageSize > maxFileBytes {
+			if err := finishPart(); err != nil {
+				return err
+			}
+			part = nil
+		}
+		if part == nil {
+			partFile := &conversationFile{name: splitFileName(file.name, len(parts)+1)}
+			parts = append(parts, partFile)
+			part, size = newJsonArrayWriter(partFile), overhead
+		}
+		if part.count > 0 {
+			size += separator
+		}
+		size += messageSize
+		return part.Write(message)
+	})
+	if err == nil && part != nil {
+		err = finishPart()
+	}
+	return parts, err
+}
+
+// forgetFileParts removes the parts of the files of the conversation written
+// to the given directory from the index, as it is being written again.
+func forgetFileParts(dir string) {
+	for whole := range fileParts {
+		if strings.HasPrefix(whole, dir+"/") {
+			delete(fileParts, whole)
+		}
+	}
+}
+
+// recordFilePart adds the file written to the archive to the index, if it is
+// a part of a split file.
+func recordFilePart(name string) {
+	whole := unsplitFileName(name)
+	if whole == name {
+		return
+	}
+	if fileParts == nil {
+		fileParts = make(map[string][]string)
+	}
+	fileParts[whole] = append(fileParts[whole], name)
+}
+
+// writeFileParts writes the index of the parts of split files, if any.
+func writeFileParts(w archiveWriter) error {
+	if len(fileParts) == 0 {
+		return nil
+	}
+	verbosePrintln(fmt.Sprintf("Writing the parts of the %d split files to %s", len(fileParts), filePartsFile))
+	outFile, err := w.Create(filePartsFile)
+	if err != nil {
+		return err
+	}
+	enc := newJsonEncoder(outFile)
+	return enc.Encode(&fileParts)
+}
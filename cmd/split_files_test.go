@@ -0,0 +1,62 @@
+package cmd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestSplitConversationFiles(t *testing.T) {
+	defer func(max int64, compact bool) { maxFileBytes, compactJson = max, compact }(maxFileBytes, compactJson)
+
+	for _, compact := range []bool{false, true} {
+		compactJson = compact
+		messages := make([]interface{}, 0)
+		for i := 0; i < 20; i++ {
+			messages = append(messages, map[string]interface{}{"ts": fmt.Sprintf("%d.000100", 1500000000+i), "text": strings.Repeat("x", 10*i)})
+		}
+		// One message larger than the parts, which gets a part of its
+		// own.
+		messages = append(messages, map[string]interface{}{"ts": "1600000000.000100", "text": strings.Repeat("y", 1000)})
+		file := &conversationFile{name: "messages.json"}
+		if err := file.encode(messages); err != nil {
+			t.Fatal(err)
+		}
+		small := &conversationFile{name: "small.json"}
+		if err := small.encode(messages[:1]); err != nil {
+			t.Fatal(err)
+		}
+		maxFileBytes = 400
+
+		files, err := splitConversationFiles([]*conversationFile{small, file})
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer removeConversationFiles(files, []*conversationFile{file, small})
+		if len(files) < 4 || files[0] != small {
+			t.Fatalf("with compact=%v, expected the small file followed by several parts, got %d files", compact, len(files))
+		}
+
+		found := make([]interface{}, 0)
+		for i, part := range files[1:] {
+			if part.name != fmt.Sprintf("messages.part%d.json", i+1) {
+				t.Errorf("expected part %d to be named messages.part%d.json, got %s", i+1, i+1, part.name)
+			}
+			var partMessages []interface{}
+			if err := part.decode(&partMessages); err != nil {
+				t.Fatal(err)
+			}
+			data, _ := part.bytes()
+			if part.size != int64(len(data)) {
+				t.Errorf("expected the size of %s to be %d, got %d", part.name, len(data), part.size)
+			}
+			if part.size > maxFileBytes && len(partMessages) > 1 {
+				t.Errorf("with compact=%v, %s has %d messages in %d bytes", compact, part.name, len(partMessages), part.size)
+			}
+			found = append(found, partMessages...)
+		}
+		if fmt.Sprint(found) != fmt.Sprint(messages) {
+			t.Errorf("with compact=%v, expected the parts to have all of the messages, in order, got\n%v", compact, found)
+		}
+	}
+}
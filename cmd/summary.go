@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"io"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+// The path of the file to write the totals of the run to once it is done, with
+// --summary-file.
+var summaryFile string
+
+// The number of bytes of files written to the output, before compression. It
+// is updated from several goroutines, so only through sync/atomic.
+var bytesWritten int64
+
+// The contents of the summary file, for dashboards and to follow how complete
+// scheduled exports are over time.
+type runSummary struct {
+	Command    string    `json:"command"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	// The wall-clock duration of the run, in seconds.
+	DurationSeconds float64 `json:"duration_seconds"`
+	// The error the command failed with, if it did.
+	Error string `json:"error,omitempty"`
+
+	Conversations int `json:"conversations"`
+	// The messages of the conversations, not counting the thread replies.
+	Messages         int   `json:"messages"`
+	Replies          int   `json:"replies"`
+	MessagesExcluded int64 `json:"messages_excluded"`
+	Attachments      int   `json:"attachments"`
+	BytesWritten     int64 `json:"bytes_written"`
+	ApiCalls         int64 `json:"api_calls"`
+	Retries          int64 `json:"retries"`
+	// The numbers of conversations which failed to be fetched, and which
+	// couldn't be read with the token.
+	FailedConversations  int `json:"failed_conversations"`
+	SkippedConversations int `json:"skipped_conversations"`
+	// Whether the --deadline was reached, leaving out conversations.
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// newRunSummary returns the totals of the run so far.
+func newRunSummary() runSummary {
+	finishedAt := time.Now()
+	return runSummary{
+		StartedAt:            runStartedAt.UTC(),
+		FinishedAt:           finishedAt.UTC(),
+		DurationSeconds:      finishedAt.Sub(runStartedAt).Seconds(),
+		Conversations:        conversationsWritten,
+		Messages:             messagesWritten - repliesWritten,
+		Replies:              repliesWritten,
+		MessagesExcluded:     atomic.LoadInt64(&messagesExcluded),
+		Attachments:          attachmentsDownloaded,
+		BytesWritten:         atomic.LoadInt64(&bytesWritten),
+		ApiCalls:             atomic.LoadInt64(&apiCalls),
+		Retries:              atomic.LoadInt64(&apiRetries),
+		FailedConversations:  len(conversationFailures),
+		SkippedConversations: len(conversationsSkipped),
+		Truncated:            exportTruncated,
+	}
+}
+
+// writeRunSummary writes the totals of the command which was run to the file
+// given with --summary-file, along with the error it failed with, if any. It
+// is written whether the command succeeded or not, for failures to show up in
+// dashboards too.
+func writeRunSummary(cmd *cobra.Command, cmdErr error) {
+	if summaryFile == "" || cmd == nil {
+		return
+	}
+	summary := newRunSummary()
+	summary.Command = cmd.Name()
+	if cmdErr != nil {
+		summary.Error = cmdErr.Error()
+	}
+
+	data, err := json.MarshalIndent(&summary, "", "    ")
+	if err == nil {
+		err = os.WriteFile(summaryFile+".tmp", append(data, '\n'), 0644)
+	}
+	if err == nil {
+		err = os.Rename(summaryFile+".tmp", summaryFile)
+	}
+	if err != nil {
+		log.Print("++++++ Failed to write the summary file " + summaryFile + "\n\n" + err.Error() + "\n")
+	}
+}
+
+// countingWriter counts the bytes of the files written to the archive, before
+// they are compressed.
+type countingWriter struct {
+	archiveWriter
+}
+
+// countingArchiveWriter returns the writer, adding the bytes written to it to
+// bytesWritten.
+func countingArchiveWriter(w archiveWriter) archiveWriter {
+	return &countingWriter{archiveWriter: w}
+}
+
+func (c *countingWriter) Create(name string) (io.Writer, error) {
+	out, err := c.archiveWriter.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return byteCounter{out}, nil
+}
+
+func (c *countingWriter) CreateHeader(header *zip.FileHeader) (io.Writer, error) {
+	out, err := c.archiveWriter.CreateHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	return byteCounter{out}, nil
+}
+
+type byteCounter struct {
+	io.Writer
+}
+
+func (b byteCounter) Write(p []byte) (int, error) {
+	n, err := b.Writer.Write(p)
+	atomic.AddInt64(&bytesWritten, int64(n))
+	return n, err
+}
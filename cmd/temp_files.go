@@ -0,0 +1,279 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"sync"
+)
+
+// The directory to write temporary files in, with --temp-dir, or "" for the
+// default one of the system.
+var tempDir string
+
+// The directory of the temporary files of the run, created in tempDir when the
+// first of them is, and removed with all of them by removeTempFiles once the
+// command is done, whether it succeeded or not.
+var (
+	runTempDir     string
+	runTempDirErr  error
+	runTempDirOnce sync.Once
+)
+
+// checkTempDir checks that the directory given with --temp-dir exists.
+func checkTempDir() error {
+	if tempDir == "" {
+		return nil
+	}
+	info, err := os.Stat(tempDir)
+	if err != nil {
+		return fmt.Errorf("invalid --temp-dir: %w", err)
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("invalid --temp-dir: %s is not a directory", tempDir)
+	}
+	return nil
+}
+
+// createTempFile creates a new temporary file in the directory of the run,
+// with a name starting with the prefix.
+func createTempFile(prefix string) (*os.File, error) {
+	runTempDirOnce.Do(func() {
+		runTempDir, runTempDirErr = ioutil.TempDir(tempDir, "slack-advanced-exporter-")
+	})
+	if runTempDirErr != nil {
+		return nil, fmt.Errorf("failed to create a temporary directory, which --temp-dir can put elsewhere: %w", runTempDirErr)
+	}
+	return ioutil.TempFile(runTempDir, prefix)
+}
+
+// removeTempFiles removes the temporary files left by the run, such as those
+// of the conversations which weren't written to the archive when it failed.
+func removeTempFiles() {
+	if runTempDir != "" {
+		os.RemoveAll(runTempDir)
+	}
+}
+
+// A file of a conversation's directory in the archive. Its contents are
+// written to a gzip-compressed temporary file as they are fetched, so that the
+// conversations waiting to be written to the archive, however large, take no
+// memory. Only the features which need all the messages of a file at once,
+// such as merging the file with that of the input archive, read them back
+// into memory, one conversation at a time.
+//
+// The temporary file is only kept open while it is being written, for the
+// conversations waiting to be written not to run out of file descriptors.
+type conversationFile struct {
+	name string
+	// The path of the temporary file, if anything was written to it.
+	path string
+	// While the file is being written, the temporary file and the writer
+	// compressing what is written to it.
+	temp *os.File
+	gz   *gzip.Writer
+	// The size of the contents, before compression.
+	size int64
+	// The error writing the temporary file failed with, if any, which
+	// reading it returns too.
+	err error
+}
+
+// newConversationFile returns a file with the given contents.
+func newConversationFile(name string, data []byte) (*conversationFile, error) {
+	file := &conversationFile{name: name}
+	if _, err := file.Write(data); err != nil {
+		file.remove()
+		return nil, err
+	}
+	return file, file.finish()
+}
+
+// Write adds to the contents of the file, which can't be written again once
+// read.
+func (f *conversationFile) Write(p []byte) (int, error) {
+	if f.gz == nil {
+		if f.path != "" {
+			return 0, fmt.Errorf("%s was written to after being written in full", f.name)
+		}
+		temp, err := createTempFile("conversation-")
+		if err != nil {
+			return 0, err
+		}
+		f.temp, f.path = temp, temp.Name()
+		// The files are only kept for a while, quick compression
+		// will do.
+		f.gz, _ = gzip.NewWriterLevel(temp, gzip.BestSpeed)
+	}
+	n, err := f.gz.Write(p)
+	f.size += int64(n)
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	return n, err
+}
+
+// finish closes the temporary file once the file is written in full.
+func (f *conversationFile) finish() error {
+	if f.gz == nil {
+		return f.err
+	}
+	err := f.gz.Close()
+	if closeErr := f.temp.Close(); err == nil {
+		err = closeErr
+	}
+	f.gz, f.temp = nil, nil
+	if err != nil && f.err == nil {
+		f.err = err
+	}
+	return f.err
+}
+
+// open returns a reader of the contents of the file, which is done being
+// written.
+func (f *conversationFile) open() (io.ReadCloser, error) {
+	if err := f.finish(); err != nil {
+		return nil, err
+	}
+	if f.path == "" {
+		return ioutil.NopCloser(bytes.NewReader(nil)), nil
+	}
+	temp, err := os.Open(f.path)
+	if err != nil {
+		return nil, err
+	}
+	r, err := gzip.NewReader(temp)
+	if err != nil {
+		temp.Close()
+		return nil, err
+	}
+	return &tempFileReader{Reader: r, file: temp}, nil
+}
+
+// bytes returns the contents of the file.
+func (f *conversationFile) bytes() ([]byte, error) {
+	r, err := f.open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return ioutil.ReadAll(r)
+}
+
+// decode parses the contents of the file as JSON into v.
+func (f *conversationFile) decode(v interface{}) error {
+	r, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return json.NewDecoder(r).Decode(v)
+}
+
+// walk reads the file as a JSON array, calling decode with the decoder of the
+// file for each of its elements in turn, so that they are read one at a time
+// rather than all of them at once.
+func (f *conversationFile) walk(decode func(dec *json.Decoder) error) error {
+	r, err := f.open()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	dec := json.NewDecoder(bufio.NewReader(r))
+	if token, err := dec.Token(); err != nil {
+		return err
+	} else if delim, ok := token.(json.Delim); !ok || delim != '[' {
+		return fmt.Errorf("expected an array of messages, got %v", token)
+	}
+	for dec.More() {
+		if err := decode(dec); err != nil {
+			return err
+		}
+	}
+	_, err = dec.Token()
+	return err
+}
+
+// walkMessages calls handle with each message of the file, one at a time.
+func (f *conversationFile) walkMessages(handle func(message map[string]interface{}) error) error {
+	return f.walk(func(dec *json.Decoder) error {
+		var message map[string]interface{}
+		if err := dec.Decode(&message); err != nil {
+			return err
+		}
+		return handle(message)
+	})
+}
+
+// rewriteMessages replaces each message of the file with what rewrite makes
+// of it, one message at a time, writing them to a new temporary file which
+// then replaces that of the file. The file is left as it was if rewrite fails.
+func (f *conversationFile) rewriteMessages(rewrite func(message map[string]interface{}) error) error {
+	out := &conversationFile{name: f.name}
+	messages := newJsonArrayWriter(out)
+	err := f.walkMessages(func(message map[string]interface{}) error {
+		if err := rewrite(message); err != nil {
+			return err
+		}
+		return messages.Write(message)
+	})
+	if err == nil {
+		err = messages.Close()
+	}
+	if err == nil {
+		err = out.finish()
+	}
+	if err != nil {
+		out.remove()
+		return err
+	}
+	f.remove()
+	f.path, f.size = out.path, out.size
+	return nil
+}
+
+// encode replaces the contents of the file with the JSON of v.
+func (f *conversationFile) encode(v interface{}) error {
+	f.remove()
+	if err := newJsonEncoder(f).Encode(v); err != nil {
+		return err
+	}
+	return f.finish()
+}
+
+// remove deletes the temporary file, leaving the file empty.
+func (f *conversationFile) remove() {
+	f.finish()
+	if f.path != "" {
+		os.Remove(f.path)
+	}
+	f.path, f.size, f.err = "", 0, nil
+}
+
+// removeConversationFiles deletes the temporary files of the files, once they
+// are written to the archive.
+func removeConversationFiles(lists ...[]*conversationFile) {
+	for _, files := range lists {
+		for _, file := range files {
+			file.remove()
+		}
+	}
+}
+
+// tempFileReader reads the contents of a temporary file, closing it along
+// with the reader decompressing it.
+type tempFileReader struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (r *tempFileReader) Close() error {
+	r.Reader.Close()
+	return r.file.Close()
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestRewriteMessages(t *testing.T) {
+	defer func(compact bool) { compactJson = compact }(compactJson)
+	for _, compact := range []bool{false, true} {
+		compactJson = compact
+
+		messages := []map[string]interface{}{
+			{"ts": "1500000000.000100", "text": "a <b> & c", "reactions": []interface{}{map[string]interface{}{"name": "+1"}}},
+			{"ts": "1500000001.000100", "text": "d"},
+		}
+		file, err := newConversationFile("messages.json", []byte(`[{"ts": "1500000000.000100", "text": "a <b> & c", "reactions": [{"name": "+1"}]}, {"ts": "1500000001.000100", "text": "d"}]`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer file.remove()
+		err = file.rewriteMessages(func(message map[string]interface{}) error {
+			message["seen"] = true
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// The file is written as encoding all of the messages at once would.
+		expected := &conversationFile{name: "expected.json"}
+		defer expected.remove()
+		for _, message := range messages {
+			message["seen"] = true
+		}
+		if err := expected.encode(messages); err != nil {
+			t.Fatal(err)
+		}
+		got, _ := file.bytes()
+		want, _ := expected.bytes()
+		if string(got) != string(want) || file.size != int64(len(want)) {
+			t.Errorf("with compact=%v, expected\n%s\ngot, in %d bytes\n%s", compact, want, file.size, got)
+		}
+	}
+
+	file, err := newConversationFile("messages.json", []byte(`{"ts": "1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.remove()
+	err = file.rewriteMessages(func(map[string]interface{}) error { return nil })
+	if err == nil || !strings.Contains(err.Error(), "expected an array of messages") {
+		t.Errorf("expected an error about the object, got %v", err)
+	}
+	if got, _ := file.bytes(); string(got) != `{"ts": "1"}` {
+		t.Errorf("expected the file to be left as it was, got %s", got)
+	}
+}
@@ -0,0 +1,147 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	// Whether to print every HTTP request and response.
+	traceRequests bool
+	// How much of the body of each response to print when tracing.
+	traceBodyBytes int
+)
+
+// The request headers and query parameters whose values are never printed.
+var tracedSecrets = []string{"authorization", "cookie", "token", "client_secret", "refresh_token"}
+
+// The string values of the secret keys of JSON bodies, such as the tokens of
+// the response of oauth.v2.access, whose values aren't printed either. The
+// value may be cut short by --trace-body-bytes.
+var tracedJsonSecret = regexp.MustCompile(`("(?:access_token|refresh_token|token|client_secret)"\s*:\s*)"(?:[^"\\]|\\.)*"?`)
+
+// The words in the names of headers which make them look secret, such as
+// those given with --header for gateways, whose values aren't printed either.
+var secretHeaderWords = []string{"auth", "token", "secret", "key", "password", "cookie", "session", "signature", "credential"}
+
+// secretHeader returns whether the value of the header is not to be printed.
+func secretHeader(name string) bool {
+	name = strings.ToLower(name)
+	if containsString(tracedSecrets, name) {
+		return true
+	}
+	for _, word := range secretHeaderWords {
+		if strings.Contains(name, word) {
+			return true
+		}
+	}
+	return false
+}
+
+// tracingTransport prints each request going through it, with its headers and
+// query parameters, and the status, headers and start of the body of its
+// response. Secrets such as the Authorization header, or the tokens in the
+// bodies of responses, are redacted.
+//
+// As it sits below the retries of the Slack client, each attempt is printed.
+type tracingTransport struct {
+	next http.RoundTripper
+}
+
+func (t *tracingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	next := t.next
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	lines := []string{fmt.Sprintf("> %s %s", req.Method, redactedUrl(req.URL))}
+	lines = append(lines, traceHeaders("> ", req.Header)...)
+	tracePrintln(strings.Join(lines, "\n"), "url", req.URL.Path)
+
+	start := time.Now()
+	resp, err := next.RoundTrip(req)
+	elapsed := time.Since(start).Round(time.Millisecond)
+	if err != nil {
+		tracePrintln(fmt.Sprintf("< %s %s failed after %s: %s", req.Method, req.URL.Path, elapsed, err), "url", req.URL.Path)
+		return nil, err
+	}
+
+	lines = []string{fmt.Sprintf("< %s in %s", resp.Status, elapsed)}
+	lines = append(lines, traceHeaders("< ", resp.Header)...)
+
+	// Only text is worth printing: files downloaded from Slack would just
+	// fill the terminal with garbage.
+	contentType := resp.Header.Get("Content-Type")
+	if traceBodyBytes > 0 && (strings.Contains(contentType, "json") || strings.HasPrefix(contentType, "text/")) {
+		start := make([]byte, traceBodyBytes)
+		n, readErr := io.ReadFull(resp.Body, start)
+		start = start[:n]
+		body := string(start)
+		if readErr == nil {
+			body += "..."
+		}
+		lines = append(lines, "< "+tracedJsonSecret.ReplaceAllString(body, `$1"[redacted]"`))
+		resp.Body = &prefixedBody{Reader: io.MultiReader(bytes.NewReader(start), resp.Body), Closer: resp.Body}
+	}
+	tracePrintln(strings.Join(lines, "\n"), "url", req.URL.Path, "status", resp.StatusCode)
+	return resp, nil
+}
+
+// prefixedBody is the body of a response whose start has already been read.
+type prefixedBody struct {
+	io.Reader
+	io.Closer
+}
+
+// tracePrintln prints a line of the trace of the requests, whatever the
+// verbosity, as they are only traced when asked to.
+func tracePrintln(line string, attrs ...interface{}) {
+	if jsonLogging {
+		slog.Info(line, append(attrs, "event", "trace")...)
+	} else {
+		fmt.Fprintln(os.Stderr, line)
+	}
+}
+
+// traceHeaders returns the headers as lines starting with the prefix, sorted
+// by name, with the values of secret ones redacted.
+func traceHeaders(prefix string, header http.Header) []string {
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	lines := make([]string, 0, len(names))
+	for _, name := range names {
+		value := strings.Join(header[name], ", ")
+		if secretHeader(name) {
+			value = "[redacted]"
+		}
+		lines = append(lines, prefix+name+": "+value)
+	}
+	return lines
+}
+
+// redactedUrl returns the URL with the values of secret query parameters
+// redacted.
+func redactedUrl(u *url.URL) string {
+	query := u.Query()
+	for name := range query {
+		if containsString(tracedSecrets, strings.ToLower(name)) {
+			query.Set(name, "[redacted]")
+		}
+	}
+	redacted := *u
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestTraceRedactsTokensInBodies(t *testing.T) {
+	body := `{"ok": true, "access_token": "xoxe.xoxp-1-secret", "refresh_token":"xoxe-1-refresh\"secret", "authed_user": {"token": "xoxp-nested"}, "team": {"id": "T1"}, "client_secret": "abc`
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		io.WriteString(w, body)
+	}))
+	defer server.Close()
+
+	defer func(stderr *os.File, bytes int) {
+		os.Stderr, traceBodyBytes = stderr, bytes
+	}(os.Stderr, traceBodyBytes)
+	trace, err := os.CreateTemp(t.TempDir(), "trace")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer trace.Close()
+	// The body is cut short in the middle of the last secret.
+	os.Stderr, traceBodyBytes = trace, len(body)-1
+
+	client := &http.Client{Transport: &tracingTransport{}}
+	resp, err := client.Get(server.URL + "/oauth.v2.access?client_secret=abc&refresh_token=xoxe-1-refresh")
+	if err != nil {
+		t.Fatal(err)
+	}
+	read, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(read) != body {
+		t.Errorf("expected the body to be read in full, got %q, %v", read, err)
+	}
+
+	traced, err := os.ReadFile(trace.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"xoxe.xoxp-1-secret", "xoxe-1-refresh", "xoxp-nested", "abc"} {
+		if strings.Contains(string(traced), secret) {
+			t.Errorf("%s is in the trace:\n%s", secret, traced)
+		}
+	}
+	for _, kept := range []string{`"access_token": "[redacted]"`, `"refresh_token":"[redacted]"`, `"token": "[redacted]"`, `"team": {"id": "T1"}`} {
+		if !strings.Contains(string(traced), kept) {
+			t.Errorf("expected %s in the trace:\n%s", kept, traced)
+		}
+	}
+}
@@ -1,7 +1,377 @@
 package cmd
 
-func verbosePrintln(line string) {
-	if verbose {
-		println(line)
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// statusPrintf prints the progress or the summary of the command to the
+// standard error, unless --quiet is given.
+func statusPrintf(format string, args ...interface{}) {
+	if quiet {
+		return
+	}
+	fmt.Fprintf(os.Stderr, format, args...)
+}
+
+// verbosePrintln prints the line when running verbosely. The attributes, given
+// as alternating keys and values, only show up in JSON logs, as the line is
+// expected to mention whatever matters in them already, except for the cursor,
+// which also shows up from -vv on.
+func verbosePrintln(line string, attrs ...interface{}) {
+	verboseLevelPrintln(1, line, attrs...)
+}
+
+// verboseLevelPrintln prints the line as verbosePrintln does, but only when
+// --verbose was given at least level times.
+func verboseLevelPrintln(level int, line string, attrs ...interface{}) {
+	if verbosity < level {
+		return
+	}
+	if jsonLogging {
+		slog.Debug(line, attrs...)
+		return
+	}
+	// From -vv on, the pagination cursors are worth printing too, to debug
+	// pagination going wrong.
+	if verbosity >= 2 {
+		for i := 0; i+1 < len(attrs); i += 2 {
+			if attrs[i] == "cursor" && attrs[i+1] != "" {
+				line += fmt.Sprintf(" (cursor %v)", attrs[i+1])
+			}
+		}
+	}
+	println(line)
+}
+
+// newJsonEncoder returns an encoder for the JSON files of the archive, which
+// uses the same indent level as export zip does, unless --compact is given.
+func newJsonEncoder(output io.Writer) *json.Encoder {
+	enc := json.NewEncoder(output)
+	if !compactJson {
+		// The same indent level as export zip uses.
+		enc.SetIndent("", "    ")
+	}
+	return enc
+}
+
+// jsonArrayWriter streams a JSON array to the underlying writer one element at
+// a time, so that large arrays never need to be held in memory in full.
+// The output is identical to what the encoder returned by newJsonEncoder
+// would produce for the whole array at once.
+type jsonArrayWriter struct {
+	output io.Writer
+	count  int
+}
+
+func newJsonArrayWriter(output io.Writer) *jsonArrayWriter {
+	return &jsonArrayWriter{output: output}
+}
+
+// Write appends a single element to the array.
+func (a *jsonArrayWriter) Write(element interface{}) error {
+	var buf []byte
+	var err error
+	separator := ","
+	if compactJson {
+		buf, err = json.Marshal(element)
+	} else {
+		// The same indent level as export zip uses.
+		buf, err = json.MarshalIndent(element, "    ", "    ")
+		separator = ",\n    "
+	}
+	if err != nil {
+		return err
+	}
+
+	if a.count == 0 {
+		separator = "[" + strings.TrimPrefix(separator, ",")
+	}
+	if _, err := io.WriteString(a.output, separator); err != nil {
+		return err
+	}
+	if _, err := a.output.Write(buf); err != nil {
+		return err
+	}
+	a.count++
+	return nil
+}
+
+// Close terminates the array. It must be called exactly once, after the last
+// element has been written.
+func (a *jsonArrayWriter) Close() error {
+	closing := "\n]\n"
+	if compactJson {
+		closing = "]\n"
+	}
+	if a.count == 0 {
+		closing = "[]\n"
+	}
+	_, err := io.WriteString(a.output, closing)
+	return err
+}
+
+// The format the messages of conversations are written in, given with
+// --message-format: array for a JSON array per file, as in Slack's exports,
+// or jsonl for one JSON object per line, in files ending in .jsonl instead of
+// .json.
+var messageFormat string
+
+// isJsonLinesFile returns whether the file of a conversation holds JSON lines.
+func isJsonLinesFile(name string) bool {
+	return strings.HasSuffix(name, ".jsonl")
+}
+
+// jsonLinesFileName returns the name of the file of a conversation holding
+// JSON lines instead of a JSON array, such as messages.jsonl for
+// messages.json.
+func jsonLinesFileName(name string) string {
+	return strings.TrimSuffix(name, ".json") + ".jsonl"
+}
+
+// jsonArrayFileName returns the name of the file of a conversation holding a
+// JSON array, such as messages.json for messages.jsonl, or the name itself if
+// it already does.
+func jsonArrayFileName(name string) string {
+	if !isJsonLinesFile(name) {
+		return name
+	}
+	return strings.TrimSuffix(name, ".jsonl") + ".json"
+}
+
+// jsonLinesToArray returns the objects of a file of JSON lines as a JSON
+// array, for the files of conversations to be read the same way whatever
+// their format.
+func jsonLinesToArray(buf []byte) ([]byte, error) {
+	values := make([]json.RawMessage, 0)
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	for dec.More() {
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+	}
+	return json.Marshal(values)
+}
+
+// jsonArrayToLines returns the elements of a JSON array as JSON lines, one
+// element per line.
+func jsonArrayToLines(buf []byte) ([]byte, error) {
+	var values []json.RawMessage
+	if err := json.Unmarshal(buf, &values); err != nil {
+		return nil, err
+	}
+	var res bytes.Buffer
+	for _, value := range values {
+		if err := json.Compact(&res, value); err != nil {
+			return nil, err
+		}
+		res.WriteByte('\n')
+	}
+	return res.Bytes(), nil
+}
+
+// Whether the files of conversations are written gzip-compressed, with
+// --gzip-json, in files ending in .gz, such as messages.json.gz.
+var gzipJson bool
+
+const gzipSuffix = ".gz"
+
+// isGzipFile returns whether the file of a conversation is gzip-compressed.
+func isGzipFile(name string) bool {
+	return strings.HasSuffix(name, gzipSuffix)
+}
+
+// gunzipFile returns the name and the contents of a file of a conversation
+// once decompressed, such as messages.json for messages.json.gz, or the file
+// as it is if it isn't gzip-compressed.
+func gunzipFile(name string, buf []byte) (string, []byte, error) {
+	if !isGzipFile(name) {
+		return name, buf, nil
+	}
+	gr, err := gzip.NewReader(bytes.NewReader(buf))
+	if err != nil {
+		return "", nil, fmt.Errorf("couldn't decompress the file %s: %w", name, err)
+	}
+	defer gr.Close()
+	data, err := ioutil.ReadAll(gr)
+	if err != nil {
+		return "", nil, fmt.Errorf("couldn't decompress the file %s: %w", name, err)
+	}
+	return strings.TrimSuffix(name, gzipSuffix), data, nil
+}
+
+// newGzipWriter returns a writer compressing what is written to it into the
+// output, at the --compression-level if it is above 0, and at the default
+// level otherwise.
+func newGzipWriter(output io.Writer) (*gzip.Writer, error) {
+	level := gzip.DefaultCompression
+	if compressionLevel > 0 {
+		level = compressionLevel
+	}
+	return gzip.NewWriterLevel(output, level)
+}
+
+// gzipFile returns the name and the contents of a file of a conversation once
+// gzip-compressed, such as messages.json.gz for messages.json. They are
+// compressed at the default level even with --compression-level 0, as storing
+// the archive uncompressed is what --gzip-json is for.
+func gzipFile(name string, buf []byte) (string, []byte, error) {
+	var res bytes.Buffer
+	gw, err := newGzipWriter(&res)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := gw.Write(buf); err != nil {
+		return "", nil, err
+	}
+	if err := gw.Close(); err != nil {
+		return "", nil, err
+	}
+	return name + gzipSuffix, res.Bytes(), nil
+}
+
+// The environment variable from which the Slack API token is read when it
+// isn't given on the command line.
+const apiTokenEnvVar = "SLACK_API_TOKEN"
+
+// resolveApiToken returns the Slack API token to use: the --api-token flag if
+// set, otherwise the contents of the --api-token-file file if set, otherwise
+// the token stored in the system's credential store under --token-keychain if
+// set, otherwise the SLACK_API_TOKEN environment variable.
+func resolveApiToken(flagToken string, tokenFile string, required bool) (string, error) {
+	if flagToken != "" {
+		return flagToken, nil
+	}
+
+	if tokenFile != "" {
+		buf, err := ioutil.ReadFile(tokenFile)
+		if err != nil {
+			return "", fmt.Errorf("could not read the API token file: %w", err)
+		}
+		token := strings.TrimSpace(string(buf))
+		if token == "" {
+			return "", fmt.Errorf("the API token file %s is empty", tokenFile)
+		}
+		return token, nil
+	}
+
+	if tokenKeychain != "" {
+		return readKeychainToken(tokenKeychain)
+	}
+
+	token := strings.TrimSpace(os.Getenv(apiTokenEnvVar))
+	if token == "" && required {
+		return "", fmt.Errorf("a Slack API token is required: use --api-token, --api-token-file, --token-keychain or the %s environment variable", apiTokenEnvVar)
+	}
+	return token, nil
+}
+
+// The units parseByteSize accepts, from the largest to the smallest, so that
+// "MB" is matched before "B".
+var byteSizeUnits = []struct {
+	suffix string
+	bytes  int64
+}{
+	{"TB", 1 << 40}, {"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"T", 1 << 40}, {"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// parseByteSize parses a size in bytes, such as 1024, 500KB or 1.5GB, with
+// units in powers of 1024. An empty value is 0.
+func parseByteSize(value string) (int64, error) {
+	value = strings.ToUpper(strings.TrimSpace(value))
+	if value == "" {
+		return 0, nil
+	}
+
+	multiplier := int64(1)
+	for _, unit := range byteSizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			value = strings.TrimSpace(strings.TrimSuffix(value, unit.suffix))
+			multiplier = unit.bytes
+			break
+		}
+	}
+	size, err := strconv.ParseFloat(value, 64)
+	if err != nil || size < 0 {
+		return 0, errors.New("expected a size such as 500KB, 100MB or 2GB")
+	}
+	return int64(size * float64(multiplier)), nil
+}
+
+// formatByteSize formats a size in bytes in the largest of the units
+// parseByteSize accepts which it is at least one of, such as 1.5GB.
+func formatByteSize(size int64) string {
+	for _, unit := range byteSizeUnits[:4] {
+		if size >= unit.bytes {
+			return fmt.Sprintf("%.1f%s", float64(size)/float64(unit.bytes), unit.suffix)
+		}
+	}
+	return fmt.Sprintf("%dB", size)
+}
+
+// parseSlackTimestamp converts a time given either as a Unix timestamp, with
+// an optional fractional part, or as an RFC3339 date or date-time, into a
+// Slack message timestamp. An empty value is returned unchanged.
+func parseSlackTimestamp(value string) (string, error) {
+	if value == "" {
+		return "", nil
+	}
+
+	if _, err := strconv.ParseFloat(value, 64); err == nil {
+		return value, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		t, err = time.Parse("2006-01-02", value)
+	}
+	if err != nil {
+		return "", fmt.Errorf("%q is neither a Unix timestamp nor an RFC3339 date", value)
+	}
+	return fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/1000), nil
+}
+
+// sortMessagesByTs sorts the messages by timestamp, oldest first, comparing
+// the timestamps as times rather than as strings, which only sort the same
+// while they have as many digits.
+func sortMessagesByTs(messages []map[string]interface{}) {
+	sort.SliceStable(messages, func(i, j int) bool {
+		return slackTimestampTime(messages[i]["ts"]).Before(slackTimestampTime(messages[j]["ts"]))
+	})
+}
+
+// slackTimestampTime returns the time of a Slack message timestamp, such as
+// "1612345678.000200". Malformed timestamps give the zero Unix time.
+func slackTimestampTime(ts interface{}) time.Time {
+	value, _ := ts.(string)
+	parts := strings.SplitN(value, ".", 2)
+	seconds, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Unix(0, 0)
+	}
+	var nanoseconds int64
+	if len(parts) == 2 {
+		// Pad or truncate the fractional part to nanoseconds.
+		fraction := (parts[1] + "000000000")[:9]
+		nanoseconds, err = strconv.ParseInt(fraction, 10, 64)
+		if err != nil {
+			return time.Unix(0, 0)
+		}
 	}
+	return time.Unix(seconds, nanoseconds)
 }
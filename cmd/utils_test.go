@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestVerboseOutputOnStderr(t *testing.T) {
+	slack := newFakeSlack(t)
+	input := writeTestArchive(t, map[string]string{"channels.json": "[]"})
+	output := filepath.Join(t.TempDir(), "output.zip")
+
+	for _, test := range []struct {
+		flag     string
+		expected string
+	}{
+		{"-v", "Processed a batch of users."},
+		{"-vv", "GET /users.list returned HTTP 200"},
+	} {
+		args := append(slack.args(), "--input-archive", input, "--output-archive", output, test.flag, "fetch-users", "--api-token", "xoxp-test")
+		cmd := exporterCommand(args...)
+		var stdout, stderr bytes.Buffer
+		cmd.Stdout, cmd.Stderr = &stdout, &stderr
+		if err := cmd.Run(); err != nil {
+			t.Fatalf("fetch-users %s failed: %v\n%s", test.flag, err, stderr.String())
+		}
+		if !strings.Contains(stderr.String(), test.expected) {
+			t.Errorf("with %s, expected %q on stderr, got\n%s", test.flag, test.expected, stderr.String())
+		}
+		if stdout.Len() > 0 {
+			t.Errorf("with %s, expected nothing on stdout, got\n%s", test.flag, stdout.String())
+		}
+	}
+}
@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Whether to check the files written against the format of Slack's exports.
+var validateOutput bool
+
+// The most problems printed when the output doesn't validate, as a file with
+// a problem tends to have it in all of its entries.
+const maxReportedProblems = 50
+
+// The files of Slack's exports which are checked, by kind: the lists of
+// channels and other conversations, the list of users, and the messages of
+// each conversation.
+var (
+	channelListFiles = []string{"channels.json", "groups.json", "mpims.json"}
+	messageFiles     = []string{"messages.json", "replies.json"}
+	dayFileName      = regexp.MustCompile(`^\d{4}-\d{2}-\d{2}\.json$`)
+)
+
+// The fields the entries of each kind of file must have, and those they may
+// have, along with their JSON types. Importers of Slack's exports mostly
+// choke on missing IDs and timestamps, or on values of the wrong type.
+var (
+	requiredFields = map[string]map[string]string{
+		"channels": {"id": "string", "name": "string", "created": "number"},
+		"dms":      {"id": "string", "created": "number"},
+		"users":    {"id": "string", "name": "string"},
+		"messages": {"type": "string", "ts": "string"},
+	}
+	optionalFields = map[string]map[string]string{
+		"channels": {"is_archived": "boolean", "members": "array", "topic": "object", "purpose": "object", "creator": "string"},
+		"dms":      {"members": "array", "user": "string"},
+		"users":    {"deleted": "boolean", "profile": "object", "real_name": "string", "team_id": "string"},
+		"messages": {"user": "string", "text": "string", "thread_ts": "string", "reactions": "array", "files": "array", "subtype": "string"},
+	}
+)
+
+// validatedFileKind returns the kind of a file of the archive which is
+// checked, or an empty string if it isn't.
+func validatedFileKind(name string) string {
+	dir, base := path.Split(strings.TrimSuffix(name, gzipSuffix))
+	messagesBase := unsplitFileName(jsonArrayFileName(base))
+	switch {
+	case dir == "" && containsString(channelListFiles, base):
+		return "channels"
+	case name == "dms.json":
+		return "dms"
+	case name == "users.json":
+		return "users"
+	case dir != "" && path.Dir(name) == path.Clean(dir) && !strings.Contains(path.Clean(dir), "/") && (containsString(messageFiles, messagesBase) || dayFileName.MatchString(messagesBase)):
+		return "messages"
+	}
+	return ""
+}
+
+// validateFile returns the problems with the entries of a file of the
+// archive which importers of Slack's exports would choke on.
+func validateFile(name string, data []byte) []string {
+	kind := validatedFileKind(name)
+
+	plainName, data, err := gunzipFile(name, data)
+	if err != nil {
+		return []string{err.Error()}
+	}
+	if isJsonLinesFile(plainName) {
+		data, err = jsonLinesToArray(data)
+		if err != nil {
+			return []string{fmt.Sprintf("%s isn't made of JSON lines: %s", name, err)}
+		}
+	}
+
+	var entries []interface{}
+	if err := json.Unmarshal(data, &entries); err != nil {
+		return []string{fmt.Sprintf("%s isn't a JSON array: %s", name, err)}
+	}
+
+	problems := make([]string, 0)
+	for i, value := range entries {
+		entry, ok := value.(map[string]interface{})
+		if !ok {
+			problems = append(problems, fmt.Sprintf("%s: entry %d isn't a JSON object", name, i+1))
+			continue
+		}
+		label := fmt.Sprintf("%s: entry %d", name, i+1)
+		if id, ok := entry["id"].(string); ok {
+			label += " (" + id + ")"
+		} else if ts, ok := entry["ts"].(string); ok {
+			label += " (" + ts + ")"
+		}
+
+		for _, field := range sortedKeys(requiredFields[kind]) {
+			fieldValue, present := entry[field]
+			if !present {
+				problems = append(problems, fmt.Sprintf("%s has no %s", label, field))
+			} else if jsonType(fieldValue) != requiredFields[kind][field] {
+				problems = append(problems, fmt.Sprintf("%s has a %s %s, instead of a %s", label, jsonType(fieldValue), field, requiredFields[kind][field]))
+			}
+		}
+		for _, field := range sortedKeys(optionalFields[kind]) {
+			fieldValue, present := entry[field]
+			if present && fieldValue != nil && jsonType(fieldValue) != optionalFields[kind][field] {
+				problems = append(problems, fmt.Sprintf("%s has a %s %s, instead of a %s", label, jsonType(fieldValue), field, optionalFields[kind][field]))
+			}
+		}
+	}
+	return problems
+}
+
+// jsonType returns the name of the JSON type of a decoded value.
+func jsonType(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case float64:
+		return "number"
+	case bool:
+		return "boolean"
+	case []interface{}:
+		return "array"
+	case map[string]interface{}:
+		return "object"
+	}
+	return "null"
+}
+
+func sortedKeys(fields map[string]string) []string {
+	keys := make([]string, 0, len(fields))
+	for key := range fields {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// validatingWriter checks the files written to the archive which Slack's
+// exports have as they are written, and fails to close the archive if any of
+// them has problems, so that an archive which importers would choke on isn't
+// written in the first place.
+//
+// Only one file is kept in memory at a time, as the writer of a file is only
+// valid until the next one is created.
+type validatingWriter struct {
+	archiveWriter
+	// The name and contents of the file being written, if it is checked.
+	name     string
+	data     *bytes.Buffer
+	problems []string
+}
+
+func (v *validatingWriter) Create(name string) (io.Writer, error) {
+	out, err := v.archiveWriter.Create(name)
+	if err != nil {
+		return nil, err
+	}
+	return v.track(name, out), nil
+}
+
+func (v *validatingWriter) CreateHeader(header *zip.FileHeader) (io.Writer, error) {
+	out, err := v.archiveWriter.CreateHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	return v.track(header.Name, out), nil
+}
+
+// track checks the file written before, and starts recording the contents of
+// the new one, if it is checked.
+func (v *validatingWriter) track(name string, out io.Writer) io.Writer {
+	v.check()
+	if validatedFileKind(name) == "" {
+		return out
+	}
+	v.name = name
+	v.data = &bytes.Buffer{}
+	return io.MultiWriter(out, v.data)
+}
+
+func (v *validatingWriter) check() {
+	if v.data == nil {
+		return
+	}
+	v.problems = append(v.problems, validateFile(v.name, v.data.Bytes())...)
+	v.data = nil
+}
+
+func (v *validatingWriter) Close() error {
+	v.check()
+	if len(v.problems) == 0 {
+		verbosePrintln("The output matches the format of Slack's exports.")
+		return v.archiveWriter.Close()
+	}
+
+	for i, problem := range v.problems {
+		if i == maxReportedProblems {
+			log.Printf("++++++ ... and %d more problems", len(v.problems)-i)
+			break
+		}
+		log.Print("++++++ " + problem)
+	}
+	return fmt.Errorf("the output doesn't match the format of Slack's exports, with %d problems (leave out --validate to write it anyway)", len(v.problems))
+}
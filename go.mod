@@ -1,5 +1,20 @@
 module github.com/grundleborg/slack-advanced-exporter
 
-go 1.16
+go 1.21
 
-require github.com/spf13/cobra v1.2.1
+require (
+	github.com/BurntSushi/toml v1.3.2
+	github.com/schollz/progressbar/v3 v3.14.6
+	github.com/spf13/cobra v1.2.1
+	github.com/spf13/pflag v1.0.5
+	golang.org/x/time v0.5.0
+	gopkg.in/yaml.v3 v3.0.1
+)
+
+require (
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/mitchellh/colorstring v0.0.0-20190213212951-d06e56a500db // indirect
+	github.com/rivo/uniseg v0.4.7 // indirect
+	golang.org/x/sys v0.22.0 // indirect
+	golang.org/x/term v0.22.0 // indirect
+)
@@ -0,0 +1,35 @@
+package slackexport
+
+import (
+	"context"
+	"strings"
+)
+
+// The identity of the user (or bot) a token belongs to, as returned by
+// auth.test.
+type AuthTest struct {
+	Url    string `json:"url"`
+	Team   string `json:"team"`
+	User   string `json:"user"`
+	TeamId string `json:"team_id"`
+	UserId string `json:"user_id"`
+	// From the X-OAuth-Scopes response header, if Slack sent it.
+	Scopes []string `json:"-"`
+}
+
+// AuthTest returns the identity of the user (or bot) the token belongs to,
+// along with the scopes of the token if Slack reports them.
+func (c *Client) AuthTest(ctx context.Context) (*AuthTest, error) {
+	var data AuthTest
+	header, err := c.get(ctx, "auth.test", nil, &data)
+	if err != nil {
+		return nil, err
+	}
+
+	if scopes := header.Get("X-OAuth-Scopes"); scopes != "" {
+		for _, scope := range strings.Split(scopes, ",") {
+			data.Scopes = append(data.Scopes, strings.TrimSpace(scope))
+		}
+	}
+	return &data, nil
+}
@@ -0,0 +1,506 @@
+// Package slackexport is a client for the methods of the Slack Web API which
+// the Slack Advanced Exporter uses to supplement Slack's exports, so that they
+// can be called from other Go programs as well.
+//
+// A Client holds the token and the settings of the requests. It retries the
+// requests which fail or are rate limited, and can be shared by several
+// goroutines, which then share its rate limit.
+package slackexport
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// DefaultBaseURL is the base URL of the Slack Web API.
+const DefaultBaseURL = "https://slack.com/api"
+
+// A Client makes requests to the Slack Web API with an API token. Its fields
+// must not be changed once it is in use.
+type Client struct {
+	// The API token, either a user token (xoxp-) or a bot token (xoxb-).
+	Token string
+	// The base URL of the API, such as DefaultBaseURL.
+	BaseURL string
+	// The client the requests are made with, or nil for http.DefaultClient.
+	HTTPClient *http.Client
+	// Limits the rate of the requests, or nil for no limit.
+	Limiter *rate.Limiter
+	// The number of times a failed request is retried before giving up.
+	MaxRetries int
+	// The delay before the first retry of a failed request, doubled on each
+	// further retry, up to five minutes.
+	RetryBaseDelay time.Duration
+	// How long to wait for each request, including reading its response,
+	// before retrying it, or 0 to wait forever.
+	Timeout time.Duration
+	// The number of items to ask for in each page of the methods which
+	// return results in pages, or 0 for the default of each method. It is
+	// capped to the largest page Slack allows for each method.
+	PageSize int
+	// The smallest page the history of a conversation is fetched in. When a
+	// page of the history times out, as pages of very large messages can,
+	// it is asked for again at half the size, down to this size, below which
+	// it is retried as any other request. 0 leaves the size of the pages as
+	// it is.
+	MinPageSize int
+	// If set, called before each request is sent, including retries.
+	OnRequest func(req *http.Request)
+	// If set, called after each request is sent, including retries, with its
+	// response or error and how long it took to get the response headers.
+	OnResponse func(req *http.Request, resp *http.Response, err error, elapsed time.Duration)
+	// If set, called before each retry of a request, with why it failed.
+	OnRetry func(req *http.Request, reason string)
+	// If set, called with messages about what the client is doing, along
+	// with attributes given as alternating keys and values.
+	Log func(msg string, attrs ...interface{})
+	// If set, called to get a new token when Slack says the current one has
+	// expired, as short-lived tokens do with token rotation, after which the
+	// request is retried with the new token.
+	Refresh func(ctx context.Context) (string, error)
+
+	// The token returned by the last call to Refresh, if any, which replaces
+	// Token. Refreshes are made one at a time.
+	tokenMutex     sync.Mutex
+	refreshedToken string
+	refreshMutex   sync.Mutex
+
+	// When Slack rate limits one request, all the requests running
+	// concurrently are held back until the Retry-After period has elapsed,
+	// rather than each of them hitting the limit in turn.
+	rateLimitMutex   sync.Mutex
+	rateLimitedUntil time.Time
+}
+
+// NewClient returns a client for the token with the default settings: five
+// retries starting one second apart, two minutes per request, and pages of
+// history down to 10 messages when they time out.
+func NewClient(token string) *Client {
+	return &Client{
+		Token:          token,
+		BaseURL:        DefaultBaseURL,
+		MaxRetries:     5,
+		RetryBaseDelay: time.Second,
+		Timeout:        2 * time.Minute,
+		MinPageSize:    10,
+	}
+}
+
+// An Error is returned when Slack responds to a request without ok=true.
+type Error struct {
+	// The API method called, such as conversations.history.
+	Method string
+	// The error code given by Slack, such as invalid_auth or not_in_channel.
+	Code string
+	// With missing_scope, the scopes the method needs and those the token
+	// has, as comma-separated lists.
+	Needed   string
+	Provided string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("unexpected lack of ok=true in Slack API response to %s. Is access token correct?", e.Method)
+	}
+	msg := fmt.Sprintf("Slack API call to %s failed with %s", e.Method, e.Code)
+	if hint := e.Hint(); hint != "" {
+		msg += ": " + hint
+	}
+	return msg
+}
+
+// Hint returns what can be done about the most common errors, or an empty
+// string for the others.
+func (e *Error) Hint() string {
+	switch e.Code {
+	case "invalid_auth", "not_authed":
+		return "the API token is wrong or incomplete, check that it was copied in full"
+	case "token_revoked", "token_expired", "account_inactive":
+		return "the API token is no longer valid, get a new one from the settings of the Slack app"
+	case "missing_scope":
+		if e.Needed != "" && e.Provided != "" {
+			return fmt.Sprintf("the API token lacks the %s scope, as it only has %s. Add it to the Slack app and reinstall the app to the workspace", e.Needed, e.Provided)
+		}
+		return "the API token lacks a scope this method needs, add it to the Slack app and reinstall the app to the workspace"
+	case "ratelimited":
+		return "Slack is rate limiting the requests, try again later or with fewer requests in parallel"
+	case "not_in_channel":
+		return "invite the bot to the conversation to fetch it"
+	case "channel_not_found":
+		return "the conversation doesn't exist, or the API token can't see it"
+	}
+	return ""
+}
+
+// MaxPageSize is the largest page size Slack allows for any method.
+const MaxPageSize = 1000
+
+// The largest page sizes Slack allows for the methods which allow less than
+// MaxPageSize.
+var maxPageSizes = map[string]int{
+	"conversations.history": 999,
+	"conversations.replies": 999,
+}
+
+// pageSize returns the number of items to ask for in each page of the method,
+// which is def unless PageSize is set.
+func (c *Client) pageSize(method string, def int) string {
+	return strconv.Itoa(c.pageLimit(method, def))
+}
+
+// pageLimit is pageSize, as a number.
+func (c *Client) pageLimit(method string, def int) int {
+	size := def
+	if c.PageSize > 0 {
+		size = c.PageSize
+	}
+	max, ok := maxPageSizes[method]
+	if !ok {
+		max = MaxPageSize
+	}
+	if size > max {
+		size = max
+	}
+	return size
+}
+
+// The part common to the responses of the methods which return results in
+// pages.
+type cursorPage struct {
+	ResponseMetadata struct {
+		NextCursor string `json:"next_cursor"`
+	} `json:"response_metadata"`
+}
+
+// nextCursor returns the cursor of the next page, failing if it is that of the
+// page just fetched, as following it would fetch the same page forever.
+func (p *cursorPage) nextCursor(method string, current string) (string, error) {
+	next := p.ResponseMetadata.NextCursor
+	if next != "" && next == current {
+		return "", fmt.Errorf("Slack API returned the cursor of the page just fetched, %s, as the next page of %s, giving up rather than fetching it forever", shortCursor(next), method)
+	}
+	return next, nil
+}
+
+// shortCursor truncates the cursor for logging, as cursors are long and only
+// their start is needed to tell them apart.
+func shortCursor(cursor string) string {
+	if len(cursor) <= 20 {
+		return cursor
+	}
+	return cursor[:20] + "..."
+}
+
+func (c *Client) log(msg string, attrs ...interface{}) {
+	if c.Log != nil {
+		c.Log(msg, attrs...)
+	}
+}
+
+// URL returns the URL of the API method, such as conversations.list.
+func (c *Client) URL(method string) string {
+	return strings.TrimRight(c.BaseURL, "/") + "/" + method
+}
+
+// Get calls the API method with the given parameters, and decodes its
+// response into result. It fails with an *Error if Slack doesn't respond
+// with ok=true.
+func (c *Client) Get(ctx context.Context, method string, params url.Values, result interface{}) error {
+	_, err := c.get(ctx, method, params, result)
+	return err
+}
+
+// CurrentToken returns the token the requests are made with: Token, unless it
+// was refreshed since.
+func (c *Client) CurrentToken() string {
+	c.tokenMutex.Lock()
+	defer c.tokenMutex.Unlock()
+	if c.refreshedToken != "" {
+		return c.refreshedToken
+	}
+	return c.Token
+}
+
+// refreshToken gets a new token, unless the token which expired was already
+// replaced by another request, so that requests hitting the expiry at the
+// same time only refresh the token once.
+func (c *Client) refreshToken(ctx context.Context, expired string) error {
+	c.refreshMutex.Lock()
+	defer c.refreshMutex.Unlock()
+	if c.CurrentToken() != expired {
+		return nil
+	}
+
+	c.log("The API token expired, refreshing it.")
+	token, err := c.Refresh(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to refresh the expired API token: %w", err)
+	}
+
+	c.tokenMutex.Lock()
+	c.refreshedToken = token
+	c.tokenMutex.Unlock()
+	return nil
+}
+
+// get is Get, also returning the headers of the response.
+func (c *Client) get(ctx context.Context, method string, params url.Values, result interface{}) (http.Header, error) {
+	token := c.CurrentToken()
+	header, err := c.getWithToken(ctx, token, method, params, result)
+
+	var slackErr *Error
+	if c.Refresh != nil && errors.As(err, &slackErr) && slackErr.Code == "token_expired" {
+		if err := c.refreshToken(ctx, token); err != nil {
+			return nil, err
+		}
+		return c.getWithToken(ctx, c.CurrentToken(), method, params, result)
+	}
+	return header, err
+}
+
+func (c *Client) getWithToken(ctx context.Context, token string, method string, params url.Values, result interface{}) (http.Header, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", c.URL(method), nil)
+	if err != nil {
+		return nil, fmt.Errorf("got error %s when building the request", err)
+	}
+	req.URL.RawQuery = params.Encode()
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	resp, err := c.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Slack API returned HTTP code %d", resp.StatusCode)
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	var status struct {
+		Ok       bool   `json:"ok"`
+		Error    string `json:"error"`
+		Needed   string `json:"needed"`
+		Provided string `json:"provided"`
+	}
+	if err := json.Unmarshal(body, &status); err != nil {
+		return nil, err
+	}
+	if !status.Ok {
+		return nil, &Error{Method: method, Code: status.Error, Needed: status.Needed, Provided: status.Provided}
+	}
+	if result != nil {
+		if err := json.Unmarshal(body, result); err != nil {
+			return nil, err
+		}
+	}
+	return resp.Header, nil
+}
+
+// Do sends the request, transparently retrying it when Slack responds with
+// HTTP 429 (rate limited) or a 5xx status, or when the request fails at the
+// network level or times out. It can be used to download files from Slack as
+// well as to call the API.
+//
+// Rate limited requests are retried after the period given in the Retry-After
+// header. Other failures are retried with exponential backoff and jitter.
+//
+// Once the context of the request is done, Do stops waiting or retrying, and
+// returns the error of the context.
+func (c *Client) Do(req *http.Request) (*http.Response, error) {
+	ctx := req.Context()
+	for attempt := 0; ; attempt++ {
+		if err := c.waitForRateLimit(ctx); err != nil {
+			return nil, err
+		}
+		if c.Limiter != nil {
+			if err := c.Limiter.Wait(ctx); err != nil {
+				return nil, err
+			}
+		}
+		if c.OnRequest != nil {
+			c.OnRequest(req)
+		}
+		start := time.Now()
+		resp, err := c.send(req)
+		if c.OnResponse != nil {
+			c.OnResponse(req, resp, err, time.Since(start))
+		}
+
+		var delay time.Duration
+		var reason string
+		switch {
+		case ctx.Err() != nil:
+			// Not a failure of the request, so there is no point retrying it.
+			if resp != nil {
+				resp.Body.Close()
+			}
+			return nil, ctx.Err()
+		case errors.Is(err, context.DeadlineExceeded):
+			if ctx.Value(noTimeoutRetriesKey{}) != nil {
+				return nil, err
+			}
+			reason = fmt.Sprintf("no response within %s", c.Timeout)
+			delay = c.backoffDelay(attempt)
+		case err != nil:
+			reason = err.Error()
+			delay = c.backoffDelay(attempt)
+		case resp.StatusCode == http.StatusTooManyRequests:
+			resp.Body.Close()
+			reason = "rate limited by Slack API"
+			delay = retryAfterDelay(resp)
+			c.holdBackRequests(delay)
+		case resp.StatusCode >= 500:
+			resp.Body.Close()
+			reason = fmt.Sprintf("Slack API returned HTTP code %d", resp.StatusCode)
+			delay = c.backoffDelay(attempt)
+		default:
+			return resp, nil
+		}
+
+		if attempt >= c.MaxRetries {
+			return nil, fmt.Errorf("giving up after %d retries: %s", c.MaxRetries, reason)
+		}
+
+		c.log(fmt.Sprintf("Request failed (%s), retrying in %s.", reason, delay), "url", req.URL.Path, "attempt", attempt+1)
+		if c.OnRetry != nil {
+			c.OnRetry(req, reason)
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// The key of the context value telling Do to give up on requests which time
+// out, instead of retrying them, for the caller to retry them differently.
+type noTimeoutRetriesKey struct{}
+
+// withoutTimeoutRetries returns the context for requests which Do doesn't
+// retry when they time out.
+func withoutTimeoutRetries(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noTimeoutRetriesKey{}, true)
+}
+
+// isTimeout returns whether the request failed because it timed out, rather
+// than because its context is done.
+func isTimeout(ctx context.Context, err error) bool {
+	return errors.Is(err, context.DeadlineExceeded) && ctx.Err() == nil
+}
+
+// sleep waits for the given duration, unless the context is done first, in
+// which case it returns the error of the context.
+func sleep(ctx context.Context, delay time.Duration) error {
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// send sends the request once, giving up if it takes longer than the timeout.
+// The timeout covers reading the body of the response as well, so it only
+// ends once the body is closed.
+//
+// A timeout per request, rather than one on the HTTP client, lets Do retry
+// requests which timed out.
+func (c *Client) send(req *http.Request) (*http.Response, error) {
+	client := c.HTTPClient
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if c.Timeout <= 0 {
+		return client.Do(req)
+	}
+
+	ctx, cancel := context.WithTimeout(req.Context(), c.Timeout)
+	resp, err := client.Do(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelOnClose releases the context of a request when its response body is
+// closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// retryAfterDelay returns how long Slack asked us to wait before retrying.
+// If the header is missing or malformed, we wait for one second.
+func retryAfterDelay(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds < 0 {
+		return time.Second
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+// waitForRateLimit blocks until any Retry-After period requested by Slack
+// has elapsed.
+func (c *Client) waitForRateLimit(ctx context.Context) error {
+	c.rateLimitMutex.Lock()
+	until := c.rateLimitedUntil
+	c.rateLimitMutex.Unlock()
+	return sleep(ctx, time.Until(until))
+}
+
+// holdBackRequests delays all further requests by at least the given duration.
+func (c *Client) holdBackRequests(delay time.Duration) {
+	c.rateLimitMutex.Lock()
+	defer c.rateLimitMutex.Unlock()
+	if until := time.Now().Add(delay); until.After(c.rateLimitedUntil) {
+		c.rateLimitedUntil = until
+	}
+}
+
+// The longest delay between two retries of a request, however many retries
+// are allowed.
+const maxRetryDelay = 5 * time.Minute
+
+// backoffDelay returns the exponential backoff delay for the given attempt,
+// capped at maxRetryDelay, plus up to 10% of random jitter so that retries
+// don't all fire at once. It is computed in floating point, as shifting the
+// base delay would overflow with many retries.
+func (c *Client) backoffDelay(attempt int) time.Duration {
+	if c.RetryBaseDelay <= 0 {
+		return 0
+	}
+	delay := maxRetryDelay
+	if d := float64(c.RetryBaseDelay) * math.Pow(2, float64(attempt)); d < float64(maxRetryDelay) {
+		delay = time.Duration(d)
+	}
+	return delay + time.Duration(rand.Int63n(int64(delay)/10+1))
+}
@@ -0,0 +1,166 @@
+package slackexport
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// retryingServer returns a server answering each request with the status of
+// its attempt, and "ok" once there are no statuses left, along with the number
+// of requests it got so far.
+func retryingServer(t *testing.T, statuses ...int) (*httptest.Server, func() int) {
+	var mutex sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		attempt := attempts
+		attempts++
+		mutex.Unlock()
+		if attempt < len(statuses) {
+			w.WriteHeader(statuses[attempt])
+			return
+		}
+		io.WriteString(w, "ok")
+	}))
+	t.Cleanup(server.Close)
+	return server, func() int {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return attempts
+	}
+}
+
+func TestDoRetries(t *testing.T) {
+	server, attempts := retryingServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	client := NewClient("xoxp-test")
+	client.RetryBaseDelay = time.Millisecond
+	var reasons []string
+	client.OnRetry = func(_ *http.Request, reason string) {
+		reasons = append(reasons, reason)
+	}
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Errorf("expected the response of the last attempt, got HTTP %d with %q", resp.StatusCode, body)
+	}
+	if attempts() != 3 {
+		t.Errorf("expected 3 attempts, got %d", attempts())
+	}
+	if len(reasons) != 2 || reasons[0] != "Slack API returned HTTP code 503" {
+		t.Errorf("expected 2 retries of the 503 responses, got %q", reasons)
+	}
+}
+
+func TestDoGivesUp(t *testing.T) {
+	server, attempts := retryingServer(t, http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	client := NewClient("xoxp-test")
+	client.RetryBaseDelay = time.Millisecond
+	client.MaxRetries = 2
+
+	req, err := http.NewRequest("GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := client.Do(req)
+	if err == nil {
+		resp.Body.Close()
+		t.Fatal("expected Do to give up")
+	}
+	if !strings.Contains(err.Error(), "giving up after 2 retries: Slack API returned HTTP code 503") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if attempts() != 3 {
+		t.Errorf("expected the request and its 2 retries, got %d attempts", attempts())
+	}
+}
+
+func TestDoStopsWithTheContext(t *testing.T) {
+	server, attempts := retryingServer(t, http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	client := NewClient("xoxp-test")
+	client.RetryBaseDelay = time.Hour
+
+	ctx, cancel := context.WithCancel(context.Background())
+	client.OnRetry = func(*http.Request, string) {
+		cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", server.URL, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(req); err != context.Canceled {
+		t.Errorf("expected the error of the context, got %v", err)
+	}
+	if attempts() != 1 {
+		t.Errorf("expected no retry once the context is done, got %d attempts", attempts())
+	}
+}
+
+func TestRepeatedCursor(t *testing.T) {
+	var mutex sync.Mutex
+	var cursors []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		cursors = append(cursors, r.URL.Query().Get("cursor"))
+		pages := len(cursors)
+		mutex.Unlock()
+		if pages > 5 {
+			t.Error("kept fetching the same page")
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		// The first page points to the second one, which points to itself.
+		io.WriteString(w, `{"ok": true, "members": [{"id": "U1"}], "response_metadata": {"next_cursor": "dXNlcjpVMg=="}}`)
+	}))
+	defer server.Close()
+
+	client := NewClient("xoxp-test")
+	client.BaseURL = server.URL
+	client.MaxRetries = 0
+	_, err := client.Users(context.Background())
+	if err == nil {
+		t.Fatal("expected an error for the repeated cursor")
+	}
+	if !strings.Contains(err.Error(), "returned the cursor of the page just fetched, dXNlcjpVMg==, as the next page of users.list") {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if len(cursors) != 2 || cursors[0] != "" || cursors[1] != "dXNlcjpVMg==" {
+		t.Errorf("expected the first page and the repeated one to be fetched once, got the cursors %q", cursors)
+	}
+}
+
+func TestBackoffDelay(t *testing.T) {
+	client := NewClient("xoxp-test")
+	for attempt, expected := range map[int]time.Duration{0: time.Second, 1: 2 * time.Second, 4: 16 * time.Second, 8: 256 * time.Second, 9: maxRetryDelay} {
+		if delay := client.backoffDelay(attempt); delay < expected || delay > expected+expected/10 {
+			t.Errorf("expected a delay of %s plus up to 10%% for attempt %d, got %s", expected, attempt, delay)
+		}
+	}
+	// Doubling the delay this many times would overflow.
+	for _, attempt := range []int{40, 63, 64, 100, 1000} {
+		if delay := client.backoffDelay(attempt); delay < maxRetryDelay || delay > maxRetryDelay+maxRetryDelay/10 {
+			t.Errorf("expected the delay of attempt %d to be capped at %s plus up to 10%%, got %s", attempt, maxRetryDelay, delay)
+		}
+	}
+	client.RetryBaseDelay = 0
+	if delay := client.backoffDelay(1000); delay != 0 {
+		t.Errorf("expected no delay without a base delay, got %s", delay)
+	}
+}
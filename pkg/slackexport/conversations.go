@@ -0,0 +1,264 @@
+package slackexport
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+// ListConversations lists all the conversations of the given comma-separated
+// types, such as private_channel,mpim, that are accessible with the token,
+// leaving out the archived ones if excludeArchived is set. The teamId is only
+// needed with a token installed on a whole Enterprise Grid organization, and
+// can be empty otherwise.
+func (c *Client) ListConversations(ctx context.Context, types string, excludeArchived bool, teamId string) ([]map[string]interface{}, error) {
+	res := make([]map[string]interface{}, 0)
+
+	params := url.Values{}
+	params.Set("limit", c.pageSize("conversations.list", 1000))
+	params.Set("types", types)
+	// Slack's default for archived channels isn't documented consistently,
+	// so we always say whether we want them.
+	params.Set("exclude_archived", strconv.FormatBool(excludeArchived))
+	if teamId != "" {
+		params.Set("team_id", teamId)
+	}
+
+	for {
+		var data struct {
+			Channels []map[string]interface{} `json:"channels"`
+			cursorPage
+		}
+		if err := c.Get(ctx, "conversations.list", params, &data); err != nil {
+			return nil, err
+		}
+		res = append(res, data.Channels...)
+
+		cursor, err := data.nextCursor("conversations.list", params.Get("cursor"))
+		if err != nil {
+			return nil, err
+		}
+		c.log("Processed a batch of channels.", "cursor", shortCursor(cursor))
+		if cursor == "" {
+			break // Exit the loop if there's no next cursor
+		}
+		params.Set("cursor", cursor)
+	}
+	return res, nil
+}
+
+// The range of messages to fetch from the history of a conversation, as Slack
+// timestamps. Both bounds are inclusive, and empty when unbounded.
+type HistoryRange struct {
+	Oldest string
+	Latest string
+}
+
+func (r HistoryRange) params(params url.Values) {
+	if r.Oldest != "" {
+		params.Set("oldest", r.Oldest)
+		params.Set("inclusive", "true")
+	}
+	if r.Latest != "" {
+		params.Set("latest", r.Latest)
+		params.Set("inclusive", "true")
+	}
+}
+
+// History calls handle for each page of the history of the conversation in
+// the range, newest messages first, starting from the given cursor, which is
+// empty for the first page. Along with the messages of each page, handle gets
+// the cursor of the next page, which is empty for the last page.
+//
+// A page which times out is asked for again at half the size, down to
+// MinPageSize, and the following pages are fetched at that size too.
+func (c *Client) History(ctx context.Context, channelId string, historyRange HistoryRange, cursor string, handle func(messages []map[string]interface{}, nextCursor string) error) error {
+	limit := c.pageLimit("conversations.history", 200)
+	params := url.Values{}
+	params.Set("channel", channelId)
+	historyRange.params(params)
+
+	for {
+		params.Set("limit", strconv.Itoa(limit))
+		if cursor != "" {
+			params.Set("cursor", cursor)
+		}
+
+		var data struct {
+			Messages []map[string]interface{} `json:"messages"`
+			cursorPage
+		}
+		pageCtx := ctx
+		if c.MinPageSize > 0 && limit > c.MinPageSize {
+			pageCtx = withoutTimeoutRetries(ctx)
+		}
+		if err := c.Get(pageCtx, "conversations.history", params, &data); err != nil {
+			if pageCtx != ctx && isTimeout(ctx, err) {
+				limit /= 2
+				if limit < c.MinPageSize {
+					limit = c.MinPageSize
+				}
+				c.log(fmt.Sprintf("A page of the history of %s timed out, asking for %d messages per page instead.", channelId, limit), "channel", channelId, "limit", limit)
+				continue
+			}
+			return err
+		}
+
+		next, err := data.nextCursor("conversations.history", cursor)
+		if err != nil {
+			return err
+		}
+		cursor = next
+		if err := handle(data.Messages, cursor); err != nil {
+			return err
+		}
+		c.log("Processed a batch of messages.", "channel", channelId, "cursor", shortCursor(cursor))
+
+		if cursor == "" {
+			break // Exit the loop if there's no next cursor
+		}
+	}
+	return nil
+}
+
+// Replies calls handle for each page of the thread whose root message has the
+// given timestamp, starting with the root message. Only the replies posted at
+// or after oldest are fetched, unless it is empty.
+func (c *Client) Replies(ctx context.Context, channelId string, ts string, oldest string, handle func(messages []map[string]interface{}) error) error {
+	params := url.Values{}
+	params.Set("limit", c.pageSize("conversations.replies", 200))
+	params.Set("channel", channelId)
+	params.Set("ts", ts)
+	HistoryRange{Oldest: oldest}.params(params)
+
+	for {
+		var data struct {
+			Messages []map[string]interface{} `json:"messages"`
+			cursorPage
+		}
+		if err := c.Get(ctx, "conversations.replies", params, &data); err != nil {
+			return err
+		}
+
+		if err := handle(data.Messages); err != nil {
+			return err
+		}
+
+		cursor, err := data.nextCursor("conversations.replies", params.Get("cursor"))
+		if err != nil {
+			return err
+		}
+		c.log("Processed a batch of replies.", "channel", channelId, "timestamp", ts, "cursor", shortCursor(cursor))
+		if cursor == "" {
+			break // Exit the loop if there's no next cursor
+		}
+		params.Set("cursor", cursor)
+	}
+	return nil
+}
+
+// Members returns the IDs of the members of the conversation.
+func (c *Client) Members(ctx context.Context, channelId string) ([]string, error) {
+	members := make([]string, 0)
+
+	params := url.Values{}
+	params.Set("limit", c.pageSize("conversations.members", 1000))
+	params.Set("channel", channelId)
+
+	for {
+		var data struct {
+			Members []string `json:"members"`
+			cursorPage
+		}
+		if err := c.Get(ctx, "conversations.members", params, &data); err != nil {
+			return nil, err
+		}
+		members = append(members, data.Members...)
+
+		cursor, err := data.nextCursor("conversations.members", params.Get("cursor"))
+		if err != nil {
+			return nil, err
+		}
+		c.log("Processed a batch of members.", "channel", channelId, "cursor", shortCursor(cursor))
+		if cursor == "" {
+			break
+		}
+		params.Set("cursor", cursor)
+	}
+	return members, nil
+}
+
+// Reactions returns the reactions of the message, with all of their users,
+// which the history only lists some of for popular reactions.
+func (c *Client) Reactions(ctx context.Context, channelId string, ts string) ([]interface{}, error) {
+	params := url.Values{}
+	params.Set("channel", channelId)
+	params.Set("timestamp", ts)
+	params.Set("full", "true")
+
+	var data struct {
+		Message struct {
+			Reactions []interface{} `json:"reactions"`
+		} `json:"message"`
+	}
+	if err := c.Get(ctx, "reactions.get", params, &data); err != nil {
+		return nil, err
+	}
+	return data.Message.Reactions, nil
+}
+
+// ConversationItems calls an API method listing the items of a conversation,
+// such as pins.list or bookmarks.list, and returns the list found in the given
+// field of its response.
+func (c *Client) ConversationItems(ctx context.Context, method string, field string, channelId string) ([]map[string]interface{}, error) {
+	params := url.Values{}
+	params.Set("channel", channelId)
+
+	var data map[string]interface{}
+	if err := c.Get(ctx, method, params, &data); err != nil {
+		return nil, err
+	}
+
+	values, _ := data[field].([]interface{})
+	items := make([]map[string]interface{}, 0, len(values))
+	for _, value := range values {
+		if item, ok := value.(map[string]interface{}); ok {
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+// ScheduledMessages lists the messages scheduled by the user or the app the
+// token belongs to, in all the conversations, as chat.scheduledMessages.list
+// only returns those. Each of them records the conversation it will be posted
+// to, its text and when it will be posted.
+func (c *Client) ScheduledMessages(ctx context.Context) ([]map[string]interface{}, error) {
+	res := make([]map[string]interface{}, 0)
+
+	params := url.Values{}
+	params.Set("limit", c.pageSize("chat.scheduledMessages.list", 100))
+
+	for {
+		var data struct {
+			ScheduledMessages []map[string]interface{} `json:"scheduled_messages"`
+			cursorPage
+		}
+		if err := c.Get(ctx, "chat.scheduledMessages.list", params, &data); err != nil {
+			return nil, err
+		}
+		res = append(res, data.ScheduledMessages...)
+
+		cursor, err := data.nextCursor("chat.scheduledMessages.list", params.Get("cursor"))
+		if err != nil {
+			return nil, err
+		}
+		c.log("Processed a batch of scheduled messages.", "cursor", shortCursor(cursor))
+		if cursor == "" {
+			break
+		}
+		params.Set("cursor", cursor)
+	}
+	return res, nil
+}
@@ -0,0 +1,78 @@
+package slackexport
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Files lists the files of the workspace of the given comma-separated types,
+// such as images,pdfs or canvas, or all of them if types is empty.
+func (c *Client) Files(ctx context.Context, types string) ([]map[string]interface{}, error) {
+	res := make([]map[string]interface{}, 0)
+
+	params := url.Values{}
+	params.Set("count", c.pageSize("files.list", 200))
+	if types != "" {
+		params.Set("types", types)
+	}
+
+	// Unlike most methods, files.list is paginated by page number.
+	for page := 1; ; page++ {
+		params.Set("page", strconv.Itoa(page))
+
+		var data struct {
+			Files  []map[string]interface{} `json:"files"`
+			Paging struct {
+				Pages int `json:"pages"`
+			} `json:"paging"`
+		}
+		if err := c.Get(ctx, "files.list", params, &data); err != nil {
+			return nil, err
+		}
+		res = append(res, data.Files...)
+
+		c.log("Processed a page of files.", "page", page, "pages", data.Paging.Pages)
+		if page >= data.Paging.Pages {
+			break
+		}
+	}
+	return res, nil
+}
+
+// Download requests the file at the URL, such as the url_private_download of a
+// file, with the token, from the byte at offset onwards with a Range request if
+// offset isn't 0. The response is returned whatever its status, for the caller
+// to handle servers which don't support ranges, and its body must be closed.
+//
+// Downloads go through Do, so they are rate limited, time out and are retried
+// as the API requests are. When the server says the token is unauthorized, the
+// download is retried once with a new one, if the client can get one.
+func (c *Client) Download(ctx context.Context, fileUrl string, offset int64) (*http.Response, error) {
+	token := c.CurrentToken()
+	resp, err := c.download(ctx, fileUrl, token, offset)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized && c.Refresh != nil && token != "" {
+		resp.Body.Close()
+		if err := c.refreshToken(ctx, token); err != nil {
+			return nil, err
+		}
+		return c.download(ctx, fileUrl, c.CurrentToken(), offset)
+	}
+	return resp, err
+}
+
+func (c *Client) download(ctx context.Context, fileUrl string, token string, offset int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", fileUrl, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create file download request: %w", err)
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+	}
+	return c.Do(req)
+}
@@ -0,0 +1,95 @@
+package slackexport
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDownload(t *testing.T) {
+	var mutex sync.Mutex
+	attempts := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mutex.Lock()
+		attempts++
+		attempt := attempts
+		mutex.Unlock()
+		switch attempt {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusBadGateway)
+		case 3:
+			if r.Header.Get("Authorization") != "Bearer xoxp-expired" {
+				t.Errorf("expected the download to be made with the token, got %q", r.Header.Get("Authorization"))
+			}
+			w.WriteHeader(http.StatusUnauthorized)
+		default:
+			if r.Header.Get("Authorization") != "Bearer xoxp-refreshed" {
+				t.Errorf("expected the download to be made with the refreshed token, got %q", r.Header.Get("Authorization"))
+			}
+			if r.Header.Get("Range") != "bytes=3-" {
+				t.Errorf("expected the download to carry on from byte 3, got range %q", r.Header.Get("Range"))
+			}
+			w.Header().Set("Content-Range", "bytes 3-5/6")
+			w.WriteHeader(http.StatusPartialContent)
+			io.WriteString(w, "def")
+		}
+	}))
+	defer server.Close()
+
+	client := NewClient("xoxp-expired")
+	client.RetryBaseDelay = time.Millisecond
+	retries := 0
+	client.OnRetry = func(*http.Request, string) {
+		retries++
+	}
+	client.Refresh = func(context.Context) (string, error) {
+		return "xoxp-refreshed", nil
+	}
+
+	resp, err := client.Download(context.Background(), server.URL+"/files/F1/a.txt", 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || string(data) != "def" {
+		t.Errorf("expected the rest of the file, got HTTP code %d and %q", resp.StatusCode, data)
+	}
+	if attempts != 4 || retries != 2 {
+		t.Errorf("expected 4 attempts, 2 of them retries of the rate limited and failed ones, got %d and %d", attempts, retries)
+	}
+}
+
+func TestDownloadWithoutToken(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if auth := r.Header.Get("Authorization"); auth != "" {
+			t.Errorf("expected no token, got %q", auth)
+		}
+		if r.Header.Get("Range") != "" {
+			t.Errorf("expected no range from the start, got %q", r.Header.Get("Range"))
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+	}))
+	defer server.Close()
+
+	client := NewClient("")
+	client.Refresh = func(context.Context) (string, error) {
+		t.Error("expected no refresh without a token")
+		return "", nil
+	}
+	resp, err := client.Download(context.Background(), server.URL, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected the status to be returned, got %d", resp.StatusCode)
+	}
+}
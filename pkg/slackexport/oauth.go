@@ -0,0 +1,34 @@
+package slackexport
+
+import (
+	"context"
+	"net/url"
+)
+
+// A token issued by oauth.v2.access.
+type OAuthToken struct {
+	AccessToken string `json:"access_token"`
+	// The refresh token to get the next access token with, as each refresh
+	// token can only be used once.
+	RefreshToken string `json:"refresh_token"`
+	// The number of seconds the access token is valid for.
+	ExpiresIn int    `json:"expires_in"`
+	TokenType string `json:"token_type"`
+}
+
+// RefreshOAuthToken exchanges the refresh token of a Slack app using token
+// rotation for a new access token, using the client ID and secret of the app.
+// The token of the client isn't used, so that this works once it has expired.
+func (c *Client) RefreshOAuthToken(ctx context.Context, clientId string, clientSecret string, refreshToken string) (*OAuthToken, error) {
+	params := url.Values{}
+	params.Set("client_id", clientId)
+	params.Set("client_secret", clientSecret)
+	params.Set("grant_type", "refresh_token")
+	params.Set("refresh_token", refreshToken)
+
+	var data OAuthToken
+	if _, err := c.getWithToken(ctx, "", "oauth.v2.access", params, &data); err != nil {
+		return nil, err
+	}
+	return &data, nil
+}
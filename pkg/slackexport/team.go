@@ -0,0 +1,30 @@
+package slackexport
+
+import (
+	"context"
+)
+
+// TeamInfo returns the workspace, with its ID, name, domain and icon among
+// others.
+func (c *Client) TeamInfo(ctx context.Context) (map[string]interface{}, error) {
+	var data struct {
+		Team map[string]interface{} `json:"team"`
+	}
+	if err := c.Get(ctx, "team.info", nil, &data); err != nil {
+		return nil, err
+	}
+	return data.Team, nil
+}
+
+// Emoji returns the custom emoji of the workspace, mapping their names to the
+// URLs of their images, or to "alias:" followed by the name of another emoji
+// for aliases.
+func (c *Client) Emoji(ctx context.Context) (map[string]string, error) {
+	var data struct {
+		Emoji map[string]string `json:"emoji"`
+	}
+	if err := c.Get(ctx, "emoji.list", nil, &data); err != nil {
+		return nil, err
+	}
+	return data.Emoji, nil
+}
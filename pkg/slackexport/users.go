@@ -0,0 +1,103 @@
+package slackexport
+
+import (
+	"context"
+	"net/url"
+)
+
+// Users lists all the users of the workspace, as found in the users.json of
+// Slack's exports.
+func (c *Client) Users(ctx context.Context) ([]map[string]interface{}, error) {
+	res := make([]map[string]interface{}, 0)
+
+	params := url.Values{}
+	params.Set("limit", c.pageSize("users.list", 1000))
+
+	for {
+		var data struct {
+			Members []map[string]interface{} `json:"members"`
+			cursorPage
+		}
+		if err := c.Get(ctx, "users.list", params, &data); err != nil {
+			return nil, err
+		}
+		res = append(res, data.Members...)
+
+		cursor, err := data.nextCursor("users.list", params.Get("cursor"))
+		if err != nil {
+			return nil, err
+		}
+		c.log("Processed a batch of users.", "cursor", shortCursor(cursor))
+		if cursor == "" {
+			break // Exit the loop if there's no next cursor
+		}
+		params.Set("cursor", cursor)
+	}
+	return res, nil
+}
+
+// UserProfile returns the full profile of the user, including custom profile
+// fields, which the users list leaves out.
+func (c *Client) UserProfile(ctx context.Context, userId string) (map[string]interface{}, error) {
+	var data struct {
+		Profile map[string]interface{} `json:"profile"`
+	}
+	if err := c.Get(ctx, "users.profile.get", url.Values{"user": {userId}}, &data); err != nil {
+		return nil, err
+	}
+	return data.Profile, nil
+}
+
+// UserPresence returns the presence of the user, active or away.
+func (c *Client) UserPresence(ctx context.Context, userId string) (string, error) {
+	var data struct {
+		Presence string `json:"presence"`
+	}
+	if err := c.Get(ctx, "users.getPresence", url.Values{"user": {userId}}, &data); err != nil {
+		return "", err
+	}
+	return data.Presence, nil
+}
+
+// UserInfo returns the user with the given ID, which may belong to another
+// workspace, as the users of Slack Connect conversations do.
+func (c *Client) UserInfo(ctx context.Context, userId string) (map[string]interface{}, error) {
+	var data struct {
+		User map[string]interface{} `json:"user"`
+	}
+	if err := c.Get(ctx, "users.info", url.Values{"user": {userId}}, &data); err != nil {
+		return nil, err
+	}
+	return data.User, nil
+}
+
+// Stars lists the items starred by the user the token belongs to, such as
+// messages and files, newest first.
+func (c *Client) Stars(ctx context.Context) ([]map[string]interface{}, error) {
+	res := make([]map[string]interface{}, 0)
+
+	params := url.Values{}
+	params.Set("limit", c.pageSize("stars.list", 100))
+
+	for {
+		var data struct {
+			Items []map[string]interface{} `json:"items"`
+			cursorPage
+		}
+		if err := c.Get(ctx, "stars.list", params, &data); err != nil {
+			return nil, err
+		}
+		res = append(res, data.Items...)
+
+		cursor, err := data.nextCursor("stars.list", params.Get("cursor"))
+		if err != nil {
+			return nil, err
+		}
+		c.log("Processed a batch of starred items.", "cursor", shortCursor(cursor))
+		if cursor == "" {
+			break
+		}
+		params.Set("cursor", cursor)
+	}
+	return res, nil
+}